@@ -12,6 +12,7 @@ require (
 	gitlab.com/NebulousLabs/siamux v0.0.0-20201105164950-869a9dc7edcf // for testing mux compatibility
 	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
 	golang.org/x/sys v0.0.0-20200831180312-196b9ba8737a
 	lukechampine.com/frand v1.3.0
 )
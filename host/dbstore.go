@@ -0,0 +1,295 @@
+package host
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// database buckets/keys
+var (
+	// keyHeight stores the current chain height.
+	keyHeight = []byte("keyHeight")
+
+	// keyCCID stores the current ConsensusChangeID.
+	keyCCID = []byte("keyCCID")
+
+	// bucketMeta contains global values for the db.
+	bucketMeta = []byte("bucketMeta")
+
+	// bucketContracts maps FileContractIDs to Contracts.
+	bucketContracts = []byte("bucketContracts")
+
+	dbBuckets = [][]byte{
+		bucketMeta,
+		bucketContracts,
+	}
+)
+
+// errNoContract is returned when a contract is not present in the store.
+var errNoContract = errors.New("no record of that contract")
+
+// BoltDBContractStore implements ContractStore with a Bolt key-value database.
+// All modifications, including the integration of consensus changes, are
+// performed in a single database transaction, so the store is never left in a
+// partially-updated state if the process crashes.
+type BoltDBContractStore struct {
+	db    *bolt.DB
+	key   ed25519.PrivateKey
+	onErr func(error)
+}
+
+func (s *BoltDBContractStore) view(fn func(*bolt.Tx) error) {
+	err := s.db.View(fn)
+	if err != nil {
+		s.onErr(err)
+	}
+}
+
+func (s *BoltDBContractStore) update(fn func(*bolt.Tx) error) {
+	err := s.db.Update(fn)
+	if err != nil {
+		s.onErr(err)
+	}
+}
+
+func getContract(tx *bolt.Tx, id types.FileContractID) (c Contract, err error) {
+	v := tx.Bucket(bucketContracts).Get(id[:])
+	if v == nil {
+		return Contract{}, errNoContract
+	}
+	if err := json.Unmarshal(v, &c); err != nil {
+		return Contract{}, fmt.Errorf("could not decode contract %v: %w", id, err)
+	}
+	return c, nil
+}
+
+func putContract(tx *bolt.Tx, c Contract) error {
+	js, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	id := c.ID()
+	return tx.Bucket(bucketContracts).Put(id[:], js)
+}
+
+func getHeight(tx *bolt.Tx) types.BlockHeight {
+	return types.BlockHeight(binary.LittleEndian.Uint64(tx.Bucket(bucketMeta).Get(keyHeight)))
+}
+
+func putHeight(tx *bolt.Tx, height types.BlockHeight) error {
+	heightBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(heightBytes, uint64(height))
+	return tx.Bucket(bucketMeta).Put(keyHeight, heightBytes)
+}
+
+// SigningKey implements ContractStore.
+func (s *BoltDBContractStore) SigningKey() ed25519.PrivateKey {
+	return s.key
+}
+
+// Contract implements ContractStore.
+func (s *BoltDBContractStore) Contract(id types.FileContractID) (c Contract, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c, err = getContract(tx, id)
+		return err
+	})
+	return
+}
+
+// AddContract implements ContractStore.
+func (s *BoltDBContractStore) AddContract(c Contract) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putContract(tx, c)
+	})
+}
+
+// ReviseContract implements ContractStore.
+func (s *BoltDBContractStore) ReviseContract(rev types.FileContractRevision, renterSig, hostSig []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c, err := getContract(tx, rev.ParentID)
+		if err != nil {
+			return err
+		}
+		c.Revision = rev
+		c.Signatures[0].Signature = renterSig
+		c.Signatures[1].Signature = hostSig
+		return putContract(tx, c)
+	})
+}
+
+// UpdateContractTransactions implements ContractStore.
+func (s *BoltDBContractStore) UpdateContractTransactions(id types.FileContractID, final, proof []types.Transaction, err error) {
+	s.update(func(tx *bolt.Tx) error {
+		c, getErr := getContract(tx, id)
+		if getErr == errNoContract {
+			return nil
+		} else if getErr != nil {
+			return getErr
+		}
+		c.FinalizationSet = final
+		c.ProofSet = proof
+		c.FatalError = err
+		return putContract(tx, c)
+	})
+}
+
+// ActionableContracts implements ContractStore.
+func (s *BoltDBContractStore) ActionableContracts() (contracts []Contract) {
+	s.view(func(tx *bolt.Tx) error {
+		height := getHeight(tx)
+		return tx.Bucket(bucketContracts).ForEach(func(_, v []byte) error {
+			var c Contract
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if ContractIsActionable(c, height) {
+				contracts = append(contracts, c)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// ApplyConsensusChange implements ContractStore.
+func (s *BoltDBContractStore) ApplyConsensusChange(reverted, applied ProcessedConsensusChange, ccid modules.ConsensusChangeID) {
+	s.update(func(tx *bolt.Tx) error {
+		// load every contract into memory; any contract may be affected by the
+		// change in height, so we can't restrict ourselves to the contracts
+		// referenced by the change
+		contracts := make(map[types.FileContractID]*Contract)
+		err := tx.Bucket(bucketContracts).ForEach(func(_, v []byte) error {
+			c := new(Contract)
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			contracts[c.ID()] = c
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		setFlags := func(ids []types.FileContractID, flag func(*Contract) *bool, val bool) {
+			for _, id := range ids {
+				if c, ok := contracts[id]; ok {
+					*flag(c) = val
+				}
+			}
+		}
+		formation := func(c *Contract) *bool { return &c.FormationConfirmed }
+		finalization := func(c *Contract) *bool { return &c.FinalizationConfirmed }
+		proof := func(c *Contract) *bool { return &c.ProofConfirmed }
+		setFlags(reverted.Contracts, formation, false)
+		setFlags(reverted.Revisions, finalization, false)
+		setFlags(reverted.Proofs, proof, false)
+		setFlags(applied.Contracts, formation, true)
+		setFlags(applied.Revisions, finalization, true)
+		setFlags(applied.Proofs, proof, true)
+
+		height := getHeight(tx)
+		height -= types.BlockHeight(len(reverted.BlockIDs))
+
+		// adjust for genesis block (this should only ever happen once)
+		var oldCCID modules.ConsensusChangeID
+		copy(oldCCID[:], tx.Bucket(bucketMeta).Get(keyCCID))
+		if oldCCID == modules.ConsensusChangeBeginning {
+			height--
+		}
+
+		for _, id := range applied.BlockIDs {
+			height++
+			for _, c := range contracts {
+				if c.ProofHeight == height && len(c.FinalizationSet) > 0 {
+					rev := c.FinalizationSet[len(c.FinalizationSet)-1].FileContractRevisions[0]
+					c.ProofSegment = StorageProofSegment(id, rev.ParentID, rev.NewFileSize)
+				}
+			}
+		}
+
+		// mark contracts as failed if their formation transaction is not
+		// confirmed within 6 blocks
+		for _, c := range contracts {
+			if c.FatalError == nil && !c.FormationConfirmed && height > c.FormationHeight+6 {
+				c.FatalError = errors.New("contract formation transaction was not confirmed on blockchain")
+			}
+		}
+
+		for _, c := range contracts {
+			if err := putContract(tx, *c); err != nil {
+				return err
+			}
+		}
+		if err := putHeight(tx, height); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMeta).Put(keyCCID, ccid[:])
+	})
+}
+
+// ConsensusChangeID implements ContractStore.
+func (s *BoltDBContractStore) ConsensusChangeID() (ccid modules.ConsensusChangeID) {
+	s.view(func(tx *bolt.Tx) error {
+		copy(ccid[:], tx.Bucket(bucketMeta).Get(keyCCID))
+		return nil
+	})
+	return
+}
+
+// Height implements ContractStore.
+func (s *BoltDBContractStore) Height() (height types.BlockHeight) {
+	s.view(func(tx *bolt.Tx) error {
+		height = getHeight(tx)
+		return nil
+	})
+	return
+}
+
+// Close closes the bolt database.
+func (s *BoltDBContractStore) Close() error {
+	return s.db.Close()
+}
+
+// NewBoltDBContractStore returns a new BoltDBContractStore, which signs
+// revisions with the provided key. Errors encountered by methods that cannot
+// return an error are passed to onErr; if onErr is nil, such errors cause a
+// panic.
+func NewBoltDBContractStore(filename string, key ed25519.PrivateKey, onErr func(error)) (*BoltDBContractStore, error) {
+	if onErr == nil {
+		onErr = func(err error) { panic(err) }
+	}
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range dbBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(bucketMeta).Get(keyHeight) == nil {
+			tx.Bucket(bucketMeta).Put(keyHeight, make([]byte, 8))
+		}
+		if tx.Bucket(bucketMeta).Get(keyCCID) == nil {
+			tx.Bucket(bucketMeta).Put(keyCCID, modules.ConsensusChangeBeginning[:])
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDBContractStore{
+		db:    db,
+		key:   key,
+		onErr: onErr,
+	}, nil
+}
@@ -0,0 +1,123 @@
+package host_test
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/host"
+)
+
+func TestBoltDBContractStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "contracts.db")
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	store, err := host.NewBoltDBContractStore(filename, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id types.FileContractID
+	frand.Read(id[:])
+	c := host.Contract{
+		Revision: types.FileContractRevision{
+			ParentID:          id,
+			NewRevisionNumber: 1,
+			NewWindowStart:    10,
+		},
+		FinalizationHeight: 10,
+		ProofHeight:        12,
+	}
+	if _, err := store.Contract(id); err == nil {
+		t.Fatal("expected error for missing contract")
+	} else if err := store.AddContract(c); err != nil {
+		t.Fatal(err)
+	}
+
+	rev := c.Revision
+	rev.NewRevisionNumber++
+	rev.NewFileSize = 4096
+	if err := store.ReviseContract(rev, []byte("renter"), []byte("host")); err != nil {
+		t.Fatal(err)
+	} else if err := store.ReviseContract(types.FileContractRevision{}, nil, nil); err == nil {
+		t.Fatal("expected error when revising missing contract")
+	}
+
+	// apply the genesis block and a block containing the contract
+	store.ApplyConsensusChange(host.ProcessedConsensusChange{}, host.ProcessedConsensusChange{
+		BlockIDs: []types.BlockID{{}},
+	}, modules.ConsensusChangeID{1})
+	if store.Height() != 0 {
+		t.Fatal("wrong height after genesis:", store.Height())
+	}
+	store.ApplyConsensusChange(host.ProcessedConsensusChange{}, host.ProcessedConsensusChange{
+		Contracts: []types.FileContractID{id},
+		BlockIDs:  []types.BlockID{{1}},
+	}, modules.ConsensusChangeID{2})
+	if len(store.ActionableContracts()) != 0 {
+		t.Fatal("contract should not be actionable")
+	}
+
+	// close and reopen the store; everything should be preserved
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = host.NewBoltDBContractStore(filename, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Height() != 1 {
+		t.Fatal("wrong height after reopening:", store.Height())
+	} else if store.ConsensusChangeID() != (modules.ConsensusChangeID{2}) {
+		t.Fatal("wrong ccid after reopening:", store.ConsensusChangeID())
+	}
+	c, err = store.Contract(id)
+	if err != nil {
+		t.Fatal(err)
+	} else if !c.FormationConfirmed {
+		t.Fatal("formation should be confirmed")
+	} else if c.Revision.NewRevisionNumber != 2 || string(c.Signatures[0].Signature) != "renter" || string(c.Signatures[1].Signature) != "host" {
+		t.Fatal("revision was not persisted")
+	}
+
+	// mine up to the finalization height; contract should become actionable
+	store.ApplyConsensusChange(host.ProcessedConsensusChange{}, host.ProcessedConsensusChange{
+		BlockIDs: make([]types.BlockID, 9),
+	}, modules.ConsensusChangeID{3})
+	if cs := store.ActionableContracts(); len(cs) != 1 || cs[0].ID() != id {
+		t.Fatal("contract should be actionable")
+	}
+	final := []types.Transaction{{FileContractRevisions: []types.FileContractRevision{rev}}}
+	store.UpdateContractTransactions(id, final, nil, nil)
+
+	// revert the formation; height should decrease and confirmation be undone
+	store.ApplyConsensusChange(host.ProcessedConsensusChange{
+		Contracts: []types.FileContractID{id},
+		BlockIDs:  make([]types.BlockID, 9),
+	}, host.ProcessedConsensusChange{}, modules.ConsensusChangeID{4})
+	if store.Height() != 1 {
+		t.Fatal("wrong height after revert:", store.Height())
+	} else if c, _ := store.Contract(id); c.FormationConfirmed || len(c.FinalizationSet) != 1 {
+		t.Fatal("revert was not applied correctly")
+	}
+
+	// leave the formation unconfirmed; contract should be marked as failed
+	store.ApplyConsensusChange(host.ProcessedConsensusChange{}, host.ProcessedConsensusChange{
+		BlockIDs: make([]types.BlockID, 10),
+	}, modules.ConsensusChangeID{5})
+	if c, _ := store.Contract(id); c.FatalError == nil {
+		t.Fatal("expected contract to be marked as failed")
+	} else if len(store.ActionableContracts()) != 0 {
+		t.Fatal("failed contract should not be actionable")
+	}
+}
@@ -55,6 +55,22 @@ type SectorStore interface {
 	SetContractRoots(id types.FileContractID, roots []crypto.Hash) error
 }
 
+// An EphemeralAccountStore stores the balances of mux protocol ephemeral
+// accounts.
+type EphemeralAccountStore interface {
+	// Balance returns the current balance of the account. Accounts that have
+	// never been funded have a balance of zero.
+	Balance(id renterhost.AccountID) (types.Currency, error)
+	// Deposit adds amount to the account's balance, returning the new balance.
+	// If the new balance would exceed max, Deposit returns
+	// ErrMaxBalanceExceeded and leaves the balance unchanged. The check and
+	// the deposit must be atomic.
+	Deposit(id renterhost.AccountID, amount, max types.Currency) (types.Currency, error)
+	// Withdraw subtracts amount from the account's balance. If the balance is
+	// less than amount, Withdraw returns ErrInsufficientBalance.
+	Withdraw(id renterhost.AccountID, amount types.Currency) error
+}
+
 // A Wallet provides addresses and funds and signs transactions.
 type Wallet interface {
 	Address() (types.UnlockHash, error)
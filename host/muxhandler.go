@@ -0,0 +1,558 @@
+package host
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/renterhost/mux"
+)
+
+// ErrInsufficientBalance is returned by an EphemeralAccountStore when a
+// withdrawal exceeds the balance of an account.
+var ErrInsufficientBalance = errors.New("ephemeral account balance was insufficient")
+
+// ErrMaxBalanceExceeded is returned by an EphemeralAccountStore when a deposit
+// would cause the balance of an account to exceed the maximum.
+var ErrMaxBalanceExceeded = errors.New("deposit would exceed maximum ephemeral account balance")
+
+const (
+	// priceTableValidity is the duration for which a price table may be used
+	// after it has been paid for.
+	priceTableValidity = 10 * time.Minute
+
+	// maxWithdrawalExpiry is the furthest in the future that a withdrawal
+	// message may expire. Spent withdrawals must be remembered until they
+	// expire, so this bounds the size of the replay-protection set.
+	maxWithdrawalExpiry = 20
+)
+
+type paymentPolicy int
+
+const (
+	payAny paymentPolicy = iota
+	payByContract
+	payByAccount
+)
+
+type muxStream struct {
+	rs   *renterhost.Stream
+	conn statsConn
+	ctx  SessionContext
+}
+
+func (s *muxStream) writeError(err error) error {
+	s.rs.WriteResponse(nil, err)
+	return err
+}
+
+func (s *muxStream) readRequest(req renterhost.ProtocolObject) error {
+	maxSize := uint64(renterhost.MinMessageSize)
+	if _, ok := req.(*renterhost.RPCAppendSectorRequest); ok {
+		maxSize += renterhost.SectorSize
+	}
+	return s.rs.ReadRequest(req, maxSize)
+}
+
+// A MuxHandler serves mux protocol sessions, in which each RPC is conducted on its
+// own renterhost/mux stream. It shares its contracts, sectors, and contract
+// locks with the SessionHandler from which it was created.
+type MuxHandler struct {
+	sh       *SessionHandler
+	accounts EphemeralAccountStore
+	rpcs     map[renterhost.Specifier]func(*muxStream) error
+
+	mu          sync.Mutex
+	priceTables map[[16]byte]priceTableEntry
+	withdrawals map[crypto.Hash]types.BlockHeight // spent withdrawals -> expiry
+}
+
+type priceTableEntry struct {
+	pt     hostdb.HostPriceTable
+	expiry time.Time
+}
+
+// Serve serves a mux protocol session on the provided connection.
+func (mh *MuxHandler) Serve(conn net.Conn) (err error) {
+	ctx := SessionContext{
+		UID:         frand.Entropy128(),
+		RenterIP:    conn.RemoteAddr().String(),
+		Timestamp:   time.Now(),
+		BlockHeight: mh.sh.contracts.Height(),
+		Settings:    mh.sh.settings.Settings(),
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	m, err := mux.Accept(conn, mh.sh.secretKey)
+	mh.sh.metrics.RecordSessionMetric(&ctx, MetricHandshake{Err: err})
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	defer m.Close()
+	defer func() { mh.sh.metrics.RecordSessionMetric(&ctx, MetricSessionEnd{Err: err}) }()
+	for {
+		stream, err := m.AcceptStream()
+		if errors.Is(err, mux.ErrPeerClosedConn) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go func() {
+			defer stream.Close()
+			mh.serveStream(stream, ctx)
+		}()
+	}
+}
+
+func (mh *MuxHandler) serveStream(stream *mux.Stream, ctx SessionContext) (err error) {
+	s := &muxStream{
+		conn: statsConn{Conn: stream},
+		ctx:  ctx,
+	}
+	// no RPC should take longer than this, not even AppendSector
+	s.conn.SetDeadline(time.Now().Add(120 * time.Second))
+	s.rs, err = renterhost.NewHostStream(&s.conn)
+	if err != nil {
+		return err
+	}
+	id, err := s.rs.ReadID()
+	if err != nil {
+		return fmt.Errorf("could not read RPC ID: %w", err)
+	}
+	rpcFn, ok := mh.rpcs[id]
+	if !ok {
+		return s.writeError(fmt.Errorf("invalid or unknown RPC %q", id.String()))
+	}
+	s.ctx.BlockHeight = mh.sh.contracts.Height()
+	start := time.Now()
+	mh.sh.metrics.RecordSessionMetric(&s.ctx, MetricRPCStart{
+		ID:        id,
+		Timestamp: start,
+	})
+	defer func() {
+		s.ctx.Elapsed = time.Since(s.ctx.Timestamp)
+		mh.sh.metrics.RecordSessionMetric(&s.ctx, MetricRPCEnd{
+			ID:        id,
+			Elapsed:   time.Since(start),
+			UpBytes:   s.conn.w,
+			DownBytes: s.conn.r,
+			Err:       err,
+		})
+	}()
+	if err := rpcFn(s); err != nil {
+		return fmt.Errorf("RPC %q failed: %w", id.String(), err)
+	}
+	return nil
+}
+
+func (mh *MuxHandler) newPriceTable() hostdb.HostPriceTable {
+	settings := mh.sh.settings.Settings()
+	minFee, maxFee, _ := mh.sh.tpool.FeeEstimate()
+	return hostdb.HostPriceTable{
+		UID:             frand.Entropy128(),
+		Validity:        priceTableValidity,
+		HostBlockHeight: mh.sh.contracts.Height(),
+
+		UpdatePriceTableCost: settings.BaseRPCPrice,
+		AccountBalanceCost:   settings.BaseRPCPrice,
+		FundAccountCost:      settings.BaseRPCPrice,
+
+		InitBaseCost:          settings.BaseRPCPrice,
+		DownloadBandwidthCost: settings.DownloadBandwidthPrice,
+		UploadBandwidthCost:   settings.UploadBandwidthPrice,
+		ReadBaseCost:          settings.SectorAccessPrice,
+		WriteBaseCost:         settings.SectorAccessPrice,
+		WriteStoreCost:        settings.StoragePrice,
+		CollateralCost:        settings.Collateral,
+		MaxCollateral:         settings.MaxCollateral,
+
+		TxnFeeMinRecommended: minFee,
+		TxnFeeMaxRecommended: maxFee,
+	}
+}
+
+func (mh *MuxHandler) readPriceTable(s *muxStream) (*hostdb.HostPriceTable, error) {
+	var uid renterhost.Specifier
+	if err := s.rs.ReadRequest(&uid, renterhost.MinMessageSize); err != nil {
+		return nil, err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for id, e := range mh.priceTables {
+		if time.Now().After(e.expiry) {
+			delete(mh.priceTables, id)
+		}
+	}
+	e, ok := mh.priceTables[[16]byte(uid)]
+	if !ok {
+		return nil, s.writeError(errors.New("unknown or expired price table"))
+	}
+	return &e.pt, nil
+}
+
+// requirePayment returns a function that rejects payments of less than cost.
+func requirePayment(cost types.Currency) func(types.Currency) error {
+	return func(amount types.Currency) error {
+		if amount.Cmp(cost) < 0 {
+			return fmt.Errorf("insufficient payment: expected %v, got %v", cost, amount)
+		}
+		return nil
+	}
+}
+
+// processPayment reads a payment from the renter, passes the payment amount to
+// validate, and, if validate succeeds, transfers the funds. If the funds were
+// transferred but the renter could not be notified, the amount is returned
+// along with the error.
+func (mh *MuxHandler) processPayment(s *muxStream, policy paymentPolicy, validate func(types.Currency) error) (types.Currency, error) {
+	var req renterhost.RPCPaymentRequest
+	if err := s.rs.ReadRequest(&req, renterhost.MinMessageSize); err != nil {
+		return types.ZeroCurrency, err
+	}
+	switch {
+	case req.Type == renterhost.PaymentTypeContract && policy != payByAccount:
+		return mh.processContractPayment(s, validate)
+	case req.Type == renterhost.PaymentTypeEphemeralAccount && policy != payByContract:
+		return mh.processAccountPayment(s, validate)
+	default:
+		return types.ZeroCurrency, s.writeError(fmt.Errorf("payment type %q is not allowed", req.Type.String()))
+	}
+}
+
+func (mh *MuxHandler) processContractPayment(s *muxStream, validate func(types.Currency) error) (types.Currency, error) {
+	var req renterhost.RPCPayByContractRequest
+	if err := s.rs.ReadRequest(&req, renterhost.MinMessageSize); err != nil {
+		return types.ZeroCurrency, err
+	}
+	if !mh.sh.lockContract(req.ContractID, 10*time.Second) {
+		return types.ZeroCurrency, s.writeError(errors.New("timed out waiting to lock contract"))
+	}
+	defer mh.sh.unlockContract(req.ContractID)
+	c, err := mh.sh.contracts.Contract(req.ContractID)
+	if err != nil {
+		return types.ZeroCurrency, s.writeError(errors.New("no such contract"))
+	} else if err := checkRevisable(c, mh.sh.contracts.Height(), s.ctx.Settings); err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	}
+	newRevision, err := calculateRevision(c.Revision, req.NewRevisionNumber, req.NewValidProofValues, req.NewMissedProofValues)
+	if err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	}
+	amount, err := validatePaymentRevision(c.Revision, newRevision)
+	if err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	} else if err := validate(amount); err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	}
+	hostSig, err := signRevision(newRevision, req.Signature, mh.sh.contracts)
+	if err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	} else if err := s.rs.WriteResponse(&renterhost.RPCPayByContractResponse{Signature: hostSig}, nil); err != nil {
+		return amount, err
+	}
+	return amount, nil
+}
+
+func (mh *MuxHandler) processAccountPayment(s *muxStream, validate func(types.Currency) error) (types.Currency, error) {
+	var req renterhost.RPCPayByEphemeralAccountRequest
+	if err := s.rs.ReadRequest(&req, renterhost.MinMessageSize); err != nil {
+		return types.ZeroCurrency, err
+	}
+	height := mh.sh.contracts.Height()
+	wm := req.Message
+	h := renterhost.HashWithdrawalMessage(wm)
+	switch {
+	case wm.Expiry <= height:
+		return types.ZeroCurrency, s.writeError(errors.New("withdrawal message has expired"))
+	case wm.Expiry > height+maxWithdrawalExpiry:
+		return types.ZeroCurrency, s.writeError(errors.New("withdrawal message expires too far in the future"))
+	case !ed25519hash.Verify(ed25519.PublicKey(wm.Account[:]), h, req.Signature):
+		return types.ZeroCurrency, s.writeError(errors.New("invalid withdrawal signature"))
+	}
+	if err := validate(wm.Amount); err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	}
+
+	// prevent replays, and forget about withdrawals that can no longer be
+	// replayed anyway
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for wh, expiry := range mh.withdrawals {
+		if expiry <= height {
+			delete(mh.withdrawals, wh)
+		}
+	}
+	if _, ok := mh.withdrawals[h]; ok {
+		return types.ZeroCurrency, s.writeError(errors.New("withdrawal message was already used"))
+	} else if err := mh.accounts.Withdraw(wm.Account, wm.Amount); err != nil {
+		return types.ZeroCurrency, s.writeError(err)
+	}
+	mh.withdrawals[h] = wm.Expiry
+	return wm.Amount, nil
+}
+
+func checkRevisable(c Contract, currentHeight types.BlockHeight, settings hostdb.HostSettings) error {
+	switch {
+	case c.FatalError != nil:
+		return c.FatalError
+	case c.Revision.NewRevisionNumber == math.MaxUint64:
+		return errors.New("contract has reached maximum revision number")
+	case currentHeight+settings.WindowSize >= c.Revision.NewWindowEnd:
+		return errors.New("refusing further revisions because contract proof window is imminent")
+	}
+	return nil
+}
+
+// validatePaymentRevision checks that rev transfers funds from the renter to the
+// host, in both the valid and missed outputs, and returns the amount
+// transferred.
+func validatePaymentRevision(old, rev types.FileContractRevision) (types.Currency, error) {
+	if rev.NewRevisionNumber <= old.NewRevisionNumber {
+		return types.ZeroCurrency, errors.New("revision number must increase")
+	} else if rev.NewValidProofOutputs[0].Value.Cmp(old.NewValidProofOutputs[0].Value) > 0 {
+		return types.ZeroCurrency, errors.New("renter's valid payout must not increase")
+	}
+	amount := old.NewValidProofOutputs[0].Value.Sub(rev.NewValidProofOutputs[0].Value)
+	switch {
+	case !rev.NewValidProofOutputs[1].Value.Equals(old.NewValidProofOutputs[1].Value.Add(amount)):
+		return types.ZeroCurrency, errors.New("host's valid payout must increase by payment amount")
+	case !rev.NewMissedProofOutputs[0].Value.Add(amount).Equals(old.NewMissedProofOutputs[0].Value):
+		return types.ZeroCurrency, errors.New("renter's missed payout must decrease by payment amount")
+	case !rev.NewMissedProofOutputs[1].Value.Equals(old.NewMissedProofOutputs[1].Value.Add(amount)):
+		return types.ZeroCurrency, errors.New("host's missed payout must increase by payment amount")
+	case !rev.NewMissedProofOutputs[2].Value.Equals(old.NewMissedProofOutputs[2].Value):
+		return types.ZeroCurrency, errors.New("void output must not change")
+	}
+	return amount, nil
+}
+
+// validateAppendRevision checks that rev leaves the renter's payouts unchanged
+// and moves at most collateral from the host's missed payout to the void.
+func validateAppendRevision(old, rev types.FileContractRevision, collateral types.Currency) error {
+	minHostMissed := types.ZeroCurrency
+	if old.NewMissedProofOutputs[1].Value.Cmp(collateral) > 0 {
+		minHostMissed = old.NewMissedProofOutputs[1].Value.Sub(collateral)
+	}
+	switch {
+	case rev.NewRevisionNumber <= old.NewRevisionNumber:
+		return errors.New("revision number must increase")
+	case !rev.NewValidProofOutputs[0].Value.Equals(old.NewValidProofOutputs[0].Value),
+		!rev.NewValidProofOutputs[1].Value.Equals(old.NewValidProofOutputs[1].Value):
+		return errors.New("valid payouts must not change")
+	case !rev.NewMissedProofOutputs[0].Value.Equals(old.NewMissedProofOutputs[0].Value):
+		return errors.New("renter's missed payout must not change")
+	case rev.NewMissedProofOutputs[1].Value.Cmp(minHostMissed) < 0:
+		return errors.New("too much collateral was moved to the void")
+	case !rev.NewMissedProofOutputs[1].Value.Add(rev.NewMissedProofOutputs[2].Value).Equals(old.NewMissedProofOutputs[1].Value.Add(old.NewMissedProofOutputs[2].Value)):
+		return errors.New("collateral must be moved from host to void")
+	}
+	return nil
+}
+
+func (mh *MuxHandler) rpcUpdatePriceTable(s *muxStream) error {
+	pt := mh.newPriceTable()
+	js, _ := json.Marshal(pt)
+	if err := s.rs.WriteResponse(&renterhost.RPCUpdatePriceTableResponse{PriceTableJSON: js}, nil); err != nil {
+		return err
+	} else if _, err := mh.processPayment(s, payAny, requirePayment(pt.UpdatePriceTableCost)); err != nil {
+		return err
+	}
+	mh.mu.Lock()
+	mh.priceTables[pt.UID] = priceTableEntry{
+		pt:     pt,
+		expiry: time.Now().Add(pt.Validity),
+	}
+	mh.mu.Unlock()
+	return s.rs.WriteResponse(&renterhost.RPCPriceTableAccepted{}, nil)
+}
+
+func (mh *MuxHandler) rpcFundAccount(s *muxStream) error {
+	pt, err := mh.readPriceTable(s)
+	if err != nil {
+		return err
+	}
+	var req renterhost.RPCFundAccountRequest
+	if err := s.readRequest(&req); err != nil {
+		return err
+	}
+	balance, err := mh.accounts.Balance(req.Account)
+	if err != nil {
+		return s.writeError(err)
+	}
+	// credit the account before the payment is signed, so that a concurrent
+	// deposit cannot push the balance over the maximum after the renter has
+	// already paid; if the payment then fails, the deposit is reverted
+	var deposit types.Currency
+	var deposited bool
+	paid, err := mh.processPayment(s, payByContract, func(amount types.Currency) error {
+		if err := requirePayment(pt.FundAccountCost)(amount); err != nil {
+			return err
+		}
+		deposit = amount.Sub(pt.FundAccountCost)
+		balance, err = mh.accounts.Deposit(req.Account, deposit, s.ctx.Settings.MaxEphemeralAccountBalance)
+		deposited = err == nil
+		return err
+	})
+	if err != nil {
+		if deposited && paid.IsZero() {
+			if werr := mh.accounts.Withdraw(req.Account, deposit); werr != nil {
+				return fmt.Errorf("%w (could not revert deposit: %v)", err, werr)
+			}
+		}
+		return err
+	}
+	return s.rs.WriteResponse(&renterhost.RPCFundAccountResponse{Balance: balance}, nil)
+}
+
+func (mh *MuxHandler) rpcAccountBalance(s *muxStream) error {
+	pt, err := mh.readPriceTable(s)
+	if err != nil {
+		return err
+	}
+	var req renterhost.RPCAccountBalanceRequest
+	if err := s.readRequest(&req); err != nil {
+		return err
+	} else if _, err := mh.processPayment(s, payAny, requirePayment(pt.AccountBalanceCost)); err != nil {
+		return err
+	}
+	balance, err := mh.accounts.Balance(req.Account)
+	if err != nil {
+		return s.writeError(err)
+	}
+	return s.rs.WriteResponse(&renterhost.RPCAccountBalanceResponse{Balance: balance}, nil)
+}
+
+func (mh *MuxHandler) rpcReadSector(s *muxStream) error {
+	pt, err := mh.readPriceTable(s)
+	if err != nil {
+		return err
+	}
+	var req renterhost.RPCReadSectorRequest
+	if err := s.readRequest(&req); err != nil {
+		return err
+	}
+	switch {
+	case req.Offset+req.Length > renterhost.SectorSize || req.Offset+req.Length < req.Offset:
+		return s.writeError(errors.New("request is out-of-bounds"))
+	case req.Length == 0:
+		return s.writeError(errors.New("length cannot be zero"))
+	case req.MerkleProof && (req.Offset%merkle.SegmentSize != 0 || req.Length%merkle.SegmentSize != 0):
+		return s.writeError(errors.New("offset and length must be multiples of SegmentSize when requesting a Merkle proof"))
+	}
+	var proofHashes uint64
+	if req.MerkleProof {
+		start := int(req.Offset / merkle.SegmentSize)
+		end := int((req.Offset + req.Length) / merkle.SegmentSize)
+		proofHashes = uint64(merkle.ProofSize(merkle.SegmentsPerSector, start, end))
+	}
+	cost := pt.ReadSectorCost(req.Length, proofHashes)
+	if _, err := mh.processPayment(s, payAny, requirePayment(cost)); err != nil {
+		return err
+	}
+
+	sec := renterhost.RPCReadRequestSection{
+		MerkleRoot: req.MerkleRoot,
+		Offset:     uint32(req.Offset),
+		Length:     uint32(req.Length),
+	}
+	resp, err := readSection(sec, req.MerkleProof, mh.sh.sectors)
+	if err != nil {
+		return s.writeError(err)
+	}
+	return s.rs.WriteResponse(&renterhost.RPCReadSectorResponse{
+		Data:        resp.Data,
+		MerkleProof: resp.MerkleProof,
+	}, nil)
+}
+
+func (mh *MuxHandler) rpcAppendSector(s *muxStream) error {
+	pt, err := mh.readPriceTable(s)
+	if err != nil {
+		return err
+	}
+	var req renterhost.RPCAppendSectorRequest
+	if err := s.readRequest(&req); err != nil {
+		return err
+	} else if uint64(len(req.Data)) != renterhost.SectorSize {
+		return s.writeError(errors.New("length of appended data must be exactly SectorSize"))
+	}
+
+	// the contract is revised, so it must be locked; consequently, the RPC
+	// must be paid for with an ephemeral account
+	if !mh.sh.lockContract(req.ContractID, 10*time.Second) {
+		return s.writeError(errors.New("timed out waiting to lock contract"))
+	}
+	defer mh.sh.unlockContract(req.ContractID)
+	c, err := mh.sh.contracts.Contract(req.ContractID)
+	if err != nil {
+		return s.writeError(errors.New("no such contract"))
+	} else if err := checkRevisable(c, mh.sh.contracts.Height(), s.ctx.Settings); err != nil {
+		return s.writeError(err)
+	}
+	currentRevision := c.Revision
+	cost, collateral := pt.AppendSectorCost(currentRevision.NewWindowEnd - pt.HostBlockHeight)
+	newRevision, err := calculateRevision(currentRevision, req.NewRevisionNumber, req.NewValidProofValues, req.NewMissedProofValues)
+	if err != nil {
+		return s.writeError(err)
+	} else if err := validateAppendRevision(currentRevision, newRevision, collateral); err != nil {
+		return s.writeError(err)
+	} else if _, err := mh.processPayment(s, payByAccount, requirePayment(cost)); err != nil {
+		return err
+	}
+
+	actions := []renterhost.RPCWriteAction{{
+		Type: renterhost.RPCWriteActionAppend,
+		Data: req.Data,
+	}}
+	merkleResp, applyModifications, err := considerModifications(req.ContractID, actions, true, mh.sh.sectors)
+	if err != nil {
+		return s.writeError(err)
+	}
+	var sigResponse renterhost.RPCWriteResponse
+	if err := s.rs.WriteResponse(merkleResp, nil); err != nil {
+		return err
+	} else if err := s.rs.ReadResponse(&sigResponse, renterhost.MinMessageSize); err != nil {
+		return err
+	}
+	newRevision.NewFileSize += renterhost.SectorSize
+	newRevision.NewFileMerkleRoot = merkleResp.NewMerkleRoot
+
+	var resp renterhost.RPCWriteResponse
+	if err := applyModifications(); err != nil {
+		return s.writeError(err)
+	} else if resp.Signature, err = signRevision(newRevision, sigResponse.Signature, mh.sh.contracts); err != nil {
+		return s.writeError(err)
+	}
+	return s.rs.WriteResponse(&resp, nil)
+}
+
+// NewMuxHandler returns an initialized mux protocol handler that shares the contracts,
+// sectors, and settings of sh, storing ephemeral account balances in accounts.
+func NewMuxHandler(sh *SessionHandler, accounts EphemeralAccountStore) *MuxHandler {
+	mh := &MuxHandler{
+		sh:          sh,
+		accounts:    accounts,
+		priceTables: make(map[[16]byte]priceTableEntry),
+		withdrawals: make(map[crypto.Hash]types.BlockHeight),
+	}
+	mh.rpcs = map[renterhost.Specifier]func(*muxStream) error{
+		renterhost.RPCAccountBalanceID:   mh.rpcAccountBalance,
+		renterhost.RPCAppendSectorID:     mh.rpcAppendSector,
+		renterhost.RPCFundAccountID:      mh.rpcFundAccount,
+		renterhost.RPCReadSectorID:       mh.rpcReadSector,
+		renterhost.RPCUpdatePriceTableID: mh.rpcUpdatePriceTable,
+	}
+	return mh
+}
@@ -0,0 +1,182 @@
+package host_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/internal/ghost"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+type sliceRecorder []proto.ContractRevision
+
+func (sr *sliceRecorder) RecordRevision(rev proto.ContractRevision) error {
+	*sr = append(*sr, rev)
+	return nil
+}
+
+func TestMuxSession(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer host.Close()
+	rev := renter.Revision()
+	if err := renter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+	s, err := proto.NewMuxSession(hostdb.ScannedHost{
+		HostSettings: host.Settings,
+		PublicKey:    host.PublicKey,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var revs sliceRecorder
+	s.SetRevisionRecorder(&revs)
+
+	// no RPCs are allowed without a price table
+	accountKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	account := proto.EphemeralAccountID(accountKey)
+	if _, err := s.AccountBalance(account, proto.PayByContract(&rev, key)); err == nil {
+		t.Fatal("expected error without price table")
+	}
+	if err := s.UpdatePriceTable(proto.PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if s.PriceTable().UID == ([16]byte{}) {
+		t.Fatal("price table was not set")
+	}
+
+	// fund the account; the free host should not charge anything
+	if bal, err := s.FundAccount(account, types.ZeroCurrency, &rev, key); err != nil {
+		t.Fatal(err)
+	} else if !bal.IsZero() {
+		t.Fatal("unexpected balance:", bal)
+	} else if len(revs) != 1 || revs[0].Revision.NewRevisionNumber != rev.Revision.NewRevisionNumber {
+		t.Fatal("revision was not recorded")
+	}
+	payment := proto.PayByEphemeralAccount(accountKey)
+	if bal, err := s.AccountBalance(account, payment); err != nil {
+		t.Fatal(err)
+	} else if !bal.IsZero() {
+		t.Fatal("unexpected balance:", bal)
+	}
+
+	// append and read a sector, paying with the account
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:128])
+	oldRevNum := rev.Revision.NewRevisionNumber
+	root, err := s.AppendSector(&sector, &rev, key, payment)
+	if err != nil {
+		t.Fatal(err)
+	} else if rev.NumSectors() != 1 || rev.Revision.NewRevisionNumber <= oldRevNum {
+		t.Fatal("revision was not updated")
+	} else if len(revs) != 2 || revs[1].Revision.NewRevisionNumber != rev.Revision.NewRevisionNumber {
+		t.Fatal("revision was not recorded")
+	}
+	var buf bytes.Buffer
+	if err := s.ReadSector(&buf, root, 0, 128, payment); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[:128]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	}
+
+	// the host's revision should match ours
+	renter, err = proto.NewSession(host.Settings.NetAddress, host.PublicKey, rev.ID(), key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer renter.Close()
+	if renter.Revision().Revision.NewRevisionNumber != rev.Revision.NewRevisionNumber {
+		t.Fatal("host's revision does not match ours")
+	}
+}
+
+func TestMuxSessionPayment(t *testing.T) {
+	settings := ghost.FreeSettings
+	settings.BaseRPCPrice = types.NewCurrency64(10)
+	settings.MaxEphemeralAccountBalance = types.NewCurrency64(100)
+	host := ghost.New(t, settings, stubWallet{}, stubTpool{})
+	defer host.Close()
+
+	renter, err := proto.NewUnlockedSession(host.Settings.NetAddress, host.PublicKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := renter.Settings(); err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := renter.FormContract(stubWallet{}, stubTpool{}, key, types.NewCurrency64(1000), 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := renter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := proto.NewMuxSession(hostdb.ScannedHost{
+		HostSettings: host.Settings,
+		PublicKey:    host.PublicKey,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.UpdatePriceTable(proto.PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if !rev.RenterFunds().Equals64(990) {
+		t.Fatal("contract was not debited for price table:", rev.RenterFunds())
+	}
+
+	// fund the account; the contract should be debited for the deposit and
+	// the RPC cost
+	accountKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	account := proto.EphemeralAccountID(accountKey)
+	payment := proto.PayByEphemeralAccount(accountKey)
+	if bal, err := s.FundAccount(account, types.NewCurrency64(50), &rev, key); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals64(50) {
+		t.Fatal("unexpected balance:", bal)
+	} else if !rev.RenterFunds().Equals64(930) {
+		t.Fatal("contract was not debited for deposit:", rev.RenterFunds())
+	}
+
+	// paying with the account should debit it
+	if bal, err := s.AccountBalance(account, payment); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals64(40) {
+		t.Fatal("account was not debited:", bal)
+	}
+
+	// deposits that would exceed the maximum balance should be rejected
+	// without charging the contract
+	if _, err := s.FundAccount(account, types.NewCurrency64(70), &rev, key); err == nil {
+		t.Fatal("expected deposit exceeding maximum balance to be rejected")
+	} else if !rev.RenterFunds().Equals64(930) {
+		t.Fatal("contract was debited for rejected deposit:", rev.RenterFunds())
+	}
+	if bal, err := s.AccountBalance(account, proto.PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals64(40) {
+		t.Fatal("rejected deposit changed balance:", bal)
+	}
+
+	// drain the account; subsequent payments should be rejected
+	for i := 0; i < 4; i++ {
+		if _, err := s.AccountBalance(account, payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.AccountBalance(account, payment); err == nil {
+		t.Fatal("expected payment with insufficient balance to be rejected")
+	}
+	if bal, err := s.AccountBalance(account, proto.PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if !bal.IsZero() {
+		t.Fatal("unexpected balance:", bal)
+	}
+}
@@ -0,0 +1,511 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/renterhost"
+)
+
+// ErrInsufficientStorage is returned when there is no free space left in any
+// storage folder.
+var ErrInsufficientStorage = errors.New("not enough free space in storage folders")
+
+// sector store database buckets
+var (
+	// bucketStorageFolders maps folder IDs to folderMetadata.
+	bucketStorageFolders = []byte("bucketStorageFolders")
+
+	// bucketSectorLocations maps sector Merkle roots to sectorLocations.
+	bucketSectorLocations = []byte("bucketSectorLocations")
+
+	// bucketContractRoots maps FileContractIDs to their sector Merkle roots.
+	bucketContractRoots = []byte("bucketContractRoots")
+
+	sectorStoreBuckets = [][]byte{
+		bucketStorageFolders,
+		bucketSectorLocations,
+		bucketContractRoots,
+	}
+)
+
+type folderMetadata struct {
+	Path     string
+	Capacity uint64
+}
+
+type sectorLocation struct {
+	Folder uint64
+	Index  uint64
+	Refs   uint64
+}
+
+// A StorageFolder is a file holding a fixed number of sectors.
+type StorageFolder struct {
+	Path     string `json:"path"`
+	Capacity uint64 `json:"capacity"` // in sectors
+	Used     uint64 `json:"used"`     // in sectors
+}
+
+type storageFolder struct {
+	path     string
+	file     *os.File
+	capacity uint64
+	used     uint64
+	usage    []uint64 // bitmap of occupied slots
+}
+
+func (sf *storageFolder) setUsed(index uint64, used bool) {
+	mask := uint64(1) << (index % 64)
+	if wasUsed := sf.usage[index/64]&mask != 0; wasUsed == used {
+		return
+	}
+	sf.usage[index/64] ^= mask
+	if used {
+		sf.used++
+	} else {
+		sf.used--
+	}
+}
+
+// freeSlot returns the first unoccupied slot below limit.
+func (sf *storageFolder) freeSlot(limit uint64) (uint64, bool) {
+	for i, w := range sf.usage {
+		if w == math.MaxUint64 {
+			continue
+		}
+		index := uint64(i*64 + bits.TrailingZeros64(^w))
+		return index, index < limit
+	}
+	return 0, false
+}
+
+func (sf *storageFolder) resizeUsage(capacity uint64) {
+	usage := make([]uint64, (capacity+63)/64)
+	copy(usage, sf.usage)
+	sf.usage = usage
+	sf.capacity = capacity
+}
+
+func (sf *storageFolder) readSector(index uint64) (*[renterhost.SectorSize]byte, error) {
+	sector := new([renterhost.SectorSize]byte)
+	if _, err := sf.file.ReadAt(sector[:], int64(index*renterhost.SectorSize)); err != nil {
+		return nil, fmt.Errorf("could not read sector from %v: %w", sf.path, err)
+	}
+	return sector, nil
+}
+
+func (sf *storageFolder) writeSector(index uint64, sector *[renterhost.SectorSize]byte) error {
+	if _, err := sf.file.WriteAt(sector[:], int64(index*renterhost.SectorSize)); err != nil {
+		return fmt.Errorf("could not write sector to %v: %w", sf.path, err)
+	}
+	return sf.file.Sync()
+}
+
+// FileSectorStore implements SectorStore by packing sectors into one or more
+// preallocated storage folder files. Sector locations and contract roots are
+// tracked in a Bolt database.
+//
+// Sectors are reference-counted: adding a sector that is already present
+// increments its count rather than storing a second copy, and the sector's
+// slot is not freed until DeleteSector has been called once for each
+// corresponding call to AddSector. This allows multiple contracts to share
+// the same sector safely.
+type FileSectorStore struct {
+	db      *bolt.DB
+	folders map[uint64]*storageFolder
+	mu      sync.Mutex
+}
+
+// update runs fn in a read-write transaction. Changes to in-memory slot usage
+// may be made by fn; if the transaction fails, they are discarded by
+// reloading usage from the database.
+func (s *FileSectorStore) update(fn func(*bolt.Tx) error) error {
+	err := s.db.Update(fn)
+	if err != nil {
+		if reloadErr := s.loadUsage(); reloadErr != nil {
+			return fmt.Errorf("%v (additionally, could not reload sector usage: %w)", err, reloadErr)
+		}
+	}
+	return err
+}
+
+func (s *FileSectorStore) loadUsage() error {
+	for _, sf := range s.folders {
+		sf.usage = make([]uint64, len(sf.usage))
+		sf.used = 0
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSectorLocations).ForEach(func(_, v []byte) error {
+			var loc sectorLocation
+			if err := encoding.Unmarshal(v, &loc); err != nil {
+				return err
+			}
+			sf, ok := s.folders[loc.Folder]
+			if !ok || loc.Index >= sf.capacity {
+				return fmt.Errorf("sector location %v:%v is invalid", loc.Folder, loc.Index)
+			}
+			sf.setUsed(loc.Index, true)
+			return nil
+		})
+	})
+}
+
+// allocate claims a free slot in the storage folder with the most free space.
+// limit returns the number of usable slots in each folder.
+func (s *FileSectorStore) allocate(limit func(id uint64, sf *storageFolder) uint64) (uint64, uint64, error) {
+	var bestID, bestIndex, bestFree uint64
+	found := false
+	for id, sf := range s.folders {
+		free := sf.capacity - sf.used
+		if found && free <= bestFree {
+			continue
+		}
+		if index, ok := sf.freeSlot(limit(id, sf)); ok {
+			bestID, bestIndex, bestFree = id, index, free
+			found = true
+		}
+	}
+	if !found {
+		return 0, 0, ErrInsufficientStorage
+	}
+	s.folders[bestID].setUsed(bestIndex, true)
+	return bestID, bestIndex, nil
+}
+
+func fullCapacity(_ uint64, sf *storageFolder) uint64 { return sf.capacity }
+
+// relocate moves each sector for which shouldMove returns true to a new slot
+// chosen according to limit.
+func (s *FileSectorStore) relocate(tx *bolt.Tx, shouldMove func(sectorLocation) bool, limit func(uint64, *storageFolder) uint64) error {
+	b := tx.Bucket(bucketSectorLocations)
+	type move struct {
+		root []byte
+		loc  sectorLocation
+	}
+	var moves []move
+	err := b.ForEach(func(k, v []byte) error {
+		var loc sectorLocation
+		if err := encoding.Unmarshal(v, &loc); err != nil {
+			return err
+		}
+		if shouldMove(loc) {
+			moves = append(moves, move{append([]byte(nil), k...), loc})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range moves {
+		sector, err := s.folders[m.loc.Folder].readSector(m.loc.Index)
+		if err != nil {
+			return err
+		}
+		id, index, err := s.allocate(limit)
+		if err != nil {
+			return err
+		} else if err := s.folders[id].writeSector(index, sector); err != nil {
+			return err
+		}
+		s.folders[m.loc.Folder].setUsed(m.loc.Index, false)
+		m.loc.Folder, m.loc.Index = id, index
+		if err := b.Put(m.root, encoding.Marshal(m.loc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSectorStore) folderByPath(path string) (uint64, *storageFolder, error) {
+	for id, sf := range s.folders {
+		if sf.path == path {
+			return id, sf, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no storage folder at %v", path)
+}
+
+// AddSector implements SectorStore.
+func (s *FileSectorStore) AddSector(root crypto.Hash, sector *[renterhost.SectorSize]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSectorLocations)
+		var loc sectorLocation
+		if v := b.Get(root[:]); v != nil {
+			if err := encoding.Unmarshal(v, &loc); err != nil {
+				return err
+			}
+			loc.Refs++
+			return b.Put(root[:], encoding.Marshal(loc))
+		}
+		id, index, err := s.allocate(fullCapacity)
+		if err != nil {
+			return err
+		} else if err := s.folders[id].writeSector(index, sector); err != nil {
+			return err
+		}
+		loc = sectorLocation{Folder: id, Index: index, Refs: 1}
+		return b.Put(root[:], encoding.Marshal(loc))
+	})
+}
+
+// Sector implements SectorStore.
+func (s *FileSectorStore) Sector(root crypto.Hash) (*[renterhost.SectorSize]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var loc sectorLocation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketSectorLocations).Get(root[:])
+		if v == nil {
+			return fmt.Errorf("no sector with Merkle root %v", root)
+		}
+		return encoding.Unmarshal(v, &loc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.folders[loc.Folder].readSector(loc.Index)
+}
+
+// DeleteSector implements SectorStore. The sector's slot is only freed once
+// its reference count reaches zero.
+func (s *FileSectorStore) DeleteSector(root crypto.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSectorLocations)
+		v := b.Get(root[:])
+		if v == nil {
+			return nil
+		}
+		var loc sectorLocation
+		if err := encoding.Unmarshal(v, &loc); err != nil {
+			return err
+		}
+		if loc.Refs > 1 {
+			loc.Refs--
+			return b.Put(root[:], encoding.Marshal(loc))
+		}
+		s.folders[loc.Folder].setUsed(loc.Index, false)
+		return b.Delete(root[:])
+	})
+}
+
+// ContractRoots implements SectorStore.
+func (s *FileSectorStore) ContractRoots(id types.FileContractID) (roots []crypto.Hash, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketContractRoots).Get(id[:])
+		roots = make([]crypto.Hash, len(v)/crypto.HashSize)
+		for i := range roots {
+			copy(roots[i][:], v[i*crypto.HashSize:])
+		}
+		return nil
+	})
+	return
+}
+
+// SetContractRoots implements SectorStore.
+func (s *FileSectorStore) SetContractRoots(id types.FileContractID, roots []crypto.Hash) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if len(roots) == 0 {
+			return tx.Bucket(bucketContractRoots).Delete(id[:])
+		}
+		buf := make([]byte, 0, len(roots)*crypto.HashSize)
+		for _, root := range roots {
+			buf = append(buf, root[:]...)
+		}
+		return tx.Bucket(bucketContractRoots).Put(id[:], buf)
+	})
+}
+
+// Folders returns the store's storage folders, sorted by path.
+func (s *FileSectorStore) Folders() []StorageFolder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	folders := make([]StorageFolder, 0, len(s.folders))
+	for _, sf := range s.folders {
+		folders = append(folders, StorageFolder{
+			Path:     sf.path,
+			Capacity: sf.capacity,
+			Used:     sf.used,
+		})
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].Path < folders[j].Path
+	})
+	return folders
+}
+
+// AddFolder adds a storage folder, backed by the file at path, with room for
+// the specified number of sectors. The file is created if it does not exist.
+func (s *FileSectorStore) AddFolder(path string, sectors uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, err := s.folderByPath(path); err == nil {
+		return fmt.Errorf("storage folder at %v already exists", path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	} else if err := f.Truncate(int64(sectors * renterhost.SectorSize)); err != nil {
+		f.Close()
+		return err
+	}
+	var id uint64
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketStorageFolders)
+		id, _ = b.NextSequence()
+		return b.Put(encoding.Marshal(id), encoding.Marshal(folderMetadata{
+			Path:     path,
+			Capacity: sectors,
+		}))
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	sf := &storageFolder{path: path, file: f}
+	sf.resizeUsage(sectors)
+	s.folders[id] = sf
+	return nil
+}
+
+// RemoveFolder moves all of the sectors in the storage folder at path to
+// other folders, and then deletes the folder's file. If the other folders
+// lack sufficient free space, ErrInsufficientStorage is returned and no
+// sectors are moved.
+func (s *FileSectorStore) RemoveFolder(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, sf, err := s.folderByPath(path)
+	if err != nil {
+		return err
+	}
+	err = s.update(func(tx *bolt.Tx) error {
+		shouldMove := func(loc sectorLocation) bool { return loc.Folder == id }
+		limit := func(fid uint64, sf *storageFolder) uint64 {
+			if fid == id {
+				return 0
+			}
+			return sf.capacity
+		}
+		if err := s.relocate(tx, shouldMove, limit); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketStorageFolders).Delete(encoding.Marshal(id))
+	})
+	if err != nil {
+		return err
+	}
+	delete(s.folders, id)
+	sf.file.Close()
+	return os.Remove(sf.path)
+}
+
+// ResizeFolder changes the number of sectors that the storage folder at path
+// can hold. When shrinking a folder, sectors stored beyond the new capacity
+// are moved to free slots, either within the folder or in other folders.
+func (s *FileSectorStore) ResizeFolder(path string, sectors uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, sf, err := s.folderByPath(path)
+	if err != nil {
+		return err
+	}
+	if sectors > sf.capacity {
+		if err := sf.file.Truncate(int64(sectors * renterhost.SectorSize)); err != nil {
+			return err
+		}
+	}
+	err = s.update(func(tx *bolt.Tx) error {
+		if sectors < sf.capacity {
+			shouldMove := func(loc sectorLocation) bool { return loc.Folder == id && loc.Index >= sectors }
+			limit := func(fid uint64, sf *storageFolder) uint64 {
+				if fid == id {
+					return sectors
+				}
+				return sf.capacity
+			}
+			if err := s.relocate(tx, shouldMove, limit); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketStorageFolders).Put(encoding.Marshal(id), encoding.Marshal(folderMetadata{
+			Path:     sf.path,
+			Capacity: sectors,
+		}))
+	})
+	if err != nil {
+		return err
+	}
+	sf.resizeUsage(sectors)
+	return sf.file.Truncate(int64(sectors * renterhost.SectorSize))
+}
+
+// Close closes the store's storage folders and database.
+func (s *FileSectorStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sf := range s.folders {
+		sf.file.Close()
+	}
+	return s.db.Close()
+}
+
+// NewFileSectorStore returns a FileSectorStore that records its metadata in
+// the Bolt database at filename. Storage folders previously added to the
+// store are reopened automatically.
+func NewFileSectorStore(filename string) (*FileSectorStore, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSectorStore{
+		db:      db,
+		folders: make(map[uint64]*storageFolder),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range sectorStoreBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketStorageFolders).ForEach(func(k, v []byte) error {
+			var id uint64
+			var meta folderMetadata
+			if err := encoding.Unmarshal(k, &id); err != nil {
+				return err
+			} else if err := encoding.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(meta.Path, os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			sf := &storageFolder{path: meta.Path, file: f}
+			sf.resizeUsage(meta.Capacity)
+			s.folders[id] = sf
+			return nil
+		})
+	})
+	if err == nil {
+		err = s.loadUsage()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,136 @@
+package host_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/host"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestFileSectorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ss, err := host.NewFileSectorStore(filepath.Join(dir, "sectors.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder1 := filepath.Join(dir, "folder1.dat")
+	folder2 := filepath.Join(dir, "folder2.dat")
+	if err := ss.AddFolder(folder1, 3); err != nil {
+		t.Fatal(err)
+	} else if err := ss.AddFolder(folder1, 3); err == nil {
+		t.Fatal("expected error when adding duplicate folder")
+	}
+
+	sectors := make([]*[renterhost.SectorSize]byte, 3)
+	roots := make([]crypto.Hash, len(sectors))
+	for i := range sectors {
+		sectors[i] = new([renterhost.SectorSize]byte)
+		frand.Read(sectors[i][:])
+		roots[i] = merkle.SectorRoot(sectors[i])
+		if err := ss.AddSector(roots[i], sectors[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var extra [renterhost.SectorSize]byte
+	if err := ss.AddSector(merkle.SectorRoot(&extra), &extra); err != host.ErrInsufficientStorage {
+		t.Fatal("expected ErrInsufficientStorage, got", err)
+	}
+
+	checkSectors := func(roots []crypto.Hash) {
+		t.Helper()
+		for i, root := range roots {
+			sector, err := ss.Sector(root)
+			if err != nil {
+				t.Fatal(err)
+			} else if *sector != *sectors[i] {
+				t.Fatal("sector data does not match")
+			}
+		}
+	}
+	checkSectors(roots)
+
+	// add the first sector again, as though it were shared by another
+	// contract; deleting it once should not remove it
+	if err := ss.AddSector(roots[0], sectors[0]); err != nil {
+		t.Fatal(err)
+	} else if err := ss.DeleteSector(roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkSectors(roots[:1])
+	if fs := ss.Folders(); len(fs) != 1 || fs[0].Used != 3 {
+		t.Fatal("unexpected folders:", fs)
+	}
+
+	// contract roots
+	var id types.FileContractID
+	frand.Read(id[:])
+	if err := ss.SetContractRoots(id, roots); err != nil {
+		t.Fatal(err)
+	} else if croots, err := ss.ContractRoots(id); err != nil {
+		t.Fatal(err)
+	} else if len(croots) != len(roots) || croots[2] != roots[2] {
+		t.Fatal("contract roots do not match")
+	}
+
+	// shrinking the folder requires space elsewhere
+	if err := ss.ResizeFolder(folder1, 1); err != host.ErrInsufficientStorage {
+		t.Fatal("expected ErrInsufficientStorage, got", err)
+	}
+	checkSectors(roots)
+	if err := ss.AddFolder(folder2, 2); err != nil {
+		t.Fatal(err)
+	} else if err := ss.ResizeFolder(folder1, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkSectors(roots)
+	if fs := ss.Folders(); len(fs) != 2 || fs[0].Capacity != 1 || fs[0].Used != 1 || fs[1].Used != 2 {
+		t.Fatal("unexpected folders:", fs)
+	}
+
+	// grow the second folder and remove the first
+	if err := ss.ResizeFolder(folder2, 4); err != nil {
+		t.Fatal(err)
+	} else if err := ss.RemoveFolder(folder1); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(folder1); !os.IsNotExist(err) {
+		t.Fatal("folder file was not deleted")
+	}
+	checkSectors(roots)
+
+	// reopen the store; everything should be preserved
+	if err := ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ss, err = host.NewFileSectorStore(filepath.Join(dir, "sectors.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	checkSectors(roots)
+	if fs := ss.Folders(); len(fs) != 1 || fs[0].Path != folder2 || fs[0].Capacity != 4 || fs[0].Used != 3 {
+		t.Fatal("unexpected folders:", fs)
+	} else if croots, err := ss.ContractRoots(id); err != nil || len(croots) != len(roots) {
+		t.Fatal("contract roots were not persisted")
+	}
+
+	// deleting the last reference should free the slot
+	if err := ss.DeleteSector(roots[0]); err != nil {
+		t.Fatal(err)
+	} else if _, err := ss.Sector(roots[0]); err == nil {
+		t.Fatal("expected sector to be deleted")
+	} else if fs := ss.Folders(); fs[0].Used != 2 {
+		t.Fatal("slot was not freed:", fs)
+	}
+}
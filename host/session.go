@@ -438,7 +438,8 @@ func (sh *SessionHandler) rpcWrite(s *session) error {
 			newSectors -= action.A
 		case renterhost.RPCWriteActionUpdate:
 			rc.Up += uint64(len(action.Data))
-			// TODO: this should count as a sector access, but existing renters don't treat it as such
+			// the host must read the sector in order to modify it
+			rc.SectorAccesses++
 		}
 	}
 	if newSectors > oldSectors {
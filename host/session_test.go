@@ -8,6 +8,7 @@ import (
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/us/internal/ghost"
+	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
@@ -89,3 +90,77 @@ func TestSession(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSessionUpdate(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	sector := [renterhost.SectorSize]byte{0: 1}
+	if _, err := renter.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite two segments in the middle of the sector
+	data := bytes.Repeat([]byte{2}, 2*merkle.SegmentSize)
+	offset := uint32(5 * merkle.SegmentSize)
+	newRoot, err := renter.Update(0, offset, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(sector[offset:], data)
+	if newRoot != merkle.SectorRoot(&sector) {
+		t.Fatal("updated sector root does not match expected root")
+	}
+
+	var sectorBuf bytes.Buffer
+	err = renter.Read(&sectorBuf, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: newRoot,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(sectorBuf.Bytes(), sector[:]) {
+		t.Fatal("downloaded sector does not match updated sector")
+	}
+
+	// misaligned updates should be rejected
+	if _, err := renter.Update(0, 1, data); err == nil {
+		t.Fatal("expected misaligned update to be rejected")
+	}
+}
+
+func TestSessionUpdatePrice(t *testing.T) {
+	settings := ghost.FreeSettings
+	settings.SectorAccessPrice = types.NewCurrency64(100)
+	host := ghost.New(t, settings, stubWallet{}, stubTpool{})
+	defer host.Close()
+	renter, err := proto.NewUnlockedSession(host.Settings.NetAddress, host.PublicKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := renter.Settings(); err != nil {
+		t.Fatal(err)
+	}
+	defer renter.Close()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := renter.FormContract(stubWallet{}, stubTpool{}, key, types.NewCurrency64(1000), 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := renter.Lock(rev.ID(), key, 0); err != nil {
+		t.Fatal(err)
+	}
+	sector := [renterhost.SectorSize]byte{0: 1}
+	if _, err := renter.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host charges a sector access for each Update, and the renter should
+	// pay for it
+	oldFunds := renter.Revision().RenterFunds()
+	if _, err := renter.Update(0, 0, make([]byte, merkle.SegmentSize)); err != nil {
+		t.Fatal(err)
+	} else if paid := oldFunds.Sub(renter.Revision().RenterFunds()); paid.Cmp(settings.SectorAccessPrice) < 0 {
+		t.Fatal("renter did not pay for sector access:", paid)
+	}
+}
@@ -45,7 +45,10 @@ func considerModifications(id types.FileContractID, actions []renterhost.RPCWrit
 		return nil, nil, err
 	}
 	newRoots := append([]crypto.Hash(nil), sectorRoots...)
-	var sectorsRemoved []crypto.Hash
+	// the store counts one reference per AddSector, so track the net change
+	// in references to each root across the whole batch; a sector may be
+	// appended more than once, or appended and then modified
+	refDeltas := make(map[crypto.Hash]int)
 	gainedSectorData := make(map[crypto.Hash]*[renterhost.SectorSize]byte)
 	for _, action := range actions {
 		switch action.Type {
@@ -55,10 +58,13 @@ func considerModifications(id types.FileContractID, actions []renterhost.RPCWrit
 			newRoot := merkle.SectorRoot(&sector)
 			newRoots = append(newRoots, newRoot)
 			gainedSectorData[newRoot] = &sector
+			refDeltas[newRoot]++
 
 		case renterhost.RPCWriteActionTrim:
 			numSectors := action.A
-			sectorsRemoved = append(sectorsRemoved, newRoots[uint64(len(newRoots))-numSectors:]...)
+			for _, root := range newRoots[uint64(len(newRoots))-numSectors:] {
+				refDeltas[root]--
+			}
 			newRoots = newRoots[:uint64(len(newRoots))-numSectors]
 
 		case renterhost.RPCWriteActionSwap:
@@ -67,13 +73,20 @@ func considerModifications(id types.FileContractID, actions []renterhost.RPCWrit
 
 		case renterhost.RPCWriteActionUpdate:
 			sectorIndex, offset := action.A, action.B
-			sector, err := ss.Sector(newRoots[sectorIndex])
-			if err != nil {
-				return nil, nil, err
+			oldSector, ok := gainedSectorData[newRoots[sectorIndex]]
+			if !ok {
+				oldSector, err = ss.Sector(newRoots[sectorIndex])
+				if err != nil {
+					return nil, nil, err
+				}
 			}
+			// modify a copy, since the store may return shared memory
+			sector := new([renterhost.SectorSize]byte)
+			*sector = *oldSector
 			copy(sector[offset:], action.Data)
 			newRoot := merkle.SectorRoot(sector)
-			sectorsRemoved = append(sectorsRemoved, newRoots[sectorIndex])
+			refDeltas[newRoots[sectorIndex]]--
+			refDeltas[newRoot]++
 			gainedSectorData[newRoot] = sector
 			newRoots[sectorIndex] = newRoot
 		}
@@ -89,15 +102,16 @@ func considerModifications(id types.FileContractID, actions []renterhost.RPCWrit
 		if err := ss.SetContractRoots(id, newRoots); err != nil {
 			return err
 		}
-		for _, root := range sectorsRemoved {
-			if err := ss.DeleteSector(root); err != nil {
-				return err
+		for root, delta := range refDeltas {
+			for ; delta > 0; delta-- {
+				if err := ss.AddSector(root, gainedSectorData[root]); err != nil {
+					return err
+				}
 			}
-			delete(gainedSectorData, root)
-		}
-		for root, sector := range gainedSectorData {
-			if err := ss.AddSector(root, sector); err != nil {
-				return err
+			for ; delta < 0; delta++ {
+				if err := ss.DeleteSector(root); err != nil {
+					return err
+				}
 			}
 		}
 		return nil
@@ -0,0 +1,90 @@
+package host
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestConsiderModificationsRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ss, err := NewFileSectorStore(filepath.Join(dir, "sectors.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	if err := ss.AddFolder(filepath.Join(dir, "folder.dat"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	var id types.FileContractID
+	frand.Read(id[:])
+	modify := func(actions ...renterhost.RPCWriteAction) {
+		t.Helper()
+		_, apply, err := considerModifications(id, actions, false, ss)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := apply(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSector := func(root crypto.Hash) {
+		t.Helper()
+		if _, err := ss.Sector(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkUsed := func(exp uint64) {
+		t.Helper()
+		if fs := ss.Folders(); fs[0].Used != exp {
+			t.Fatalf("expected %v used slots, got %v", exp, fs[0].Used)
+		}
+	}
+	appendAction := func(sector []byte) renterhost.RPCWriteAction {
+		return renterhost.RPCWriteAction{Type: renterhost.RPCWriteActionAppend, Data: sector}
+	}
+
+	// appending the same sector twice should add two references, so trimming
+	// one of them must not free the sector
+	var sectorA [renterhost.SectorSize]byte
+	frand.Read(sectorA[:])
+	rootA := merkle.SectorRoot(&sectorA)
+	modify(appendAction(sectorA[:]), appendAction(sectorA[:]))
+	modify(renterhost.RPCWriteAction{Type: renterhost.RPCWriteActionTrim, A: 1})
+	checkSector(rootA)
+	checkUsed(1)
+
+	// appending a sector that is shared with another contract and then
+	// updating it in the same batch must not remove the other reference
+	var sectorB [renterhost.SectorSize]byte
+	frand.Read(sectorB[:])
+	rootB := merkle.SectorRoot(&sectorB)
+	if err := ss.AddSector(rootB, &sectorB); err != nil {
+		t.Fatal(err)
+	}
+	modify(appendAction(sectorB[:]), renterhost.RPCWriteAction{
+		Type: renterhost.RPCWriteActionUpdate,
+		A:    1,
+		B:    0,
+		Data: make([]byte, merkle.SegmentSize),
+	})
+	checkSector(rootA)
+	checkSector(rootB)
+	checkUsed(3)
+	if roots, err := ss.ContractRoots(id); err != nil {
+		t.Fatal(err)
+	} else if len(roots) != 2 || roots[0] != rootA || roots[1] == rootB {
+		t.Fatal("contract roots are incorrect")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/us/renterhost"
@@ -96,7 +97,7 @@ type HostSettings struct {
 	RevisionNumber         uint64             `json:"revisionNumber"`
 	Version                string             `json:"version"`
 
-	// RHP3 specific fields
+	// mux protocol fields
 	EphemeralAccountExpiry     time.Duration  `json:"ephemeralAccountExpiry"`
 	MaxEphemeralAccountBalance types.Currency `json:"maxEphemeralAccountBalance"`
 	SiaMuxPort                 string         `json:"siaMuxPort"`
@@ -106,6 +107,60 @@ type HostSettings struct {
 	Model string `json:"model"`
 }
 
+// A HostPriceTable contains the costs of the mux protocol RPCs offered by a
+// host. Price tables are only valid for a limited time, and are identified by
+// their UID. Note that this is not the price table schema used by siad.
+type HostPriceTable struct {
+	UID             [16]byte          `json:"uid"`
+	Validity        time.Duration     `json:"validity"`
+	HostBlockHeight types.BlockHeight `json:"hostBlockHeight"`
+
+	UpdatePriceTableCost types.Currency `json:"updatePriceTableCost"`
+	AccountBalanceCost   types.Currency `json:"accountBalanceCost"`
+	FundAccountCost      types.Currency `json:"fundAccountCost"`
+
+	InitBaseCost          types.Currency `json:"initBaseCost"`
+	DownloadBandwidthCost types.Currency `json:"downloadBandwidthCost"`
+	UploadBandwidthCost   types.Currency `json:"uploadBandwidthCost"`
+	ReadBaseCost          types.Currency `json:"readBaseCost"`
+	ReadLengthCost        types.Currency `json:"readLengthCost"`
+	WriteBaseCost         types.Currency `json:"writeBaseCost"`
+	WriteLengthCost       types.Currency `json:"writeLengthCost"`
+	WriteStoreCost        types.Currency `json:"writeStoreCost"`
+	CollateralCost        types.Currency `json:"collateralCost"`
+	MaxCollateral         types.Currency `json:"maxCollateral"`
+
+	TxnFeeMinRecommended types.Currency `json:"txnFeeMinRecommended"`
+	TxnFeeMaxRecommended types.Currency `json:"txnFeeMaxRecommended"`
+}
+
+// ReadSectorCost returns the cost of reading length bytes of a sector,
+// including the bandwidth required to transfer the data and its Merkle proof.
+func (pt HostPriceTable) ReadSectorCost(length, proofHashes uint64) types.Currency {
+	bandwidth := length + proofHashes*crypto.HashSize
+	return pt.InitBaseCost.
+		Add(pt.ReadBaseCost).
+		Add(pt.ReadLengthCost.Mul64(length)).
+		Add(pt.DownloadBandwidthCost.Mul64(bandwidth))
+}
+
+// AppendSectorCost returns the cost of appending a sector to a contract and
+// storing it for the specified duration, along with the collateral that the
+// host will risk for it.
+func (pt HostPriceTable) AppendSectorCost(duration types.BlockHeight) (cost, collateral types.Currency) {
+	const sectorSize = renterhost.SectorSize
+	cost = pt.InitBaseCost.
+		Add(pt.WriteBaseCost).
+		Add(pt.WriteLengthCost.Mul64(sectorSize)).
+		Add(pt.WriteStoreCost.Mul64(sectorSize).Mul64(uint64(duration))).
+		Add(pt.UploadBandwidthCost.Mul64(sectorSize))
+	collateral = pt.CollateralCost.Mul64(sectorSize).Mul64(uint64(duration))
+	if collateral.Cmp(pt.MaxCollateral) > 0 {
+		collateral = pt.MaxCollateral
+	}
+	return
+}
+
 // ScannedHost groups a host's settings with its public key and other scan-
 // related metrics.
 type ScannedHost struct {
@@ -10,6 +10,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
@@ -32,8 +33,12 @@ var DefaultSettings = hostdb.HostSettings{
 	DownloadBandwidthPrice: types.SiacoinPrecision.Div64(3e9),
 	WindowSize:             5,
 	Version:                "1.5.0",
-	Make:                   "ghost",
-	Model:                  "v0.1.0",
+
+	EphemeralAccountExpiry:     time.Hour,
+	MaxEphemeralAccountBalance: types.SiacoinPrecision,
+
+	Make:  "ghost",
+	Model: "v0.1.0",
 }
 
 // FreeSettings are the cheapest possible ghost settings.
@@ -50,8 +55,12 @@ var FreeSettings = hostdb.HostSettings{
 	DownloadBandwidthPrice: types.ZeroCurrency,
 	WindowSize:             5,
 	Version:                "1.5.0",
-	Make:                   "ghost",
-	Model:                  "v0.1.0",
+
+	EphemeralAccountExpiry:     time.Hour,
+	MaxEphemeralAccountBalance: types.SiacoinPrecision,
+
+	Make:  "ghost",
+	Model: "v0.1.0",
 }
 
 // A Host is an ephemeral Sia host.
@@ -59,15 +68,17 @@ type Host struct {
 	Settings  hostdb.HostSettings
 	PublicKey hostdb.HostPublicKey
 	l         net.Listener
+	ml        net.Listener
 	cw        *host.ChainWatcher
 }
 
-// Close closes the host's listener.
+// Close closes the host's listeners.
 func (h *Host) Close() error {
 	if h.l == nil {
 		return nil
 	}
 	h.l.Close()
+	h.ml.Close()
 	h.cw.Close()
 	h.l = nil
 	return nil
@@ -79,7 +90,8 @@ func (h *Host) ProcessConsensusChange(cc modules.ConsensusChange) {
 }
 
 // New returns an initialized host that listens for incoming sessions on a
-// random localhost port. The host is automatically closed with tb.Cleanup.
+// random localhost port, and for incoming mux protocol sessions on another. The host is
+// automatically closed with tb.Cleanup.
 func New(tb testing.TB, settings hostdb.HostSettings, wm host.Wallet, tpool host.TransactionPool) *Host {
 	tb.Helper()
 	l, err := net.Listen("tcp", ":0")
@@ -87,7 +99,13 @@ func New(tb testing.TB, settings hostdb.HostSettings, wm host.Wallet, tpool host
 		tb.Fatal(err)
 	}
 	tb.Cleanup(func() { l.Close() })
+	ml, err := net.Listen("tcp", ":0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ml.Close() })
 	settings.NetAddress = modules.NetAddress(l.Addr().String())
+	_, settings.SiaMuxPort, _ = net.SplitHostPort(ml.Addr().String())
 	settings.UnlockHash, err = wm.Address()
 	if err != nil {
 		tb.Fatal(err)
@@ -97,11 +115,14 @@ func New(tb testing.TB, settings hostdb.HostSettings, wm host.Wallet, tpool host
 		PublicKey: hostdb.HostKeyFromPublicKey(ed25519hash.ExtractPublicKey(key)),
 		Settings:  settings,
 		l:         l,
+		ml:        ml,
 	}
 	cs := newEphemeralContractStore(key)
 	ss := newEphemeralSectorStore()
 	sh := host.NewSessionHandler(key, (*constantHostSettings)(&h.Settings), cs, ss, wm, tpool, nopMetricsRecorder{})
-	go listen(sh, l)
+	mh := host.NewMuxHandler(sh, newEphemeralAccountStore())
+	go listen(sh.Serve, l)
+	go listen(mh.Serve, ml)
 	h.cw = host.NewChainWatcher(tpool, wm, cs, ss)
 	return h
 }
@@ -114,7 +135,7 @@ func debugLn(args ...interface{}) {
 	}
 }
 
-func listen(sh *host.SessionHandler, l net.Listener) {
+func listen(serve func(net.Conn) error, l net.Listener) {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -123,7 +144,7 @@ func listen(sh *host.SessionHandler, l net.Listener) {
 		}
 		go func() {
 			defer conn.Close()
-			err := sh.Serve(conn)
+			err := serve(conn)
 			if err != nil {
 				debugLn("rpc error:", err)
 			}
@@ -321,6 +342,43 @@ func newEphemeralContractStore(key ed25519.PrivateKey) *ephemeralContractStore {
 	}
 }
 
+type ephemeralAccountStore struct {
+	balances map[renterhost.AccountID]types.Currency
+	mu       sync.Mutex
+}
+
+func (eas *ephemeralAccountStore) Balance(id renterhost.AccountID) (types.Currency, error) {
+	eas.mu.Lock()
+	defer eas.mu.Unlock()
+	return eas.balances[id], nil
+}
+
+func (eas *ephemeralAccountStore) Deposit(id renterhost.AccountID, amount, max types.Currency) (types.Currency, error) {
+	eas.mu.Lock()
+	defer eas.mu.Unlock()
+	if eas.balances[id].Add(amount).Cmp(max) > 0 {
+		return eas.balances[id], host.ErrMaxBalanceExceeded
+	}
+	eas.balances[id] = eas.balances[id].Add(amount)
+	return eas.balances[id], nil
+}
+
+func (eas *ephemeralAccountStore) Withdraw(id renterhost.AccountID, amount types.Currency) error {
+	eas.mu.Lock()
+	defer eas.mu.Unlock()
+	if eas.balances[id].Cmp(amount) < 0 {
+		return host.ErrInsufficientBalance
+	}
+	eas.balances[id] = eas.balances[id].Sub(amount)
+	return nil
+}
+
+func newEphemeralAccountStore() *ephemeralAccountStore {
+	return &ephemeralAccountStore{
+		balances: make(map[renterhost.AccountID]types.Currency),
+	}
+}
+
 type nopMetricsRecorder struct{}
 
 func (nopMetricsRecorder) RecordSessionMetric(ctx *host.SessionContext, m host.Metric) {}
@@ -713,6 +713,46 @@ func TestBuildVerifyDiffProofTrim(t *testing.T) {
 	}
 }
 
+func TestBuildVerifyDiffProofUpdate(t *testing.T) {
+	const numSectors = 9
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	sectorRoots := make([]crypto.Hash, numSectors)
+	for i := range sectorRoots {
+		sectorRoots[i] = frand.Entropy256()
+	}
+	sectorRoots[5] = SectorRoot(&sector)
+	oldRoot := MetaRoot(sectorRoots)
+
+	// the renter computes the new root of the updated sector from a proof of
+	// the segments it modifies
+	proof := BuildProof(&sector, 3, 5, nil)
+	update := frand.Bytes(2 * SegmentSize)
+	newSectorRoot := ProofRoot(proof, update, 3, 5)
+	copy(sector[3*SegmentSize:], update)
+	if newSectorRoot != SectorRoot(&sector) {
+		t.Fatal("ProofRoot computed incorrect root")
+	}
+
+	actions := []renterhost.RPCWriteAction{
+		{Type: renterhost.RPCWriteActionSwap, A: 1, B: 8},
+		{Type: renterhost.RPCWriteActionUpdate, A: 5, B: 3 * SegmentSize, Data: update},
+	}
+	treeHashes, leafHashes := BuildDiffProof(actions, sectorRoots)
+	newRoot := MetaRoot([]crypto.Hash{
+		sectorRoots[0], sectorRoots[8], sectorRoots[2], sectorRoots[3],
+		sectorRoots[4], newSectorRoot, sectorRoots[6], sectorRoots[7],
+		sectorRoots[1],
+	})
+
+	if VerifyDiffProof(actions, numSectors, treeHashes, leafHashes, oldRoot, newRoot, nil) {
+		t.Error("VerifyDiffProof should fail without the new root of the updated sector")
+	}
+	if !VerifyDiffProof(actions, numSectors, treeHashes, leafHashes, oldRoot, newRoot, []crypto.Hash{newSectorRoot}) {
+		t.Error("failed to verify proof produced by BuildDiffProof")
+	}
+}
+
 func BenchmarkBuildDiffProof(b *testing.B) {
 	const numSectors = 12
 	sectorRoots := make([]crypto.Hash, numSectors)
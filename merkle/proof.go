@@ -117,6 +117,12 @@ func verifyProof(proof []crypto.Hash, subtreeRoot func(i, j int) crypto.Hash, st
 	// proof set), but this is the simplest way I was able to implement it.
 	// Namely, it has the important advantage of being symmetrical to the
 	// Build operation.
+	return proofRoot(proof, subtreeRoot, start, end) == root
+}
+
+// proofRoot computes the root of a sector from a proof produced by BuildProof
+// and the roots of the subtrees within [start, end).
+func proofRoot(proof []crypto.Hash, subtreeRoot func(i, j int) crypto.Hash, start, end int) crypto.Hash {
 	var rec func(int, int) crypto.Hash
 	rec = func(i, j int) crypto.Hash {
 		if i >= start && j <= end {
@@ -137,7 +143,7 @@ func verifyProof(proof []crypto.Hash, subtreeRoot func(i, j int) crypto.Hash, st
 			return blake2b.SumPair(left, right)
 		}
 	}
-	return rec(0, SegmentsPerSector) == root
+	return rec(0, SegmentsPerSector)
 }
 
 // VerifyProof verifies a proof produced by BuildProof. Only sector-sized
@@ -160,6 +166,29 @@ func VerifyProof(proof []crypto.Hash, segments []byte, start, end int, root cryp
 	return verifyProof(proof, subtreeRoot, start, end, root)
 }
 
+// ProofRoot returns the Merkle root of a sector, given a proof produced by
+// BuildProof for the segment range [start, end) and the segments within that
+// range. If the proof was previously verified against the sector's current
+// root, ProofRoot can be used to compute the root that the sector would have if
+// the segments were modified.
+func ProofRoot(proof []crypto.Hash, segments []byte, start, end int) crypto.Hash {
+	if len(segments) != (end-start)*SegmentSize {
+		panic("ProofRoot: segments length does not match range")
+	} else if start < 0 || end > SegmentsPerSector || start >= end {
+		panic("ProofRoot: illegal proof range")
+	} else if len(proof) != ProofSize(SegmentsPerSector, start, end) {
+		panic("ProofRoot: proof has wrong size")
+	}
+
+	var s appendStack
+	subtreeRoot := func(i, j int) crypto.Hash {
+		s.reset()
+		s.appendLeaves(segments[(i-start)*SegmentSize : (j-start)*SegmentSize])
+		return s.root()
+	}
+	return proofRoot(proof, subtreeRoot, start, end)
+}
+
 // BuildSectorRangeProof constructs a proof for the sector range [start, end).
 func BuildSectorRangeProof(sectorRoots []crypto.Hash, start, end int) []crypto.Hash {
 	if len(sectorRoots) == 0 {
@@ -240,6 +269,9 @@ func sectorsChanged(actions []renterhost.RPCWriteAction, numSectors int) []int {
 			sectorsChanged[int(action.A)] = struct{}{}
 			sectorsChanged[int(action.B)] = struct{}{}
 
+		case renterhost.RPCWriteActionUpdate:
+			sectorsChanged[int(action.A)] = struct{}{}
+
 		default:
 			panic("unknown or unsupported action type: " + action.Type.String())
 		}
@@ -256,7 +288,6 @@ func sectorsChanged(actions []renterhost.RPCWriteAction, numSectors int) []int {
 }
 
 // BuildDiffProof constructs a diff proof for the specified actions.
-// ActionUpdate is not supported.
 func BuildDiffProof(actions []renterhost.RPCWriteAction, sectorRoots []crypto.Hash) (treeHashes, leafHashes []crypto.Hash) {
 	proofIndices := sectorsChanged(actions, len(sectorRoots))
 	leafHashes = make([]crypto.Hash, len(proofIndices))
@@ -302,10 +333,12 @@ func PrecomputeAppendRoots(actions []renterhost.RPCWriteAction) []crypto.Hash {
 	return roots
 }
 
-// VerifyDiffProof verifies a proof produced by BuildDiffProof. ActionUpdate is
-// not supported. If appendRoots is non-nil, it is assumed to contain the
-// precomputed SectorRoots of all Append actions.
-func VerifyDiffProof(actions []renterhost.RPCWriteAction, numLeaves int, treeHashes, leafHashes []crypto.Hash, oldRoot, newRoot crypto.Hash, appendRoots []crypto.Hash) bool {
+// VerifyDiffProof verifies a proof produced by BuildDiffProof. If newRoots is
+// non-nil, it is assumed to contain the precomputed SectorRoots of all Append
+// and Update actions, in order. Since the new SectorRoot of an updated sector
+// cannot be derived from the Update action alone, VerifyDiffProof returns false
+// if actions contains an Update action and newRoots is nil.
+func VerifyDiffProof(actions []renterhost.RPCWriteAction, numLeaves int, treeHashes, leafHashes []crypto.Hash, oldRoot, newRoot crypto.Hash, newRoots []crypto.Hash) bool {
 	verifyMulti := func(proofIndices []int, treeHashes, leafHashes []crypto.Hash, numLeaves int, root crypto.Hash) bool {
 		var s proofStack
 		insertRange := func(i, j int) {
@@ -339,7 +372,10 @@ func VerifyDiffProof(actions []renterhost.RPCWriteAction, numLeaves int, treeHas
 	}
 
 	// then modify the proof according to actions and construct the newRoot
-	newLeafHashes := modifyLeaves(leafHashes, actions, numLeaves, appendRoots)
+	newLeafHashes, ok := modifyLeaves(leafHashes, actions, numLeaves, newRoots)
+	if !ok {
+		return false
+	}
 	newProofIndices := modifyProofRanges(proofIndices, actions, numLeaves)
 	numLeaves += len(newLeafHashes) - len(leafHashes)
 
@@ -370,8 +406,9 @@ func modifyProofRanges(proofIndices []int, actions []renterhost.RPCWriteAction,
 }
 
 // modifyLeaves modifies the leaf hashes of a Merkle diff proof to verify a
-// post-modification Merkle diff proof for the specified actions.
-func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction, numSectors int, appendRoots []crypto.Hash) []crypto.Hash {
+// post-modification Merkle diff proof for the specified actions. It returns
+// false if the new root of an updated sector is not available.
+func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction, numSectors int, newRoots []crypto.Hash) ([]crypto.Hash, bool) {
 	// determine which sector index corresponds to each leaf hash
 	var indices []int
 	for _, action := range actions {
@@ -386,6 +423,8 @@ func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction,
 			}
 		case renterhost.RPCWriteActionSwap:
 			indices = append(indices, int(action.A), int(action.B))
+		case renterhost.RPCWriteActionUpdate:
+			indices = append(indices, int(action.A))
 
 		default:
 			panic("unknown or unsupported action type: " + action.Type.String())
@@ -404,8 +443,8 @@ func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction,
 		switch action.Type {
 		case renterhost.RPCWriteActionAppend:
 			var root crypto.Hash
-			if len(appendRoots) > 0 {
-				root, appendRoots = appendRoots[0], appendRoots[1:]
+			if len(newRoots) > 0 {
+				root, newRoots = newRoots[0], newRoots[1:]
 			} else {
 				root = unsafeSectorRoot(action.Data)
 			}
@@ -418,11 +457,17 @@ func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction,
 			i, j := indexMap[int(action.A)], indexMap[int(action.B)]
 			leafHashes[i], leafHashes[j] = leafHashes[j], leafHashes[i]
 
+		case renterhost.RPCWriteActionUpdate:
+			if len(newRoots) == 0 {
+				return nil, false
+			}
+			leafHashes[indexMap[int(action.A)]], newRoots = newRoots[0], newRoots[1:]
+
 		default:
 			panic("unknown or unsupported action type: " + action.Type.String())
 		}
 	}
-	return leafHashes
+	return leafHashes, true
 }
 
 // A RangeProofVerifier allows for proofs to be verified in streaming fashion.
@@ -2,6 +2,7 @@ package renter
 
 import (
 	"bytes"
+	"context"
 	"io"
 
 	"github.com/pkg/errors"
@@ -123,6 +124,17 @@ func (d *ShardDownloader) CopySection(w io.Writer, offset, length int64) error {
 	return d.Downloader.Read(cw, sections)
 }
 
+// CopySectionContext is like CopySection, but aborts the download if ctx is
+// cancelled.
+func (d *ShardDownloader) CopySectionContext(ctx context.Context, w io.Writer, offset, length int64) error {
+	sections, err := calcSections(d.Slices, offset, length)
+	if err != nil {
+		return err
+	}
+	cw := &cryptWriter{w, d.Slices, d.Key, offset}
+	return d.Downloader.ReadContext(ctx, cw, sections)
+}
+
 // DownloadAndDecrypt downloads the SectorSlice associated with chunkIndex.
 // The data is decrypted and validated before it is returned. The returned
 // slice is only valid until the next call to DownloadAndDecrypt.
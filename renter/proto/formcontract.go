@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"context"
 	"crypto/ed25519"
 	"math/big"
 	"time"
@@ -31,6 +32,28 @@ func FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, host
 	return s.FormContract(w, tpool, key, renterPayout, startHeight, endHeight)
 }
 
+// FormContractContext is like FormContract, but aborts the negotiation if ctx
+// is cancelled.
+func FormContractContext(ctx context.Context, w Wallet, tpool TransactionPool, key ed25519.PrivateKey, host hostdb.ScannedHost, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (ContractRevision, []types.Transaction, error) {
+	s, err := NewUnlockedSessionContext(ctx, host.NetAddress, host.PublicKey, 0)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+	s.host = host
+	defer s.Close()
+	return s.FormContractContext(ctx, w, tpool, key, renterPayout, startHeight, endHeight)
+}
+
+// FormContractContext is like FormContract, but aborts the negotiation if ctx
+// is cancelled.
+func (s *Session) FormContractContext(ctx context.Context, w Wallet, tpool TransactionPool, key ed25519.PrivateKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (rev ContractRevision, txnSet []types.Transaction, err error) {
+	err = s.withContext(ctx, func() error {
+		rev, txnSet, err = s.FormContract(w, tpool, key, renterPayout, startHeight, endHeight)
+		return err
+	})
+	return
+}
+
 // FormContract forms a contract with a host. The resulting contract will have
 // renterPayout coins in the renter output.
 func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
@@ -0,0 +1,504 @@
+package proto
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/renterhost/mux"
+)
+
+// ErrPriceTableExpired is returned by mux protocol RPCs when the session's
+// price table is missing or no longer valid. Call UpdatePriceTable to obtain a
+// new one.
+var ErrPriceTableExpired = errors.New("price table has expired")
+
+// A PaymentMethod pays for a mux protocol RPC. It is created with PayByContract or
+// PayByEphemeralAccount.
+type PaymentMethod interface {
+	pay(s *renterhost.Stream, amount types.Currency, pt *hostdb.HostPriceTable) error
+}
+
+type payByContract struct {
+	rev  *ContractRevision
+	key  ed25519.PrivateKey
+	revs RevisionRecorder
+}
+
+func (p *payByContract) pay(s *renterhost.Stream, amount types.Currency, pt *hostdb.HostPriceTable) error {
+	if !p.rev.IsValid() {
+		return errors.New("invalid contract revision")
+	} else if p.rev.Revision.NewRevisionNumber == math.MaxUint64 {
+		return ErrContractFinalized
+	} else if p.rev.RenterFunds().Cmp(amount) < 0 {
+		return ErrInsufficientFunds
+	}
+
+	// construct new revision; unlike Session RPCs, the missed payout goes to
+	// the host rather than the void, since these payments are not conditional
+	// on storage
+	rev := p.rev.Revision
+	rev.NewRevisionNumber++
+	rev.NewValidProofOutputs = append([]types.SiacoinOutput(nil), rev.NewValidProofOutputs...)
+	rev.NewMissedProofOutputs = append([]types.SiacoinOutput(nil), rev.NewMissedProofOutputs...)
+	rev.NewValidProofOutputs[0].Value = rev.NewValidProofOutputs[0].Value.Sub(amount)
+	rev.NewValidProofOutputs[1].Value = rev.NewValidProofOutputs[1].Value.Add(amount)
+	rev.NewMissedProofOutputs[0].Value = rev.NewMissedProofOutputs[0].Value.Sub(amount)
+	rev.NewMissedProofOutputs[1].Value = rev.NewMissedProofOutputs[1].Value.Add(amount)
+	revisionHash := renterhost.HashRevision(rev)
+	renterSig := ed25519hash.Sign(p.key, revisionHash)
+
+	req := &renterhost.RPCPayByContractRequest{
+		ContractID:        rev.ParentID,
+		NewRevisionNumber: rev.NewRevisionNumber,
+		Signature:         renterSig,
+	}
+	for _, o := range rev.NewValidProofOutputs {
+		req.NewValidProofValues = append(req.NewValidProofValues, o.Value)
+	}
+	for _, o := range rev.NewMissedProofOutputs {
+		req.NewMissedProofValues = append(req.NewMissedProofValues, o.Value)
+	}
+	if err := s.WriteResponse(&renterhost.RPCPaymentRequest{Type: renterhost.PaymentTypeContract}, nil); err != nil {
+		return err
+	} else if err := s.WriteResponse(req, nil); err != nil {
+		return err
+	}
+	var resp renterhost.RPCPayByContractResponse
+	if err := s.ReadResponse(&resp, 4096); err != nil {
+		return wrapResponseErr(err, "couldn't read payment response", "host rejected payment")
+	} else if !ed25519hash.Verify(p.rev.HostKey().Ed25519(), revisionHash, resp.Signature) {
+		return errors.New("host's signature is invalid")
+	}
+	p.rev.Revision = rev
+	p.rev.Signatures[0].Signature = renterSig
+	p.rev.Signatures[1].Signature = resp.Signature
+	if p.revs != nil {
+		if err := p.revs.RecordRevision(*p.rev); err != nil {
+			return errors.Wrap(err, "could not record revision")
+		}
+	}
+	return nil
+}
+
+type payByEphemeralAccount struct {
+	key ed25519.PrivateKey
+}
+
+func (p *payByEphemeralAccount) pay(s *renterhost.Stream, amount types.Currency, pt *hostdb.HostPriceTable) error {
+	wm := renterhost.WithdrawalMessage{
+		Account: EphemeralAccountID(p.key),
+		Expiry:  pt.HostBlockHeight + 6,
+		Amount:  amount,
+	}
+	frand.Read(wm.Nonce[:])
+	req := &renterhost.RPCPayByEphemeralAccountRequest{
+		Message:   wm,
+		Signature: ed25519hash.Sign(p.key, renterhost.HashWithdrawalMessage(wm)),
+	}
+	if err := s.WriteResponse(&renterhost.RPCPaymentRequest{Type: renterhost.PaymentTypeEphemeralAccount}, nil); err != nil {
+		return err
+	}
+	return s.WriteResponse(req, nil)
+}
+
+// PayByContract returns a PaymentMethod that pays for RPCs by revising the
+// supplied contract. The revision is updated in place after each payment.
+func PayByContract(rev *ContractRevision, key ed25519.PrivateKey) PaymentMethod {
+	return &payByContract{rev: rev, key: key}
+}
+
+// PayByRecordedContract is like PayByContract, but also reports each updated
+// revision to revs.
+func PayByRecordedContract(rev *ContractRevision, key ed25519.PrivateKey, revs RevisionRecorder) PaymentMethod {
+	return &payByContract{rev: rev, key: key, revs: revs}
+}
+
+// PayByEphemeralAccount returns a PaymentMethod that pays for RPCs by
+// withdrawing from the ephemeral account controlled by key.
+func PayByEphemeralAccount(key ed25519.PrivateKey) PaymentMethod {
+	return &payByEphemeralAccount{key: key}
+}
+
+// EphemeralAccountID returns the ID of the ephemeral account controlled by key.
+func EphemeralAccountID(key ed25519.PrivateKey) (id renterhost.AccountID) {
+	copy(id[:], ed25519hash.ExtractPublicKey(key))
+	return
+}
+
+// A MuxSession is a connection to a host via the mux protocol. Each RPC is
+// conducted on its own mux stream, so a single MuxSession may be shared by
+// multiple goroutines, and no contract needs to be locked.
+//
+// The mux protocol is specific to us hosts; it is modeled on siad's RHP3, but
+// is not compatible with it. See renterhost.Stream for details.
+type MuxSession struct {
+	mux     *mux.Mux
+	hostKey hostdb.HostPublicKey
+	height  types.BlockHeight
+	timeout time.Duration
+	revs    RevisionRecorder
+
+	ptMu     sync.Mutex
+	pt       hostdb.HostPriceTable
+	ptExpiry time.Time
+}
+
+// HostKey returns the public key of the host.
+func (s *MuxSession) HostKey() hostdb.HostPublicKey { return s.hostKey }
+
+// PriceTable returns the session's current price table.
+func (s *MuxSession) PriceTable() hostdb.HostPriceTable {
+	s.ptMu.Lock()
+	defer s.ptMu.Unlock()
+	return s.pt
+}
+
+// currentPriceTable returns a snapshot of the session's price table, or
+// ErrPriceTableExpired if it is no longer valid. Each RPC uses a single
+// snapshot, so that a concurrent UpdatePriceTable cannot change its prices
+// midway through.
+func (s *MuxSession) currentPriceTable() (hostdb.HostPriceTable, error) {
+	s.ptMu.Lock()
+	defer s.ptMu.Unlock()
+	if time.Now().After(s.ptExpiry) {
+		return hostdb.HostPriceTable{}, ErrPriceTableExpired
+	}
+	return s.pt, nil
+}
+
+// SetTimeout sets the timeout for each RPC.
+func (s *MuxSession) SetTimeout(d time.Duration) { s.timeout = d }
+
+// SetRevisionRecorder sets the RevisionRecorder for the MuxSession. Contract
+// revisions made by FundAccount and AppendSector are reported to it.
+func (s *MuxSession) SetRevisionRecorder(revs RevisionRecorder) { s.revs = revs }
+
+// newStream opens a new mux stream and conducts the subscriber handshake.
+func (s *MuxSession) newStream() (*mux.Stream, *renterhost.Stream, error) {
+	ms, err := s.mux.DialStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	ms.SetDeadline(time.Now().Add(s.timeout))
+	rs, err := renterhost.NewRenterStream(ms)
+	if err != nil {
+		ms.Close()
+		return nil, nil, err
+	}
+	return ms, rs, nil
+}
+
+// call opens a new stream and sends the RPC ID, the ID of pt, and the request
+// object. The caller is responsible for paying for the RPC, reading the
+// response, and closing the returned stream.
+func (s *MuxSession) call(rpcID renterhost.Specifier, pt *hostdb.HostPriceTable, req renterhost.ProtocolObject) (*mux.Stream, *renterhost.Stream, error) {
+	ms, rs, err := s.newStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	uid := renterhost.Specifier(pt.UID)
+	if err := rs.WriteRequest(rpcID, &uid); err != nil {
+		ms.Close()
+		return nil, nil, err
+	} else if err := rs.WriteResponse(req, nil); err != nil {
+		ms.Close()
+		return nil, nil, err
+	}
+	return ms, rs, nil
+}
+
+func (s *MuxSession) validatePriceTable(pt hostdb.HostPriceTable) error {
+	const maxHeightDrift = 6
+	switch {
+	case pt.UID == [16]byte{}:
+		return errors.New("price table has empty UID")
+	case pt.Validity <= 0:
+		return errors.New("price table has non-positive validity")
+	case pt.HostBlockHeight+maxHeightDrift < s.height:
+		return errors.Errorf("host's block height (%v) is too far behind ours (%v)", pt.HostBlockHeight, s.height)
+	case pt.HostBlockHeight > s.height+maxHeightDrift:
+		return errors.Errorf("host's block height (%v) is too far ahead of ours (%v)", pt.HostBlockHeight, s.height)
+	}
+	return nil
+}
+
+// UpdatePriceTable calls the UpdatePriceTable RPC, requesting a new price table
+// from the host and paying for it with the supplied PaymentMethod. The new
+// price table is used for all subsequent RPCs.
+func (s *MuxSession) UpdatePriceTable(payment PaymentMethod) (err error) {
+	defer wrapErr(&err, "UpdatePriceTable")
+	ms, rs, err := s.newStream()
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	var resp renterhost.RPCUpdatePriceTableResponse
+	var pt hostdb.HostPriceTable
+	if err := rs.WriteRequest(renterhost.RPCUpdatePriceTableID, nil); err != nil {
+		return err
+	} else if err := rs.ReadResponse(&resp, 16384); err != nil {
+		return wrapResponseErr(err, "couldn't read price table", "host rejected UpdatePriceTable request")
+	} else if err := json.Unmarshal(resp.PriceTableJSON, &pt); err != nil {
+		return errors.Wrap(err, "couldn't decode price table")
+	} else if err := s.validatePriceTable(pt); err != nil {
+		return errors.Wrap(err, "invalid price table")
+	}
+	// the price table's validity begins once the host receives payment
+	expiry := time.Now().Add(pt.Validity)
+	if err := payment.pay(rs, pt.UpdatePriceTableCost, &pt); err != nil {
+		return err
+	} else if err := rs.ReadResponse(&renterhost.RPCPriceTableAccepted{}, 4096); err != nil {
+		return wrapResponseErr(err, "couldn't read price table acceptance", "host rejected payment")
+	}
+	s.ptMu.Lock()
+	s.pt = pt
+	s.ptExpiry = expiry
+	s.ptMu.Unlock()
+	return nil
+}
+
+// FundAccount calls the FundAccount RPC, depositing amount into the specified
+// ephemeral account. The host's FundAccountCost is paid in addition to amount.
+// Accounts can only be funded from a contract; the contract revision is updated
+// in place. FundAccount returns the new balance of the account.
+func (s *MuxSession) FundAccount(account renterhost.AccountID, amount types.Currency, rev *ContractRevision, key ed25519.PrivateKey) (_ types.Currency, err error) {
+	defer wrapErr(&err, "FundAccount")
+	pt, err := s.currentPriceTable()
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+	ms, rs, err := s.call(renterhost.RPCFundAccountID, &pt, &renterhost.RPCFundAccountRequest{Account: account})
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+	defer ms.Close()
+
+	payment := PayByRecordedContract(rev, key, s.revs)
+	var resp renterhost.RPCFundAccountResponse
+	if err := payment.pay(rs, amount.Add(pt.FundAccountCost), &pt); err != nil {
+		return types.ZeroCurrency, err
+	} else if err := rs.ReadResponse(&resp, 4096); err != nil {
+		return types.ZeroCurrency, wrapResponseErr(err, "couldn't read FundAccount response", "host rejected FundAccount request")
+	}
+	return resp.Balance, nil
+}
+
+// AccountBalance calls the AccountBalance RPC, returning the current balance of
+// the specified ephemeral account.
+func (s *MuxSession) AccountBalance(account renterhost.AccountID, payment PaymentMethod) (_ types.Currency, err error) {
+	defer wrapErr(&err, "AccountBalance")
+	pt, err := s.currentPriceTable()
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+	ms, rs, err := s.call(renterhost.RPCAccountBalanceID, &pt, &renterhost.RPCAccountBalanceRequest{Account: account})
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+	defer ms.Close()
+
+	var resp renterhost.RPCAccountBalanceResponse
+	if err := payment.pay(rs, pt.AccountBalanceCost, &pt); err != nil {
+		return types.ZeroCurrency, err
+	} else if err := rs.ReadResponse(&resp, 4096); err != nil {
+		return types.ZeroCurrency, wrapResponseErr(err, "couldn't read AccountBalance response", "host rejected AccountBalance request")
+	}
+	return resp.Balance, nil
+}
+
+// ReadSector calls the ReadSector RPC, writing the specified range of the
+// sector to w. The offset and length must be multiples of the segment size. A
+// Merkle proof is always requested and verified before any data is written to
+// w.
+func (s *MuxSession) ReadSector(w io.Writer, root crypto.Hash, offset, length uint32, payment PaymentMethod) (err error) {
+	defer wrapErr(&err, "ReadSector")
+	if uint64(offset)+uint64(length) > renterhost.SectorSize {
+		return errors.New("illegal offset and/or length")
+	} else if offset%merkle.SegmentSize != 0 || length%merkle.SegmentSize != 0 {
+		return errors.New("offset and length must be multiples of SegmentSize")
+	}
+	proofStart := int(offset) / merkle.SegmentSize
+	proofEnd := int(offset+length) / merkle.SegmentSize
+	proofHashes := uint64(merkle.ProofSize(merkle.SegmentsPerSector, proofStart, proofEnd))
+
+	pt, err := s.currentPriceTable()
+	if err != nil {
+		return err
+	}
+	ms, rs, err := s.call(renterhost.RPCReadSectorID, &pt, &renterhost.RPCReadSectorRequest{
+		MerkleRoot:  root,
+		Offset:      uint64(offset),
+		Length:      uint64(length),
+		MerkleProof: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	var resp renterhost.RPCReadSectorResponse
+	if err := payment.pay(rs, pt.ReadSectorCost(uint64(length), proofHashes), &pt); err != nil {
+		return err
+	} else if err := rs.ReadResponse(&resp, 4096+uint64(length)+proofHashes*crypto.HashSize); err != nil {
+		return wrapResponseErr(err, "couldn't read sector data", "host rejected ReadSector request")
+	} else if uint64(len(resp.Data)) != uint64(length) {
+		return errors.New("host sent wrong amount of sector data")
+	} else if !merkle.VerifyProof(resp.MerkleProof, resp.Data, proofStart, proofEnd, root) {
+		return ErrInvalidMerkleProof
+	}
+	_, err = w.Write(resp.Data)
+	return err
+}
+
+// AppendSector calls the AppendSector RPC, appending sector to the contract
+// and paying for it with the supplied PaymentMethod. The contract revision is
+// updated in place. It returns the Merkle root of the sector.
+func (s *MuxSession) AppendSector(sector *[renterhost.SectorSize]byte, rev *ContractRevision, key ed25519.PrivateKey, payment PaymentMethod) (_ crypto.Hash, err error) {
+	defer wrapErr(&err, "AppendSector")
+	pt, err := s.currentPriceTable()
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	if !rev.IsValid() {
+		return crypto.Hash{}, errors.New("invalid contract revision")
+	} else if rev.Revision.NewRevisionNumber == math.MaxUint64 {
+		return crypto.Hash{}, ErrContractFinalized
+	} else if rev.Revision.NewWindowStart <= pt.HostBlockHeight {
+		return crypto.Hash{}, errors.New("contract has expired")
+	}
+
+	// the host risks collateral for the sector, moving it from its missed
+	// payout to the void; the renter's payouts are unaffected, since the
+	// storage itself is paid for separately
+	duration := rev.Revision.NewWindowEnd - pt.HostBlockHeight
+	cost, collateral := pt.AppendSectorCost(duration)
+	if collateral.Cmp(rev.Revision.NewMissedProofOutputs[1].Value) > 0 {
+		collateral = rev.Revision.NewMissedProofOutputs[1].Value
+	}
+	newRev := rev.Revision
+	newRev.NewValidProofOutputs = append([]types.SiacoinOutput(nil), newRev.NewValidProofOutputs...)
+	newRev.NewMissedProofOutputs = append([]types.SiacoinOutput(nil), newRev.NewMissedProofOutputs...)
+	newRev.NewMissedProofOutputs[1].Value = newRev.NewMissedProofOutputs[1].Value.Sub(collateral)
+	newRev.NewMissedProofOutputs[2].Value = newRev.NewMissedProofOutputs[2].Value.Add(collateral)
+	req := &renterhost.RPCAppendSectorRequest{
+		ContractID:        rev.ID(),
+		Data:              sector[:],
+		NewRevisionNumber: newRev.NewRevisionNumber + 1,
+	}
+	for _, o := range newRev.NewValidProofOutputs {
+		req.NewValidProofValues = append(req.NewValidProofValues, o.Value)
+	}
+	for _, o := range newRev.NewMissedProofOutputs {
+		req.NewMissedProofValues = append(req.NewMissedProofValues, o.Value)
+	}
+
+	ms, rs, err := s.call(renterhost.RPCAppendSectorID, &pt, req)
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	defer ms.Close()
+	if err := payment.pay(rs, cost, &pt); err != nil {
+		return crypto.Hash{}, err
+	}
+
+	// read and verify Merkle proof
+	actions := []renterhost.RPCWriteAction{{
+		Type: renterhost.RPCWriteActionAppend,
+		Data: sector[:],
+	}}
+	appendRoots := merkle.PrecomputeAppendRoots(actions)
+	var merkleResp renterhost.RPCWriteMerkleProof
+	if err := rs.ReadResponse(&merkleResp, 4096); err != nil {
+		return crypto.Hash{}, wrapResponseErr(err, "couldn't read Merkle proof response", "host rejected AppendSector request")
+	} else if !merkle.VerifyDiffProof(actions, rev.NumSectors(), merkleResp.OldSubtreeHashes, merkleResp.OldLeafHashes, newRev.NewFileMerkleRoot, merkleResp.NewMerkleRoot, appendRoots) {
+		err := ErrInvalidMerkleProof
+		rs.WriteResponse(nil, err)
+		return crypto.Hash{}, err
+	}
+
+	// update revision and exchange signatures
+	newRev.NewRevisionNumber++
+	newRev.NewFileSize += renterhost.SectorSize
+	newRev.NewFileMerkleRoot = merkleResp.NewMerkleRoot
+	revisionHash := renterhost.HashRevision(newRev)
+	renterSig := &renterhost.RPCWriteResponse{
+		Signature: ed25519hash.Sign(key, revisionHash),
+	}
+	var hostSig renterhost.RPCWriteResponse
+	if err := rs.WriteResponse(renterSig, nil); err != nil {
+		return crypto.Hash{}, errors.Wrap(err, "couldn't write signature response")
+	} else if err := rs.ReadResponse(&hostSig, 4096); err != nil {
+		return crypto.Hash{}, wrapResponseErr(err, "couldn't read signature response", "host rejected AppendSector signature")
+	} else if !ed25519hash.Verify(rev.HostKey().Ed25519(), revisionHash, hostSig.Signature) {
+		return crypto.Hash{}, errors.New("host's signature is invalid")
+	}
+	rev.Revision = newRev
+	rev.Signatures[0].Signature = renterSig.Signature
+	rev.Signatures[1].Signature = hostSig.Signature
+	if s.revs != nil {
+		if err := s.revs.RecordRevision(*rev); err != nil {
+			return crypto.Hash{}, errors.Wrap(err, "could not record revision")
+		}
+	}
+	return appendRoots[0], nil
+}
+
+// Close closes the underlying mux.
+func (s *MuxSession) Close() error {
+	return s.mux.Close()
+}
+
+// NewMuxSession initiates a new mux protocol session with the specified host, dialing
+// the host's SiaMux port. The session does not have a price table; call
+// UpdatePriceTable before invoking any other RPC.
+func NewMuxSession(host hostdb.ScannedHost, currentHeight types.BlockHeight) (_ *MuxSession, err error) {
+	defer wrapErrWithReplace(&err, "NewMuxSession")
+	if host.SiaMuxPort == "" {
+		return nil, errors.New("host does not support the mux protocol")
+	}
+	addr := modules.NetAddress(net.JoinHostPort(host.NetAddress.Host(), host.SiaMuxPort))
+	conn, err := net.DialTimeout("tcp", string(addr), 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	s, err := NewMuxSessionFromConn(conn, host.PublicKey, currentHeight)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return s, nil
+}
+
+// NewMuxSessionFromConn initiates a new mux protocol session on top of the provided
+// conn. The conn should have a deadline appropriate for the mux handshake.
+func NewMuxSessionFromConn(conn net.Conn, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *MuxSession, err error) {
+	defer wrapErr(&err, "NewMuxSessionFromConn")
+	m, err := mux.Dial(conn, hostKey.Ed25519())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &MuxSession{
+		mux:     m,
+		hostKey: hostKey,
+		height:  currentHeight,
+		// extremely generous default timeout
+		timeout: 2 * time.Minute,
+	}, nil
+}
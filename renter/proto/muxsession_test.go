@@ -0,0 +1,207 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"math"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/internal/ghost"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// createTestingMuxPair creates a host that charges for RPCs, forms a contract
+// with it, uploads a sector, and returns a MuxSession connected to the host.
+func createTestingMuxPair(tb testing.TB) (*MuxSession, *ghost.Host, ContractRevision, ed25519.PrivateKey, *[renterhost.SectorSize]byte) {
+	tb.Helper()
+
+	settings := ghost.FreeSettings
+	settings.BaseRPCPrice = types.NewCurrency64(10)
+	settings.MaxEphemeralAccountBalance = types.NewCurrency64(1000)
+	host := ghost.New(tb, settings, stubWallet{}, stubTpool{})
+
+	s, err := NewUnlockedSession(host.Settings.NetAddress, host.PublicKey, 0)
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := s.Settings(); err != nil {
+		tb.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := s.FormContract(stubWallet{}, stubTpool{}, key, types.NewCurrency64(10000), 0, 100)
+	if err != nil {
+		tb.Fatal(err)
+	} else if err := s.Lock(rev.ID(), key, 0); err != nil {
+		tb.Fatal(err)
+	}
+	sector := new([renterhost.SectorSize]byte)
+	frand.Read(sector[:])
+	if _, err := s.Append(sector); err != nil {
+		tb.Fatal(err)
+	}
+	rev = s.Revision()
+	if err := s.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	ms, err := NewMuxSession(hostdb.ScannedHost{
+		HostSettings: host.Settings,
+		PublicKey:    host.PublicKey,
+	}, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ms, host, rev, key, sector
+}
+
+func TestMuxSessionPriceTable(t *testing.T) {
+	s, host, rev, key, _ := createTestingMuxPair(t)
+	defer host.Close()
+	defer s.Close()
+
+	// RPCs should fail without a price table
+	account := EphemeralAccountID(ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)))
+	if _, err := s.AccountBalance(account, PayByContract(&rev, key)); errors.Cause(err) != ErrPriceTableExpired {
+		t.Fatal("expected ErrPriceTableExpired, got", err)
+	}
+
+	// updating the price table should debit the contract
+	oldFunds := rev.RenterFunds()
+	if err := s.UpdatePriceTable(PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	}
+	pt := s.PriceTable()
+	if pt.UID == ([16]byte{}) {
+		t.Fatal("price table was not set")
+	} else if !pt.UpdatePriceTableCost.Equals(host.Settings.BaseRPCPrice) {
+		t.Fatal("unexpected price table cost:", pt.UpdatePriceTableCost)
+	} else if !oldFunds.Sub(rev.RenterFunds()).Equals(pt.UpdatePriceTableCost) {
+		t.Fatal("contract was not debited for price table:", rev.RenterFunds())
+	}
+
+	// paying with an empty account should fail, and leave the old price table
+	// in place
+	if err := s.UpdatePriceTable(PayByEphemeralAccount(ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)))); err == nil {
+		t.Fatal("expected payment from empty account to be rejected")
+	} else if s.PriceTable().UID != pt.UID {
+		t.Fatal("price table was replaced after rejected payment")
+	}
+
+	// paying with a finalized contract should fail without contacting the host
+	finalRev := rev
+	finalRev.Revision.NewRevisionNumber = math.MaxUint64
+	if err := s.UpdatePriceTable(PayByContract(&finalRev, key)); errors.Cause(err) != ErrContractFinalized {
+		t.Fatal("expected ErrContractFinalized, got", err)
+	}
+}
+
+func TestMuxSessionPayment(t *testing.T) {
+	s, host, rev, key, _ := createTestingMuxPair(t)
+	defer host.Close()
+	defer s.Close()
+	var trr testRevisionRecorder
+	s.SetRevisionRecorder(&trr)
+	if err := s.UpdatePriceTable(PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	}
+	pt := s.PriceTable()
+
+	// funding an account should debit the contract for the deposit and the
+	// RPC cost, and record the new revision
+	accountKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	account := EphemeralAccountID(accountKey)
+	oldFunds := rev.RenterFunds()
+	if bal, err := s.FundAccount(account, types.NewCurrency64(100), &rev, key); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals64(100) {
+		t.Fatal("unexpected balance:", bal)
+	} else if !oldFunds.Sub(rev.RenterFunds()).Equals(pt.FundAccountCost.Add64(100)) {
+		t.Fatal("contract was not debited for deposit:", rev.RenterFunds())
+	} else if len(trr.revs) != 1 || trr.revs[0].Revision.NewRevisionNumber != rev.Revision.NewRevisionNumber {
+		t.Fatal("revision was not recorded")
+	}
+
+	// paying by account should debit the account, not the contract
+	oldFunds = rev.RenterFunds()
+	if bal, err := s.AccountBalance(account, PayByEphemeralAccount(accountKey)); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals(types.NewCurrency64(100).Sub(pt.AccountBalanceCost)) {
+		t.Fatal("account was not debited:", bal)
+	} else if !rev.RenterFunds().Equals(oldFunds) {
+		t.Fatal("contract was debited for account payment")
+	}
+
+	// paying by contract should debit the contract, not the account
+	if bal, err := s.AccountBalance(account, PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals(types.NewCurrency64(100).Sub(pt.AccountBalanceCost)) {
+		t.Fatal("account was debited for contract payment:", bal)
+	} else if !oldFunds.Sub(rev.RenterFunds()).Equals(pt.AccountBalanceCost) {
+		t.Fatal("contract was not debited:", rev.RenterFunds())
+	}
+
+	// a contract without sufficient funds should be rejected locally
+	poorRev := rev
+	poorRev.Revision.NewValidProofOutputs = append([]types.SiacoinOutput(nil), rev.Revision.NewValidProofOutputs...)
+	poorRev.Revision.NewValidProofOutputs[0].Value = types.ZeroCurrency
+	if _, err := s.AccountBalance(account, PayByContract(&poorRev, key)); errors.Cause(err) != ErrInsufficientFunds {
+		t.Fatal("expected ErrInsufficientFunds, got", err)
+	}
+}
+
+func TestMuxSessionReadSector(t *testing.T) {
+	s, host, rev, key, sector := createTestingMuxPair(t)
+	defer host.Close()
+	defer s.Close()
+	if err := s.UpdatePriceTable(PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	}
+	pt := s.PriceTable()
+	accountKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	account := EphemeralAccountID(accountKey)
+	if _, err := s.FundAccount(account, types.NewCurrency64(500), &rev, key); err != nil {
+		t.Fatal(err)
+	}
+	root := merkle.SectorRoot(sector)
+
+	// read the full sector, paying with the contract
+	var buf bytes.Buffer
+	if err := s.ReadSector(&buf, root, 0, renterhost.SectorSize, PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	}
+
+	// read a partial sector, paying with the account
+	buf.Reset()
+	offset, length := uint32(merkle.SegmentSize*3), uint32(merkle.SegmentSize*5)
+	proofHashes := merkle.ProofSize(merkle.SegmentsPerSector, 3, 8)
+	if err := s.ReadSector(&buf, root, offset, length, PayByEphemeralAccount(accountKey)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[offset:][:length]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	}
+	expBalance := types.NewCurrency64(500).Sub(pt.ReadSectorCost(uint64(length), uint64(proofHashes)))
+	if bal, err := s.AccountBalance(account, PayByContract(&rev, key)); err != nil {
+		t.Fatal(err)
+	} else if !bal.Equals(expBalance) {
+		t.Fatalf("expected balance of %v after read, got %v", expBalance, bal)
+	}
+
+	// invalid ranges should be rejected before contacting the host
+	if err := s.ReadSector(&buf, root, 1, merkle.SegmentSize, PayByContract(&rev, key)); err == nil {
+		t.Fatal("expected unaligned read to be rejected")
+	} else if err := s.ReadSector(&buf, root, renterhost.SectorSize-merkle.SegmentSize, 2*merkle.SegmentSize, PayByContract(&rev, key)); err == nil {
+		t.Fatal("expected out-of-bounds read to be rejected")
+	}
+
+	// reading a sector the host does not have should fail
+	if err := s.ReadSector(&buf, crypto.Hash{1}, 0, merkle.SegmentSize, PayByContract(&rev, key)); err == nil {
+		t.Fatal("expected read of missing sector to fail")
+	}
+}
@@ -69,6 +69,14 @@ type RPCStatsRecorder interface {
 	RecordRPCStats(stats RPCStats)
 }
 
+// A RevisionRecorder records ContractRevisions, as reported by a Session.
+// RecordRevision is called after every RPC that revises the locked contract,
+// and after the contract is locked. If it returns an error, the RPC fails, even
+// though the host has accepted the revision.
+type RevisionRecorder interface {
+	RecordRevision(rev ContractRevision) error
+}
+
 // A ContractRevision contains the most recent revision to a file contract and
 // its signatures.
 type ContractRevision struct {
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"context"
 	"crypto/ed25519"
 	"math"
 	"time"
@@ -29,9 +30,35 @@ func RenewContract(w Wallet, tpool TransactionPool, id types.FileContractID, key
 	return s.RenewContract(w, tpool, renterPayout, startHeight, endHeight)
 }
 
+// RenewContractContext is like RenewContract, but aborts the negotiation if ctx
+// is cancelled.
+func RenewContractContext(ctx context.Context, w Wallet, tpool TransactionPool, id types.FileContractID, key ed25519.PrivateKey, host hostdb.ScannedHost, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (ContractRevision, []types.Transaction, error) {
+	s, err := NewUnlockedSessionContext(ctx, host.NetAddress, host.PublicKey, 0)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+	s.host = host
+	defer s.Close()
+	if err := s.LockContext(ctx, id, key, 10*time.Second); err != nil {
+		return ContractRevision{}, nil, err
+	}
+	return s.RenewContractContext(ctx, w, tpool, renterPayout, startHeight, endHeight)
+}
+
+// RenewContractContext is like RenewContract, but aborts the negotiation if ctx
+// is cancelled.
+func (s *Session) RenewContractContext(ctx context.Context, w Wallet, tpool TransactionPool, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (rev ContractRevision, txnSet []types.Transaction, err error) {
+	err = s.withContext(ctx, func() error {
+		rev, txnSet, err = s.RenewContract(w, tpool, renterPayout, startHeight, endHeight)
+		return err
+	})
+	return
+}
+
 // RenewContract negotiates a new file contract and initial revision for data
 // already stored with a host. The old contract is "cleared," reverting its
-// filesize to zero.
+// filesize to zero; its final revision becomes the Session's current revision,
+// and is reported to the Session's RevisionRecorder.
 func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
 	defer wrapErr(&err, "RenewContract")
 	if endHeight < startHeight {
@@ -204,10 +231,11 @@ func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout ty
 	}
 
 	// Send signatures.
+	finalRevisionHash := renterhost.HashRevision(finalOldRevision)
 	renterSigs := &renterhost.RPCRenewAndClearContractSignatures{
 		ContractSignatures:     addedSignatures,
 		RevisionSignature:      renterRevisionSig,
-		FinalRevisionSignature: ed25519hash.Sign(s.key, renterhost.HashRevision(finalOldRevision)),
+		FinalRevisionSignature: ed25519hash.Sign(s.key, finalRevisionHash),
 	}
 	if err := s.sess.WriteResponse(renterSigs, nil); err != nil {
 		return ContractRevision{}, nil, err
@@ -217,8 +245,18 @@ func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout ty
 	var hostSigs renterhost.RPCRenewAndClearContractSignatures
 	if err := s.sess.ReadResponse(&hostSigs, 4096); err != nil {
 		return ContractRevision{}, nil, err
+	} else if !ed25519hash.Verify(s.host.PublicKey.Ed25519(), finalRevisionHash, hostSigs.FinalRevisionSignature) {
+		return ContractRevision{}, nil, errors.New("host's final revision signature is invalid")
 	}
 	txn.TransactionSignatures = append(txn.TransactionSignatures, hostSigs.ContractSignatures...)
+
+	// update the old contract to its final (cleared) revision
+	s.rev.Revision = finalOldRevision
+	s.rev.Signatures[0].Signature = renterSigs.FinalRevisionSignature
+	s.rev.Signatures[1].Signature = hostSigs.FinalRevisionSignature
+	if err := s.recordRevision(); err != nil {
+		return ContractRevision{}, nil, err
+	}
 	signedTxnSet := append(resp.Parents, append(parents, txn)...)
 
 	return ContractRevision{
@@ -2,11 +2,13 @@ package proto
 
 import (
 	"bufio"
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/bits"
 	"net"
@@ -45,6 +47,12 @@ var (
 	// question has reached its maximum revision number, meaning the contract
 	// can no longer be revised.
 	ErrContractFinalized = errors.New("contract cannot be revised further")
+
+	// ErrDesync is returned by the Write RPC when an error occurs after the
+	// renter has signed the new revision. The host may or may not have applied
+	// the revision, so the Session is closed; the contract must be locked again
+	// to learn its true state.
+	ErrDesync = errors.New("contract revision may be out of sync with host")
 )
 
 // wrapResponseErr formats RPC response errors nicely, wrapping them in either
@@ -80,11 +88,13 @@ type Session struct {
 	sess        *renterhost.Session
 	conn        *statsConn
 	appendRoots []crypto.Hash
+	updateRoots []crypto.Hash
 
 	latency       time.Duration
 	readDeadline  time.Duration
 	writeDeadline time.Duration
 	stats         RPCStatsRecorder
+	revs          RevisionRecorder
 
 	host   hostdb.ScannedHost
 	height types.BlockHeight
@@ -95,6 +105,9 @@ type Session struct {
 // HostKey returns the public key of the host.
 func (s *Session) HostKey() hostdb.HostPublicKey { return s.host.PublicKey }
 
+// HostSettings returns the most recent settings obtained from the host.
+func (s *Session) HostSettings() hostdb.HostSettings { return s.host.HostSettings }
+
 // Revision returns the most recent revision of the locked contract.
 func (s *Session) Revision() ContractRevision { return s.rev }
 
@@ -158,6 +171,21 @@ func (s *Session) collectStats(id renterhost.Specifier, err *error) (record func
 	}
 }
 
+// SetRevisionRecorder sets the RevisionRecorder for the Session.
+func (s *Session) SetRevisionRecorder(revs RevisionRecorder) { s.revs = revs }
+
+// recordRevision reports the current revision to the Session's
+// RevisionRecorder, if any.
+func (s *Session) recordRevision() error {
+	if s.revs == nil {
+		return nil
+	}
+	if err := s.revs.RecordRevision(s.rev); err != nil {
+		return errors.Wrap(err, "could not record revision")
+	}
+	return nil
+}
+
 // call is a helper method that writes a request and then reads a response.
 func (s *Session) call(rpcID renterhost.Specifier, req, resp renterhost.ProtocolObject) error {
 	if err := s.sess.WriteRequest(rpcID, req); err != nil {
@@ -169,6 +197,48 @@ func (s *Session) call(rpcID renterhost.Specifier, req, resp renterhost.Protocol
 	return wrapResponseErr(err, fmt.Sprintf("couldn't read %v response", rpcID), fmt.Sprintf("host rejected %v request", rpcID))
 }
 
+// watchContext closes c if ctx is cancelled before the returned function is
+// called. The returned function reports whether c was closed.
+func watchContext(ctx context.Context, c io.Closer) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-aborted
+	}
+}
+
+// withContext calls fn, closing the underlying connection if ctx is cancelled
+// before fn returns. This unblocks any pending I/O, causing fn to fail; in that
+// case, ctx.Err() is returned instead of the I/O error. Once aborted, the
+// Session is closed and cannot be reused, even if fn succeeded.
+func (s *Session) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := watchContext(ctx, s.conn)
+	err := fn()
+	if stop() {
+		s.sess.Close() // mark the session as closed
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
 func (s *Session) isLocked() bool    { return s.rev.IsValid() }
 func (s *Session) isRevisable() bool { return s.rev.Revision.NewRevisionNumber < math.MaxUint64 }
 
@@ -227,6 +297,9 @@ func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey, timeout
 		Signatures: [2]types.TransactionSignature{resp.Signatures[0], resp.Signatures[1]},
 	}
 	s.key = key
+	if err := s.recordRevision(); err != nil {
+		return err
+	}
 
 	if s.rev.Revision.NewRevisionNumber == math.MaxUint64 {
 		return ErrContractFinalized
@@ -234,6 +307,11 @@ func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey, timeout
 	return nil
 }
 
+// LockContext is like Lock, but aborts the RPC if ctx is cancelled.
+func (s *Session) LockContext(ctx context.Context, id types.FileContractID, key ed25519.PrivateKey, timeout time.Duration) error {
+	return s.withContext(ctx, func() error { return s.Lock(id, key, timeout) })
+}
+
 // Unlock calls the Unlock RPC, unlocking the currently-locked contract.
 //
 // It is typically not necessary to manually unlock a contract, as the host will
@@ -267,6 +345,15 @@ func (s *Session) Settings() (_ hostdb.HostSettings, err error) {
 	return s.host.HostSettings, nil
 }
 
+// SettingsContext is like Settings, but aborts the RPC if ctx is cancelled.
+func (s *Session) SettingsContext(ctx context.Context) (settings hostdb.HostSettings, err error) {
+	err = s.withContext(ctx, func() error {
+		settings, err = s.Settings()
+		return err
+	})
+	return
+}
+
 // SectorRoots calls the SectorRoots RPC, returning the requested range of
 // sector Merkle roots of the currently-locked contract.
 func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
@@ -328,6 +415,9 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	s.rev.Revision = rev
 	s.rev.Signatures[0].Signature = req.Signature
 	s.rev.Signatures[1].Signature = resp.Signature
+	if err := s.recordRevision(); err != nil {
+		return nil, err
+	}
 
 	// verify the proof
 	if !merkle.VerifySectorRangeProof(resp.MerkleProof, resp.SectorRoots, offset, offset+n, s.rev.NumSectors(), rev.NewFileMerkleRoot) {
@@ -336,6 +426,16 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	return resp.SectorRoots, nil
 }
 
+// SectorRootsContext is like SectorRoots, but aborts the RPC if ctx is
+// cancelled.
+func (s *Session) SectorRootsContext(ctx context.Context, offset, n int) (roots []crypto.Hash, err error) {
+	err = s.withContext(ctx, func() error {
+		roots, err = s.SectorRoots(offset, n)
+		return err
+	})
+	return
+}
+
 // helper type for ensuring that we always write in multiples of SegmentSize,
 // which is required by e.g. (renter.KeySeed).XORKeyStream
 type segWriter struct {
@@ -368,7 +468,17 @@ func (sw *segWriter) Write(p []byte) (int, error) {
 func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection) (err error) {
 	defer wrapErr(&err, "Read")
 	defer s.collectStats(renterhost.RPCReadID, &err)()
+	return s.read(w, sections, nil)
+}
+
+// ReadContext is like Read, but aborts the RPC if ctx is cancelled.
+func (s *Session) ReadContext(ctx context.Context, w io.Writer, sections []renterhost.RPCReadRequestSection) error {
+	return s.withContext(ctx, func() error { return s.Read(w, sections) })
+}
 
+// read implements the Read RPC. If proofFn is non-nil, it is called with the
+// index and verified Merkle proof of each section.
+func (s *Session) read(w io.Writer, sections []renterhost.RPCReadRequestSection, proofFn func(i int, proof []crypto.Hash)) error {
 	if !s.isLocked() {
 		return ErrNoContractLocked
 	} else if !s.isRevisable() {
@@ -427,7 +537,7 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	// before returning
 	defer s.sess.WriteResponse(&renterhost.RPCReadStop, nil)
 	var hostSig []byte
-	for _, sec := range sections {
+	for i, sec := range sections {
 		// NOTE: normally, we would call ReadResponse here to read an AEAD RPC
 		// message, verify the tag and decrypt, and then pass the data to
 		// merkle.VerifyProof. As an optimization, we instead stream the message
@@ -484,6 +594,9 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 		if !rpv.Verify(proof, sec.MerkleRoot) {
 			return ErrInvalidMerkleProof
 		}
+		if proofFn != nil {
+			proofFn(i, proof)
+		}
 		// if the host sent a signature, exit the loop; they won't be sending
 		// any more data
 		if len(hostSig) > 0 {
@@ -509,14 +622,19 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	s.rev.Signatures[0].Signature = renterSig
 	s.rev.Signatures[1].Signature = hostSig
 
-	return nil
+	return s.recordRevision()
 }
 
-// Write implements the Write RPC, except for ActionUpdate. A Merkle proof is
-// always requested.
+// Write implements the Write RPC. A Merkle proof is always requested.
+//
+// Update actions must be aligned to segment boundaries, and may only modify
+// sectors that were present before the Write and that are not swapped,
+// trimmed, or updated by an earlier action. To verify the host's Merkle proof,
+// the new root of each updated sector must be known; Write computes it by
+// calling the SectorRoots and Read RPCs on the affected segments before
+// calling the Write RPC.
 func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	defer wrapErr(&err, "Write")
-	defer s.collectStats(renterhost.RPCWriteID, &err)()
 
 	if !s.isLocked() {
 		return ErrNoContractLocked
@@ -525,10 +643,15 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	} else if len(actions) == 0 {
 		return nil
 	}
+	updateRoots, err := s.computeUpdateRoots(actions)
+	if err != nil {
+		return err
+	}
+	defer s.collectStats(renterhost.RPCWriteID, &err)()
 	rev := s.rev.Revision
 
 	// calculate the new Merkle root set and sectors uploaded/stored
-	var uploadBandwidth uint64
+	var uploadBandwidth, sectorAccesses uint64
 	newFileSize := rev.NewFileSize
 	for _, action := range actions {
 		switch action.Type {
@@ -541,6 +664,10 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 
 		case renterhost.RPCWriteActionSwap:
 
+		case renterhost.RPCWriteActionUpdate:
+			uploadBandwidth += uint64(len(action.Data))
+			sectorAccesses++
+
 		default:
 			panic("unknown/unsupported action type")
 		}
@@ -571,7 +698,8 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	bandwidthPrice := s.host.UploadBandwidthPrice.Mul64(uploadBandwidth).Add(s.host.DownloadBandwidthPrice.Mul64(downloadBandwidth))
 
 	// check that enough funds are available
-	price := s.host.BaseRPCPrice.Add(bandwidthPrice).Add(storagePrice)
+	sectorAccessPrice := s.host.SectorAccessPrice.Mul64(sectorAccesses)
+	price := s.host.BaseRPCPrice.Add(bandwidthPrice).Add(storagePrice).Add(sectorAccessPrice)
 	// NOTE: hosts can be picky about price, so add 5% just to be sure.
 	price = price.MulFloat(1.05)
 	if !s.sufficientFunds(price) {
@@ -627,7 +755,11 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	// edge case. Need to investigate what proofs siad hosts are producing (are
 	// they valid?) and reconcile those with our Merkle algorithms.
 	<-precompChan
-	if newFileSize > 0 && !merkle.VerifyDiffProof(actions, s.rev.NumSectors(), proofHashes, leafHashes, oldRoot, newRoot, s.appendRoots) {
+	newRoots := s.appendRoots
+	if len(updateRoots) > 0 {
+		newRoots = mergeNewRoots(actions, s.appendRoots, updateRoots)
+	}
+	if newFileSize > 0 && !merkle.VerifyDiffProof(actions, s.rev.NumSectors(), proofHashes, leafHashes, oldRoot, newRoot, newRoots) {
 		err := ErrInvalidMerkleProof
 		s.sess.WriteResponse(nil, err)
 		return err
@@ -642,24 +774,144 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 		Signature: ed25519hash.Sign(s.key, revisionHash),
 	}
 	if err := s.sess.WriteResponse(renterSig, nil); err != nil {
-		return errors.Wrap(err, "couldn't write signature response")
+		return s.desync(errors.Wrap(err, "couldn't write signature response"))
 	}
 	var hostSig renterhost.RPCWriteResponse
 	if err := s.sess.ReadResponse(&hostSig, 4096); err != nil {
-		return wrapResponseErr(err, "couldn't read signature response", "host rejected Write signature")
+		return s.desync(wrapResponseErr(err, "couldn't read signature response", "host rejected Write signature"))
 	}
 
 	// verify the host signature
 	if !ed25519hash.Verify(s.host.PublicKey.Ed25519(), revisionHash, hostSig.Signature) {
-		return errors.New("host's signature is invalid")
+		return s.desync(errors.New("host's signature is invalid"))
 	}
 	s.rev.Revision = rev
 	s.rev.Signatures[0].Signature = renterSig.Signature
 	s.rev.Signatures[1].Signature = hostSig.Signature
+	s.updateRoots = updateRoots
 
+	if err := s.recordRevision(); err != nil {
+		return s.desync(err)
+	}
 	return nil
 }
 
+// desync closes the Session after an error that leaves the renter unsure
+// whether the host has applied a revision.
+func (s *Session) desync(err error) error {
+	s.sess.Close()
+	return errors.WithMessage(ErrDesync, err.Error())
+}
+
+// WriteContext is like Write, but aborts the RPC if ctx is cancelled.
+func (s *Session) WriteContext(ctx context.Context, actions []renterhost.RPCWriteAction) error {
+	return s.withContext(ctx, func() error { return s.Write(actions) })
+}
+
+// computeUpdateRoots returns the new SectorRoot of each sector modified by an
+// Update action in actions.
+func (s *Session) computeUpdateRoots(actions []renterhost.RPCWriteAction) ([]crypto.Hash, error) {
+	oldSectors := uint64(s.rev.NumSectors())
+	numSectors := oldSectors
+	modified := make(map[uint64]bool)
+	var roots []crypto.Hash
+	for _, action := range actions {
+		switch action.Type {
+		case renterhost.RPCWriteActionAppend:
+			numSectors++
+		case renterhost.RPCWriteActionTrim:
+			for i := uint64(0); i < action.A && numSectors > 0; i++ {
+				numSectors--
+				modified[numSectors] = true
+			}
+		case renterhost.RPCWriteActionSwap:
+			modified[action.A] = true
+			modified[action.B] = true
+		case renterhost.RPCWriteActionUpdate:
+			index, offset, length := action.A, action.B, uint64(len(action.Data))
+			switch {
+			case index >= oldSectors || modified[index]:
+				return nil, errors.New("Update action must modify an existing sector that is not modified by an earlier action")
+			case length == 0 || offset+length > renterhost.SectorSize:
+				return nil, errors.New("updated section is out-of-bounds")
+			case offset%merkle.SegmentSize != 0 || length%merkle.SegmentSize != 0:
+				return nil, errors.New("updated section must align to SegmentSize boundaries")
+			}
+			modified[index] = true
+
+			// read the old segments along with a Merkle proof, which, combined
+			// with the new segments, yields the new root
+			oldRoots, err := s.SectorRoots(int(index), 1)
+			if err != nil {
+				return nil, errors.Wrap(err, "couldn't fetch root of updated sector")
+			}
+			var proof []crypto.Hash
+			sections := []renterhost.RPCReadRequestSection{{
+				MerkleRoot: oldRoots[0],
+				Offset:     uint32(offset),
+				Length:     uint32(length),
+			}}
+			err = func() (err error) {
+				defer s.collectStats(renterhost.RPCReadID, &err)()
+				return s.read(ioutil.Discard, sections, func(_ int, p []crypto.Hash) { proof = p })
+			}()
+			if err != nil {
+				return nil, errors.Wrap(err, "couldn't read updated segments")
+			}
+			start := int(offset / merkle.SegmentSize)
+			end := int((offset + length) / merkle.SegmentSize)
+			roots = append(roots, merkle.ProofRoot(proof, action.Data, start, end))
+		}
+	}
+	return roots, nil
+}
+
+// mergeNewRoots interleaves the roots of appended and updated sectors in the
+// order of their corresponding actions, as expected by merkle.VerifyDiffProof.
+func mergeNewRoots(actions []renterhost.RPCWriteAction, appendRoots, updateRoots []crypto.Hash) []crypto.Hash {
+	newRoots := make([]crypto.Hash, 0, len(appendRoots)+len(updateRoots))
+	for _, action := range actions {
+		switch action.Type {
+		case renterhost.RPCWriteActionAppend:
+			newRoots = append(newRoots, appendRoots[0])
+			appendRoots = appendRoots[1:]
+		case renterhost.RPCWriteActionUpdate:
+			newRoots = append(newRoots, updateRoots[0])
+			updateRoots = updateRoots[1:]
+		}
+	}
+	return newRoots
+}
+
+// Update calls the Write RPC with a single action, overwriting the sector at
+// the specified index with data, starting at offset. The offset and length of
+// data must be multiples of merkle.SegmentSize. It returns the new Merkle root
+// of the sector.
+//
+// If Update returns ErrDesync, the host may have applied the update; the caller
+// must not assume that the sector is unchanged.
+func (s *Session) Update(index int, offset uint32, data []byte) (crypto.Hash, error) {
+	err := s.Write([]renterhost.RPCWriteAction{{
+		Type: renterhost.RPCWriteActionUpdate,
+		A:    uint64(index),
+		B:    uint64(offset),
+		Data: data,
+	}})
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	return s.updateRoots[0], nil
+}
+
+// UpdateContext is like Update, but aborts the RPCs if ctx is cancelled.
+func (s *Session) UpdateContext(ctx context.Context, index int, offset uint32, data []byte) (root crypto.Hash, err error) {
+	err = s.withContext(ctx, func() error {
+		root, err = s.Update(index, offset, data)
+		return err
+	})
+	return
+}
+
 // Append calls the Write RPC with a single action, appending the provided
 // sector. It returns the Merkle root of the sector.
 func (s *Session) Append(sector *[renterhost.SectorSize]byte) (crypto.Hash, error) {
@@ -673,6 +925,15 @@ func (s *Session) Append(sector *[renterhost.SectorSize]byte) (crypto.Hash, erro
 	return s.appendRoots[0], nil
 }
 
+// AppendContext is like Append, but aborts the RPC if ctx is cancelled.
+func (s *Session) AppendContext(ctx context.Context, sector *[renterhost.SectorSize]byte) (root crypto.Hash, err error) {
+	err = s.withContext(ctx, func() error {
+		root, err = s.Append(sector)
+		return err
+	})
+	return
+}
+
 // DeleteSectors calls the Write RPC with a set of Swap and Trim actions that
 // delete the specified sectors.
 func (s *Session) DeleteSectors(roots []crypto.Hash) error {
@@ -742,6 +1003,12 @@ func (s *Session) DeleteSectors(roots []crypto.Hash) error {
 	return s.Write(actions)
 }
 
+// DeleteSectorsContext is like DeleteSectors, but aborts the RPCs if ctx is
+// cancelled.
+func (s *Session) DeleteSectorsContext(ctx context.Context, roots []crypto.Hash) error {
+	return s.withContext(ctx, func() error { return s.DeleteSectors(roots) })
+}
+
 // Close gracefully terminates the session and closes the underlying connection.
 func (s *Session) Close() (err error) {
 	defer wrapErr(&err, "Close")
@@ -808,6 +1075,33 @@ func NewUnlockedSessionFromConn(conn net.Conn, hostKey hostdb.HostPublicKey, cur
 	}, nil
 }
 
+// NewUnlockedSessionContext is like NewUnlockedSession, but aborts the dial and
+// handshake if ctx is cancelled, returning ctx.Err().
+func NewUnlockedSessionContext(ctx context.Context, hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", string(hostIP))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.Wrap(err, "NewUnlockedSessionContext")
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	stop := watchContext(ctx, conn)
+	s, err := NewUnlockedSessionFromConn(conn, hostKey, currentHeight)
+	if stop() {
+		if err == nil {
+			s.Close()
+		}
+		return nil, ctx.Err()
+	}
+	return s, err
+}
+
 func updateRevisionOutputs(rev *types.FileContractRevision, cost, collateral types.Currency) (valid, missed []types.Currency) {
 	// allocate new slices; don't want to risk accidentally sharing memory
 	rev.NewValidProofOutputs = append([]types.SiacoinOutput(nil), rev.NewValidProofOutputs...)
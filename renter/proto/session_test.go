@@ -2,9 +2,12 @@ package proto
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"io/ioutil"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
@@ -141,6 +144,106 @@ func TestSession(t *testing.T) {
 	}
 }
 
+// cancelWriter cancels a context upon its first Write.
+type cancelWriter struct {
+	cancel func()
+}
+
+func (cw cancelWriter) Write(p []byte) (int, error) {
+	cw.cancel()
+	// give the session time to abort the connection
+	time.Sleep(10 * time.Millisecond)
+	return len(p), nil
+}
+
+func TestSessionContext(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	sector := [renterhost.SectorSize]byte{0: 1}
+	sectorRoot, err := renter.AppendContext(context.Background(), &sector)
+	if err != nil {
+		t.Fatal(err)
+	} else if roots, err := renter.SectorRootsContext(context.Background(), 0, 1); err != nil {
+		t.Fatal(err)
+	} else if roots[0] != sectorRoot {
+		t.Fatal("reported sector root does not match actual sector root")
+	}
+	sections := []renterhost.RPCReadRequestSection{{
+		MerkleRoot: sectorRoot,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}}
+
+	// an already-cancelled context should not affect the session
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := renter.ReadContext(ctx, ioutil.Discard, sections); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if renter.IsClosed() {
+		t.Fatal("session should not be closed")
+	} else if _, err := NewUnlockedSessionContext(ctx, host.Settings.NetAddress, host.PublicKey, 0); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+
+	// cancelling mid-download should abort the session
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := renter.ReadContext(ctx, cancelWriter{cancel}, sections); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if !renter.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+}
+
+type testRevisionRecorder struct {
+	revs []ContractRevision
+	err  error
+}
+
+func (trr *testRevisionRecorder) RecordRevision(rev ContractRevision) error {
+	if trr.err != nil {
+		return trr.err
+	}
+	trr.revs = append(trr.revs, rev)
+	return nil
+}
+
+func TestRevisionRecorder(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var trr testRevisionRecorder
+	renter.SetRevisionRecorder(&trr)
+
+	// each revising RPC should record the new revision
+	sector := [renterhost.SectorSize]byte{0: 1}
+	sectorRoot, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(trr.revs) != 1 || trr.revs[0].Revision.NewRevisionNumber != renter.Revision().Revision.NewRevisionNumber {
+		t.Fatal("revision was not recorded")
+	}
+	err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: sectorRoot,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(trr.revs) != 2 || trr.revs[1].Revision.NewRevisionNumber != renter.Revision().Revision.NewRevisionNumber {
+		t.Fatal("revision was not recorded")
+	}
+
+	// if the revision cannot be recorded, the RPC should fail
+	trr.err = errors.New("disk full")
+	if _, err := renter.SectorRoots(0, 1); errors.Cause(err) != trr.err {
+		t.Fatal("expected recorder error, got", err)
+	}
+}
+
 func TestRenew(t *testing.T) {
 	renter, host := createTestingPair(t)
 	defer renter.Close()
@@ -152,11 +255,18 @@ func TestRenew(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	var trr testRevisionRecorder
+	renter.SetRevisionRecorder(&trr)
 	newContract, _, err := renter.RenewContract(stubWallet{}, stubTpool{}, types.ZeroCurrency, 5, 20)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	// the final revision of the old contract should be recorded
+	if len(trr.revs) != 1 || trr.revs[0].Revision.NewRevisionNumber != math.MaxUint64 || trr.revs[0].NumSectors() != 0 {
+		t.Fatal("final revision was not recorded")
+	}
+
 	// attempting to revise the old contract should cause an error
 	err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
 		MerkleRoot: sectorRoot,
@@ -167,6 +277,7 @@ func TestRenew(t *testing.T) {
 		t.Fatal("expected error, got nil")
 	}
 	oldID, oldKey := renter.Revision().ID(), renter.key
+	renter.Close()
 	renter, err = NewUnlockedSession(host.Settings.NetAddress, host.PublicKey, 0)
 	if err != nil {
 		t.Fatal(err)
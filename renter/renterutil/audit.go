@@ -0,0 +1,216 @@
+package renterutil
+
+import (
+	"io/ioutil"
+	"math/bits"
+	"reflect"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+// number of recent audit results retained for each host
+const auditHistorySize = 100
+
+// An AuditResult records the outcome of auditing a single segment.
+type AuditResult struct {
+	HostKey   hostdb.HostPublicKey
+	Root      crypto.Hash
+	Segment   uint32 // index of the audited segment within the sector
+	Timestamp time.Time
+	Err       error // nil if the audit passed
+	// Unreachable is true if the audit could not be conducted because the
+	// host could not be connected to. Such audits say nothing about whether
+	// the host still stores the sector.
+	Unreachable bool
+}
+
+// Passed returns true if the host supplied the segment along with a valid
+// Merkle proof.
+func (r AuditResult) Passed() bool { return r.Err == nil }
+
+// Failed returns true if the host was reached, but did not supply the segment
+// along with a valid Merkle proof.
+func (r AuditResult) Failed() bool { return r.Err != nil && !r.Unreachable }
+
+// AuditStats summarizes the audit history of a host. Unreachable audits are
+// not counted as failures.
+type AuditStats struct {
+	Passed          int
+	Failed          int
+	Unreachable     int
+	LastPassed      time.Time
+	LastFailed      time.Time
+	LastUnreachable time.Time
+	// Recent contains the most recent results, oldest first.
+	Recent []AuditResult
+}
+
+// An AuditBudget limits the resources spent in a single audit round. A zero
+// value for either field means no limit.
+type AuditBudget struct {
+	MaxBytes uint64
+	MaxCost  types.Currency
+}
+
+// An AuditRound summarizes a single call to (*Auditor).Audit.
+type AuditRound struct {
+	Results []AuditResult
+	Bytes   uint64
+	Cost    types.Currency
+	// Skipped is the number of segments that were not audited because doing so
+	// would have exceeded the budget.
+	Skipped int
+}
+
+// An Auditor spot-checks hosts by downloading random segments of stored
+// sectors. Session.Read verifies the host's Merkle proof for each segment
+// against the MerkleRoot recorded in the metafile, so a host that has lost or
+// corrupted a sector cannot pass an audit of it.
+type Auditor struct {
+	hosts  *HostSet
+	budget AuditBudget
+
+	mu    sync.Mutex
+	stats map[hostdb.HostPublicKey]*AuditStats
+}
+
+// SetBudget sets the budget used for subsequent audit rounds.
+func (a *Auditor) SetBudget(b AuditBudget) {
+	a.mu.Lock()
+	a.budget = b
+	a.mu.Unlock()
+}
+
+// Stats returns the audit history of the specified host.
+func (a *Auditor) Stats(hostKey hostdb.HostPublicKey) AuditStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.stats[hostKey]
+	if !ok {
+		return AuditStats{}
+	}
+	stats := *s
+	stats.Recent = append([]AuditResult(nil), s.Recent...)
+	return stats
+}
+
+func (a *Auditor) record(r AuditResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.stats[r.HostKey]
+	if !ok {
+		s = new(AuditStats)
+		a.stats[r.HostKey] = s
+	}
+	switch {
+	case r.Passed():
+		s.Passed++
+		s.LastPassed = r.Timestamp
+	case r.Unreachable:
+		s.Unreachable++
+		s.LastUnreachable = r.Timestamp
+	default:
+		s.Failed++
+		s.LastFailed = r.Timestamp
+	}
+	s.Recent = append(s.Recent, r)
+	if len(s.Recent) > auditHistorySize {
+		s.Recent = append(s.Recent[:0], s.Recent[len(s.Recent)-auditHistorySize:]...)
+	}
+}
+
+// auditCost returns the number of bytes downloaded, and the amount paid, when
+// auditing a single segment.
+func auditCost(settings hostdb.HostSettings) (uint64, types.Currency) {
+	// the host charges for a worst-case proof size, and for at least
+	// MinMessageSize bytes
+	bandwidth := uint64(merkle.SegmentSize + 2*bits.Len64(merkle.SegmentsPerSector)*crypto.HashSize)
+	if bandwidth < renterhost.MinMessageSize {
+		bandwidth = renterhost.MinMessageSize
+	}
+	cost := settings.BaseRPCPrice.
+		Add(settings.SectorAccessPrice).
+		Add(settings.DownloadBandwidthPrice.Mul64(bandwidth))
+	return bandwidth, cost
+}
+
+// Audit samples one random segment from each SectorSlice of files and
+// downloads it from the host storing it, verifying it against the slice's
+// MerkleRoot. The samples are audited in random order until the budget is
+// exhausted. Slices stored on hosts outside the Auditor's HostSet are
+// ignored.
+func (a *Auditor) Audit(files []*renter.MetaFile) AuditRound {
+	type sample struct {
+		hostKey hostdb.HostPublicKey
+		root    crypto.Hash
+		segment uint32
+	}
+	var samples []sample
+	for _, m := range files {
+		for i, hostKey := range m.Hosts {
+			if !a.hosts.HasHost(hostKey) {
+				continue
+			}
+			for _, ss := range m.Shards[i] {
+				if ss.NumSegments == 0 {
+					continue
+				}
+				samples = append(samples, sample{
+					hostKey: hostKey,
+					root:    ss.MerkleRoot,
+					segment: ss.SegmentIndex + uint32(frand.Intn(int(ss.NumSegments))),
+				})
+			}
+		}
+	}
+	frand.Shuffle(len(samples), reflect.Swapper(samples))
+
+	a.mu.Lock()
+	budget := a.budget
+	a.mu.Unlock()
+	var round AuditRound
+	for _, s := range samples {
+		h, err := a.hosts.acquire(s.hostKey)
+		if err != nil {
+			r := AuditResult{s.hostKey, s.root, s.segment, time.Now(), err, true}
+			a.record(r)
+			round.Results = append(round.Results, r)
+			continue
+		}
+		bytes, cost := auditCost(h.HostSettings())
+		if (budget.MaxBytes != 0 && round.Bytes+bytes > budget.MaxBytes) ||
+			(!budget.MaxCost.IsZero() && round.Cost.Add(cost).Cmp(budget.MaxCost) > 0) {
+			a.hosts.release(h)
+			round.Skipped++
+			continue
+		}
+		err = h.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+			MerkleRoot: s.root,
+			Offset:     s.segment * merkle.SegmentSize,
+			Length:     merkle.SegmentSize,
+		}})
+		a.hosts.release(h)
+		round.Bytes += bytes
+		round.Cost = round.Cost.Add(cost)
+		r := AuditResult{s.hostKey, s.root, s.segment, time.Now(), err, false}
+		a.record(r)
+		round.Results = append(round.Results, r)
+	}
+	return round
+}
+
+// NewAuditor returns an Auditor that audits the hosts in the provided set.
+func NewAuditor(hosts *HostSet) *Auditor {
+	return &Auditor{
+		hosts: hosts,
+		stats: make(map[hostdb.HostPublicKey]*AuditStats),
+	}
+}
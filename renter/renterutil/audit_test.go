@@ -0,0 +1,99 @@
+package renterutil
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestAuditor(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(frand.Bytes(renterhost.SectorSize)); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	m, err := fs.store.ReadMetaFile(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all audits should pass
+	a := NewAuditor(fs.hosts)
+	round := a.Audit([]*renter.MetaFile{m})
+	if len(round.Results) != 2 || round.Skipped != 0 {
+		t.Fatalf("expected 2 audits, got %v (%v skipped)", len(round.Results), round.Skipped)
+	}
+	for _, r := range round.Results {
+		if !r.Passed() {
+			t.Fatal("audit failed:", r.Err)
+		} else if s := a.Stats(r.HostKey); s.Passed != 1 || s.Failed != 0 || len(s.Recent) != 1 {
+			t.Fatalf("unexpected stats: %+v", s)
+		}
+	}
+
+	// with a limited budget, only one segment should be audited
+	a.SetBudget(AuditBudget{MaxBytes: renterhost.MinMessageSize})
+	if round := a.Audit([]*renter.MetaFile{m}); len(round.Results) != 1 || round.Skipped != 1 {
+		t.Fatalf("expected 1 audit, got %v (%v skipped)", len(round.Results), round.Skipped)
+	}
+	a.SetBudget(AuditBudget{})
+
+	// delete the sector from one host; its audit should fail
+	hostKey := m.Hosts[0]
+	h, err := fs.hosts.acquire(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.DeleteSectors([]crypto.Hash{m.Shards[0][0].MerkleRoot})
+	fs.hosts.release(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range a.Audit([]*renter.MetaFile{m}).Results {
+		if r.HostKey == hostKey && r.Passed() {
+			t.Fatal("audit of deleted sector should fail")
+		} else if r.HostKey != hostKey && !r.Passed() {
+			t.Fatal("audit failed:", r.Err)
+		}
+	}
+	if s := a.Stats(hostKey); s.Failed != 1 || s.LastFailed.IsZero() {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// make the other host unreachable; its audit should be recorded as
+	// unreachable rather than failed
+	hostKey = m.Hosts[1]
+	h, err = fs.hosts.acquire(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	fs.hosts.release(h)
+	delete(fs.hosts.hkr.(testHKR), hostKey)
+	for _, r := range a.Audit([]*renter.MetaFile{m}).Results {
+		if r.HostKey == hostKey && (!r.Unreachable || r.Passed() || r.Failed()) {
+			t.Fatal("audit of unreachable host should be unreachable:", r)
+		}
+	}
+	if s := a.Stats(hostKey); s.Failed != 0 || s.Unreachable != 1 || s.LastUnreachable.IsZero() {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
@@ -0,0 +1,200 @@
+package renterutil
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+// contract store buckets
+var (
+	// bucketContracts maps contract IDs to contractEntries.
+	bucketContracts = []byte("bucketContracts")
+
+	contractStoreBuckets = [][]byte{
+		bucketContracts,
+	}
+)
+
+// A contractEntry is the persisted state of a contract.
+type contractEntry struct {
+	HostKey   hostdb.HostPublicKey
+	RenterKey ed25519.PrivateKey
+	Revision  proto.ContractRevision
+	// RenewedTo is the ID of the contract that this contract was renewed to,
+	// or zero if the contract has not been renewed.
+	RenewedTo types.FileContractID
+}
+
+func (e contractEntry) contract(id types.FileContractID) renter.Contract {
+	return renter.Contract{
+		HostKey:   e.HostKey,
+		ID:        id,
+		RenterKey: e.RenterKey,
+	}
+}
+
+func getContractEntry(tx *bolt.Tx, id types.FileContractID) (e contractEntry, err error) {
+	v := tx.Bucket(bucketContracts).Get(id[:])
+	if v == nil {
+		return contractEntry{}, errNoContract
+	}
+	err = encoding.Unmarshal(v, &e)
+	return
+}
+
+func putContractEntry(tx *bolt.Tx, id types.FileContractID, e contractEntry) error {
+	return tx.Bucket(bucketContracts).Put(id[:], encoding.Marshal(e))
+}
+
+// A ContractStore is a persistent store of contracts and their most recent
+// revisions. Each revision is written to disk before the RPC that produced it
+// returns, so if the renter crashes, it does not lose track of revisions signed
+// by the host.
+//
+// A ContractStore implements proto.RevisionRecorder, and ContractSaver for use
+// with a ContractManager.
+type ContractStore struct {
+	db *bolt.DB
+}
+
+// AddContract adds a newly-formed contract and its initial revision to the
+// store.
+func (cs *ContractStore) AddContract(c renter.Contract, rev proto.ContractRevision) error {
+	if rev.ID() != c.ID {
+		return errors.New("revision does not match contract")
+	}
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		return putContractEntry(tx, c.ID, contractEntry{
+			HostKey:   c.HostKey,
+			RenterKey: c.RenterKey,
+			Revision:  rev,
+		})
+	})
+}
+
+// Contract returns the contract with the specified ID, along with its most
+// recent revision.
+func (cs *ContractStore) Contract(id types.FileContractID) (c renter.Contract, rev proto.ContractRevision, err error) {
+	err = cs.db.View(func(tx *bolt.Tx) error {
+		e, err := getContractEntry(tx, id)
+		c, rev = e.contract(id), e.Revision
+		return err
+	})
+	return
+}
+
+// Contracts returns every contract in the store that has not been renewed.
+func (cs *ContractStore) Contracts() ([]renter.Contract, error) {
+	var contracts []renter.Contract
+	err := cs.forEachContract(func(c renter.Contract, _ proto.ContractRevision) {
+		contracts = append(contracts, c)
+	})
+	return contracts, err
+}
+
+// forEachContract calls fn with every contract in the store that has not been
+// renewed, along with its most recent revision.
+func (cs *ContractStore) forEachContract(fn func(renter.Contract, proto.ContractRevision)) error {
+	return cs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContracts).ForEach(func(k, v []byte) error {
+			var e contractEntry
+			if err := encoding.Unmarshal(v, &e); err != nil {
+				return err
+			} else if e.RenewedTo != (types.FileContractID{}) {
+				return nil
+			}
+			var id types.FileContractID
+			copy(id[:], k)
+			fn(e.contract(id), e.Revision)
+			return nil
+		})
+	})
+}
+
+// RecordRevision implements proto.RevisionRecorder. Revisions older than the
+// stored revision are ignored.
+func (cs *ContractStore) RecordRevision(rev proto.ContractRevision) error {
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		e, err := getContractEntry(tx, rev.ID())
+		if err != nil {
+			return err
+		} else if rev.Revision.NewRevisionNumber < e.Revision.Revision.NewRevisionNumber {
+			return nil
+		}
+		e.Revision = rev
+		return putContractEntry(tx, rev.ID(), e)
+	})
+}
+
+// SaveRenewedContract implements ContractSaver. The new contract is added to
+// the store, and the old contract is marked as renewed, in a single
+// transaction.
+func (cs *ContractStore) SaveRenewedContract(oldID types.FileContractID, c renter.Contract, rev proto.ContractRevision) error {
+	if rev.ID() != c.ID {
+		return errors.New("revision does not match contract")
+	}
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		old, err := getContractEntry(tx, oldID)
+		if err != nil {
+			return err
+		}
+		old.RenewedTo = c.ID
+		if err := putContractEntry(tx, oldID, old); err != nil {
+			return err
+		}
+		return putContractEntry(tx, c.ID, contractEntry{
+			HostKey:   c.HostKey,
+			RenterKey: c.RenterKey,
+			Revision:  rev,
+		})
+	})
+}
+
+// HostSet returns a HostSet containing every contract in the store that has
+// not been renewed. Sessions initiated by the HostSet record their revisions
+// in the store. When a contract is locked, the host's revision is compared
+// with the stored revision; if the host's revision is older, the contract is
+// not used.
+func (cs *ContractStore) HostSet(hkr renter.HostKeyResolver, currentHeight types.BlockHeight) (*HostSet, error) {
+	set := NewHostSet(hkr, currentHeight)
+	set.SetRevisionRecorder(cs)
+	if err := cs.forEachContract(set.addHost); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// Close closes the store's database.
+func (cs *ContractStore) Close() error {
+	return cs.db.Close()
+}
+
+// NewContractStore returns a ContractStore backed by the specified database
+// file, creating it if it does not exist.
+func NewContractStore(filename string) (*ContractStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range contractStoreBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ContractStore{db: db}, nil
+}
@@ -0,0 +1,190 @@
+package renterutil
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter/proto"
+)
+
+func TestContractStore(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storePath := filepath.Join(dir, "contracts.db")
+	store, err := NewContractStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Close() }()
+
+	host, c := createHostWithContract(t)
+	defer host.Close()
+	hkr := testHKR{host.PublicKey: host.Settings.NetAddress}
+	hostRevision := func() proto.ContractRevision {
+		t.Helper()
+		s, err := proto.NewSession(host.Settings.NetAddress, host.PublicKey, c.ID, c.RenterKey, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		return s.Revision()
+	}
+	checkRevision := func(id types.FileContractID, exp proto.ContractRevision) {
+		t.Helper()
+		if _, rev, err := store.Contract(id); err != nil {
+			t.Fatal(err)
+		} else if rev.Revision.NewRevisionNumber != exp.Revision.NewRevisionNumber || rev.NumSectors() != exp.NumSectors() {
+			t.Fatalf("stored revision (%v, %v sectors) does not match expected revision (%v, %v sectors)",
+				rev.Revision.NewRevisionNumber, rev.NumSectors(), exp.Revision.NewRevisionNumber, exp.NumSectors())
+		}
+	}
+
+	initRev := hostRevision()
+	if err := store.AddContract(c, initRev); err != nil {
+		t.Fatal(err)
+	}
+	checkRevision(c.ID, initRev)
+
+	// upload a file; the store should track each revision
+	hs, err := store.HostSet(hkr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFileSystem(os.TempDir(), hs)
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(frand.Bytes(100)); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rev := hostRevision()
+	if rev.NumSectors() != 1 {
+		t.Fatal("expected contract to contain 1 sector, got", rev.NumSectors())
+	}
+	checkRevision(c.ID, rev)
+
+	// older revisions should be ignored, and unknown contracts rejected
+	if err := store.RecordRevision(initRev); err != nil {
+		t.Fatal(err)
+	}
+	checkRevision(c.ID, rev)
+	unknown := initRev
+	unknown.Revision.ParentID = frand.Entropy256()
+	if err := store.RecordRevision(unknown); err == nil {
+		t.Fatal("expected error when recording revision of unknown contract")
+	}
+
+	// reopen the store; the contract and its revision should persist
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewContractStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRevision(c.ID, rev)
+	if contracts, err := store.Contracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != c.ID || contracts[0].HostKey != c.HostKey {
+		t.Fatal("store contains wrong contracts:", contracts)
+	}
+
+	// simulate a crash before the latest revision was recorded; when the
+	// contract is locked, the host's newer revision should be recorded
+	freshStore := func(name string, rev proto.ContractRevision) *ContractStore {
+		t.Helper()
+		fresh, err := NewContractStore(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := fresh.AddContract(c, rev); err != nil {
+			t.Fatal(err)
+		}
+		return fresh
+	}
+	stale := freshStore("stale.db", initRev)
+	defer stale.Close()
+	staleHS, err := stale.HostSet(hkr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := staleHS.acquire(host.PublicKey); err != nil {
+		t.Fatal(err)
+	} else {
+		staleHS.release(s)
+	}
+	staleHS.Close()
+	if _, sr, err := stale.Contract(c.ID); err != nil {
+		t.Fatal(err)
+	} else if sr.Revision.NewRevisionNumber != rev.Revision.NewRevisionNumber {
+		t.Fatal("host's newer revision was not recorded")
+	}
+
+	// if the host's revision is older than the stored revision, the contract
+	// should not be used
+	aheadRev := rev
+	aheadRev.Revision.NewRevisionNumber++
+	ahead := freshStore("ahead.db", aheadRev)
+	defer ahead.Close()
+	aheadHS, err := ahead.HostSet(hkr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := aheadHS.acquire(host.PublicKey); err == nil {
+		aheadHS.release(s)
+		t.Fatal("expected error when host's revision is older than stored revision")
+	} else if !strings.Contains(err.Error(), "older than ours") {
+		t.Fatal("expected stale revision error, got", err)
+	}
+	aheadHS.Close()
+
+	// renew the contract; the store should only return the renewed contract
+	hs, err = store.HostSet(hkr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	cm, err := NewContractManager(hs, stubHeighter(5), stubWallet{}, stubTpool{}, store, RenewPolicy{
+		RenewWindow: 10,
+		Duration:    20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := cm.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 || !events[0].Succeeded() {
+		t.Fatal("expected one successful renewal, got", events)
+	}
+	newID := events[0].NewID
+	if contracts, err := store.Contracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != newID {
+		t.Fatal("store contains wrong contracts:", contracts)
+	} else if _, _, err := store.Contract(c.ID); err != nil {
+		t.Fatal("old contract should remain in store:", err)
+	}
+}
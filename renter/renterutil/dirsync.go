@@ -0,0 +1,436 @@
+package renterutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+)
+
+// A SyncOp is the type of change made by a SyncAction.
+type SyncOp int
+
+// SyncOp types.
+const (
+	SyncUpload SyncOp = iota // upload a new file
+	SyncUpdate               // re-upload a changed file
+	SyncDelete               // delete a file or directory
+	SyncRename               // rename a file
+)
+
+// A SyncAction is a change made to a PseudoFS by SyncDir. Paths are relative
+// to the synced directories and use forward slashes.
+type SyncAction struct {
+	Op      SyncOp
+	Path    string
+	OldPath string // for renames
+	Size    int64
+}
+
+// String implements fmt.Stringer.
+func (a SyncAction) String() string {
+	switch a.Op {
+	case SyncUpload:
+		return fmt.Sprintf("upload %v (%v bytes)", a.Path, a.Size)
+	case SyncUpdate:
+		return fmt.Sprintf("update %v (%v bytes)", a.Path, a.Size)
+	case SyncDelete:
+		return fmt.Sprintf("delete %v", a.Path)
+	case SyncRename:
+		return fmt.Sprintf("rename %v -> %v", a.OldPath, a.Path)
+	default:
+		return fmt.Sprintf("unknown action on %v", a.Path)
+	}
+}
+
+// SyncOptions control the behavior of SyncDir.
+type SyncOptions struct {
+	// MinShards is the redundancy of uploaded files.
+	MinShards int
+	// If Checksum is set, files of the same size are compared by the checksum
+	// of their contents instead of their modification time. This requires
+	// downloading each such file from the PseudoFS.
+	Checksum bool
+	// If Delete is set, files and directories that are not present locally
+	// are deleted from the PseudoFS. As with (PseudoFS).Remove, the deleted
+	// files' data is not deleted from hosts; use (PseudoFS).GC for that.
+	Delete bool
+	// If DetectRenames is set, a new local file with the same size and
+	// checksum as a file that would be deleted is renamed instead of
+	// uploaded. Checksums are always compared for rename candidates,
+	// regardless of Checksum, since pairing unrelated files would corrupt the
+	// backup. DetectRenames has no effect unless Delete is also set.
+	DetectRenames bool
+	// If DryRun is set, SyncDir only reports the actions it would take.
+	DryRun bool
+	// Concurrency is the maximum number of files uploaded in parallel. If
+	// zero, files are uploaded one at a time.
+	Concurrency int
+}
+
+// SyncDir makes the remoteDir tree of fs match the localDir tree. New and
+// changed files are uploaded, and, depending on opts, files that are not
+// present locally are deleted or renamed. A file is considered changed if its
+// size or modification time differs, or if opts.Checksum is set, if its
+// size or contents differ. Uploaded files are given the modification time of
+// their local counterpart.
+//
+// SyncDir returns the actions it took, or would take if opts.DryRun is set. If
+// an error is returned, some of the actions may not have been completed.
+func SyncDir(fs *PseudoFS, localDir, remoteDir string, opts SyncOptions) ([]SyncAction, error) {
+	s := &dirSyncer{
+		fs:         fs,
+		localDir:   localDir,
+		remoteDir:  remoteDir,
+		opts:       opts,
+		localSums:  make(map[string]crypto.Hash),
+		remoteSums: make(map[string]crypto.Hash),
+	}
+	actions, err := s.plan()
+	if err != nil || opts.DryRun {
+		return actions, err
+	}
+	return actions, s.apply(actions)
+}
+
+type dirSyncer struct {
+	fs        *PseudoFS
+	localDir  string
+	remoteDir string
+	opts      SyncOptions
+
+	// cached checksums
+	localSums  map[string]crypto.Hash
+	remoteSums map[string]crypto.Hash
+}
+
+func (s *dirSyncer) localPath(name string) string {
+	return filepath.Join(s.localDir, filepath.FromSlash(name))
+}
+
+func (s *dirSyncer) remotePath(name string) string {
+	return path.Join(s.remoteDir, name)
+}
+
+// walkLocal returns the regular files and directories within localDir.
+func (s *dirSyncer) walkLocal() (files map[string]os.FileInfo, dirs map[string]bool, err error) {
+	files = make(map[string]os.FileInfo)
+	dirs = make(map[string]bool)
+	err = filepath.Walk(s.localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.localDir, p)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			dirs[rel] = true
+		} else if info.Mode().IsRegular() {
+			files[rel] = info
+		}
+		return nil
+	})
+	return
+}
+
+// walkRemote returns the files and directories within remoteDir.
+func (s *dirSyncer) walkRemote() (files map[string]os.FileInfo, dirs map[string]bool, err error) {
+	files = make(map[string]os.FileInfo)
+	dirs = make(map[string]bool)
+	if !s.fs.isDir(s.remoteDir) {
+		return files, dirs, nil // nothing uploaded yet
+	}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		d, err := s.fs.Open(s.remotePath(dir))
+		if err != nil {
+			return err
+		}
+		infos, err := d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			rel := path.Join(dir, info.Name())
+			if info.IsDir() {
+				dirs[rel] = true
+				if err := walk(rel); err != nil {
+					return err
+				}
+			} else {
+				files[rel] = info
+			}
+		}
+		return nil
+	}
+	return files, dirs, walk("")
+}
+
+func (s *dirSyncer) localChecksum(name string) (crypto.Hash, error) {
+	if h, ok := s.localSums[name]; ok {
+		return h, nil
+	}
+	f, err := os.Open(s.localPath(name))
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	defer f.Close()
+	h, err := checksum(f)
+	if err == nil {
+		s.localSums[name] = h
+	}
+	return h, err
+}
+
+func (s *dirSyncer) remoteChecksum(name string) (crypto.Hash, error) {
+	if h, ok := s.remoteSums[name]; ok {
+		return h, nil
+	}
+	pf, err := s.fs.Open(s.remotePath(name))
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	defer pf.Close()
+	h, err := checksum(pf)
+	if err == nil {
+		s.remoteSums[name] = h
+	}
+	return h, err
+}
+
+func checksum(r io.Reader) (h crypto.Hash, err error) {
+	hasher := crypto.NewHash()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return h, err
+	}
+	copy(h[:], hasher.Sum(nil))
+	return h, nil
+}
+
+// same reports whether the local file and remote file appear to have the same
+// contents.
+func (s *dirSyncer) same(localName string, local os.FileInfo, remoteName string, remote os.FileInfo) (bool, error) {
+	if local.Size() != remote.Size() {
+		return false, nil
+	} else if !s.opts.Checksum {
+		// metafiles preserve modification times at full precision, but some
+		// local filesystems do not
+		return local.ModTime().Unix() == remote.ModTime().Unix(), nil
+	}
+	return s.sameChecksum(localName, remoteName)
+}
+
+// sameChecksum reports whether the local file and remote file have the same
+// checksum.
+func (s *dirSyncer) sameChecksum(localName, remoteName string) (bool, error) {
+	lh, err := s.localChecksum(localName)
+	if err != nil {
+		return false, err
+	}
+	rh, err := s.remoteChecksum(remoteName)
+	if err != nil {
+		return false, err
+	}
+	return lh == rh, nil
+}
+
+func (s *dirSyncer) plan() ([]SyncAction, error) {
+	localFiles, localDirs, err := s.walkLocal()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read local directory")
+	}
+	remoteFiles, remoteDirs, err := s.walkRemote()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read remote directory")
+	}
+
+	var uploads, updates, renames, deletes []SyncAction
+	for _, name := range sortedKeys(localFiles) {
+		local := localFiles[name]
+		if remote, ok := remoteFiles[name]; !ok {
+			uploads = append(uploads, SyncAction{Op: SyncUpload, Path: name, Size: local.Size()})
+		} else if same, err := s.same(name, local, name, remote); err != nil {
+			return nil, err
+		} else if !same {
+			updates = append(updates, SyncAction{Op: SyncUpdate, Path: name, Size: local.Size()})
+		}
+	}
+	if !s.opts.Delete {
+		return append(uploads, updates...), nil
+	}
+	var orphans []string
+	for _, name := range sortedKeys(remoteFiles) {
+		if _, ok := localFiles[name]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+
+	if s.opts.DetectRenames {
+		remaining := uploads[:0]
+		for _, up := range uploads {
+			renamed := false
+			for i, name := range orphans {
+				if up.Size != remoteFiles[name].Size() {
+					continue
+				}
+				same, err := s.sameChecksum(up.Path, name)
+				if err != nil {
+					return nil, err
+				} else if same {
+					renames = append(renames, SyncAction{Op: SyncRename, Path: up.Path, OldPath: name, Size: up.Size})
+					orphans = append(orphans[:i], orphans[i+1:]...)
+					renamed = true
+					break
+				}
+			}
+			if !renamed {
+				remaining = append(remaining, up)
+			}
+		}
+		uploads = remaining
+	}
+
+	// delete directories that are not present locally; files within them
+	// do not need to be deleted individually
+	deletedDirs := make(map[string]bool)
+	for name := range remoteDirs {
+		if !localDirs[name] {
+			deletedDirs[name] = true
+		}
+	}
+	covered := func(name string) bool {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if deletedDirs[dir] {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range orphans {
+		if !covered(name) {
+			deletes = append(deletes, SyncAction{Op: SyncDelete, Path: name, Size: remoteFiles[name].Size()})
+		}
+	}
+	var dirNames []string
+	for name := range deletedDirs {
+		if !covered(name) {
+			dirNames = append(dirNames, name)
+		}
+	}
+	sort.Strings(dirNames)
+	for _, name := range dirNames {
+		deletes = append(deletes, SyncAction{Op: SyncDelete, Path: name})
+	}
+
+	// renames must precede deletions, since the renamed file may be within a
+	// deleted directory
+	actions := append(renames, uploads...)
+	actions = append(actions, updates...)
+	return append(actions, deletes...), nil
+}
+
+func sortedKeys(m map[string]os.FileInfo) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *dirSyncer) upload(name string) error {
+	f, err := os.Open(s.localPath(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	remoteName := s.remotePath(name)
+	if err := s.fs.MkdirAll(path.Dir(remoteName), 0700); err != nil {
+		return err
+	}
+	pf, err := s.fs.OpenFile(remoteName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, info.Mode().Perm(), s.opts.MinShards)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(pf, f); err != nil {
+		pf.Close()
+		return err
+	} else if err := pf.Sync(); err != nil {
+		pf.Close()
+		return err
+	} else if err := pf.Close(); err != nil {
+		return err
+	}
+	return s.fs.Chtimes(remoteName, info.ModTime(), info.ModTime())
+}
+
+func (s *dirSyncer) apply(actions []SyncAction) error {
+	// perform renames first, then uploads (in parallel), then deletions
+	var transfers []SyncAction
+	for _, a := range actions {
+		if a.Op != SyncRename {
+			if a.Op == SyncUpload || a.Op == SyncUpdate {
+				transfers = append(transfers, a)
+			}
+			continue
+		}
+		newName := s.remotePath(a.Path)
+		if err := s.fs.MkdirAll(path.Dir(newName), 0700); err != nil {
+			return err
+		} else if err := s.fs.Rename(s.remotePath(a.OldPath), newName); err != nil {
+			return errors.Wrapf(err, "could not rename %v", a.OldPath)
+		}
+	}
+
+	concurrency := s.opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, a := range transfers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			if err := s.upload(name); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "could not upload %v", name)
+				}
+				mu.Unlock()
+			}
+		}(a.Path)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for _, a := range actions {
+		if a.Op != SyncDelete {
+			continue
+		}
+		if err := s.fs.RemoveAll(s.remotePath(a.Path)); err != nil {
+			return errors.Wrapf(err, "could not delete %v", a.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+func TestSyncDir(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	localDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteRoot, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteRoot)
+	tfs, cleanup := createTestingFS(t, 1)
+	defer cleanup()
+	fs := NewFileSystem(remoteRoot, tfs.hosts)
+
+	writeLocal := func(name string, data []byte, mtime time.Time) {
+		t.Helper()
+		p := filepath.Join(localDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func(opts SyncOptions, exp ...SyncAction) {
+		t.Helper()
+		opts.MinShards = 1
+		actions, err := SyncDir(fs, localDir, "backup", opts)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(actions) != len(exp) || (len(exp) > 0 && !reflect.DeepEqual(actions, exp)) {
+			t.Fatalf("expected actions %v, got %v", exp, actions)
+		}
+	}
+	checkContents := func(name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(filepath.Join("backup", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		p, err := ioutil.ReadAll(pf)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatalf("contents of %v do not match", name)
+		}
+	}
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	dataA, dataB := frand.Bytes(100), frand.Bytes(200)
+	writeLocal("a", dataA, mtime)
+	writeLocal("sub/b", dataB, mtime)
+	uploadAll := []SyncAction{
+		{Op: SyncUpload, Path: "a", Size: 100},
+		{Op: SyncUpload, Path: "sub/b", Size: 200},
+	}
+
+	// a dry run should not modify the filesystem
+	sync(SyncOptions{DryRun: true}, uploadAll...)
+	sync(SyncOptions{DryRun: true}, uploadAll...)
+
+	// upload everything; syncing again should be a no-op
+	sync(SyncOptions{Concurrency: 2}, uploadAll...)
+	sync(SyncOptions{})
+	sync(SyncOptions{Checksum: true})
+	checkContents("a", dataA)
+	checkContents("sub/b", dataB)
+
+	// change the contents of a file without changing its size or mtime; this
+	// should only be detected when comparing checksums
+	dataA = frand.Bytes(100)
+	writeLocal("a", dataA, mtime)
+	sync(SyncOptions{})
+	sync(SyncOptions{Checksum: true}, SyncAction{Op: SyncUpdate, Path: "a", Size: 100})
+	checkContents("a", dataA)
+
+	// a modified mtime should trigger an update
+	writeLocal("a", dataA, mtime.Add(time.Minute))
+	sync(SyncOptions{}, SyncAction{Op: SyncUpdate, Path: "a", Size: 100})
+
+	// rename a local file; without Delete, it should be uploaded and the old
+	// file retained
+	if err := os.Rename(filepath.Join(localDir, "sub", "b"), filepath.Join(localDir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(localDir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	sync(SyncOptions{DryRun: true}, SyncAction{Op: SyncUpload, Path: "c", Size: 200})
+	sync(SyncOptions{Delete: true, DryRun: true},
+		SyncAction{Op: SyncUpload, Path: "c", Size: 200},
+		SyncAction{Op: SyncDelete, Path: "sub"},
+	)
+
+	// with DetectRenames, the file should be renamed instead
+	sync(SyncOptions{Delete: true, DetectRenames: true},
+		SyncAction{Op: SyncRename, Path: "c", OldPath: "sub/b", Size: 200},
+		SyncAction{Op: SyncDelete, Path: "sub"},
+	)
+	sync(SyncOptions{Delete: true})
+	checkContents("c", dataB)
+	if _, err := fs.Stat("backup/sub"); !isNotExist(err) {
+		t.Fatal("expected sub to be deleted, got", err)
+	}
+
+	// a new file with the same size and mtime as a deleted file, but different
+	// contents, must not be treated as a rename
+	if err := os.Remove(filepath.Join(localDir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	dataD := frand.Bytes(200)
+	writeLocal("d", dataD, mtime)
+	sync(SyncOptions{Delete: true, DetectRenames: true},
+		SyncAction{Op: SyncUpload, Path: "d", Size: 200},
+		SyncAction{Op: SyncDelete, Path: "c", Size: 200},
+	)
+	checkContents("d", dataD)
+}
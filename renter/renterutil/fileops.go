@@ -2,8 +2,10 @@ package renterutil
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -12,16 +14,26 @@ import (
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
+// An openMetaFile is a metafile held in memory, along with its uncommitted
+// changes. All fields other than name and closed are guarded by mu; closed is
+// guarded by the PseudoFS's mu.
 type openMetaFile struct {
+	mu            sync.RWMutex
 	name          string
 	m             *renter.MetaFile
 	pendingWrites []pendingWrite
 	pendingChunks []pendingChunk
 	offset        int64
+	dirty         bool // m differs from the stored metafile
 	closed        bool
+
+	// contribution of pendingWrites to the PseudoFS's pending totals
+	pendingShardSize int64
+	pendingBytes     int64
 }
 
 type pendingWrite struct {
@@ -78,6 +90,12 @@ func (f *openMetaFile) filesize() int64 {
 	return size
 }
 
+// touch marks f as modified.
+func (f *openMetaFile) touch() {
+	f.m.ModTime = time.Now()
+	f.dirty = true
+}
+
 func (f *openMetaFile) calcShardSize(offset int64, n int64) int64 {
 	numSegments := n / f.m.MinChunkSize()
 	if offset%f.m.MinChunkSize() != 0 {
@@ -99,7 +117,9 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 	oldShards := f.m.Shards
 	newShards := make([][]renter.SectorSlice, len(oldShards))
 	for i := range newShards {
-		newShards[i] = oldShards[i][:0]
+		// newShards must not share memory with oldShards, since pending
+		// chunks may be inserted ahead of the old slices being consumed
+		newShards[i] = make([]renter.SectorSlice, 0, len(oldShards[i])+len(f.pendingChunks))
 	}
 	pending := f.pendingChunks
 	var offset int64
@@ -127,10 +147,9 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 					overlap -= int64(ss.NumSegments)
 				} else {
 					// trim the beginning of this chunk
-					delta := ss.NumSegments - uint32(overlap)
 					for i := range oldShards {
-						oldShards[i][0].SegmentIndex += delta
-						oldShards[i][0].NumSegments -= delta
+						oldShards[i][0].SegmentIndex += uint32(overlap)
+						oldShards[i][0].NumSegments -= uint32(overlap)
 					}
 					break
 				}
@@ -161,16 +180,34 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 	f.m.Filesize = f.filesize()
 }
 
-func (fs *PseudoFS) commitChanges(f *openMetaFile) error {
-	if !f.m.ModTime.After(fs.lastCommitTime) {
-		return nil
+// updatePendingSizes recomputes f's contribution to the filesystem's pending
+// totals. It must be called whenever f.pendingWrites changes. The caller must
+// hold f.mu and fs.pendingMu.
+func (fs *PseudoFS) updatePendingSizes(f *openMetaFile) {
+	var shardSize, n int64
+	for _, pw := range f.pendingWrites {
+		shardSize += f.calcShardSize(pw.offset, int64(len(pw.data)))
+		n += int64(len(pw.data))
 	}
-	return renter.WriteMetaFile(fs.path(f.name)+metafileExt, f.m)
+	for _, hostKey := range f.m.Hosts {
+		fs.pendingSizes[hostKey] += shardSize - f.pendingShardSize
+	}
+	fs.pendingBytes += n - f.pendingBytes
+	f.pendingShardSize, f.pendingBytes = shardSize, n
+}
+
+// flushUnlocked flushes the filesystem while f, which the caller must hold, is
+// unlocked, so that the flush can lock it. Other operations on f may occur
+// during the flush.
+func (fs *PseudoFS) flushUnlocked(ctx context.Context, f *openMetaFile) error {
+	f.mu.Unlock()
+	defer f.mu.Lock()
+	return fs.flushSectorsContext(ctx)
 }
 
 // fill shared sectors with encoded chunks from pending writes; creates
 // pendingChunks from pendingWrites
-func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
+func (fs *PseudoFS) fillSectors(ctx context.Context, f *openMetaFile) error {
 	f.pendingChunks = nil
 	if len(f.pendingWrites) == 0 {
 		return nil
@@ -199,7 +236,7 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 		// that segment
 		if align := pw.offset % f.m.MinChunkSize(); align != 0 {
 			chunk := make([]byte, f.m.MinChunkSize())
-			_, err := fs.fileReadAt(f, chunk, pw.offset-align)
+			_, err := fs.fileReadAt(ctx, f, chunk, pw.offset-align)
 			if err != nil && err != io.EOF {
 				return err
 			}
@@ -210,7 +247,7 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 		// that segment
 		if align := pw.end() % f.m.MinChunkSize(); align != 0 && pw.end() < f.m.Filesize {
 			chunk := make([]byte, f.m.MinChunkSize())
-			_, err := fs.fileReadAt(f, chunk, pw.end()-align)
+			_, err := fs.fileReadAt(ctx, f, chunk, pw.end()-align)
 			if err != nil && err != io.EOF {
 				return err
 			}
@@ -227,6 +264,12 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 			}
 			i++
 		}
+		// if possible, patch the existing sectors instead of appending
+		if ok, err := fs.updateInPlace(ctx, f, pw); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
 		// encode the chunk
 		for i, hostKey := range f.m.Hosts {
 			// map lookup guaranteed to succeed by earlier check
@@ -237,7 +280,7 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 		// append the shards to each sector
 		pc := pendingChunk{
 			offset: pw.offset / f.m.MinChunkSize(),
-			length: int64(len(shards[0])),
+			length: int64(len(shards[0])) / merkle.SegmentSize,
 		}
 		for shardIndex, hostKey := range f.m.Hosts {
 			pc.sliceIndex = fs.sectors[hostKey].Append(shards[shardIndex], f.m.MasterKey, renter.RandomNonce())
@@ -249,17 +292,244 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 	return nil
 }
 
+// ownedSectors returns the roots of the sectors that are fully covered by the
+// slices of shard. Since PseudoFS packs data from many files into each sector,
+// only these sectors can be modified or deleted without affecting other files.
+func ownedSectors(shard []renter.SectorSlice) map[crypto.Hash]bool {
+	segments := make(map[crypto.Hash]uint32)
+	for _, ss := range shard {
+		segments[ss.MerkleRoot] += ss.NumSegments
+	}
+	owned := make(map[crypto.Hash]bool)
+	for root, n := range segments {
+		if n == merkle.SegmentsPerSector {
+			owned[root] = true
+		}
+	}
+	return owned
+}
+
+// unshareSectors removes from roots any sector that is referenced by a
+// metafile other than f's, e.g. a clone of f created by (PseudoFS).Clone.
+// Sectors can only be shared if the filesystem has a SectorIndex, since Clone
+// requires one; without an index, roots is left unchanged.
+func (fs *PseudoFS) unshareSectors(f *openMetaFile, roots map[crypto.Hash]bool) error {
+	idx := fs.sectorIndex()
+	if len(roots) == 0 || idx == nil {
+		return nil
+	}
+	return idx.unshare(storeName(f.name), roots)
+}
+
+// updateInPlace attempts to write pw directly into the sectors that already
+// store the affected region of f, using the Update action of the Write RPC.
+// This is only possible when pw lies entirely within a single uploaded slice
+// whose sectors are owned by f. It reports whether the write was applied to
+// every host; if not, pw must be appended to new sectors as usual.
+//
+// Since an updated sector's old root no longer exists on its host, f's
+// metafile is written as soon as the updates complete, before anything else in
+// the flush can fail.
+func (fs *PseudoFS) updateInPlace(ctx context.Context, f *openMetaFile, pw pendingWrite) (bool, error) {
+	chunkSize := f.m.MinChunkSize()
+	if pw.offset%chunkSize != 0 || pw.end() > f.m.Filesize || len(f.m.Shards[0]) == 0 {
+		return false, nil
+	}
+	start := pw.offset / chunkSize
+	end := (pw.end() + chunkSize - 1) / chunkSize
+
+	// locate the slice containing the written segments
+	sliceIndex := -1
+	var sliceStart int64
+	for i, ss := range f.m.Shards[0] {
+		sliceEnd := sliceStart + int64(ss.NumSegments)
+		if start < sliceEnd {
+			if end <= sliceEnd {
+				sliceIndex = i
+			}
+			break
+		}
+		sliceStart = sliceEnd
+	}
+	if sliceIndex < 0 {
+		return false, nil
+	}
+	roots := make(map[crypto.Hash]bool)
+	for _, shard := range f.m.Shards {
+		if !ownedSectors(shard)[shard[sliceIndex].MerkleRoot] {
+			return false, nil
+		}
+		roots[shard[sliceIndex].MerkleRoot] = true
+	}
+	// sectors shared with a clone must not be modified
+	n := len(roots)
+	if err := fs.unshareSectors(f, roots); err != nil || len(roots) != n {
+		return false, nil
+	}
+
+	// encode the chunk; if it extends to the end of the file, pad it to a
+	// whole number of segments
+	data := pw.data
+	if rem := int64(len(data)) % chunkSize; rem != 0 {
+		data = append(data[:len(data):len(data)], make([]byte, chunkSize-rem)...)
+	}
+	shards := make([][]byte, len(f.m.Hosts))
+	for i := range shards {
+		shards[i] = make([]byte, 0, len(data)/f.m.MinShards)
+	}
+	f.m.ErasureCode().Encode(data, shards)
+
+	// encrypt each shard under a fresh nonce (reusing the slice's nonce would
+	// reuse its keystream) and upload it to its host in parallel
+	nonce := renter.RandomNonce()
+	relIndex, numSegments := uint32(start-sliceStart), uint32(end-start)
+	type result struct {
+		shardIndex int
+		oldRoot    crypto.Hash
+		newRoot    crypto.Hash
+		err        error
+	}
+	resChan := make(chan result)
+	for shardIndex, hostKey := range f.m.Hosts {
+		go func(shardIndex int, hostKey hostdb.HostPublicKey) {
+			ss := f.m.Shards[shardIndex][sliceIndex]
+			segmentIndex := ss.SegmentIndex + relIndex
+			f.m.MasterKey.XORKeyStream(shards[shardIndex], nonce[:], uint64(segmentIndex))
+			newRoot, err := fs.hosts.updateSector(ctx, hostKey, ss.MerkleRoot, segmentIndex*merkle.SegmentSize, shards[shardIndex])
+			resChan <- result{shardIndex, ss.MerkleRoot, newRoot, err}
+		}(shardIndex, hostKey)
+	}
+	results := make([]result, len(f.m.Hosts))
+	updated, anyUpdated := true, false
+	var desyncErr error
+	for range f.m.Hosts {
+		r := <-resChan
+		results[r.shardIndex] = r
+		updated = updated && r.err == nil
+		anyUpdated = anyUpdated || r.err == nil
+		if errors.Cause(r.err) == proto.ErrDesync {
+			desyncErr = &HostError{f.m.Hosts[r.shardIndex], r.err}
+		}
+	}
+
+	// split the slice in every shard, so that the shards remain aligned with
+	// each other; shards whose hosts were not updated keep their old data
+	for shardIndex, r := range results {
+		shard := f.m.Shards[shardIndex]
+		ss := shard[sliceIndex]
+		var split []renter.SectorSlice
+		if relIndex > 0 {
+			split = append(split, renter.SectorSlice{
+				MerkleRoot:   ss.MerkleRoot,
+				SegmentIndex: ss.SegmentIndex,
+				NumSegments:  relIndex,
+				Nonce:        ss.Nonce,
+			})
+		}
+		mid := ss
+		mid.SegmentIndex += relIndex
+		mid.NumSegments = numSegments
+		if r.err == nil {
+			mid.Nonce = nonce
+		}
+		split = append(split, mid)
+		if rem := ss.NumSegments - relIndex - numSegments; rem > 0 {
+			split = append(split, renter.SectorSlice{
+				MerkleRoot:   ss.MerkleRoot,
+				SegmentIndex: ss.SegmentIndex + relIndex + numSegments,
+				NumSegments:  rem,
+				Nonce:        ss.Nonce,
+			})
+		}
+		newShard := append(append(shard[:sliceIndex:sliceIndex], split...), shard[sliceIndex+1:]...)
+		if r.err == nil {
+			for i := range newShard {
+				if newShard[i].MerkleRoot == r.oldRoot {
+					newShard[i].MerkleRoot = r.newRoot
+				}
+			}
+		}
+		f.m.Shards[shardIndex] = newShard
+	}
+	if anyUpdated {
+		if err := fs.writeMetaFile(f.name, f.m); err != nil {
+			return false, err
+		}
+	}
+	// if we could not determine whether a host applied its update, the shard
+	// retains its old root, which may no longer exist; abort the flush rather
+	// than compounding the damage
+	if desyncErr != nil {
+		return false, desyncErr
+	}
+	return updated, nil
+}
+
 // flushSectors uploads any non-empty sectors to their respective hosts, and
-// updates any metafiles with pending changes.
+// updates any metafiles with pending changes. Only files with uncommitted
+// changes are locked during the flush; other files may be read and written
+// concurrently. The caller must not hold any locks.
 func (fs *PseudoFS) flushSectors() error {
+	return fs.flushSectorsContext(context.Background())
+}
+
+// flushSectorsContext is like flushSectors, but aborts any uploads if ctx is
+// cancelled. An aborted flush leaves all pending writes uncommitted, so that
+// they may be flushed again later.
+func (fs *PseudoFS) flushSectorsContext(ctx context.Context) error {
+	fs.flushMu.Lock()
+	defer fs.flushMu.Unlock()
+	start := time.Now()
+	var journalMark int64
+	if fs.journal != nil {
+		journalMark = fs.journal.size()
+	}
+
+	// lock each file with uncommitted changes. Any op journaled before
+	// journalMark belongs to one of these files.
+	fs.mu.RLock()
+	candidates := make([]*openMetaFile, 0, len(fs.files))
+	for _, f := range fs.files {
+		candidates = append(candidates, f)
+	}
+	fs.mu.RUnlock()
+	var dirty []*openMetaFile
+	for _, f := range candidates {
+		f.mu.Lock()
+		if f.dirty {
+			dirty = append(dirty, f)
+		} else {
+			f.mu.Unlock()
+		}
+	}
+	defer func() {
+		for _, f := range dirty {
+			f.mu.Unlock()
+		}
+	}()
+	// files removed from fs.files before we locked them must not be committed
+	fs.mu.RLock()
+	open := make(map[*openMetaFile]bool, len(fs.files))
+	for _, f := range fs.files {
+		open[f] = true
+	}
+	fs.mu.RUnlock()
+	for i := 0; i < len(dirty); i++ {
+		if f := dirty[i]; !open[f] {
+			f.mu.Unlock()
+			dirty = append(dirty[:i], dirty[i+1:]...)
+			i--
+		}
+	}
+
 	// reset sectors
 	for _, sb := range fs.sectors {
 		sb.Reset()
 	}
 
 	// construct sectors by concatenating uncommitted writes in all files
-	for _, f := range fs.files {
-		if err := fs.fillSectors(f); err != nil {
+	for _, f := range dirty {
+		if err := fs.fillSectors(ctx, f); err != nil {
 			return err
 		}
 	}
@@ -274,13 +544,16 @@ func (fs *PseudoFS) flushSectors() error {
 		numHosts++
 		go func(hostKey hostdb.HostPublicKey, sb *renter.SectorBuilder) {
 			sector := sb.Finish()
-			h, err := fs.hosts.acquire(hostKey)
+			h, err := fs.hosts.acquireContext(ctx, hostKey)
 			if err != nil {
 				errChan <- &HostError{hostKey, err}
 				return
 			}
-			root, err := h.Append(sector)
-			fs.hosts.release(hostKey)
+			root, err := h.AppendContext(ctx, sector)
+			if err == nil {
+				fs.hosts.recordAppend(h, root)
+			}
+			fs.hosts.release(h)
 			if err != nil {
 				errChan <- &HostError{hostKey, err}
 				return
@@ -296,26 +569,59 @@ func (fs *PseudoFS) flushSectors() error {
 		}
 	}
 	if len(errs) != 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		return errors.Wrap(errs, "could not upload to some hosts")
 	}
 
-	// update files
-	for fd, f := range fs.files {
+	// update files, writing all of their metafiles at once
+	committed := make(map[string]*renter.MetaFile, len(dirty))
+	for _, f := range dirty {
 		f.commitPendingSlices(fs.sectors)
-		if err := fs.commitChanges(f); err != nil {
-			return err
-		}
+		committed[f.name] = f.m
+	}
+	if err := fs.writeMetaFiles(committed); err != nil {
+		return err
+	}
+	for _, f := range dirty {
+		f.dirty = false
 		f.pendingWrites = f.pendingWrites[:0]
-		if f.closed {
+		fs.pendingMu.Lock()
+		fs.updatePendingSizes(f)
+		fs.pendingMu.Unlock()
+	}
+	flushed := make(map[*openMetaFile]bool, len(dirty))
+	for _, f := range dirty {
+		flushed[f] = true
+	}
+	fs.mu.Lock()
+	for fd, f := range fs.files {
+		if f.closed && flushed[f] && !f.dirty {
 			delete(fs.files, fd)
 		}
 	}
-	fs.lastCommitTime = time.Now()
+	fs.mu.Unlock()
+	fs.pendingMu.Lock()
+	if fs.pendingBytes == 0 {
+		fs.dirtySince = time.Time{}
+	} else {
+		// some files were written during the flush
+		fs.dirtySince = start
+	}
+	fs.pendingMu.Unlock()
+	// every change journaled before the flush began has now been committed
+	if fs.journal != nil {
+		return fs.journal.discard(journalMark)
+	}
 	return nil
 }
 
-func (fs *PseudoFS) fileRead(f *openMetaFile, p []byte) (int, error) {
-	if size := f.filesize(); f.offset >= size {
+func (fs *PseudoFS) fileRead(ctx context.Context, f *openMetaFile, p []byte) (int, error) {
+	// a cancelled read fails even if it would otherwise return io.EOF
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	} else if size := f.filesize(); f.offset >= size {
 		return 0, io.EOF
 	} else if int64(len(p)) > size-f.offset {
 		// partial read at EOF
@@ -325,7 +631,7 @@ func (fs *PseudoFS) fileRead(f *openMetaFile, p []byte) (int, error) {
 		p = p[:f.m.MaxChunkSize()]
 	}
 
-	_, err := fs.fileReadAt(f, p, f.offset)
+	_, err := fs.fileReadAt(ctx, f, p, f.offset)
 	if err != nil {
 		return 0, err
 	}
@@ -333,8 +639,8 @@ func (fs *PseudoFS) fileRead(f *openMetaFile, p []byte) (int, error) {
 	return len(p), err
 }
 
-func (fs *PseudoFS) fileWrite(f *openMetaFile, p []byte) (int, error) {
-	if _, err := fs.fileWriteAt(f, p, f.offset); err != nil {
+func (fs *PseudoFS) fileWrite(ctx context.Context, f *openMetaFile, p []byte) (int, error) {
+	if _, err := fs.fileWriteAt(ctx, f, p, f.offset); err != nil {
 		return 0, err
 	}
 	f.offset += int64(len(p))
@@ -358,10 +664,16 @@ func (fs *PseudoFS) fileSeek(f *openMetaFile, offset int64, whence int) (int64,
 	return f.offset, nil
 }
 
-func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error) {
+func (fs *PseudoFS) fileReadAt(ctx context.Context, f *openMetaFile, p []byte, off int64) (int, error) {
+	fs.mu.RLock()
+	extraHosts, overdriveTimeout := fs.overdrive, fs.overdriveTimeout
+	fs.mu.RUnlock()
+
 	lenp := len(p)
 	partial := false
-	if size := f.filesize(); off >= size {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	} else if size := f.filesize(); off >= size {
 		return 0, io.EOF
 	} else if off+int64(len(p)) > size {
 		p = p[:size-off]
@@ -406,71 +718,169 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 		shardIndex int
 		block      bool // wait to acquire
 	}
-	reqChan := make(chan req, f.m.MinShards)
-	respChan := make(chan *HostError, f.m.MinShards)
-	reqQueue := make([]req, len(f.m.Hosts))
-	// initialize queue in random order
-	for i, shardIndex := range frand.Perm(len(reqQueue)) {
-		reqQueue[i] = req{shardIndex, false}
+	type resp struct {
+		shardIndex int
+		shard      []byte
+		err        *HostError
 	}
-	for len(reqQueue) > len(f.m.Hosts)-f.m.MinShards {
-		go func() {
-			for req := range reqChan {
+	type download struct {
+		cancel func()
+		start  time.Time // zero until the host is acquired
+	}
+	// NOTE: respChan is buffered so that workers never block on a response
+	// that will not be received, e.g. after their download was cancelled
+	reqChan := make(chan req, len(f.m.Hosts))
+	respChan := make(chan resp, len(f.m.Hosts))
+	var inflightMu sync.Mutex
+	inflight := make(map[int]download)
+	var wg sync.WaitGroup
+	worker := func() {
+		defer wg.Done()
+		for req := range reqChan {
+			// each request gets its own context, so that it can be cancelled
+			// once enough shards have been downloaded
+			reqCtx, cancel := context.WithCancel(ctx)
+			inflightMu.Lock()
+			inflight[req.shardIndex] = download{cancel: cancel}
+			inflightMu.Unlock()
+			shard, err := func() ([]byte, error) {
+				defer func() {
+					inflightMu.Lock()
+					delete(inflight, req.shardIndex)
+					inflightMu.Unlock()
+					cancel()
+				}()
 				hostKey := f.m.Hosts[req.shardIndex]
-				s, err := fs.hosts.tryAcquire(hostKey)
+				s, err := fs.hosts.tryAcquireContext(reqCtx, hostKey)
 				if err == errHostAcquired && req.block {
-					s, err = fs.hosts.acquire(hostKey)
+					s, err = fs.hosts.acquireContext(reqCtx, hostKey)
 				}
 				if err != nil {
-					respChan <- &HostError{hostKey, err}
-					continue
+					return nil, err
 				}
-				buf := bytes.NewBuffer(shards[req.shardIndex])
+				defer fs.hosts.release(s)
+				inflightMu.Lock()
+				inflight[req.shardIndex] = download{cancel, time.Now()}
+				inflightMu.Unlock()
+				buf := bytes.NewBuffer(make([]byte, 0, length))
 				err = (&renter.ShardDownloader{
 					Downloader: s,
 					Key:        f.m.MasterKey,
 					Slices:     f.m.Shards[req.shardIndex],
-				}).CopySection(buf, offset, length)
-				fs.hosts.release(hostKey)
-				if err != nil {
-					respChan <- &HostError{hostKey, err}
-					continue
-				}
-				shards[req.shardIndex] = buf.Bytes()
-				respChan <- nil
+				}).CopySectionContext(reqCtx, buf, offset, length)
+				return buf.Bytes(), err
+			}()
+			if err != nil {
+				respChan <- resp{req.shardIndex, nil, &HostError{f.m.Hosts[req.shardIndex], err}}
+				continue
 			}
-		}()
-		reqChan <- reqQueue[0]
+			respChan <- resp{req.shardIndex, shard, nil}
+		}
+	}
+	spawnWorker := func() {
+		wg.Add(1)
+		go worker()
+	}
+	// deadlines of outstanding requests, after which we overdrive
+	deadlines := make(map[int]time.Time)
+	send := func(r req) {
+		if extraHosts > 0 {
+			deadlines[r.shardIndex] = time.Now().Add(fs.overdriveThreshold(f.m.Hosts[r.shardIndex], overdriveTimeout))
+		}
+		reqChan <- r
+	}
+	reqQueue := make([]req, len(f.m.Hosts))
+	// initialize queue in random order
+	for i, shardIndex := range frand.Perm(len(reqQueue)) {
+		reqQueue[i] = req{shardIndex, false}
+	}
+	for len(reqQueue) > len(f.m.Hosts)-f.m.MinShards {
+		spawnWorker()
+		send(reqQueue[0])
 		reqQueue = reqQueue[1:]
 	}
 
-	var goodShards int
+	var goodShards, extraShards int
 	var errs HostErrorSet
 	for goodShards < f.m.MinShards && goodShards+len(errs) < len(f.m.Hosts) {
-		err := <-respChan
-		if err == nil {
-			goodShards++
-		} else {
-			if err.Err == errHostAcquired {
+		var overdrive <-chan time.Time
+		if extraShards < extraHosts && len(reqQueue) > 0 && len(deadlines) > 0 {
+			var earliest time.Time
+			for _, d := range deadlines {
+				if earliest.IsZero() || d.Before(earliest) {
+					earliest = d
+				}
+			}
+			overdrive = time.After(time.Until(earliest))
+		}
+
+		select {
+		case r := <-respChan:
+			delete(deadlines, r.shardIndex)
+			if r.err == nil {
+				shards[r.shardIndex] = r.shard
+				goodShards++
+				continue
+			}
+			if r.err.Err == errHostAcquired {
 				// host could not be acquired without blocking; add it to the back
 				// of the queue, but next time, block
 				reqQueue = append(reqQueue, req{
-					shardIndex: f.m.HostIndex(err.HostKey),
+					shardIndex: r.shardIndex,
 					block:      true,
 				})
 			} else {
 				// downloading from this host failed; don't try it again
-				errs = append(errs, err)
+				errs = append(errs, r.err)
 			}
 			// try the next host in the queue
 			if len(reqQueue) > 0 {
-				reqChan <- reqQueue[0]
+				send(reqQueue[0])
 				reqQueue = reqQueue[1:]
 			}
+
+		case <-overdrive:
+			// at least one host is slow; download from an additional host
+			// without waiting for it
+			now := time.Now()
+			for shardIndex, d := range deadlines {
+				if !d.After(now) {
+					delete(deadlines, shardIndex)
+				}
+			}
+			extraShards++
+			spawnWorker()
+			send(reqQueue[0])
+			reqQueue = reqQueue[1:]
 		}
 	}
 	close(reqChan)
+
+	// cancel any downloads that are still in progress, and wait for their
+	// workers to release their sessions; cancelled sessions are closed, and
+	// will be reconnected to when they are next acquired
+	inflightMu.Lock()
+	for shardIndex, d := range inflight {
+		d.cancel()
+		if d.start.IsZero() {
+			continue
+		}
+		// the download took at least this long; record it so that we don't
+		// continue to overestimate the host's speed
+		fs.hosts.RecordRPCStats(proto.RPCStats{
+			Host:      f.m.Hosts[shardIndex],
+			RPC:       renterhost.RPCReadID,
+			Timestamp: d.start,
+			Elapsed:   time.Since(d.start),
+		})
+	}
+	inflightMu.Unlock()
+	wg.Wait()
+
 	if goodShards < f.m.MinShards {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		return 0, errors.Wrapf(errs, "too many hosts did not supply their shard (needed %v, got %v)",
 			f.m.MinShards, goodShards)
 	}
@@ -499,59 +909,86 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 	return lenp, nil
 }
 
-func (fs *PseudoFS) maxWriteSize(f *openMetaFile, off int64, n int64) int64 {
-	sectorSizes := make(map[hostdb.HostPublicKey]int64)
-	for _, of := range fs.files {
-		for _, pw := range of.pendingWrites {
-			shardSize := of.calcShardSize(pw.offset, int64(len(pw.data)))
-			for _, hostKey := range of.m.Hosts {
-				sectorSizes[hostKey] += shardSize
-			}
-		}
+// overdriveThreshold returns the amount of time that a download from the
+// specified host may take before another host is tried.
+func (fs *PseudoFS) overdriveThreshold(hostKey hostdb.HostPublicKey, timeout time.Duration) time.Duration {
+	if d, ok := fs.hosts.readLatency(hostKey); ok && 2*d < timeout {
+		return 2 * d
 	}
+	return timeout
+}
+
+// maxWriteSize returns the number of bytes of a write to f that can be added
+// without exceeding the capacity of the next flush. The caller must hold
+// fs.pendingMu.
+func (fs *PseudoFS) maxWriteSize(f *openMetaFile, off int64, n int64) int64 {
 	var maxRem int64
 	for _, hostKey := range f.m.Hosts {
-		if rem := renterhost.SectorSize - sectorSizes[hostKey]; rem > maxRem {
+		if rem := renterhost.SectorSize - fs.pendingSizes[hostKey]; rem > maxRem {
 			maxRem = rem
 		}
 	}
-	maxSegs := maxRem / f.m.MinChunkSize()
-	if maxSegs > 0 && off%f.m.MinChunkSize() != 0 {
-		maxSegs--
+	// each chunk of the file occupies one segment of each shard; an
+	// unaligned write may occupy an extra segment at either end
+	maxChunks := maxRem / merkle.SegmentSize
+	if off%f.m.MinChunkSize() != 0 {
+		maxChunks -= 2
 	}
-	if maxSegs > 0 && (off+maxRem)%f.m.MinChunkSize() != 0 {
-		maxSegs--
+	if maxChunks < 0 {
+		maxChunks = 0
 	}
-	if maxWrite := maxSegs * merkle.SegmentSize; n > maxWrite {
+	if maxWrite := maxChunks * f.m.MinChunkSize(); n > maxWrite {
 		n = maxWrite
 	}
 	return n
 }
 
-func (fs *PseudoFS) fileWriteAt(f *openMetaFile, p []byte, off int64) (int, error) {
+func (fs *PseudoFS) fileWriteAt(ctx context.Context, f *openMetaFile, p []byte, off int64) (int, error) {
 	lenp := len(p)
+	// journal the write only after it has been merged; if a flush occurs
+	// midway through, it will empty the journal
+	op := journalOp{typ: journalWrite, name: f.name, offset: off, data: p}
 	for len(p) > 0 {
-		if n := fs.maxWriteSize(f, off, int64(len(p))); n <= 0 {
-			if err := fs.flushSectors(); err != nil {
-				return 0, err
-			}
-		} else {
+		// the capacity check and the write must be atomic, since other files
+		// may be written concurrently
+		fs.pendingMu.Lock()
+		n := fs.maxWriteSize(f, off, int64(len(p)))
+		if n > 0 {
 			f.pendingWrites = mergePendingWrites(f.pendingWrites, pendingWrite{
 				data:   append([]byte(nil), p[:n]...),
 				offset: off,
 			})
-			p = p[n:]
-			off += n
+			fs.updatePendingSizes(f)
+			// mark f dirty immediately, so that a flush triggered later in
+			// this loop commits the merged data and frees up capacity
+			f.dirty = true
+		}
+		fs.pendingMu.Unlock()
+		if n <= 0 {
+			if err := fs.flushUnlocked(ctx, f); err != nil {
+				return 0, err
+			}
+			continue
 		}
+		p = p[n:]
+		off += n
+	}
+	f.touch()
+	if err := fs.journalOp(op); err != nil {
+		return 0, err
+	} else if err := fs.recordWrite(ctx, f); err != nil {
+		return 0, err
 	}
-	f.m.ModTime = time.Now()
 	return lenp, nil
 }
 
 func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 	if size > f.filesize() {
 		zeros := make([]byte, size-f.filesize())
-		_, err := fs.fileWriteAt(f, zeros, f.filesize())
+		_, err := fs.fileWriteAt(context.Background(), f, zeros, f.filesize())
+		return err
+	}
+	if err := fs.journalOp(journalOp{typ: journalTruncate, name: f.name, offset: size}); err != nil {
 		return err
 	}
 
@@ -566,6 +1003,9 @@ func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 		newPending = append(newPending, pw)
 	}
 	f.pendingWrites = newPending
+	fs.pendingMu.Lock()
+	fs.updatePendingSizes(f)
+	fs.pendingMu.Unlock()
 
 	if size < f.m.Filesize {
 		f.m.Filesize = size
@@ -591,37 +1031,53 @@ func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 		}
 	}
 
-	f.m.ModTime = time.Now()
-	return fs.flushSectors() // TODO: avoid this
+	f.touch()
+	return fs.flushUnlocked(context.Background(), f) // TODO: avoid this
 }
 
 func (fs *PseudoFS) fileFree(f *openMetaFile) error {
+	if err := fs.journalOp(journalOp{typ: journalTruncate, name: f.name, offset: 0}); err != nil {
+		return err
+	}
+
 	// discard pending writes
 	f.pendingWrites = f.pendingWrites[:0]
 	f.pendingChunks = f.pendingChunks[:0]
+	fs.pendingMu.Lock()
+	fs.updatePendingSizes(f)
+	fs.pendingMu.Unlock()
+
+	// determine which sectors can be deleted; sectors shared with a clone
+	// must be retained. If the filesystem has a SectorIndex, every reference
+	// to a sector is known, so partially-filled sectors can be deleted too.
+	indexed := fs.sectorIndex() != nil
+	owned := make(map[crypto.Hash]bool)
+	for _, shard := range f.m.Shards {
+		shardOwned := ownedSectors(shard)
+		for _, ss := range shard {
+			if indexed || shardOwned[ss.MerkleRoot] {
+				owned[ss.MerkleRoot] = true
+			}
+		}
+	}
+	if err := fs.unshareSectors(f, owned); err != nil {
+		return err
+	}
 
 	// delete from each host
 	//
 	// TODO: parallelize
 	for shardIndex, hostKey := range f.m.Hosts {
 		shard := f.m.Shards[shardIndex]
-		err := func() error {
-			h, err := fs.hosts.acquire(hostKey)
-			if err != nil {
-				return err
-			}
-			defer fs.hosts.release(hostKey)
-			var roots []crypto.Hash
-			for _, ss := range shard {
-				if ss.NumSegments == merkle.SegmentsPerSector {
-					roots = append(roots, ss.MerkleRoot)
-				}
-			}
-			if err := h.DeleteSectors(roots); err != nil {
-				return err
+		var roots []crypto.Hash
+		for _, ss := range shard {
+			if owned[ss.MerkleRoot] {
+				roots = append(roots, ss.MerkleRoot)
 			}
-			return nil
-		}()
+		}
+		err := fs.hosts.forEachContract(hostKey, func(h *proto.Session) error {
+			return h.DeleteSectors(roots)
+		})
 		if err != nil {
 			return err
 		}
@@ -631,13 +1087,13 @@ func (fs *PseudoFS) fileFree(f *openMetaFile) error {
 
 	f.m.Filesize = 0
 	f.offset = 0
-	f.m.ModTime = time.Now()
+	f.touch()
 	return nil
 }
 
-func (fs *PseudoFS) fileSync(f *openMetaFile) error {
-	if len(f.pendingWrites) > 0 {
-		return fs.flushSectors()
+func (fs *PseudoFS) fileSync(ctx context.Context, f *openMetaFile) error {
+	if f.dirty {
+		return fs.flushUnlocked(ctx, f)
 	}
 	return nil
 }
@@ -4,9 +4,11 @@ package renterutil // import "lukechampine.com/us/renter/renterutil"
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
-	"path/filepath"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,7 @@ import (
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 )
 
 // assume metafiles have this extension
@@ -37,21 +40,82 @@ func (i pseudoFileInfo) ModTime() time.Time { return i.m.ModTime }
 func (i pseudoFileInfo) IsDir() bool        { return false }
 func (i pseudoFileInfo) Sys() interface{}   { return i.m }
 
+// helper type to override the name reported by an os.FileInfo
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i namedFileInfo) Name() string { return i.name }
+
 // PseudoFS implements a filesystem by uploading and downloading data from Sia
 // hosts.
+//
+// PseudoFS is safe for concurrent use. Locks are acquired in the following
+// order: flushMu, then the mu of each openMetaFile, then mu, and finally
+// pendingMu. Only flushSectors holds more than one openMetaFile lock at a time.
 type PseudoFS struct {
-	root           string
-	curFD          int
-	files          map[int]*openMetaFile
-	dirs           map[int]*os.File
-	hosts          *HostSet
-	sectors        map[hostdb.HostPublicKey]*renter.SectorBuilder
-	lastCommitTime time.Time
-	mu             sync.RWMutex
+	store MetaStore
+	hosts *HostSet
+
+	// mu guards the file table and the filesystem settings
+	mu    sync.RWMutex
+	curFD int
+	files map[int]*openMetaFile
+	dirs  map[int]*openDir
+	index *SectorIndex
+
+	// flushMu guards the sector builders; it is held for the duration of each
+	// flush, and by operations that must not observe a partial flush
+	flushMu sync.Mutex
+	sectors map[hostdb.HostPublicKey]*renter.SectorBuilder
+
+	// pendingMu guards the totals of all uncommitted writes
+	pendingMu    sync.Mutex
+	pendingSizes map[hostdb.HostPublicKey]int64 // shard bytes per host
+	pendingBytes int64
+
+	// overdrive settings
+	overdrive        int
+	overdriveTimeout time.Duration
+
+	// optional; see NewJournaledFileSystem
+	journal *journal
+
+	// flush policy state; see SetFlushPolicy. dirtySince and lastWriteTime
+	// are guarded by pendingMu.
+	flushPolicy   FlushPolicy
+	dirtySince    time.Time
+	lastWriteTime time.Time
+	flushStop     chan struct{}
+	flushDone     chan struct{}
+}
+
+// lookupName returns the open file with the specified name, if any.
+func (fs *PseudoFS) lookupName(name string) (int, *openMetaFile) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for fd, f := range fs.files {
+		if f.name == name {
+			return fd, f
+		}
+	}
+	return 0, nil
 }
 
-func (fs *PseudoFS) path(name string) string {
-	return filepath.Join(fs.root, name)
+// isOpen reports whether f is still open as fd. Callers that look up a file
+// and then lock it must use isOpen to check that the file was not closed in
+// the meantime.
+func (fs *PseudoFS) isOpen(fd int, f *openMetaFile) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.files[fd] == f && !f.closed
+}
+
+// isDir reports whether the named file is a directory.
+func (fs *PseudoFS) isDir(name string) bool {
+	info, err := fs.store.Stat(storeName(name))
+	return err == nil && info.IsDir()
 }
 
 func isDir(path string) bool {
@@ -59,40 +123,108 @@ func isDir(path string) bool {
 	return err == nil && stat.IsDir()
 }
 
-func exists(path string) bool {
-	_, err := os.Stat(path)
-	return !os.IsNotExist(err)
-}
-
 // Chmod changes the mode of the named file to mode.
 func (fs *PseudoFS) Chmod(name string, mode os.FileMode) error {
-	path := fs.path(name)
-	if isDir(path) {
-		return os.Chmod(path, mode)
+	if fs.isDir(name) {
+		return fs.store.Chmod(storeName(name), mode)
 	}
-	path += metafileExt
 
 	// check for open file
-	for _, of := range fs.files {
-		if of.name == name {
-			of.m.Mode = mode
-			of.m.ModTime = time.Now()
-			return nil
-		}
+	if _, of := fs.lookupName(name); of != nil {
+		of.mu.Lock()
+		defer of.mu.Unlock()
+		of.m.Mode = mode
+		of.touch()
+		return fs.journalOp(journalOp{typ: journalChmod, name: name, mode: mode})
 	}
 
-	m, err := renter.ReadMetaFile(path)
+	m, err := fs.store.ReadMetaFile(storeName(name))
 	if err != nil {
-		return errors.Wrapf(err, "chmod %v", path)
+		return errors.Wrapf(err, "chmod %v", name)
 	}
 	m.Mode = mode
 	m.ModTime = time.Now()
-	if err := renter.WriteMetaFile(path, m); err != nil {
-		return errors.Wrapf(err, "chmod %v", path)
+	if err := fs.writeMetaFile(name, m); err != nil {
+		return errors.Wrapf(err, "chmod %v", name)
 	}
 	return nil
 }
 
+// Chtimes changes the modification time of the named file. Metafiles do not
+// record access times, so atime is ignored unless name is a directory.
+func (fs *PseudoFS) Chtimes(name string, atime, mtime time.Time) error {
+	if fs.isDir(name) {
+		return fs.store.Chtimes(storeName(name), atime, mtime)
+	}
+
+	// check for open file
+	if _, of := fs.lookupName(name); of != nil {
+		of.mu.Lock()
+		defer of.mu.Unlock()
+		of.m.ModTime = mtime
+		of.dirty = true
+		return fs.journalOp(journalOp{typ: journalChtimes, name: name, offset: mtime.UnixNano()})
+	}
+
+	m, err := fs.store.ReadMetaFile(storeName(name))
+	if err != nil {
+		return errors.Wrapf(err, "chtimes %v", name)
+	}
+	m.ModTime = mtime
+	if err := fs.writeMetaFile(name, m); err != nil {
+		return errors.Wrapf(err, "chtimes %v", name)
+	}
+	return nil
+}
+
+// Clone creates dst as a copy of src. The copy references the same sectors as
+// src, so no data is uploaded or downloaded. Subsequent writes to either file do
+// not affect the other: sectors referenced by more than one file are never
+// modified in place, and are not deleted by Free until the last reference is
+// gone. If dst already exists, Clone replaces it; dst must not be open.
+//
+// Clone requires a SectorIndex (see SetSectorIndex), which is used to track
+// the references to each sector. A filesystem containing clones must not be
+// used without its SectorIndex.
+func (fs *PseudoFS) Clone(src, dst string) error {
+	if fs.sectorIndex() == nil {
+		return errors.Errorf("clone %v: filesystem has no sector index", src)
+	}
+	// if there is an open file with src, we must sync its contents first
+	if err := fs.flushIfDirty(src); err != nil {
+		return err
+	}
+	if _, f := fs.lookupName(dst); f != nil {
+		return errors.Errorf("clone %v: destination file is open", dst)
+	}
+
+	if fs.isDir(src) {
+		return errors.Wrapf(ErrDirectory, "clone %v", src)
+	}
+	m, err := fs.store.ReadMetaFile(storeName(src))
+	if err != nil {
+		return errors.Wrapf(err, "clone %v", src)
+	}
+	m.ModTime = time.Now()
+	return errors.Wrapf(fs.writeMetaFile(dst, m), "clone %v", dst)
+}
+
+// flushIfDirty flushes the filesystem if the named file is open and has
+// uncommitted changes.
+func (fs *PseudoFS) flushIfDirty(name string) error {
+	_, f := fs.lookupName(name)
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	dirty := f.dirty
+	f.mu.RUnlock()
+	if !dirty {
+		return nil
+	}
+	return fs.flushSectors()
+}
+
 // Create creates the named file with the specified redundancy and mode 0666
 // (before umask), truncating it if it already exists. The returned file has
 // mode O_RDWR.
@@ -100,10 +232,28 @@ func (fs *PseudoFS) Create(name string, minShards int) (*PseudoFile, error) {
 	return fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666, minShards)
 }
 
+// createWithIndex is like Create, but uses the hosts, encryption key, and
+// redundancy of index instead of choosing new ones. Files created with the
+// same index can be joined without re-encoding their data.
+func (fs *PseudoFS) createWithIndex(name string, index renter.MetaIndex) (*PseudoFile, error) {
+	pf, err := fs.Create(name, index.MinShards)
+	if err != nil {
+		return nil, err
+	}
+	f, _ := pf.lookupFD()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.m
+	m.MasterKey = index.MasterKey
+	m.Hosts = append([]hostdb.HostPublicKey(nil), index.Hosts...)
+	m.Shards = make([][]renter.SectorSlice, len(m.Hosts))
+	return pf, nil
+}
+
 // Mkdir creates a new directory with the specified name and permission bits
 // (before umask).
 func (fs *PseudoFS) Mkdir(name string, perm os.FileMode) error {
-	return os.Mkdir(fs.path(name), perm)
+	return fs.store.Mkdir(storeName(name), perm)
 }
 
 // MkdirAll creates a directory named path, along with any necessary parents,
@@ -111,7 +261,7 @@ func (fs *PseudoFS) Mkdir(name string, perm os.FileMode) error {
 // umask) are used for all directories that MkdirAll creates. If path is already
 // a directory, MkdirAll does nothing and returns nil.
 func (fs *PseudoFS) MkdirAll(path string, perm os.FileMode) error {
-	return os.MkdirAll(fs.path(path), perm)
+	return fs.store.MkdirAll(storeName(path), perm)
 }
 
 // Open opens the named file for reading. The returned file is read-only.
@@ -123,16 +273,10 @@ func (fs *PseudoFS) Open(name string) (*PseudoFile, error) {
 // instead. It opens the named file with specified flag (os.O_RDONLY etc.) and perm
 // (before umask), if applicable.
 func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards int) (*PseudoFile, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	path := fs.path(name)
-	if isDir(path) {
-		dir, err := os.OpenFile(path, flag, perm)
-		if err != nil {
-			return nil, err
-		}
-		fs.dirs[fs.curFD] = dir
+	if fs.isDir(name) {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		fs.dirs[fs.curFD] = &openDir{name: name}
 		fs.curFD++
 		return &PseudoFile{
 			name: name,
@@ -140,61 +284,93 @@ func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards
 			fs:   fs,
 		}, nil
 	}
-	path += metafileExt
 
-	// first check open files
-	for fd, of := range fs.files {
-		if of.name == name {
-			// if reopening a file with write permissions, check that we have all hosts
-			if flag&rwmask == os.O_WRONLY || flag&rwmask == os.O_RDWR {
-				var missing []string
-				for _, hostKey := range of.m.Hosts {
-					if _, ok := fs.hosts.sessions[hostKey]; !ok {
-						missing = append(missing, hostKey.ShortKey())
-					}
-				}
-				if len(missing) > 0 {
-					return nil, errors.Errorf("insufficient contracts: need a contract from each of these hosts: %v",
-						strings.Join(missing, " "))
-				}
+	for {
+		// first check open files
+		if fd, of := fs.lookupName(name); of != nil {
+			pf, err := fs.reopenFile(fd, of, flag)
+			if err == errFileClosed {
+				continue // of was removed from the file table; try again
 			}
-			of.closed = false
-			of.offset = 0
-			if flag&os.O_APPEND == os.O_APPEND {
-				of.offset = of.filesize()
+			return pf, err
+		}
+		pf, err := fs.openMetaFile(name, flag, perm, minShards)
+		if err == errFileOpened {
+			continue // another call opened the file first; try again
+		}
+		return pf, err
+	}
+}
+
+var (
+	errFileClosed = errors.New("file was closed")
+	errFileOpened = errors.New("file was opened")
+)
+
+// reopenFile returns a new PseudoFile for an existing openMetaFile.
+func (fs *PseudoFS) reopenFile(fd int, of *openMetaFile, flag int) (*PseudoFile, error) {
+	of.mu.Lock()
+	defer of.mu.Unlock()
+	// if reopening a file with write permissions, check that we have all hosts
+	if flag&rwmask == os.O_WRONLY || flag&rwmask == os.O_RDWR {
+		var missing []string
+		for _, hostKey := range of.m.Hosts {
+			if _, ok := fs.hosts.sessions[hostKey]; !ok {
+				missing = append(missing, hostKey.ShortKey())
 			}
-			return &PseudoFile{
-				name:  name,
-				flags: flag,
-				fd:    fd,
-				fs:    fs,
-			}, nil
+		}
+		if len(missing) > 0 {
+			return nil, errors.Errorf("insufficient contracts: need a contract from each of these hosts: %v",
+				strings.Join(missing, " "))
+		}
+	}
+	fs.mu.Lock()
+	if fs.files[fd] != of {
+		fs.mu.Unlock()
+		return nil, errFileClosed
+	}
+	of.closed = false
+	fs.mu.Unlock()
+	of.offset = 0
+	if flag&os.O_APPEND == os.O_APPEND {
+		of.offset = of.filesize()
+	}
+	return &PseudoFile{
+		name:  of.name,
+		flags: flag,
+		fd:    fd,
+		fs:    fs,
+	}, nil
+}
+
+// openMetaFile creates or opens a metafile in the store and adds it to the
+// file table.
+func (fs *PseudoFS) openMetaFile(name string, flag int, perm os.FileMode, minShards int) (*PseudoFile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, of := range fs.files {
+		if of.name == name {
+			return nil, errFileOpened
 		}
 	}
 
-	// no open file; create/open a metafile on disk
 	var m *renter.MetaFile
 	if flag&os.O_CREATE == os.O_CREATE {
 		if len(fs.hosts.sessions) < minShards {
 			return nil, errors.New("minShards cannot be greater than the number of hosts")
 		}
-		if flag&os.O_TRUNC == os.O_TRUNC {
-			// remove existing file
-			for fd, f := range fs.files {
-				if f.name == name && f.closed {
-					delete(fs.files, fd)
-					break
-				}
-			}
-		}
 		hosts := make([]hostdb.HostPublicKey, 0, len(fs.hosts.sessions))
 		for hostKey := range fs.hosts.sessions {
 			hosts = append(hosts, hostKey)
 		}
 		m = renter.NewMetaFile(perm, 0, hosts, minShards)
+		err := fs.journalOp(journalOp{typ: journalCreate, name: name, mode: perm, minShards: minShards})
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		var err error
-		m, err = renter.ReadMetaFile(path)
+		m, err = fs.store.ReadMetaFile(storeName(name))
 		if err != nil {
 			return nil, errors.Wrapf(err, "open %v", name)
 		}
@@ -220,8 +396,9 @@ func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards
 		}
 	}
 	of := &openMetaFile{
-		name: name,
-		m:    m,
+		name:  name,
+		m:     m,
+		dirty: flag&os.O_CREATE == os.O_CREATE,
 	}
 	if flag&os.O_APPEND == os.O_APPEND {
 		of.offset = m.Filesize
@@ -239,26 +416,23 @@ func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards
 // Remove removes the named file or (empty) directory. It does NOT delete the
 // file data on the host; use (PseudoFS).GC and (PseudoFile).Free for that.
 func (fs *PseudoFS) Remove(name string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
 	// remove the file from fs.files if it is closed
-	for fd, f := range fs.files {
-		if f.name == name && f.closed {
-			delete(fs.files, fd)
-			break
+	if fd, f := fs.lookupName(name); f != nil {
+		if err := fs.dropClosed(fd, f); err != nil {
+			return err
 		}
 	}
-	// delete the directory or metafile on disk
-	path := fs.path(name)
-	if !isDir(path) {
-		path += metafileExt
-	}
-	// if none of the file's data has been flushed to hosts, there won't be a
-	// metafile to remove yet
-	if !exists(path) {
+	// delete the directory or metafile from the store. If none of the file's
+	// data has been flushed to hosts, there won't be a metafile to remove yet.
+	if err := fs.store.Remove(storeName(name)); isNotExist(err) {
 		return nil
+	} else if err != nil {
+		return err
 	}
-	return os.Remove(path)
+	if idx := fs.sectorIndex(); idx != nil {
+		return idx.removeFiles(storeName(name))
+	}
+	return nil
 }
 
 // RemoveAll removes path and any children it contains. It removes everything it
@@ -266,17 +440,48 @@ func (fs *PseudoFS) Remove(name string) error {
 // RemoveAll returns nil (no error).
 func (fs *PseudoFS) RemoveAll(path string) error {
 	// if the remove affects closed files in fs.files, delete them
+	fs.mu.RLock()
+	affected := make(map[int]*openMetaFile)
 	for fd, f := range fs.files {
-		if strings.HasPrefix(f.name, path) && f.closed {
-			delete(fs.files, fd)
+		if strings.HasPrefix(f.name, path) {
+			affected[fd] = f
 		}
 	}
-	// delete the directories and metafiles on disk
-	path = fs.path(path)
-	if !isDir(path) {
-		path += metafileExt
+	fs.mu.RUnlock()
+	for fd, f := range affected {
+		if err := fs.dropClosed(fd, f); err != nil {
+			return err
+		}
 	}
-	return os.RemoveAll(path)
+	// delete the directories and metafiles from the store
+	if err := fs.store.RemoveAll(storeName(path)); err != nil {
+		return err
+	}
+	if idx := fs.sectorIndex(); idx != nil {
+		return idx.removeFiles(storeName(path))
+	}
+	return nil
+}
+
+// dropClosed deletes f from the file table if it has been closed, discarding
+// any uncommitted writes.
+func (fs *PseudoFS) dropClosed(fd int, f *openMetaFile) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fs.mu.Lock()
+	if fs.files[fd] != f || !f.closed {
+		fs.mu.Unlock()
+		return nil
+	}
+	delete(fs.files, fd)
+	fs.mu.Unlock()
+	// f is no longer reachable, so its writes are no longer pending
+	f.pendingWrites = nil
+	f.dirty = false
+	fs.pendingMu.Lock()
+	fs.updatePendingSizes(f)
+	fs.pendingMu.Unlock()
+	return fs.journalOp(journalOp{typ: journalRemove, name: f.name})
 }
 
 // GC deletes unused data from the filesystem's host set. Any data not
@@ -292,9 +497,17 @@ func (fs *PseudoFS) RemoveAll(path string) error {
 // examine the full filesystem. Free should be called frequently as a "first
 // line of defense," while GC should be called infrequently to remove any
 // sectors missed by Free.
+//
+// If the filesystem has a SectorIndex, GC instead deletes only the sectors that
+// the index has recorded as unreferenced since the last GC. This is much
+// faster, but will not delete sectors that were orphaned by other means, e.g.
+// an interrupted flush.
 func (fs *PseudoFS) GC() error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	fs.flushMu.Lock()
+	defer fs.flushMu.Unlock()
+	if idx := fs.sectorIndex(); idx != nil {
+		return fs.gcIndexed(idx)
+	}
 
 	// Strategy: build a set of all sector roots stored on hosts. Iterate
 	// through all files in the fs, deleting their sector roots from the set.
@@ -303,49 +516,20 @@ func (fs *PseudoFS) GC() error {
 	// gather the sector roots from each host
 	hostRoots := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
 	for hostKey := range fs.hosts.sessions {
-		err := func() error {
-			h, err := fs.hosts.acquire(hostKey)
-			if err != nil {
-				return err
-			}
-			defer fs.hosts.release(hostKey)
-
-			numRoots := h.Revision().NumSectors()
-			rootMap := make(map[crypto.Hash]struct{}, numRoots)
-			for offset := 0; offset < numRoots; {
-				n := 130000 // a little less than 4MiB of roots
-				if offset+n > numRoots {
-					n = numRoots - offset
-				}
-				roots, err := h.SectorRoots(offset, n)
-				if err != nil {
-					return err
-				}
-				for _, r := range roots {
-					rootMap[r] = struct{}{}
-				}
-				offset += n
-			}
-			hostRoots[hostKey] = rootMap
-			return nil
-		}()
+		rootMap, err := fs.hostSectorRoots(hostKey)
 		if err != nil {
 			return err
 		}
+		hostRoots[hostKey] = rootMap
 	}
 
 	// iterate through all files, deleting their sector roots from the set
 	//
-	// NOTE: we only iterate over the metafiles on disk, not the files
+	// NOTE: we only iterate over the metafiles in the store, not the files
 	// in-memory. We don't need to worry about the latter, because their sectors
 	// have not been flushed to hosts yet.
-	err := filepath.Walk(fs.root, func(path string, info os.FileInfo, err error) error {
-		if (info != nil && info.IsDir()) || !strings.HasSuffix(path, ".usa") {
-			return nil
-		} else if err != nil {
-			return err
-		}
-		m, err := renter.ReadMetaFile(path)
+	err := fs.store.Walk(".", func(name string, _ os.FileInfo) error {
+		m, err := fs.store.ReadMetaFile(name)
 		if err != nil {
 			// don't continue if a file couldn't be read; the user needs to be
 			// confident that all files were checked
@@ -373,20 +557,16 @@ func (fs *PseudoFS) GC() error {
 		return nil
 	}
 
-	// delete the remaining sectors
+	// delete the remaining sectors; DeleteSectors ignores roots that are not
+	// stored under the contract, so each contract can be given the full set
 	for hostKey, rootsMap := range hostRoots {
-		err := func() error {
-			h, err := fs.hosts.acquire(hostKey)
-			if err != nil {
-				return err
-			}
-			defer fs.hosts.release(hostKey)
-			roots := make([]crypto.Hash, 0, len(rootsMap))
-			for root := range rootsMap {
-				roots = append(roots, root)
-			}
+		roots := make([]crypto.Hash, 0, len(rootsMap))
+		for root := range rootsMap {
+			roots = append(roots, root)
+		}
+		err := fs.hosts.forEachContract(hostKey, func(h *proto.Session) error {
 			return h.DeleteSectors(roots)
-		}()
+		})
 		if err != nil {
 			return err
 		}
@@ -394,74 +574,110 @@ func (fs *PseudoFS) GC() error {
 	return nil
 }
 
+// hostSectorRoots returns the set of sector roots stored under the contracts
+// with the specified host.
+func (fs *PseudoFS) hostSectorRoots(hostKey hostdb.HostPublicKey) (map[crypto.Hash]struct{}, error) {
+	rootMap := make(map[crypto.Hash]struct{})
+	err := fs.hosts.forEachContract(hostKey, func(h *proto.Session) error {
+		numRoots := h.Revision().NumSectors()
+		for offset := 0; offset < numRoots; {
+			n := 130000 // a little less than 4MiB of roots
+			if offset+n > numRoots {
+				n = numRoots - offset
+			}
+			roots, err := h.SectorRoots(offset, n)
+			if err != nil {
+				return err
+			}
+			for _, r := range roots {
+				rootMap[r] = struct{}{}
+			}
+			offset += n
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rootMap, nil
+}
+
 // Rename renames (moves) oldpath to newpath. If newpath already exists and is
 // not a directory, Rename replaces it. OS-specific restrictions may apply when
 // oldpath and newpath are in different directories.
 func (fs *PseudoFS) Rename(oldname, newname string) error {
 	// if there is an open file with oldname, we must sync its contents first
-	fs.mu.Lock()
-	for _, f := range fs.files {
-		if f.name == oldname && len(f.pendingWrites) > 0 {
-			if err := fs.flushSectors(); err != nil {
-				return err
-			}
-			break
-		}
+	if err := fs.flushIfDirty(oldname); err != nil {
+		return err
 	}
-	fs.mu.Unlock()
 
 	// TODO: how does this interact with open files?
-	oldpath, newpath := fs.path(oldname), fs.path(newname)
-	if !isDir(oldpath) {
-		oldpath += metafileExt
+	if err := fs.store.Rename(storeName(oldname), storeName(newname)); err != nil {
+		return err
 	}
-	if !isDir(newpath) {
-		newpath += metafileExt
+	if idx := fs.sectorIndex(); idx != nil {
+		return idx.renameFiles(storeName(oldname), storeName(newname))
 	}
-	return os.Rename(oldpath, newpath)
+	return nil
 }
 
 // Stat returns the FileInfo structure describing file.
 func (fs *PseudoFS) Stat(name string) (os.FileInfo, error) {
-	fs.mu.RLock()
-	for _, f := range fs.files {
-		if f.name == name {
-			info := pseudoFileInfo{name: f.name, m: f.m.MetaIndex}
-			info.m.Filesize = f.filesize()
-			fs.mu.RUnlock()
-			return info, nil
-		}
+	if _, f := fs.lookupName(name); f != nil {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		info := pseudoFileInfo{name: f.name, m: f.m.MetaIndex}
+		info.m.Filesize = f.filesize()
+		return info, nil
 	}
-	fs.mu.RUnlock()
 
-	path := fs.path(name)
-	if isDir(path) {
-		return os.Stat(path)
-	}
-	path += metafileExt
-	index, err := renter.ReadMetaIndex(path)
+	info, err := fs.store.Stat(storeName(name))
 	if err != nil {
 		return nil, errors.Wrapf(err, "stat %v", name)
+	} else if info.IsDir() {
+		return info, nil
 	}
-	return pseudoFileInfo{name, index}, nil
+	return pseudoFileInfo{name, info.Sys().(renter.MetaIndex)}, nil
+}
+
+// SetOverdrive configures the filesystem to download from up to extra
+// additional hosts when reading. Normally, a read downloads shards from exactly
+// MinShards hosts, only trying other hosts if one of them fails. With overdrive
+// enabled, if a host takes more than twice its typical Read latency to supply
+// its shard (or more than timeout, if its latency is unknown or greater than
+// timeout), a download from another host is started. Once MinShards shards
+// have been downloaded, any remaining downloads are cancelled by closing their
+// host sessions.
+//
+// By default, overdrive is disabled.
+func (fs *PseudoFS) SetOverdrive(extra int, timeout time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.overdrive = extra
+	fs.overdriveTimeout = timeout
 }
 
 // Close closes the filesystem by flushing any uncommitted writes, closing any
 // open files, and terminating all active host sessions.
 func (fs *PseudoFS) Close() error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	fs.stopFlushLoop()
+	// flushSectors commits every file with uncommitted changes
 	if err := fs.flushSectors(); err != nil {
 		return err
 	}
-	for fd, f := range fs.files {
-		if err := fs.commitChanges(f); err != nil {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for fd := range fs.files {
+		delete(fs.files, fd)
+	}
+	if fs.journal != nil {
+		if err := fs.journal.reset(); err != nil {
+			return err
+		} else if err := fs.journal.Close(); err != nil {
 			return err
 		}
-		delete(fs.files, fd)
 	}
-	for fd, d := range fs.dirs {
-		d.Close()
+	for fd := range fs.dirs {
 		delete(fs.dirs, fd)
 	}
 	return fs.hosts.Close()
@@ -470,20 +686,75 @@ func (fs *PseudoFS) Close() error {
 // NewFileSystem returns a new pseudo-filesystem rooted at root, which must be a
 // directory containing only metafiles and other directories.
 func NewFileSystem(root string, hosts *HostSet) *PseudoFS {
+	return NewFileSystemWithStore(NewDirStore(root), hosts)
+}
+
+// NewFileSystemWithStore returns a new pseudo-filesystem whose metadata is
+// stored in store. The caller is responsible for closing store (if necessary)
+// after the filesystem is closed.
+func NewFileSystemWithStore(store MetaStore, hosts *HostSet) *PseudoFS {
 	sectors := make(map[hostdb.HostPublicKey]*renter.SectorBuilder)
 	for hostKey := range hosts.sessions {
 		sectors[hostKey] = new(renter.SectorBuilder)
 	}
 	return &PseudoFS{
-		root:           root,
-		files:          make(map[int]*openMetaFile),
-		dirs:           make(map[int]*os.File),
-		hosts:          hosts,
-		sectors:        sectors,
-		lastCommitTime: time.Now(),
+		store:        store,
+		files:        make(map[int]*openMetaFile),
+		dirs:         make(map[int]*openDir),
+		hosts:        hosts,
+		sectors:      sectors,
+		pendingSizes: make(map[hostdb.HostPublicKey]int64),
+
+		overdriveTimeout: 10 * time.Second,
 	}
 }
 
+// An openDir is a directory opened by OpenFile.
+type openDir struct {
+	name string
+
+	// entries not yet returned by Readdir; populated by the first call
+	mu      sync.Mutex
+	read    bool
+	entries []os.FileInfo
+}
+
+// readDir returns the contents of the named directory, including any open
+// files that have not yet been written to the store.
+func (fs *PseudoFS) readDir(name string) ([]os.FileInfo, error) {
+	dir := storeName(name)
+	files, err := fs.store.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.RLock()
+	open := make([]*openMetaFile, 0, len(fs.files))
+	for _, f := range fs.files {
+		open = append(open, f)
+	}
+	fs.mu.RUnlock()
+outer:
+	for _, f := range open {
+		if path.Dir(storeName(f.name)) == dir {
+			f.mu.RLock()
+			info := pseudoFileInfo{name: path.Base(storeName(f.name)), m: f.m.MetaIndex}
+			info.m.Filesize = f.filesize()
+			f.mu.RUnlock()
+			for i := range files {
+				if files[i].Name() == info.Name() {
+					files[i] = info
+					continue outer
+				}
+			}
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
+}
+
 // A PseudoFile presents a file-like interface for a metafile stored on Sia
 // hosts.
 type PseudoFile struct {
@@ -520,7 +791,9 @@ func (pf PseudoFile) appendOnly() bool {
 	return pf.flags&os.O_APPEND == os.O_APPEND
 }
 
-func (pf PseudoFile) lookupFD() (file *openMetaFile, dir *os.File) {
+func (pf PseudoFile) lookupFD() (file *openMetaFile, dir *openDir) {
+	pf.fs.mu.RLock()
+	defer pf.fs.mu.RUnlock()
 	file = pf.fs.files[pf.fd]
 	if file != nil && file.closed {
 		file = nil
@@ -530,18 +803,27 @@ func (pf PseudoFile) lookupFD() (file *openMetaFile, dir *os.File) {
 
 // Close implements io.Closer.
 func (pf PseudoFile) Close() error {
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return ErrInvalidFileDescriptor
 	} else if d != nil {
+		pf.fs.mu.Lock()
 		delete(pf.fs.dirs, pf.fd)
-		return d.Close()
+		pf.fs.mu.Unlock()
+		return nil
 	}
-	// f is only truly deleted if it has no pending writes; otherwise, it sticks
-	// around until the next flush
-	if len(f.pendingWrites) == 0 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pf.fs.mu.Lock()
+	defer pf.fs.mu.Unlock()
+	if pf.fs.files[pf.fd] != f || f.closed {
+		return ErrInvalidFileDescriptor
+	}
+	// f is only truly deleted if it has no uncommitted changes; otherwise, it
+	// sticks around until the next flush
+	if f.dirty {
+		f.closed = true
+	} else {
 		delete(pf.fs.files, pf.fd)
 	}
 	return nil
@@ -549,51 +831,78 @@ func (pf PseudoFile) Close() error {
 
 // Read implements io.Reader.
 func (pf PseudoFile) Read(p []byte) (int, error) {
+	return pf.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but aborts any downloads if ctx is cancelled,
+// returning ctx.Err().
+func (pf PseudoFile) ReadContext(ctx context.Context, p []byte) (int, error) {
 	if !pf.readable() {
 		return 0, ErrNotReadable
 	}
-	// we need a write lock here because Read modifies the seek offset
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return 0, ErrInvalidFileDescriptor
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
-	return pf.fs.fileRead(f, p)
+	// we need a write lock here because Read modifies the seek offset
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return 0, ErrInvalidFileDescriptor
+	}
+	return pf.fs.fileRead(ctx, f, p)
 }
 
 // Write implements io.Writer.
 func (pf PseudoFile) Write(p []byte) (int, error) {
+	return pf.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but aborts any uploads triggered by the write if
+// ctx is cancelled, returning ctx.Err().
+func (pf PseudoFile) WriteContext(ctx context.Context, p []byte) (int, error) {
 	if !pf.writeable() {
 		return 0, ErrNotWriteable
 	}
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return 0, ErrInvalidFileDescriptor
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
-	return pf.fs.fileWrite(f, p)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return 0, ErrInvalidFileDescriptor
+	}
+	return pf.fs.fileWrite(ctx, f, p)
 }
 
 // ReadAt implements io.ReaderAt.
 func (pf PseudoFile) ReadAt(p []byte, off int64) (int, error) {
+	return pf.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is like ReadAt, but aborts any downloads if ctx is cancelled,
+// returning ctx.Err().
+func (pf PseudoFile) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
 	if !pf.readable() {
 		return 0, ErrNotReadable
 	}
-	pf.fs.mu.RLock()
-	defer pf.fs.mu.RUnlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return 0, ErrInvalidFileDescriptor
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
-	return pf.fs.fileReadAt(f, p, off)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return 0, ErrInvalidFileDescriptor
+	}
+	return pf.fs.fileReadAt(ctx, f, p, off)
 }
 
 // ReadAtP is a helper method that makes multiple concurrent ReadAt calls, with
@@ -608,18 +917,21 @@ func (pf PseudoFile) ReadAtP(p []byte, off int64) (int, error) {
 	if !pf.readable() {
 		return 0, ErrNotReadable
 	}
-	pf.fs.mu.RLock()
-	defer pf.fs.mu.RUnlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return 0, ErrInvalidFileDescriptor
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return 0, ErrInvalidFileDescriptor
+	}
 
 	splitSize := len(p) / (len(f.m.Hosts) / f.m.MinShards)
 	if splitSize == 0 {
-		return pf.fs.fileReadAt(f, p, off)
+		return pf.fs.fileReadAt(context.Background(), f, p, off)
 	}
 
 	type readResult struct {
@@ -633,7 +945,7 @@ func (pf PseudoFile) ReadAtP(p []byte, off int64) (int, error) {
 		suboff := off + int64(len(p)-buf.Len())
 		subp := buf.Next(splitSize)
 		go func() {
-			n, err := pf.fs.fileReadAt(f, subp, suboff)
+			n, err := pf.fs.fileReadAt(context.Background(), f, subp, suboff)
 			resChan <- readResult{n, err}
 		}()
 	}
@@ -651,21 +963,30 @@ func (pf PseudoFile) ReadAtP(p []byte, off int64) (int, error) {
 
 // WriteAt implements io.WriterAt.
 func (pf PseudoFile) WriteAt(p []byte, off int64) (int, error) {
+	return pf.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext is like WriteAt, but aborts any uploads triggered by the write
+// if ctx is cancelled, returning ctx.Err().
+func (pf PseudoFile) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
 	if !pf.writeable() {
 		return 0, ErrNotWriteable
 	}
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return 0, ErrInvalidFileDescriptor
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return 0, ErrInvalidFileDescriptor
+	}
 	if pf.appendOnly() && off != f.filesize() {
 		return 0, ErrAppendOnly
 	}
-	return pf.fs.fileWriteAt(f, p, off)
+	return pf.fs.fileWriteAt(ctx, f, p, off)
 }
 
 // Seek implements io.Seeker.
@@ -673,14 +994,17 @@ func (pf PseudoFile) Seek(offset int64, whence int) (int64, error) {
 	if pf.appendOnly() {
 		return 0, ErrAppendOnly
 	}
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return 0, ErrInvalidFileDescriptor
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return 0, ErrInvalidFileDescriptor
+	}
 	return pf.fs.fileSeek(f, offset, whence)
 }
 
@@ -701,43 +1025,34 @@ func (pf PseudoFile) Name() string { return pf.name }
 // before the end of the directory, Readdir returns the FileInfo read until that
 // point and a non-nil error.
 func (pf PseudoFile) Readdir(n int) ([]os.FileInfo, error) {
-	pf.fs.mu.RLock()
-	defer pf.fs.mu.RUnlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return nil, ErrInvalidFileDescriptor
 	} else if d == nil {
 		return nil, ErrNotDirectory
 	}
-	files, err := d.Readdir(n)
-	for i := range files {
-		if files[i].IsDir() {
-			continue
-		}
-		index, err := renter.ReadMetaIndex(filepath.Join(d.Name(), files[i].Name()))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.read {
+		entries, err := pf.fs.readDir(d.name)
 		if err != nil {
 			return nil, err
 		}
-		files[i] = pseudoFileInfo{
-			m:    index,
-			name: strings.TrimSuffix(files[i].Name(), metafileExt),
-		}
+		d.entries = entries
+		d.read = true
 	}
-outer:
-	for _, f := range pf.fs.files {
-		if filepath.Dir(filepath.Join(pf.fs.root, f.name)) == d.Name() {
-			info := pseudoFileInfo{name: filepath.Base(f.name), m: f.m.MetaIndex}
-			info.m.Filesize = f.filesize()
-			for i := range files {
-				if files[i].Name() == info.Name() {
-					files[i] = info
-					continue outer
-				}
-			}
-			files = append(files, info)
-		}
+	if n <= 0 {
+		files := d.entries
+		d.entries = nil
+		return files, nil
+	} else if len(d.entries) == 0 {
+		return nil, io.EOF
+	} else if n > len(d.entries) {
+		n = len(d.entries)
 	}
-	return files, err
+	files := d.entries[:n]
+	d.entries = d.entries[n:]
+	return files, nil
 }
 
 // Readdirnames reads and returns a slice of names from the directory pf.
@@ -752,36 +1067,27 @@ outer:
 // error before the end of the directory, Readdirnames returns the names read
 // until that point and a non-nil error.
 func (pf PseudoFile) Readdirnames(n int) ([]string, error) {
-	pf.fs.mu.RLock()
-	defer pf.fs.mu.RUnlock()
-	f, d := pf.lookupFD()
-	if f == nil && d == nil {
-		return nil, ErrInvalidFileDescriptor
-	} else if d == nil {
-		return nil, ErrNotDirectory
-	}
-	dirnames, err := d.Readdirnames(n)
-	if err != nil {
-		return nil, err
-	}
-	for _, f := range pf.fs.files {
-		if filepath.Dir(filepath.Join(pf.fs.root, f.name)) == d.Name() {
-			dirnames = append(dirnames, filepath.Base(f.name))
-		}
+	files, err := pf.Readdir(n)
+	dirnames := make([]string, len(files))
+	for i := range files {
+		dirnames[i] = files[i].Name()
 	}
-	return dirnames, nil
+	return dirnames, err
 }
 
 // Stat returns the FileInfo structure describing the file. If the file is a
 // metafile, its renter.MetaIndex will be available via the Sys method.
 func (pf PseudoFile) Stat() (os.FileInfo, error) {
-	pf.fs.mu.RLock()
-	defer pf.fs.mu.RUnlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return nil, ErrInvalidFileDescriptor
 	} else if d != nil {
-		return d.Stat()
+		return pf.fs.store.Stat(storeName(d.name))
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return nil, ErrInvalidFileDescriptor
 	}
 	return pf.fs.fileStat(f)
 }
@@ -792,18 +1098,28 @@ func (pf PseudoFile) Stat() (os.FileInfo, error) {
 // files to be synced as well. Sync typically results in a full sector of data
 // being uploaded to each host.
 func (pf PseudoFile) Sync() error {
+	return pf.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync, but aborts the upload if ctx is cancelled,
+// returning ctx.Err(). The file's uncommitted changes are retained, and will be
+// uploaded by a subsequent Sync.
+func (pf PseudoFile) SyncContext(ctx context.Context) error {
 	if !pf.writeable() {
 		return nil
 	}
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return ErrInvalidFileDescriptor
 	} else if d != nil {
-		return d.Sync()
+		return nil
 	}
-	return pf.fs.fileSync(f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return ErrInvalidFileDescriptor
+	}
+	return pf.fs.fileSync(ctx, f)
 }
 
 // Truncate changes the size of the file. It does not change the I/O offset. The
@@ -812,23 +1128,29 @@ func (pf PseudoFile) Truncate(size int64) error {
 	if !pf.writeable() {
 		return ErrNotWriteable
 	}
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return ErrInvalidFileDescriptor
 	} else if d != nil {
 		return ErrDirectory
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return ErrInvalidFileDescriptor
+	}
 	return pf.fs.fileTruncate(f, size)
 }
 
 // Free truncates the file to 0 bytes and deletes file data from the
 // filesystem's host set. Free only deletes sectors that it can prove are
 // exclusively storing the file's data. If multiple files were packed into the
-// same sector, Free will not delete that sector. Similarly, Free cannot safely
-// delete "trailing" sectors at the end of a file. Use (PseudoFS).GC to delete
-// such sectors after calling Remove on all the relevant files.
+// same sector, Free will not delete that sector, nor will it delete sectors
+// shared with a clone of the file. Similarly, Free cannot safely delete
+// "trailing" sectors at the end of a file. Use (PseudoFS).GC to delete such
+// sectors after calling Remove on all the relevant files. If the filesystem
+// has a SectorIndex, these restrictions do not apply: Free deletes every sector
+// that is not referenced by another file.
 //
 // Note that Free also discards any uncommitted Writes, so it may be necessary
 // to call Sync prior to Free.
@@ -836,13 +1158,16 @@ func (pf PseudoFile) Free() error {
 	if !pf.writeable() {
 		return ErrNotWriteable
 	}
-	pf.fs.mu.Lock()
-	defer pf.fs.mu.Unlock()
 	f, d := pf.lookupFD()
 	if f == nil && d == nil {
 		return ErrInvalidFileDescriptor
 	} else if d != nil {
 		return ErrDirectory
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !pf.fs.isOpen(pf.fd, f) {
+		return ErrInvalidFileDescriptor
+	}
 	return pf.fs.fileFree(f)
 }
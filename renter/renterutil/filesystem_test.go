@@ -2,11 +2,16 @@ package renterutil
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
@@ -125,6 +130,169 @@ func TestHostErrorSet(t *testing.T) {
 	}
 }
 
+func TestHostSetCircuitBreaker(t *testing.T) {
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	h, c := createHostWithContract(t)
+	hkr[h.PublicKey] = h.Settings.NetAddress
+	hs.AddHost(c)
+	h.Close()
+	hs.SetCircuitBreaker(2, 100*time.Millisecond, time.Second)
+
+	status := func() HostStatus {
+		t.Helper()
+		statuses := hs.Status()
+		if len(statuses) != 1 || statuses[0].HostKey != h.PublicKey {
+			t.Fatal("expected status of one host, got", statuses)
+		}
+		return statuses[0]
+	}
+
+	// the circuit should remain closed until the second failure
+	if _, err := hs.acquire(h.PublicKey); err == nil || errors.Cause(err) == ErrCircuitOpen {
+		t.Fatal("expected connection error, got", err)
+	} else if s := status(); s.State != CircuitClosed || s.ConsecutiveFailures != 1 || s.LastError == nil {
+		t.Fatalf("unexpected status after one failure: %+v", s)
+	}
+	if _, err := hs.acquire(h.PublicKey); err == nil || errors.Cause(err) == ErrCircuitOpen {
+		t.Fatal("expected connection error, got", err)
+	} else if s := status(); s.State != CircuitOpen || s.ConsecutiveFailures != 2 {
+		t.Fatalf("unexpected status after two failures: %+v", s)
+	} else if s.RetryAt.Sub(s.LastFailure) != 100*time.Millisecond {
+		t.Fatal("expected initial backoff of 100ms, got", s.RetryAt.Sub(s.LastFailure))
+	}
+
+	// while open, acquiring the host should fail immediately
+	if _, err := hs.acquire(h.PublicKey); errors.Cause(err) != ErrCircuitOpen {
+		t.Fatal("expected ErrCircuitOpen, got", err)
+	} else if _, err := hs.tryAcquire(h.PublicKey); errors.Cause(err) != ErrCircuitOpen {
+		t.Fatal("expected ErrCircuitOpen, got", err)
+	} else if s := status(); s.ConsecutiveFailures != 2 {
+		t.Fatal("fast failures should not count as failed attempts, got", s.ConsecutiveFailures)
+	}
+
+	// once the backoff elapses, one attempt should be allowed; its failure
+	// should reopen the circuit with a doubled backoff
+	time.Sleep(150 * time.Millisecond)
+	if s := status(); s.State != CircuitHalfOpen {
+		t.Fatal("expected half-open circuit, got", s.State)
+	}
+	if _, err := hs.acquire(h.PublicKey); err == nil || errors.Cause(err) == ErrCircuitOpen {
+		t.Fatal("expected connection error, got", err)
+	} else if s := status(); s.State != CircuitOpen || s.ConsecutiveFailures != 3 {
+		t.Fatalf("unexpected status after half-open failure: %+v", s)
+	} else if s.RetryAt.Sub(s.LastFailure) != 200*time.Millisecond {
+		t.Fatal("expected backoff of 200ms, got", s.RetryAt.Sub(s.LastFailure))
+	}
+}
+
+func TestHostSetMultipleContracts(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hkr[h.PublicKey] = h.Settings.NetAddress
+	hs.AddHost(c)
+
+	// adding the same contract again should have no effect
+	hs.AddHost(c)
+	if statuses := hs.Status(); len(statuses) != 1 || statuses[0].Contracts != 1 {
+		t.Fatal("expected one host with one contract, got", statuses)
+	}
+
+	// form a second contract with the same host; it must differ from the
+	// first, or the two would share an ID
+	sh := hostdb.ScannedHost{
+		HostSettings: h.Settings,
+		PublicKey:    h.PublicKey,
+	}
+	rev, _, err := proto.FormContract(stubWallet{}, stubTpool{}, c.RenterKey, sh, types.ZeroCurrency, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	} else if rev.ID() == c.ID {
+		t.Fatal("second contract has the same ID as the first")
+	}
+	hs.AddHost(renter.Contract{
+		HostKey:   rev.HostKey(),
+		ID:        rev.ID(),
+		RenterKey: c.RenterKey,
+	})
+	if statuses := hs.Status(); len(statuses) != 1 || statuses[0].Contracts != 2 {
+		t.Fatal("expected one host with two contracts, got", statuses)
+	}
+
+	// both contracts should be usable at the same time
+	s1, err := hs.acquire(h.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := hs.tryAcquire(h.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if s1.Revision().ID() == s2.Revision().ID() {
+		t.Fatal("expected sessions to use different contracts")
+	}
+	if _, err := hs.tryAcquire(h.PublicKey); err != errHostAcquired {
+		t.Fatal("expected errHostAcquired, got", err)
+	}
+	hs.release(s2)
+	if s3, err := hs.tryAcquire(h.PublicKey); err != nil {
+		t.Fatal(err)
+	} else {
+		hs.release(s3)
+	}
+	hs.release(s1)
+
+	// files should be readable regardless of which contract stores them, and
+	// the sectors of every contract should be visible to GC
+	fs := NewFileSystem(os.TempDir(), hs)
+	defer fs.Close()
+	data := frand.Bytes(100)
+	for i := 0; i < 2; i++ {
+		metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+		pf, err := fs.Create(metaName, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// hold one session, forcing the flush to use the other
+		s, err := hs.acquire(h.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.flushSectors()
+		hs.release(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Remove(metaName)
+
+		pf, err = fs.Open(metaName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadAll(pf)
+		pf.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match")
+		}
+	}
+	if roots, err := fs.hostSectorRoots(h.PublicKey); err != nil {
+		t.Fatal(err)
+	} else if len(roots) != 2 {
+		t.Fatal("expected two sectors across both contracts, got", len(roots))
+	}
+}
+
 func TestFileSystemBasic(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -400,6 +568,207 @@ func TestFileSystemLargeWrite(t *testing.T) {
 	}
 }
 
+func TestFileSystemUpdateInPlace(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	storedSectors := func() map[hostdb.HostPublicKey]int {
+		t.Helper()
+		n := make(map[hostdb.HostPublicKey]int)
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n[hostKey] = h.Revision().NumSectors()
+			fs.hosts.release(h)
+		}
+		return n
+	}
+
+	// create metafile
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill one sector on each host
+	data := frand.Bytes(renterhost.SectorSize * 2)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	before := storedSectors()
+
+	// overwrite a few unaligned bytes; no new sectors should be uploaded
+	copy(data[1000:], "foo bar baz")
+	if _, err := pf.WriteAt([]byte("foo bar baz"), 1000); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if after := storedSectors(); len(after) != len(before) {
+		t.Fatal("host set changed")
+	} else {
+		for hostKey, n := range after {
+			if n != before[hostKey] {
+				t.Fatalf("expected %v stored sectors, got %v", before[hostKey], n)
+			}
+		}
+	}
+
+	// check contents
+	p := make([]byte, len(data))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+
+	// the updated roots should be committed as soon as the hosts apply the
+	// update, before the rest of the flush
+	copy(data[2000:], "qux")
+	if _, err := pf.WriteAt([]byte("qux"), 2000); err != nil {
+		t.Fatal(err)
+	}
+	fs.mu.RLock()
+	f := fs.files[pf.fd]
+	fs.mu.RUnlock()
+	f.mu.Lock()
+	err = fs.fillSectors(context.Background(), f)
+	f.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fs.store.ReadMetaFile(storeName(metaName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Shards {
+		if len(m.Shards[i]) != len(f.m.Shards[i]) {
+			t.Fatal("stored metafile does not match updated metafile")
+		}
+		for j := range m.Shards[i] {
+			if m.Shards[i][j] != f.m.Shards[i][j] {
+				t.Fatal("stored metafile does not match updated metafile")
+			}
+		}
+	}
+	if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// contents should survive reopening the file
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Remove(metaName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemOverdrive(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	data := frand.Bytes(renterhost.SectorSize / 2)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with a tiny timeout, every read should overdrive, cancelling the
+	// slower downloads; reads should still succeed, even though hosts must be
+	// reconnected to
+	fs.SetOverdrive(2, time.Nanosecond)
+	p := make([]byte, len(data))
+	for i := 0; i < 5; i++ {
+		if _, err := pf.ReadAt(p, 0); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match data")
+		}
+	}
+
+	// latencies should have been recorded
+	for hostKey := range fs.hosts.sessions {
+		if _, ok := fs.hosts.readLatency(hostKey); ok {
+			return
+		}
+	}
+	t.Fatal("no read latencies were recorded")
+}
+
+func TestFileSystemContext(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	data := frand.Bytes(100)
+	if _, err := pf.WriteContext(cancelled, data); err != nil {
+		t.Fatal(err) // buffered writes should not be affected
+	}
+
+	// a cancelled Sync should leave the data uncommitted
+	if err := pf.SyncContext(cancelled); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a cancelled Read should not return any data
+	p := make([]byte, len(data))
+	if _, err := pf.ReadAtContext(cancelled, p, 0); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if _, err := pf.ReadContext(cancelled, p); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	}
+}
+
 func TestFileSystemTruncate(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -566,7 +935,7 @@ func TestFileSystemDelete(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			defer fs.hosts.release(hostKey)
+			defer fs.hosts.release(h)
 			if h.Revision().NumSectors() != n {
 				t.Fatalf("expected %v stored sectors, got %v", n, h.Revision().NumSectors())
 			}
@@ -690,6 +1059,224 @@ func TestFileSystemDelete(t *testing.T) {
 	expectStoredSectors(0)
 }
 
+func TestFileSystemClone(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// use a dedicated root, so that building the index is cheap
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 1)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+
+	storedSectors := func() int {
+		t.Helper()
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.hosts.release(h)
+			return h.Revision().NumSectors()
+		}
+		t.Fatal("couldn't connect to any hosts")
+		return 0
+	}
+	checkContents := func(name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		p := make([]byte, len(data))
+		if _, err := pf.ReadAt(p, 0); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatalf("contents of %v do not match", name)
+		}
+	}
+	newName := func() string {
+		return t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	}
+
+	// upload a full sector
+	data := frand.Bytes(renterhost.SectorSize)
+	origName := newName()
+	orig, err := fs.Create(origName, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := orig.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := orig.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := orig.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := storedSectors(); n != 1 {
+		t.Fatalf("expected 1 stored sector, got %v", n)
+	}
+
+	// cloning requires a sector index
+	if err := fs.Clone(origName, newName()); err == nil {
+		t.Fatal("expected Clone to fail without a sector index")
+	}
+	idx, err := NewSectorIndex(filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if err := fs.SetSectorIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Free a clone; the sector is shared, so it should not be deleted
+	clone1Name := newName()
+	if err := fs.Clone(origName, clone1Name); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(clone1Name, data)
+	clone1, err := fs.OpenFile(clone1Name, os.O_RDWR, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := clone1.Free(); err != nil {
+		t.Fatal(err)
+	} else if err := clone1.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := storedSectors(); n != 1 {
+		t.Fatalf("expected 1 stored sector, got %v", n)
+	}
+	checkContents(origName, data)
+
+	// overwrite part of another clone; the shared sector should not be
+	// modified in place
+	clone2Name := newName()
+	if err := fs.Clone(origName, clone2Name); err != nil {
+		t.Fatal(err)
+	}
+	clone2, err := fs.OpenFile(clone2Name, os.O_RDWR, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := clone2.WriteAt([]byte("foo bar baz"), 0); err != nil {
+		t.Fatal(err)
+	} else if err := clone2.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := clone2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := storedSectors(); n != 2 {
+		t.Fatalf("expected 2 stored sectors, got %v", n)
+	}
+	checkContents(origName, data)
+	checkContents(clone2Name, append([]byte("foo bar baz"), data[11:]...))
+
+	// once the clones are removed, Free should delete the sector
+	if err := fs.Remove(clone1Name); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Remove(clone2Name); err != nil {
+		t.Fatal(err)
+	}
+	orig, err = fs.OpenFile(origName, os.O_RDWR, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := orig.Free(); err != nil {
+		t.Fatal(err)
+	} else if n := storedSectors(); n != 1 {
+		t.Fatalf("expected 1 stored sector, got %v", n)
+	} else if err := orig.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Remove(origName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// upload a file that will be read while other files are written
+	shared := frand.Bytes(10000)
+	sharedName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(sharedName, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(shared); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+			wf, err := fs.Create(name, 2)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer wf.Close()
+			var data []byte
+			for j := 0; j < 20; j++ {
+				d := frand.Bytes(frand.Intn(4096) + 1)
+				if _, err := wf.Write(d); err != nil {
+					errs <- err
+					return
+				}
+				data = append(data, d...)
+				if j%5 == 4 {
+					if err := wf.Sync(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+			buf := make([]byte, len(data))
+			if _, err := wf.ReadAt(buf, 0); err != nil {
+				errs <- err
+			} else if !bytes.Equal(buf, data) {
+				errs <- errors.New("written data does not match")
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(shared))
+			for j := 0; j < 10; j++ {
+				if _, err := pf.ReadAt(buf, 0); err != nil {
+					errs <- err
+					return
+				} else if !bytes.Equal(buf, shared) {
+					errs <- errors.New("read data does not match")
+					return
+				} else if _, err := fs.Stat(sharedName); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 func BenchmarkFileSystemWrite(b *testing.B) {
 	const numHosts = 4
 	const minShards = 4
@@ -0,0 +1,135 @@
+package renterutil
+
+import (
+	"context"
+	"time"
+)
+
+// A FlushPolicy determines when a PseudoFS automatically flushes uncommitted
+// writes to hosts. A zero value for any field disables the corresponding
+// trigger.
+type FlushPolicy struct {
+	// MaxDirtyBytes bounds the total size of uncommitted writes across all
+	// files. A Write that causes the bound to be exceeded will flush before
+	// returning.
+	MaxDirtyBytes int64
+	// MaxAge is the maximum amount of time that a write may remain
+	// uncommitted.
+	MaxAge time.Duration
+	// IdleTimeout triggers a flush when no writes have occurred for the
+	// specified duration.
+	IdleTimeout time.Duration
+	// OnError, if non-nil, is called with the error returned by each failed
+	// background flush. It must not block.
+	OnError func(error)
+}
+
+// minimum interval between checks of the MaxAge and IdleTimeout triggers
+const minFlushCheckInterval = 10 * time.Millisecond
+
+// SetFlushPolicy configures the filesystem to flush uncommitted writes
+// according to p. The MaxAge and IdleTimeout triggers are checked by a
+// background goroutine, which is stopped by Close. If a background flush fails,
+// the writes remain uncommitted, the error is passed to p.OnError, and the
+// flush is retried at the next check.
+//
+// By default, uncommitted writes are only flushed when Sync or Close is called,
+// or when they would not fit in a single sector.
+func (fs *PseudoFS) SetFlushPolicy(p FlushPolicy) {
+	fs.stopFlushLoop()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.flushPolicy = p
+
+	interval := p.MaxAge
+	if interval == 0 || (p.IdleTimeout != 0 && p.IdleTimeout < interval) {
+		interval = p.IdleTimeout
+	}
+	if interval == 0 {
+		return
+	}
+	interval /= 2
+	if interval < minFlushCheckInterval {
+		interval = minFlushCheckInterval
+	}
+	fs.flushStop = make(chan struct{})
+	fs.flushDone = make(chan struct{})
+	go fs.flushLoop(interval, fs.flushStop, fs.flushDone)
+}
+
+func (fs *PseudoFS) stopFlushLoop() {
+	fs.mu.Lock()
+	stop, done := fs.flushStop, fs.flushDone
+	fs.flushStop, fs.flushDone = nil, nil
+	fs.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (fs *PseudoFS) flushLoop(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !fs.flushDue(time.Now()) {
+			continue
+		}
+		// on failure, retry at next tick
+		if err := fs.flushSectors(); err != nil {
+			fs.mu.RLock()
+			onError := fs.flushPolicy.OnError
+			fs.mu.RUnlock()
+			if onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// flushDue reports whether the MaxAge or IdleTimeout triggers have been
+// reached.
+func (fs *PseudoFS) flushDue(now time.Time) bool {
+	fs.mu.RLock()
+	p := fs.flushPolicy
+	fs.mu.RUnlock()
+	fs.pendingMu.Lock()
+	defer fs.pendingMu.Unlock()
+	if fs.dirtySince.IsZero() {
+		return false
+	}
+	return (p.MaxAge != 0 && now.Sub(fs.dirtySince) >= p.MaxAge) ||
+		(p.IdleTimeout != 0 && now.Sub(fs.lastWriteTime) >= p.IdleTimeout)
+}
+
+// dirtyBytes returns the total size of all uncommitted writes.
+func (fs *PseudoFS) dirtyBytes() int64 {
+	fs.pendingMu.Lock()
+	defer fs.pendingMu.Unlock()
+	return fs.pendingBytes
+}
+
+// recordWrite updates the state used by the flush policy after a write to f,
+// and flushes if MaxDirtyBytes has been exceeded. The caller must hold f.mu.
+func (fs *PseudoFS) recordWrite(ctx context.Context, f *openMetaFile) error {
+	fs.mu.RLock()
+	maxDirty := fs.flushPolicy.MaxDirtyBytes
+	fs.mu.RUnlock()
+	fs.pendingMu.Lock()
+	fs.lastWriteTime = time.Now()
+	if fs.dirtySince.IsZero() {
+		fs.dirtySince = fs.lastWriteTime
+	}
+	exceeded := maxDirty != 0 && fs.pendingBytes > maxDirty
+	fs.pendingMu.Unlock()
+	if exceeded {
+		return fs.flushUnlocked(ctx, f)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package renterutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+func TestFileSystemFlushPolicy(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+	defer fs.SetFlushPolicy(FlushPolicy{})
+
+	dirty := fs.dirtyBytes
+	waitForFlush := func() {
+		t.Helper()
+		for start := time.Now(); dirty() != 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatal("writes were not flushed")
+			}
+		}
+	}
+
+	// exceeding MaxDirtyBytes should flush immediately
+	fs.SetFlushPolicy(FlushPolicy{MaxDirtyBytes: 1000})
+	pf, err := fs.Create("foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(frand.Bytes(500)); err != nil {
+		t.Fatal(err)
+	} else if dirty() != 500 {
+		t.Fatal("write should not have been flushed")
+	} else if _, err := pf.Write(frand.Bytes(600)); err != nil {
+		t.Fatal(err)
+	} else if dirty() != 0 {
+		t.Fatal("write should have been flushed")
+	} else if _, err := fs.store.Stat("foo"); err != nil {
+		t.Fatal("metafile should exist after flush:", err)
+	}
+
+	// writes older than MaxAge should be flushed in the background, even if
+	// writes continue
+	fs.SetFlushPolicy(FlushPolicy{MaxAge: 200 * time.Millisecond})
+	if _, err := pf.Write(frand.Bytes(100)); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; time.Sleep(20 * time.Millisecond) {
+		if _, err := pf.Write(frand.Bytes(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForFlush()
+
+	// an idle filesystem should be flushed after IdleTimeout
+	fs.SetFlushPolicy(FlushPolicy{IdleTimeout: 100 * time.Millisecond})
+	if _, err := pf.Write(frand.Bytes(100)); err != nil {
+		t.Fatal(err)
+	}
+	waitForFlush()
+
+	// disabling the policy should leave writes uncommitted
+	fs.SetFlushPolicy(FlushPolicy{})
+	if _, err := pf.Write(frand.Bytes(100)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if dirty() != 100 {
+		t.Fatal("write should not have been flushed")
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemFlushPolicyError(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	h, c := createHostWithContract(t)
+	hkr[h.PublicKey] = h.Settings.NetAddress
+	hs.AddHost(c)
+	h.Close()
+	fs := NewFileSystem(dir, hs)
+	defer fs.Close()
+
+	// background flushes to an unreachable host should report their errors
+	errChan := make(chan error, 1)
+	fs.SetFlushPolicy(FlushPolicy{
+		MaxAge: 50 * time.Millisecond,
+		OnError: func(err error) {
+			select {
+			case errChan <- err:
+			default:
+			}
+		},
+	})
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(frand.Bytes(100)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatal("expected non-nil error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush error was not reported")
+	}
+	fs.SetFlushPolicy(FlushPolicy{})
+	if fs.dirtyBytes() != 100 {
+		t.Fatal("failed flush should leave writes uncommitted")
+	}
+}
@@ -0,0 +1,164 @@
+package renterutil
+
+import (
+	"os"
+	"sort"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// A FileHealth describes the redundancy of a single file.
+type FileHealth struct {
+	Name        string `json:"name"`
+	Filesize    int64  `json:"filesize"`
+	MinShards   int    `json:"minShards"`
+	TotalShards int    `json:"totalShards"`
+	// Redundancy is the number of retrievable shards in the file's least
+	// redundant chunk. If it is less than MinShards, the file cannot be fully
+	// recovered.
+	Redundancy int `json:"redundancy"`
+	// MissingHosts lists the hosts that cannot supply all of their shards,
+	// either because they are unreachable or because they no longer store the
+	// file's sectors.
+	MissingHosts []hostdb.HostPublicKey `json:"missingHosts"`
+}
+
+// Recoverable returns true if every chunk of the file can be recovered.
+func (fh FileHealth) Recoverable() bool {
+	return fh.Redundancy >= fh.MinShards
+}
+
+// A HostHealth describes the state of the contracts formed with a host. If there
+// are multiple contracts, EndHeight is that of the earliest-ending contract, and
+// NumSectors is the total across all contracts.
+type HostHealth struct {
+	HostKey    hostdb.HostPublicKey `json:"hostKey"`
+	EndHeight  types.BlockHeight    `json:"endHeight"`
+	NumSectors int                  `json:"numSectors"`
+	// Err is non-empty if the host's sector roots could not be retrieved. In
+	// that case, EndHeight and NumSectors reflect the most recent revisions
+	// seen, if any.
+	Err string `json:"error,omitempty"`
+}
+
+// A HealthReport describes the redundancy of the files in a PseudoFS, along
+// with the state of the contracts that store them.
+type HealthReport struct {
+	Height        types.BlockHeight      `json:"height"`
+	Files         []FileHealth           `json:"files"`
+	Hosts         []HostHealth           `json:"hosts"`
+	Unrecoverable []string               `json:"unrecoverable"`
+	Expiring      []hostdb.HostPublicKey `json:"expiring"`
+}
+
+// Health examines every metafile in the filesystem and reports the number of
+// shards of each file that are actually retrievable from hosts. Each host is
+// queried for its sector roots exactly once. Contracts that end within
+// expiryWindow blocks of the current height are reported as expiring.
+//
+// Like GC, Health only considers metafiles in the store; data that has not
+// been flushed to hosts yet is not included in the report. The metafiles are
+// read before any hosts are queried, so files flushed during the check are
+// not included either.
+func (fs *PseudoFS) Health(expiryWindow types.BlockHeight) (*HealthReport, error) {
+	report := &HealthReport{
+		Height: fs.hosts.height(),
+	}
+
+	// snapshot the metafiles; the lock is released before contacting any
+	// hosts, so that a slow host does not block flushes
+	type namedMetaFile struct {
+		name string
+		m    *renter.MetaFile
+	}
+	var files []namedMetaFile
+	fs.flushMu.Lock()
+	err := fs.store.Walk(".", func(name string, _ os.FileInfo) error {
+		m, err := fs.store.ReadMetaFile(name)
+		if err != nil {
+			// as in GC, the report is only useful if every file was checked
+			return err
+		}
+		files = append(files, namedMetaFile{name, m})
+		return nil
+	})
+	fs.flushMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// gather the sector roots from each host; unreachable hosts are reported,
+	// but do not cause the check to fail. The expiration of their contracts
+	// is determined from the most recent revisions seen.
+	hostRoots := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
+	for hostKey := range fs.hosts.sessions {
+		hh := HostHealth{HostKey: hostKey}
+		if rootMap, err := fs.hostSectorRoots(hostKey); err != nil {
+			hh.Err = err.Error()
+		} else {
+			hostRoots[hostKey] = rootMap
+		}
+		for _, rev := range fs.hosts.knownRevisions(hostKey) {
+			if hh.EndHeight == 0 || rev.EndHeight() < hh.EndHeight {
+				hh.EndHeight = rev.EndHeight()
+			}
+			hh.NumSectors += rev.NumSectors()
+		}
+		if hh.EndHeight != 0 && hh.EndHeight <= report.Height+expiryWindow {
+			report.Expiring = append(report.Expiring, hostKey)
+		}
+		report.Hosts = append(report.Hosts, hh)
+	}
+	sort.Slice(report.Hosts, func(i, j int) bool {
+		return report.Hosts[i].HostKey < report.Hosts[j].HostKey
+	})
+	sort.Slice(report.Expiring, func(i, j int) bool {
+		return report.Expiring[i] < report.Expiring[j]
+	})
+
+	for _, f := range files {
+		fh := checkFileHealth(f.m, hostRoots)
+		fh.Name = f.name
+		report.Files = append(report.Files, fh)
+		if !fh.Recoverable() {
+			report.Unrecoverable = append(report.Unrecoverable, fh.Name)
+		}
+	}
+	return report, nil
+}
+
+func checkFileHealth(m *renter.MetaFile, hostRoots map[hostdb.HostPublicKey]map[crypto.Hash]struct{}) FileHealth {
+	fh := FileHealth{
+		Filesize:    m.Filesize,
+		MinShards:   m.MinShards,
+		TotalShards: len(m.Hosts),
+		Redundancy:  len(m.Hosts),
+	}
+	missing := make([]bool, len(m.Hosts))
+	for chunkIndex := range m.Shards[0] {
+		var available int
+		for i, hostKey := range m.Hosts {
+			roots, ok := hostRoots[hostKey]
+			if ok {
+				_, ok = roots[m.Shards[i][chunkIndex].MerkleRoot]
+			}
+			if ok {
+				available++
+			} else {
+				missing[i] = true
+			}
+		}
+		if available < fh.Redundancy {
+			fh.Redundancy = available
+		}
+	}
+	for i, hostKey := range m.Hosts {
+		if missing[i] {
+			fh.MissingHosts = append(fh.MissingHosts, hostKey)
+		}
+	}
+	return fh
+}
@@ -0,0 +1,105 @@
+package renterutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"lukechampine.com/us/hostdb"
+)
+
+func TestFileSystemHealth(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// use a dedicated root, so that metafiles from other tests are not included
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+
+	pf, err := fs.Create("foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write([]byte("foo bar baz")); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.Health(0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(report.Files) != 1 || len(report.Hosts) != 3 {
+		t.Fatalf("expected 1 file and 3 hosts, got %v and %v", len(report.Files), len(report.Hosts))
+	} else if fh := report.Files[0]; fh.Name != "foo" || fh.Redundancy != 3 || len(fh.MissingHosts) != 0 {
+		t.Fatalf("unexpected file health: %+v", fh)
+	} else if len(report.Unrecoverable) != 0 || len(report.Expiring) != 0 {
+		t.Fatal("file should be healthy")
+	}
+	// the test contracts end at height 10
+	if report, err := fs.Health(100); err != nil {
+		t.Fatal(err)
+	} else if len(report.Expiring) != 3 {
+		t.Fatal("expected all contracts to be expiring, got", len(report.Expiring))
+	}
+
+	// an unreachable host should be reported, along with the expiration of
+	// its contract
+	hkr := fs.hosts.hkr.(testHKR)
+	var hostKey hostdb.HostPublicKey
+	for hostKey = range fs.hosts.sessions {
+		break
+	}
+	addr := hkr[hostKey]
+	delete(hkr, hostKey)
+	h, err := fs.hosts.acquire(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	fs.hosts.release(h)
+	if report, err := fs.Health(100); err != nil {
+		t.Fatal(err)
+	} else if len(report.Expiring) != 3 {
+		t.Fatal("expected all contracts to be expiring, got", len(report.Expiring))
+	} else if fh := report.Files[0]; fh.Redundancy != 2 || len(fh.MissingHosts) != 1 || fh.MissingHosts[0] != hostKey {
+		t.Fatalf("unexpected file health: %+v", fh)
+	} else {
+		for _, hh := range report.Hosts {
+			if hh.HostKey == hostKey && (hh.Err == "" || hh.EndHeight != 10) {
+				t.Fatalf("unexpected host health: %+v", hh)
+			}
+		}
+	}
+	hkr[hostKey] = addr
+
+	// remove hosts from the set; redundancy should decrease accordingly
+	for hostKey := range fs.hosts.sessions {
+		delete(fs.hosts.sessions, hostKey)
+		break
+	}
+	if report, err := fs.Health(0); err != nil {
+		t.Fatal(err)
+	} else if fh := report.Files[0]; fh.Redundancy != 2 || len(fh.MissingHosts) != 1 || !fh.Recoverable() {
+		t.Fatalf("unexpected file health: %+v", fh)
+	}
+	for hostKey := range fs.hosts.sessions {
+		delete(fs.hosts.sessions, hostKey)
+		break
+	}
+	if report, err := fs.Health(0); err != nil {
+		t.Fatal(err)
+	} else if fh := report.Files[0]; fh.Redundancy != 1 || fh.Recoverable() {
+		t.Fatalf("unexpected file health: %+v", fh)
+	} else if len(report.Unrecoverable) != 1 || report.Unrecoverable[0] != "foo" {
+		t.Fatal("file should be reported as unrecoverable")
+	}
+}
@@ -1,19 +1,32 @@
 package renterutil
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
 )
 
 var errNoHost = errors.New("no record of that host")
+var errNoContract = errors.New("no record of that contract")
 var errHostAcquired = errors.New("host is currently acquired")
+var errSectorNotFound = errors.New("sector is not stored under host's contract")
+
+// ErrCircuitOpen is returned when attempting to use a host whose circuit
+// breaker is open, i.e. a host that has recently failed too many consecutive
+// connection attempts.
+var ErrCircuitOpen = errors.New("host circuit breaker is open")
 
 // A HostError associates an error with a given host.
 type HostError struct {
@@ -45,48 +58,360 @@ func (hes HostErrorSet) Error() string {
 	return "\n" + strings.Join(strs, "\n")
 }
 
-type tryLock struct {
-	c    chan struct{}
-	once sync.Once
+// A CircuitState is the state of a host's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state: the host is used as usual.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen indicates that the host has failed too many consecutive
+	// connection attempts. Attempts to use the host fail immediately with
+	// ErrCircuitOpen until its backoff period has elapsed.
+	CircuitOpen
+	// CircuitHalfOpen indicates that the host's backoff period has elapsed.
+	// The next attempt to use the host is allowed through; if it succeeds, the
+	// circuit closes, otherwise it reopens with a longer backoff period.
+	CircuitHalfOpen
+)
+
+// String implements fmt.Stringer.
+func (cs CircuitState) String() string {
+	switch cs {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(cs))
+	}
+}
+
+// HostStatus describes the health of a host within a HostSet.
+type HostStatus struct {
+	HostKey             hostdb.HostPublicKey
+	Contracts           int
+	State               CircuitState
+	ConsecutiveFailures int
+	LastError           error
+	LastFailure         time.Time
+	// RetryAt is the time at which an open circuit becomes half-open. It is
+	// zero if the circuit is closed.
+	RetryAt time.Time
 }
 
-func (mu *tryLock) init() {
-	mu.c = make(chan struct{}, 1)
-	mu.c <- struct{}{}
+// hostHealth tracks the connection failures of a host. It is guarded by its
+// own mutex so that it can be consulted without acquiring the host.
+type hostHealth struct {
+	mu          sync.Mutex
+	failures    int
+	lastErr     error
+	lastFailure time.Time
+	retryAt     time.Time
+	probing     bool // a half-open attempt is in progress
 }
 
-func (mu *tryLock) Lock() {
-	mu.once.Do(mu.init)
-	<-mu.c
+// A lockedHost is a session with a host, locked to a single contract.
+type lockedHost struct {
+	reconnect func(ctx context.Context) error
+	contract  renter.Contract // guarded by the pool's mu
+	s         *proto.Session
+	// the contract's most recent known revision, updated whenever the session
+	// is released; guarded by the pool's mu
+	rev proto.ContractRevision
+	// cached indices of the contract's sector roots; may be stale
+	sectorIndices map[crypto.Hash]int
+	// if non-nil, the contract cannot be used, and connecting fails with this
+	// error; guarded by the pool's mu
+	unavailable error
 }
 
-func (mu *tryLock) TryLock() bool {
-	mu.once.Do(mu.init)
-	select {
-	case <-mu.c:
-		return true
-	default:
-		return false
+// A hostPool is the set of sessions with a single host, one per contract. Each
+// session may be used by only one caller at a time; spreading callers across
+// sessions allows them to use the host concurrently.
+type hostPool struct {
+	mu    sync.Mutex
+	cond  sync.Cond // signalled when a session is returned
+	conns []*lockedHost
+	idle  []*lockedHost
+
+	health hostHealth
+}
+
+// get removes an idle session from the pool, blocking until one is available
+// or ctx is cancelled.
+func (p *hostPool) get(ctx context.Context) (*lockedHost, error) {
+	if ctx.Done() != nil {
+		// wake up the waiters below if ctx is cancelled
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			case <-done:
+			}
+		}()
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p.cond.Wait()
+	}
+	return p.popIdle(), nil
 }
 
-func (mu *tryLock) Unlock() {
-	mu.c <- struct{}{}
+// tryGet removes an idle session from the pool, returning nil if none are
+// available.
+func (p *hostPool) tryGet() *lockedHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	return p.popIdle()
 }
 
-type lockedHost struct {
-	reconnect func() error
-	s         *proto.Session
-	mu        tryLock
+// popIdle removes an idle session from the pool, which must not be empty.
+// Sessions whose contracts are available are preferred; among those, the most
+// recently used session is preferred, since it is the most likely to still be
+// connected. p.mu must be held.
+func (p *hostPool) popIdle() *lockedHost {
+	i := len(p.idle) - 1
+	for j := i; j >= 0; j-- {
+		if p.idle[j].unavailable == nil {
+			i = j
+			break
+		}
+	}
+	lh := p.idle[i]
+	p.idle = append(p.idle[:i], p.idle[i+1:]...)
+	return lh
 }
 
-// A HostSet is a collection of renter-host protocol sessions.
+// take removes the specified session from the pool, blocking until it is
+// idle.
+func (p *hostPool) take(lh *lockedHost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for i := range p.idle {
+			if p.idle[i] == lh {
+				p.idle = append(p.idle[:i], p.idle[i+1:]...)
+				return
+			}
+		}
+		p.cond.Wait()
+	}
+}
+
+// put returns a session to the pool.
+func (p *hostPool) put(lh *lockedHost) {
+	p.mu.Lock()
+	p.idle = append(p.idle, lh)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// swap replaces the contract of the acquired session lh with c, whose most
+// recent revision is rev, closing the session and returning it to the pool.
+func (p *hostPool) swap(lh *lockedHost, c renter.Contract, rev proto.ContractRevision) {
+	if lh.s != nil {
+		lh.s.Close()
+	}
+	p.mu.Lock()
+	lh.s = nil
+	lh.contract = c
+	lh.rev = rev
+	lh.sectorIndices = nil
+	lh.unavailable = nil
+	p.mu.Unlock()
+	p.put(lh)
+}
+
+// hasContract reports whether the pool contains a session for the specified
+// contract.
+func (p *hostPool) hasContract(id types.FileContractID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, lh := range p.conns {
+		if lh.contract.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds a new session to the pool.
+func (p *hostPool) add(lh *lockedHost) {
+	p.mu.Lock()
+	p.conns = append(p.conns, lh)
+	p.mu.Unlock()
+	p.put(lh)
+}
+
+// A HostSet is a collection of renter-host protocol sessions. A HostSet may
+// hold multiple contracts with the same host, in which case it maintains one
+// session per contract and distributes concurrent operations across them.
 type HostSet struct {
-	sessions      map[hostdb.HostPublicKey]*lockedHost
+	sessions      map[hostdb.HostPublicKey]*hostPool
 	hkr           renter.HostKeyResolver
-	currentHeight types.BlockHeight
+	currentHeight types.BlockHeight // accessed atomically
 	lockTimeout   time.Duration
 	onConnect     func(s *proto.Session)
+	revs          proto.RevisionRecorder
+
+	// circuit breaker parameters
+	maxFailures int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	latencyMu sync.Mutex
+	latencies map[hostdb.HostPublicKey]time.Duration
+}
+
+// RecordRPCStats implements proto.RPCStatsRecorder. The HostSet uses the
+// elapsed time of successful Read RPCs to estimate the latency of each host.
+//
+// Every Session initiated by the HostSet reports its stats to the HostSet. If
+// the function passed to SetOnConnect replaces a Session's RPCStatsRecorder,
+// the new recorder should forward its stats to the HostSet.
+func (set *HostSet) RecordRPCStats(stats proto.RPCStats) {
+	if stats.RPC != renterhost.RPCReadID || stats.Err != nil {
+		return
+	}
+	set.latencyMu.Lock()
+	defer set.latencyMu.Unlock()
+	if old, ok := set.latencies[stats.Host]; ok {
+		// exponentially-weighted moving average
+		set.latencies[stats.Host] = (4*old + stats.Elapsed) / 5
+	} else {
+		set.latencies[stats.Host] = stats.Elapsed
+	}
+}
+
+// readLatency returns the typical latency of a Read RPC with the specified
+// host, if known.
+func (set *HostSet) readLatency(host hostdb.HostPublicKey) (time.Duration, bool) {
+	set.latencyMu.Lock()
+	defer set.latencyMu.Unlock()
+	d, ok := set.latencies[host]
+	return d, ok
+}
+
+// state returns the circuit state of h at time now. h.mu must be held.
+func (set *HostSet) state(h *hostHealth, now time.Time) CircuitState {
+	if h.failures < set.maxFailures {
+		return CircuitClosed
+	} else if now.Before(h.retryAt) || h.probing {
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// checkCircuit returns ErrCircuitOpen if the host's circuit is open. If the
+// circuit is half-open, it is marked as probing, and the caller must later
+// report the outcome of its attempt via recordAttempt.
+func (set *HostSet) checkCircuit(p *hostPool) error {
+	h := &p.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	switch set.state(h, now) {
+	case CircuitOpen:
+		if h.probing {
+			return errors.Wrapf(ErrCircuitOpen, "waiting on reconnect attempt (last error: %v)", h.lastErr)
+		}
+		return errors.Wrapf(ErrCircuitOpen, "retrying in %v (last error: %v)", h.retryAt.Sub(now).Round(time.Millisecond), h.lastErr)
+	case CircuitHalfOpen:
+		h.probing = true
+	}
+	return nil
+}
+
+// recordAttempt updates the host's health with the outcome of a connection
+// attempt.
+func (set *HostSet) recordAttempt(p *hostPool, err error) {
+	h := &p.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing = false
+	if err == nil {
+		h.failures = 0
+		h.retryAt = time.Time{}
+		return
+	}
+	h.failures++
+	h.lastErr = err
+	h.lastFailure = time.Now()
+	if h.failures >= set.maxFailures {
+		// double the backoff for each failure beyond the threshold
+		backoff := set.maxBackoff
+		if shift := uint(h.failures - set.maxFailures); shift < 32 {
+			if b := set.minBackoff << shift; b > 0 && b < backoff {
+				backoff = b
+			}
+		}
+		h.retryAt = h.lastFailure.Add(backoff)
+	}
+}
+
+// abandonAttempt clears the probing state of the host's circuit without
+// recording a success or failure. It is called when a caller gives up on a
+// connection attempt, which says nothing about the health of the host.
+func (set *HostSet) abandonAttempt(p *hostPool) {
+	p.health.mu.Lock()
+	p.health.probing = false
+	p.health.mu.Unlock()
+}
+
+// Status returns the health of each host in the set, sorted by host key.
+func (set *HostSet) Status() []HostStatus {
+	statuses := make([]HostStatus, 0, len(set.sessions))
+	now := time.Now()
+	for hostKey, p := range set.sessions {
+		h := &p.health
+		h.mu.Lock()
+		hs := HostStatus{
+			HostKey:             hostKey,
+			Contracts:           len(p.conns),
+			State:               set.state(h, now),
+			ConsecutiveFailures: h.failures,
+			LastError:           h.lastErr,
+			LastFailure:         h.lastFailure,
+		}
+		if hs.State != CircuitClosed {
+			hs.RetryAt = h.retryAt
+		}
+		h.mu.Unlock()
+		statuses = append(statuses, hs)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].HostKey < statuses[j].HostKey
+	})
+	return statuses
+}
+
+// Contracts returns the contracts in the set, sorted by host key.
+func (set *HostSet) Contracts() []renter.Contract {
+	var contracts []renter.Contract
+	for _, p := range set.sessions {
+		p.mu.Lock()
+		for _, lh := range p.conns {
+			contracts = append(contracts, lh.contract)
+		}
+		p.mu.Unlock()
+	}
+	sort.SliceStable(contracts, func(i, j int) bool {
+		return contracts[i].HostKey < contracts[j].HostKey
+	})
+	return contracts
 }
 
 // HasHost returns true if the specified host is in the set.
@@ -95,68 +420,415 @@ func (set *HostSet) HasHost(hostKey hostdb.HostPublicKey) bool {
 	return ok
 }
 
-// Close closes all of the sessions in the set.
+// Close closes all of the sessions in the set, waiting for any acquired
+// sessions to be released.
 func (set *HostSet) Close() error {
-	for hostKey, lh := range set.sessions {
-		lh.mu.Lock()
-		if lh.s != nil {
-			lh.s.Close()
-			lh.s = nil
+	for hostKey, p := range set.sessions {
+		for _, lh := range p.conns {
+			p.take(lh)
+			if lh.s != nil {
+				lh.s.Close()
+				lh.s = nil
+			}
 		}
 		delete(set.sessions, hostKey)
 	}
 	return nil
 }
 
+// connect (re)connects lh, which must have been removed from p, and records
+// the outcome in the host's health. If the connection fails, lh is returned to
+// p.
+func (set *HostSet) connect(ctx context.Context, p *hostPool, lh *lockedHost) (*proto.Session, error) {
+	p.mu.Lock()
+	unavailable := lh.unavailable
+	p.mu.Unlock()
+	if unavailable != nil {
+		// says nothing about the health of the host
+		set.abandonAttempt(p)
+		p.put(lh)
+		return nil, unavailable
+	}
+	err := lh.reconnect(ctx)
+	if err != nil && ctx.Err() != nil {
+		set.abandonAttempt(p)
+		p.put(lh)
+		return nil, ctx.Err()
+	}
+	set.recordAttempt(p, err)
+	if err != nil {
+		p.put(lh)
+		return nil, err
+	}
+	return lh.s, nil
+}
+
+// acquire acquires an idle session with the specified host, blocking until one
+// is available. The session must be released with release.
 func (set *HostSet) acquire(host hostdb.HostPublicKey) (*proto.Session, error) {
-	ls, ok := set.sessions[host]
+	return set.acquireContext(context.Background(), host)
+}
+
+// acquireContext is like acquire, but gives up if ctx is cancelled while
+// waiting for or connecting to the host.
+func (set *HostSet) acquireContext(ctx context.Context, host hostdb.HostPublicKey) (*proto.Session, error) {
+	p, ok := set.sessions[host]
 	if !ok {
 		return nil, errNoHost
 	}
-	ls.mu.Lock()
-	if err := ls.reconnect(); err != nil {
-		ls.mu.Unlock()
+	// check the circuit before waiting for a session, so that callers don't
+	// queue up behind a dead host
+	if err := set.checkCircuit(p); err != nil {
+		return nil, err
+	}
+	lh, err := p.get(ctx)
+	if err != nil {
+		set.abandonAttempt(p)
 		return nil, err
 	}
-	return ls.s, nil
+	return set.connect(ctx, p, lh)
 }
 
+// tryAcquire is like acquire, but returns errHostAcquired instead of blocking
+// if every session with the host is in use.
 func (set *HostSet) tryAcquire(host hostdb.HostPublicKey) (*proto.Session, error) {
-	ls, ok := set.sessions[host]
+	return set.tryAcquireContext(context.Background(), host)
+}
+
+// tryAcquireContext is like tryAcquire, but gives up if ctx is cancelled while
+// connecting to the host.
+func (set *HostSet) tryAcquireContext(ctx context.Context, host hostdb.HostPublicKey) (*proto.Session, error) {
+	p, ok := set.sessions[host]
 	if !ok {
 		return nil, errNoHost
 	}
-	if !ls.mu.TryLock() {
+	lh := p.tryGet()
+	if lh == nil {
 		return nil, errHostAcquired
 	}
-	if err := ls.reconnect(); err != nil {
-		ls.mu.Unlock()
+	if err := set.checkCircuit(p); err != nil {
+		p.put(lh)
 		return nil, err
 	}
-	return ls.s, nil
+	return set.connect(ctx, p, lh)
 }
 
-func (set *HostSet) release(host hostdb.HostPublicKey) {
-	lh := set.sessions[host]
-	if lh.s.IsClosed() {
-		lh.s = nil // force a reconnect
+// release returns an acquired session to the set.
+func (set *HostSet) release(s *proto.Session) {
+	p := set.sessions[s.HostKey()]
+	for _, lh := range p.conns {
+		if lh.s == s {
+			if rev := s.Revision(); rev.IsValid() {
+				p.mu.Lock()
+				lh.rev = rev
+				p.mu.Unlock()
+			}
+			if s.IsClosed() {
+				lh.s = nil // force a reconnect
+			}
+			p.put(lh)
+			return
+		}
 	}
-	lh.mu.Unlock()
+	panic("released session does not belong to the set")
+}
+
+// knownRevisions returns the most recent known revision of each of the host's
+// contracts, without contacting the host. Contracts whose revisions are not
+// yet known are omitted.
+func (set *HostSet) knownRevisions(host hostdb.HostPublicKey) []proto.ContractRevision {
+	p, ok := set.sessions[host]
+	if !ok {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var revs []proto.ContractRevision
+	for _, lh := range p.conns {
+		if lh.rev.IsValid() {
+			revs = append(revs, lh.rev)
+		}
+	}
+	return revs
+}
+
+// acquireContract acquires the session locked to the specified contract,
+// blocking until it is idle. The session must be released with release or
+// replaceContract.
+func (set *HostSet) acquireContract(ctx context.Context, id types.FileContractID) (*proto.Session, error) {
+	for _, p := range set.sessions {
+		var lh *lockedHost
+		p.mu.Lock()
+		for _, c := range p.conns {
+			if c.contract.ID == id {
+				lh = c
+				break
+			}
+		}
+		p.mu.Unlock()
+		if lh == nil {
+			continue
+		}
+		if err := set.checkCircuit(p); err != nil {
+			return nil, err
+		}
+		p.take(lh)
+		return set.connect(ctx, p, lh)
+	}
+	return nil, errNoContract
+}
+
+// replaceContract releases the acquired session s, replacing the contract it
+// is locked to with c, whose most recent revision is rev. The session is
+// closed; the next caller to acquire c will establish a new session.
+func (set *HostSet) replaceContract(s *proto.Session, c renter.Contract, rev proto.ContractRevision) {
+	p := set.sessions[s.HostKey()]
+	for _, lh := range p.conns {
+		if lh.s == s {
+			p.swap(lh, c, rev)
+			return
+		}
+	}
+	panic("replaced session does not belong to the set")
+}
+
+// suspendContract releases the acquired session s, closing it and marking its
+// contract as unavailable until it is replaced via swapContract. Attempts to
+// use the contract in the meantime fail with err.
+func (set *HostSet) suspendContract(s *proto.Session, err error) {
+	p := set.sessions[s.HostKey()]
+	for _, lh := range p.conns {
+		if lh.s == s {
+			s.Close()
+			p.mu.Lock()
+			lh.s = nil
+			lh.unavailable = err
+			p.mu.Unlock()
+			p.put(lh)
+			return
+		}
+	}
+	panic("suspended session does not belong to the set")
+}
+
+// swapContract is like replaceContract, but acquires the session locked to
+// the contract with ID oldID itself, without connecting to the host. It is
+// used when the old contract can no longer be locked, e.g. because it has been
+// renewed.
+func (set *HostSet) swapContract(oldID types.FileContractID, c renter.Contract, rev proto.ContractRevision) error {
+	p, ok := set.sessions[c.HostKey]
+	if !ok {
+		return errNoHost
+	}
+	p.mu.Lock()
+	var lh *lockedHost
+	for _, l := range p.conns {
+		if l.contract.ID == oldID {
+			lh = l
+			break
+		}
+	}
+	p.mu.Unlock()
+	if lh == nil {
+		return errNoContract
+	}
+	p.take(lh)
+	p.swap(lh, c, rev)
+	return nil
+}
+
+// forEachContract acquires the session for each of the host's contracts in
+// turn, calling fn with the session. It is used for operations that must be
+// applied to every contract, such as enumerating or deleting sectors.
+func (set *HostSet) forEachContract(host hostdb.HostPublicKey, fn func(*proto.Session) error) error {
+	p, ok := set.sessions[host]
+	if !ok {
+		return errNoHost
+	}
+	p.mu.Lock()
+	conns := append([]*lockedHost(nil), p.conns...)
+	p.mu.Unlock()
+	for _, lh := range conns {
+		if err := set.checkCircuit(p); err != nil {
+			return err
+		}
+		p.take(lh)
+		s, err := set.connect(context.Background(), p, lh)
+		if err != nil {
+			return err
+		}
+		err = fn(s)
+		set.release(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectorIndex returns the index of the sector with the specified root within
+// the contract, or errSectorNotFound if the contract does not contain the
+// sector. lh must be acquired.
+func (lh *lockedHost) sectorIndex(root crypto.Hash) (int, error) {
+	// the cached index is invalidated by any modification that reorders the
+	// contract's sectors, so confirm it with the host before using it
+	if index, ok := lh.sectorIndices[root]; ok && index < lh.s.Revision().NumSectors() {
+		if roots, err := lh.s.SectorRoots(index, 1); err == nil && roots[0] == root {
+			return index, nil
+		}
+	}
+	numRoots := lh.s.Revision().NumSectors()
+	lh.sectorIndices = make(map[crypto.Hash]int, numRoots)
+	for offset := 0; offset < numRoots; {
+		n := 130000 // a little less than 4MiB of roots
+		if offset+n > numRoots {
+			n = numRoots - offset
+		}
+		roots, err := lh.s.SectorRoots(offset, n)
+		if err != nil {
+			lh.sectorIndices = nil
+			return 0, err
+		}
+		for i, r := range roots {
+			lh.sectorIndices[r] = offset + i
+		}
+		offset += n
+	}
+	index, ok := lh.sectorIndices[root]
+	if !ok {
+		return 0, errSectorNotFound
+	}
+	return index, nil
+}
+
+// recordAppend records the index of root, which was just appended to the
+// contract locked by the acquired session s, so that updateSector does not
+// need to fetch it from the host.
+func (set *HostSet) recordAppend(s *proto.Session, root crypto.Hash) {
+	for _, lh := range set.sessions[s.HostKey()].conns {
+		if lh.s == s {
+			if lh.sectorIndices == nil {
+				lh.sectorIndices = make(map[crypto.Hash]int)
+			}
+			lh.sectorIndices[root] = s.Revision().NumSectors() - 1
+			return
+		}
+	}
+	panic("session does not belong to the set")
+}
+
+// updateSector overwrites the sector with the specified root, starting at
+// offset, with data, and returns the new Merkle root of the sector. The offset
+// and length of data must be multiples of merkle.SegmentSize.
+func (set *HostSet) updateSector(ctx context.Context, host hostdb.HostPublicKey, root crypto.Hash, offset uint32, data []byte) (crypto.Hash, error) {
+	p, ok := set.sessions[host]
+	if !ok {
+		return crypto.Hash{}, errNoHost
+	}
+	p.mu.Lock()
+	conns := append([]*lockedHost(nil), p.conns...)
+	p.mu.Unlock()
+	// the sector may be stored under any of the host's contracts; check each
+	// in turn
+	for _, lh := range conns {
+		if err := set.checkCircuit(p); err != nil {
+			return crypto.Hash{}, err
+		}
+		p.take(lh)
+		h, err := set.connect(ctx, p, lh)
+		if err != nil {
+			return crypto.Hash{}, err
+		}
+		index, err := lh.sectorIndex(root)
+		if err == errSectorNotFound {
+			set.release(h)
+			continue
+		} else if err != nil {
+			set.release(h)
+			return crypto.Hash{}, err
+		}
+		newRoot, err := h.UpdateContext(ctx, index, offset, data)
+		if errors.Cause(err) == proto.ErrDesync {
+			// the host may have applied the update; reconnecting locks the
+			// contract again, after which the sector's root reveals whether
+			// it did
+			if h, err = set.connect(ctx, p, lh); err != nil {
+				return crypto.Hash{}, errors.WithMessage(proto.ErrDesync, err.Error())
+			}
+			if roots, rerr := h.SectorRoots(index, 1); rerr != nil {
+				err = errors.WithMessage(proto.ErrDesync, rerr.Error())
+			} else if roots[0] == root {
+				err = errors.New("host did not apply update")
+			} else {
+				newRoot = roots[0]
+			}
+		}
+		if err == nil {
+			delete(lh.sectorIndices, root)
+			lh.sectorIndices[newRoot] = index
+		}
+		set.release(h)
+		return newRoot, err
+	}
+	return crypto.Hash{}, errSectorNotFound
 }
 
 // SetLockTimeout sets the timeout used for all Lock RPCs in Sessions initiated
 // by the HostSet.
 func (set *HostSet) SetLockTimeout(timeout time.Duration) { set.lockTimeout = timeout }
 
+// SetCircuitBreaker configures the circuit breaker of each host in the set.
+// After maxFailures consecutive failed connection attempts, a host's circuit
+// opens for minBackoff; each further failure doubles the backoff, up to
+// maxBackoff.
+func (set *HostSet) SetCircuitBreaker(maxFailures int, minBackoff, maxBackoff time.Duration) {
+	set.maxFailures = maxFailures
+	set.minBackoff = minBackoff
+	set.maxBackoff = maxBackoff
+}
+
+// SetCurrentHeight sets the height used by Sessions subsequently initiated by
+// the HostSet.
+func (set *HostSet) SetCurrentHeight(height types.BlockHeight) {
+	atomic.StoreUint64((*uint64)(&set.currentHeight), uint64(height))
+}
+
+func (set *HostSet) height() types.BlockHeight {
+	return types.BlockHeight(atomic.LoadUint64((*uint64)(&set.currentHeight)))
+}
+
+// SetRevisionRecorder sets the RevisionRecorder of all Sessions subsequently
+// initiated by the HostSet.
+func (set *HostSet) SetRevisionRecorder(revs proto.RevisionRecorder) { set.revs = revs }
+
 // SetOnConnect sets the function called on all newly-connected Sessions.
 func (set *HostSet) SetOnConnect(fn func(*proto.Session)) { set.onConnect = fn }
 
-// AddHost adds a host to the set for later use.
+// AddHost adds a host to the set for later use. If the set already contains a
+// contract with the host, c is added to the host's pool of sessions, allowing
+// the host to be used by multiple callers concurrently. Adding a contract that
+// is already in the set has no effect.
 func (set *HostSet) AddHost(c renter.Contract) {
-	lh := new(lockedHost)
+	set.addHost(c, proto.ContractRevision{})
+}
+
+// addHost is like AddHost, but also supplies the contract's most recent known
+// revision, if valid. When the contract is locked, the host's revision is
+// checked against it, so that a host that has lost revisions is detected
+// before the contract is used.
+func (set *HostSet) addHost(c renter.Contract, rev proto.ContractRevision) {
+	p, ok := set.sessions[c.HostKey]
+	if ok && p.hasContract(c.ID) {
+		return
+	} else if !ok {
+		p = new(hostPool)
+		p.cond.L = &p.mu
+		set.sessions[c.HostKey] = p
+	}
+	lh := &lockedHost{contract: c, rev: rev}
 	// lazy connection function
 	var lastSeen time.Time
-	lh.reconnect = func() error {
+	lh.reconnect = func(ctx context.Context) error {
 		if lh.s != nil && !lh.s.IsClosed() {
 			// if it hasn't been long since the last reconnect, assume the
 			// connection is still open
@@ -172,36 +844,66 @@ func (set *HostSet) AddHost(c renter.Contract) {
 			// caller to handle the reconnection logic after calling whatever
 			// RPC it wants to call; that way, we only do extra work if the host
 			// has actually disconnected. But that feels too burdensome.
-			if _, err := lh.s.Settings(); err == nil {
+			if _, err := lh.s.SettingsContext(ctx); err == nil {
 				lastSeen = time.Now()
 				return nil
+			} else if ctx.Err() != nil {
+				return err
 			}
 			// connection timed out, or some other error occurred; close our
 			// end (just in case) and fallthrough to the reconnection logic
 			lh.s.Close()
 		}
+		c := lh.contract
 		hostIP, err := set.hkr.ResolveHostKey(c.HostKey)
 		if err != nil {
 			return errors.Wrap(err, "could not resolve host key")
 		}
 		// create and lock the session manually so that we can use our custom
 		// lock timeout
-		lh.s, err = proto.NewUnlockedSession(hostIP, c.HostKey, set.currentHeight)
+		lh.s, err = proto.NewUnlockedSessionContext(ctx, hostIP, c.HostKey, set.height())
 		if err != nil {
 			return err
 		}
-		if err := lh.s.Lock(c.ID, c.RenterKey, set.lockTimeout); err != nil {
+		lh.s.SetRevisionRecorder(set.revs)
+		if err := lh.s.LockContext(ctx, c.ID, c.RenterKey, set.lockTimeout); err != nil {
+			lh.s.Close()
+			return err
+		}
+		p.mu.Lock()
+		known := lh.rev
+		p.mu.Unlock()
+		if err := checkHostRevision(known, lh.s.Revision()); err != nil {
 			lh.s.Close()
 			return err
-		} else if _, err := lh.s.Settings(); err != nil {
+		} else if _, err := lh.s.SettingsContext(ctx); err != nil {
 			lh.s.Close()
 			return err
 		}
+		lh.s.SetRPCStatsRecorder(set)
 		set.onConnect(lh.s)
 		lastSeen = time.Now()
 		return nil
 	}
-	set.sessions[c.HostKey] = lh
+	p.add(lh)
+}
+
+// checkHostRevision compares the revision claimed by the host when locking a
+// contract with the most recent revision known to the renter. A newer host
+// revision is expected if the renter crashed before recording it, and is
+// recorded by the Session as usual; an older or conflicting one means that the
+// host has lost or tampered with the contract's state.
+func checkHostRevision(known, host proto.ContractRevision) error {
+	if !known.IsValid() {
+		return nil
+	}
+	knownNum, hostNum := known.Revision.NewRevisionNumber, host.Revision.NewRevisionNumber
+	if hostNum < knownNum {
+		return errors.Errorf("host's revision of contract %v (%v) is older than ours (%v)", known.ID(), hostNum, knownNum)
+	} else if hostNum == knownNum && renterhost.HashRevision(host.Revision) != renterhost.HashRevision(known.Revision) {
+		return errors.Errorf("host's revision of contract %v conflicts with ours", known.ID())
+	}
+	return nil
 }
 
 // NewHostSet creates an empty HostSet using the provided resolver and current
@@ -210,8 +912,12 @@ func NewHostSet(hkr renter.HostKeyResolver, currentHeight types.BlockHeight) *Ho
 	return &HostSet{
 		hkr:           hkr,
 		currentHeight: currentHeight,
-		sessions:      make(map[hostdb.HostPublicKey]*lockedHost),
+		sessions:      make(map[hostdb.HostPublicKey]*hostPool),
 		lockTimeout:   10 * time.Second,
 		onConnect:     func(*proto.Session) {},
+		maxFailures:   3,
+		minBackoff:    5 * time.Second,
+		maxBackoff:    5 * time.Minute,
+		latencies:     make(map[hostdb.HostPublicKey]time.Duration),
 	}
 }
@@ -0,0 +1,37 @@
+package renterutil
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// httpFileSystem implements http.FileSystem.
+type httpFileSystem struct {
+	fs *PseudoFS
+}
+
+// Open implements http.FileSystem.
+func (hfs httpFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+	pf, err := hfs.fs.Open(name)
+	if err != nil {
+		// http.FileServer relies on os.IsNotExist to distinguish 404s
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	return pf, nil
+}
+
+// NewHTTPFileSystem returns an http.FileSystem that serves the files of fs.
+// The returned files are read-only, and support Range requests via Seek.
+func NewHTTPFileSystem(fs *PseudoFS) http.FileSystem {
+	return httpFileSystem{fs}
+}
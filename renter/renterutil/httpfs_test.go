@@ -0,0 +1,79 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestHTTPFileSystem(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+
+	if err := fs.Mkdir("sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(4096)
+	pf, err := fs.Create("sub/foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.FileServer(NewHTTPFileSystem(fs)))
+	defer srv.Close()
+
+	// full download
+	resp, err := http.Get(srv.URL + "/sub/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("unexpected response: %v (%v bytes)", resp.Status, len(body))
+	}
+
+	// range request
+	req, _ := http.NewRequest("GET", srv.URL+"/sub/foo", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[100:200]) {
+		t.Fatalf("unexpected response: %v (%v bytes)", resp.Status, len(body))
+	}
+
+	// missing file
+	resp, err = http.Get(srv.URL + "/sub/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+}
@@ -0,0 +1,110 @@
+// +build go1.16
+
+package renterutil
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// IOFS implements fs.FS, fs.ReadDirFS, and fs.StatFS on top of a PseudoFS.
+type IOFS struct {
+	fs *PseudoFS
+}
+
+func convertPathErr(op, name string, err error) error {
+	cause := errors.Cause(err)
+	switch {
+	case os.IsNotExist(cause):
+		cause = fs.ErrNotExist
+	case os.IsPermission(cause):
+		cause = fs.ErrPermission
+	}
+	return &fs.PathError{Op: op, Path: name, Err: cause}
+}
+
+// Open implements fs.FS.
+func (fsys IOFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	pf, err := fsys.fs.Open(name)
+	if err != nil {
+		return nil, convertPathErr("open", name, err)
+	}
+	return ioFile{pf}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (fsys IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.(ioFile).ReadDir(-1)
+	if err != nil {
+		return nil, convertPathErr("readdir", name, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// Stat implements fs.StatFS.
+func (fsys IOFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := fsys.fs.Stat(name)
+	if err != nil {
+		return nil, convertPathErr("stat", name, err)
+	}
+	return namedFileInfo{info, path.Base(name)}, nil
+}
+
+// NewIOFS returns an IOFS that provides read-only access to the files of fs.
+func NewIOFS(fs *PseudoFS) IOFS {
+	return IOFS{fs}
+}
+
+// ioFile implements fs.ReadDirFile. Its embedded PseudoFile also supports
+// io.ReaderAt and io.Seeker.
+type ioFile struct {
+	*PseudoFile
+}
+
+// Stat implements fs.File.
+func (f ioFile) Stat() (fs.FileInfo, error) {
+	info, err := f.PseudoFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// open files report their full path, but fs.FileInfo requires the base name
+	return namedFileInfo{info, path.Base(f.Name())}, nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f ioFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i := range infos {
+		entries[i] = dirEntry{infos[i]}
+	}
+	return entries, err
+}
+
+// dirEntry implements fs.DirEntry.
+type dirEntry struct {
+	info fs.FileInfo
+}
+
+func (e dirEntry) Name() string               { return e.info.Name() }
+func (e dirEntry) IsDir() bool                { return e.info.IsDir() }
+func (e dirEntry) Type() fs.FileMode          { return e.info.Mode().Type() }
+func (e dirEntry) Info() (fs.FileInfo, error) { return e.info, nil }
@@ -0,0 +1,83 @@
+// +build go1.16
+
+package renterutil
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestIOFS(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	pfs := NewFileSystem(dir, tfs.hosts)
+
+	if err := pfs.Mkdir("sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(4096)
+	for _, name := range []string{"sub/foo", "bar"} {
+		pf, err := pfs.Create(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := NewIOFS(pfs)
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []string{".", "bar", "sub", "sub/foo"}; len(walked) != len(exp) {
+		t.Fatalf("expected to walk %v, got %v", exp, walked)
+	} else {
+		for i := range exp {
+			if walked[i] != exp[i] {
+				t.Fatalf("expected to walk %v, got %v", exp, walked)
+			}
+		}
+	}
+
+	if b, err := fs.ReadFile(fsys, "sub/foo"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, data) {
+		t.Fatal("contents do not match data")
+	}
+	if info, err := fs.Stat(fsys, "sub/foo"); err != nil {
+		t.Fatal(err)
+	} else if info.Name() != "foo" || info.Size() != int64(len(data)) {
+		t.Fatalf("unexpected file info: %v %v", info.Name(), info.Size())
+	}
+	if _, err := fsys.Open("sub/baz"); !os.IsNotExist(err) {
+		t.Fatal("expected ErrNotExist, got", err)
+	}
+	if _, err := fsys.Open("/bar"); err == nil {
+		t.Fatal("expected invalid path to be rejected")
+	}
+}
@@ -0,0 +1,332 @@
+package renterutil
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+)
+
+// journal operation types
+const (
+	journalCreate = iota + 1
+	journalWrite
+	journalTruncate
+	journalChmod
+	journalRemove
+	journalChtimes
+)
+
+// size of a journal record header: the payload length, followed by a checksum
+// of the payload
+const journalHeaderSize = 8 + crypto.HashSize
+
+// A journalOp is a modification to an open file that has not yet been
+// committed to its metafile.
+type journalOp struct {
+	typ       uint8
+	name      string
+	offset    int64 // for writes and truncates; the mtime, for chtimes
+	mode      os.FileMode
+	minShards int
+	data      []byte
+}
+
+func (op journalOp) marshal() []byte {
+	b := make([]byte, journalHeaderSize+1+8+len(op.name)+8+4+8+len(op.data))
+	p := b[journalHeaderSize:]
+	p[0] = op.typ
+	binary.LittleEndian.PutUint64(p[1:], uint64(len(op.name)))
+	n := 9 + copy(p[9:], op.name)
+	binary.LittleEndian.PutUint64(p[n:], uint64(op.offset))
+	binary.LittleEndian.PutUint32(p[n+8:], uint32(op.mode))
+	binary.LittleEndian.PutUint64(p[n+12:], uint64(op.minShards))
+	copy(p[n+20:], op.data)
+
+	binary.LittleEndian.PutUint64(b[:8], uint64(len(p)))
+	checksum := crypto.HashBytes(p)
+	copy(b[8:], checksum[:])
+	return b
+}
+
+func (op *journalOp) unmarshal(p []byte) error {
+	if len(p) < 9+20 {
+		return io.ErrUnexpectedEOF
+	}
+	op.typ = p[0]
+	nameLen := binary.LittleEndian.Uint64(p[1:])
+	if nameLen > uint64(len(p)-9-20) {
+		return io.ErrUnexpectedEOF
+	}
+	n := 9 + int(nameLen)
+	op.name = string(p[9:n])
+	op.offset = int64(binary.LittleEndian.Uint64(p[n:]))
+	op.mode = os.FileMode(binary.LittleEndian.Uint32(p[n+8:]))
+	op.minShards = int(binary.LittleEndian.Uint64(p[n+12:]))
+	op.data = append([]byte(nil), p[n+20:]...)
+	if op.typ < journalCreate || op.typ > journalChtimes {
+		return errors.Errorf("unknown journal operation %v", op.typ)
+	}
+	return nil
+}
+
+// A journal is an append-only log of journalOps. Each op is synced to disk
+// before append returns.
+type journal struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	n    int64 // size of f
+}
+
+func (j *journal) append(op journalOp) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	b := op.marshal()
+	if _, err := j.f.Write(b); err != nil {
+		return errors.Wrap(err, "could not write to journal")
+	}
+	j.n += int64(len(b))
+	return errors.Wrap(j.f.Sync(), "could not sync journal")
+}
+
+// size returns the current size of the journal. It can be passed to discard
+// to remove every op appended before size was called.
+func (j *journal) size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.n
+}
+
+// discard removes the ops stored before offset mark, which must have been
+// returned by size. Ops appended after mark are preserved. It should only be
+// called once every op before mark has been committed.
+func (j *journal) discard(mark int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if mark == 0 {
+		return nil
+	} else if mark >= j.n {
+		return j.truncate()
+	}
+
+	// copy the remaining ops to a new file, then atomically replace the
+	// journal with it
+	tail := make([]byte, j.n-mark)
+	if _, err := j.f.ReadAt(tail, mark); err != nil {
+		return errors.Wrap(err, "could not read journal")
+	}
+	tmpPath := j.path + "_tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not create journal")
+	} else if _, err := f.Write(tail); err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not write to journal")
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not sync journal")
+	} else if err := os.Rename(tmpPath, j.path); err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not replace journal")
+	}
+	j.f.Close()
+	j.f = f
+	j.n = int64(len(tail))
+	return nil
+}
+
+// reset discards all ops in the journal. It should only be called once every
+// op has been committed.
+func (j *journal) reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.truncate()
+}
+
+func (j *journal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return errors.Wrap(err, "could not truncate journal")
+	} else if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "could not truncate journal")
+	}
+	j.n = 0
+	return errors.Wrap(j.f.Sync(), "could not sync journal")
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// openJournal opens the journal at path, creating it if necessary, and returns
+// the ops stored in it. If the journal ends with an incomplete or corrupt op,
+// e.g. due to a crash during append, the op is discarded.
+func openJournal(path string) (*journal, []journalOp, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not open journal")
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "could not read journal")
+	}
+	var ops []journalOp
+	var valid int64
+	for len(b) >= journalHeaderSize {
+		n := binary.LittleEndian.Uint64(b[:8])
+		if n > uint64(len(b)-journalHeaderSize) {
+			break
+		}
+		p := b[journalHeaderSize:][:n]
+		var checksum crypto.Hash
+		copy(checksum[:], b[8:])
+		var op journalOp
+		if crypto.HashBytes(p) != checksum || op.unmarshal(p) != nil {
+			break
+		}
+		ops = append(ops, op)
+		b = b[journalHeaderSize+n:]
+		valid += journalHeaderSize + int64(n)
+	}
+	// discard any trailing garbage, so that new ops are not appended after it
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "could not truncate journal")
+	} else if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "could not seek journal")
+	}
+	return &journal{path: path, f: f, n: valid}, ops, nil
+}
+
+func (fs *PseudoFS) journalOp(op journalOp) error {
+	if fs.journal == nil {
+		return nil
+	}
+	return fs.journal.append(op)
+}
+
+// replayJournal applies ops to fs and flushes the result to hosts.
+func (fs *PseudoFS) replayJournal(ops []journalOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	fds := make(map[string]int)
+	lookup := func(name string) (*openMetaFile, error) {
+		if fd, ok := fds[name]; ok {
+			f, _ := PseudoFile{fd: fd, fs: fs}.lookupFD()
+			return f, nil
+		}
+		pf, err := fs.OpenFile(name, os.O_RDWR, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		fds[name] = pf.fd
+		f, _ := pf.lookupFD()
+		return f, nil
+	}
+	drop := func(name string) error {
+		fd, ok := fds[name]
+		if !ok {
+			return nil
+		}
+		delete(fds, name)
+		pf := PseudoFile{fd: fd, fs: fs}
+		f, _ := pf.lookupFD()
+		if err := pf.Close(); err != nil {
+			return err
+		}
+		return fs.dropClosed(fd, f)
+	}
+	for _, op := range ops {
+		switch op.typ {
+		case journalCreate:
+			if err := drop(op.name); err != nil {
+				return err
+			}
+			pf, err := fs.OpenFile(op.name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, op.mode, op.minShards)
+			if err != nil {
+				return err
+			}
+			fds[op.name] = pf.fd
+		case journalWrite:
+			f, err := lookup(op.name)
+			if err != nil {
+				return err
+			}
+			f.mu.Lock()
+			_, err = fs.fileWriteAt(context.Background(), f, op.data, op.offset)
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case journalTruncate:
+			f, err := lookup(op.name)
+			if err != nil {
+				return err
+			}
+			f.mu.Lock()
+			err = fs.fileTruncate(f, op.offset)
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case journalChmod:
+			if _, err := lookup(op.name); err != nil {
+				return err
+			} else if err := fs.Chmod(op.name, op.mode); err != nil {
+				return err
+			}
+		case journalRemove:
+			if err := drop(op.name); err != nil {
+				return err
+			}
+		case journalChtimes:
+			mtime := time.Unix(0, op.offset)
+			if _, err := lookup(op.name); err != nil {
+				return err
+			} else if err := fs.Chtimes(op.name, mtime, mtime); err != nil {
+				return err
+			}
+		}
+	}
+	// replayed files are deleted from fs.files once they are flushed
+	for _, fd := range fds {
+		if err := (PseudoFile{fd: fd, fs: fs}).Close(); err != nil {
+			return err
+		}
+	}
+	return fs.flushSectors()
+}
+
+// NewJournaledFileSystem returns a PseudoFS that records uncommitted writes and
+// metadata changes in a journal at journalPath before acknowledging them. If
+// the journal contains changes that were not committed, e.g. because the
+// process crashed, they are replayed and flushed to hosts before
+// NewJournaledFileSystem returns. The journal is emptied whenever all changes
+// have been committed.
+func NewJournaledFileSystem(root string, hosts *HostSet, journalPath string) (*PseudoFS, error) {
+	fs := NewFileSystem(root, hosts)
+	j, ops, err := openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.replayJournal(ops); err != nil {
+		j.Close()
+		return nil, errors.Wrap(err, "could not replay journal")
+	} else if err := j.reset(); err != nil {
+		j.Close()
+		return nil, err
+	}
+	fs.journal = j
+	return fs, nil
+}
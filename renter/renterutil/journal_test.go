@@ -0,0 +1,113 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestJournalReplay(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	journalPath := filepath.Join(dir, "journal")
+	fs, err := NewJournaledFileSystem(dir, tfs.hosts, journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write some data and change the file's mode, without syncing
+	data := frand.Bytes(3000)
+	pf, err := fs.Create("foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data[:2000]); err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.WriteAt(data[2000:], 2000); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Chmod("foo", 0600); err != nil {
+		t.Fatal(err)
+	}
+	// create and remove a file; it should not be resurrected
+	pf2, err := fs.Create("bar", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf2.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf2.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Remove("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.store.Stat("foo"); !isNotExist(err) {
+		t.Fatal("metafile should not exist before flush")
+	}
+
+	// simulate a crash midway through appending to the journal
+	jf, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := jf.Write(journalOp{typ: journalWrite, name: "foo", data: []byte("torn")}.marshal()[:30]); err != nil {
+		t.Fatal(err)
+	}
+	jf.Close()
+
+	// reopen the filesystem; the journal should be replayed and flushed
+	fs, err = NewJournaledFileSystem(dir, tfs.hosts, journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(journalPath); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 0 {
+		t.Fatal("journal should be empty after replay, has size", stat.Size())
+	}
+	pf, err = fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := pf.Stat(); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode() != 0600 {
+		t.Fatal("wrong mode:", stat.Mode())
+	}
+	buf := make([]byte, len(data))
+	if _, err := pf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, data) {
+		t.Fatal("replayed data does not match")
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("bar"); err == nil {
+		t.Fatal("removed file should not be replayed")
+	}
+
+	// syncing should empty the journal
+	pf, err = fs.OpenFile("foo", os.O_RDWR, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(journalPath); stat.Size() == 0 {
+		t.Fatal("write was not journaled")
+	}
+	if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if stat, _ := os.Stat(journalPath); stat.Size() != 0 {
+		t.Fatal("journal should be empty after sync")
+	}
+}
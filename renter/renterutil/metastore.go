@@ -0,0 +1,659 @@
+package renterutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/encoding"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/renter"
+)
+
+// A MetaStore stores the metadata of a PseudoFS: its directory tree and the
+// metafile of each file within it.
+//
+// Names are slash-separated paths relative to the root of the store, cleaned
+// as by path.Clean; the root itself is ".". Errors for nonexistent files and
+// directories satisfy os.IsNotExist (after errors.Cause), and the FileInfo of
+// a file returns its renter.MetaIndex from its Sys method.
+type MetaStore interface {
+	// Stat returns the FileInfo of the named file or directory.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the FileInfos of the files and directories within the
+	// named directory, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Walk calls fn for each file (but not directory) within the named
+	// directory and its subdirectories. The entries of each directory are
+	// visited in lexical order. If fn returns an error, Walk stops and
+	// returns that error.
+	Walk(dir string, fn func(name string, info os.FileInfo) error) error
+	// ReadMetaFile returns the named metafile.
+	ReadMetaFile(name string) (*renter.MetaFile, error)
+	// WriteMetaFiles creates or replaces each of the specified metafiles. The
+	// parent directory of each file must already exist.
+	WriteMetaFiles(files map[string]*renter.MetaFile) error
+	// Mkdir creates the named directory with the specified permission bits.
+	Mkdir(name string, perm os.FileMode) error
+	// MkdirAll creates the named directory, along with any necessary parents.
+	MkdirAll(name string, perm os.FileMode) error
+	// Chmod changes the mode of the named directory.
+	Chmod(name string, mode os.FileMode) error
+	// Chtimes changes the access and modification times of the named
+	// directory.
+	Chtimes(name string, atime, mtime time.Time) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// RemoveAll removes the named file or directory and any children it
+	// contains. If the name does not exist, RemoveAll returns nil.
+	RemoveAll(name string) error
+	// Rename renames (moves) the named file or directory.
+	Rename(oldname, newname string) error
+}
+
+// storeName returns the name under which the named file is stored in a
+// MetaStore.
+func storeName(name string) string {
+	return path.Clean(strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/"))
+}
+
+func isNotExist(err error) bool {
+	return os.IsNotExist(errors.Cause(err))
+}
+
+// helper type to implement os.FileInfo for directories
+type dirInfo struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i dirInfo) Name() string       { return i.name }
+func (i dirInfo) Size() int64        { return 0 }
+func (i dirInfo) Mode() os.FileMode  { return i.mode }
+func (i dirInfo) ModTime() time.Time { return i.modTime }
+func (i dirInfo) IsDir() bool        { return true }
+func (i dirInfo) Sys() interface{}   { return nil }
+
+var errDirNotEmpty = errors.New("directory not empty")
+
+// A DirStore is a MetaStore that stores each metafile as a separate archive
+// within a directory tree on disk. This is the traditional layout of a
+// PseudoFS.
+//
+// Each metafile is written atomically, but WriteMetaFiles is not atomic as a
+// whole: if it fails, some of the metafiles may have been written.
+type DirStore struct {
+	root string
+}
+
+func (ds *DirStore) path(name string) string {
+	return filepath.Join(ds.root, filepath.FromSlash(name))
+}
+
+// Stat implements MetaStore.
+func (ds *DirStore) Stat(name string) (os.FileInfo, error) {
+	p := ds.path(name)
+	if isDir(p) {
+		return os.Stat(p)
+	}
+	index, err := renter.ReadMetaIndex(p + metafileExt)
+	if err != nil {
+		return nil, err
+	}
+	return pseudoFileInfo{name: path.Base(name), m: index}, nil
+}
+
+// ReadDir implements MetaStore.
+func (ds *DirStore) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, err := os.Open(ds.path(name))
+	if err != nil {
+		return nil, err
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	files := infos[:0]
+	for _, info := range infos {
+		if !info.IsDir() {
+			if !strings.HasSuffix(info.Name(), metafileExt) {
+				continue // not a metafile
+			}
+			index, err := renter.ReadMetaIndex(filepath.Join(dir.Name(), info.Name()))
+			if err != nil {
+				return nil, err
+			}
+			info = pseudoFileInfo{
+				name: strings.TrimSuffix(info.Name(), metafileExt),
+				m:    index,
+			}
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
+}
+
+// Walk implements MetaStore.
+func (ds *DirStore) Walk(dir string, fn func(name string, info os.FileInfo) error) error {
+	return filepath.Walk(ds.path(dir), func(p string, info os.FileInfo, err error) error {
+		if (info != nil && info.IsDir()) || !strings.HasSuffix(p, metafileExt) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(ds.root, strings.TrimSuffix(p, metafileExt))
+		if err != nil {
+			return err
+		}
+		index, err := renter.ReadMetaIndex(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		return fn(name, pseudoFileInfo{name: path.Base(name), m: index})
+	})
+}
+
+// ReadMetaFile implements MetaStore.
+func (ds *DirStore) ReadMetaFile(name string) (*renter.MetaFile, error) {
+	return renter.ReadMetaFile(ds.path(name) + metafileExt)
+}
+
+// WriteMetaFiles implements MetaStore.
+func (ds *DirStore) WriteMetaFiles(files map[string]*renter.MetaFile) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := renter.WriteMetaFile(ds.path(name)+metafileExt, files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mkdir implements MetaStore.
+func (ds *DirStore) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(ds.path(name), perm)
+}
+
+// MkdirAll implements MetaStore.
+func (ds *DirStore) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(ds.path(name), perm)
+}
+
+// Chmod implements MetaStore.
+func (ds *DirStore) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(ds.path(name), mode)
+}
+
+// Chtimes implements MetaStore.
+func (ds *DirStore) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(ds.path(name), atime, mtime)
+}
+
+// Remove implements MetaStore.
+func (ds *DirStore) Remove(name string) error {
+	p := ds.path(name)
+	if !isDir(p) {
+		p += metafileExt
+	}
+	return os.Remove(p)
+}
+
+// RemoveAll implements MetaStore.
+func (ds *DirStore) RemoveAll(name string) error {
+	p := ds.path(name)
+	if !isDir(p) {
+		p += metafileExt
+	}
+	return os.RemoveAll(p)
+}
+
+// Rename implements MetaStore.
+func (ds *DirStore) Rename(oldname, newname string) error {
+	oldpath, newpath := ds.path(oldname), ds.path(newname)
+	if !isDir(oldpath) {
+		oldpath += metafileExt
+		if !isDir(newpath) {
+			newpath += metafileExt
+		}
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// NewDirStore returns a DirStore rooted at root, which must be a directory
+// containing only metafiles and other directories.
+func NewDirStore(root string) *DirStore {
+	return &DirStore{root: root}
+}
+
+// bolt store buckets
+var (
+	// bucketMetaEntries maps each file and directory to its MetaIndex,
+	// encoded as JSON. Directories are identified by the os.ModeDir bit of
+	// their mode. Keys are the name of the parent directory, followed by a
+	// zero byte and the base name, so that the entries of each directory
+	// are stored contiguously.
+	bucketMetaEntries = []byte("bucketMetaEntries")
+
+	// bucketMetaShards maps the name of each file to the shards of its
+	// metafile.
+	bucketMetaShards = []byte("bucketMetaShards")
+
+	metaStoreBuckets = [][]byte{
+		bucketMetaEntries,
+		bucketMetaShards,
+	}
+)
+
+// entryKey returns the bucketMetaEntries key for the named file.
+func entryKey(name string) []byte {
+	return []byte(path.Dir(name) + "\x00" + path.Base(name))
+}
+
+// A BoltStore is a MetaStore that stores all metadata in a single bolt
+// database. Each method of a BoltStore is atomic; in particular,
+// WriteMetaFiles either writes every metafile or none of them, and renaming a
+// directory moves all of its contents at once.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func getEntry(tx *bolt.Tx, name string) (renter.MetaIndex, bool, error) {
+	if name == "." {
+		return renter.MetaIndex{Mode: os.ModeDir | 0700}, true, nil
+	}
+	v := tx.Bucket(bucketMetaEntries).Get(entryKey(name))
+	if v == nil {
+		return renter.MetaIndex{}, false, nil
+	}
+	var index renter.MetaIndex
+	err := json.Unmarshal(v, &index)
+	return index, true, err
+}
+
+func putEntry(tx *bolt.Tx, name string, index renter.MetaIndex) error {
+	v, _ := json.Marshal(index)
+	return tx.Bucket(bucketMetaEntries).Put(entryKey(name), v)
+}
+
+func entryInfo(name string, index renter.MetaIndex) os.FileInfo {
+	if index.Mode.IsDir() {
+		return dirInfo{name: path.Base(name), mode: index.Mode, modTime: index.ModTime}
+	}
+	return pseudoFileInfo{name: path.Base(name), m: index}
+}
+
+// checkParent returns an error if the parent directory of name does not
+// exist.
+func checkParent(tx *bolt.Tx, op, name string) error {
+	parent, ok, err := getEntry(tx, path.Dir(name))
+	if err != nil {
+		return err
+	} else if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	} else if !parent.Mode.IsDir() {
+		return &os.PathError{Op: op, Path: name, Err: ErrNotDirectory}
+	}
+	return nil
+}
+
+// Stat implements MetaStore.
+func (bs *BoltStore) Stat(name string) (info os.FileInfo, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		index, ok, err := getEntry(tx, name)
+		if err != nil {
+			return err
+		} else if !ok {
+			return &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		info = entryInfo(name, index)
+		return nil
+	})
+	return
+}
+
+// ReadDir implements MetaStore.
+func (bs *BoltStore) ReadDir(name string) (infos []os.FileInfo, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		index, ok, err := getEntry(tx, name)
+		if err != nil {
+			return err
+		} else if !ok {
+			return &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+		} else if !index.Mode.IsDir() {
+			return &os.PathError{Op: "readdir", Path: name, Err: ErrNotDirectory}
+		}
+		prefix := []byte(name + "\x00")
+		c := tx.Bucket(bucketMetaEntries).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var index renter.MetaIndex
+			if err := json.Unmarshal(v, &index); err != nil {
+				return err
+			}
+			infos = append(infos, entryInfo(string(k[len(prefix):]), index))
+		}
+		return nil
+	})
+	return
+}
+
+// Walk implements MetaStore.
+func (bs *BoltStore) Walk(dir string, fn func(name string, info os.FileInfo) error) error {
+	// read each directory in a separate transaction, so that fn can use the
+	// store
+	infos, err := bs.ReadDir(dir)
+	if isNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			err = bs.Walk(name, fn)
+		} else {
+			err = fn(name, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMetaFile implements MetaStore.
+func (bs *BoltStore) ReadMetaFile(name string) (m *renter.MetaFile, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		index, ok, err := getEntry(tx, name)
+		if err != nil {
+			return err
+		} else if !ok {
+			return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		} else if index.Mode.IsDir() {
+			return &os.PathError{Op: "open", Path: name, Err: ErrDirectory}
+		}
+		m = &renter.MetaFile{MetaIndex: index}
+		return encoding.Unmarshal(tx.Bucket(bucketMetaShards).Get([]byte(name)), &m.Shards)
+	})
+	return
+}
+
+// WriteMetaFiles implements MetaStore.
+func (bs *BoltStore) WriteMetaFiles(files map[string]*renter.MetaFile) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for name, m := range files {
+			if len(m.Shards) != len(m.Hosts) {
+				return errors.Errorf("invalid metafile %v: number of shards (%v) does not match number of hosts (%v)", name, len(m.Shards), len(m.Hosts))
+			} else if err := checkParent(tx, "write", name); err != nil {
+				return err
+			}
+			if index, ok, err := getEntry(tx, name); err != nil {
+				return err
+			} else if ok && index.Mode.IsDir() {
+				return &os.PathError{Op: "write", Path: name, Err: ErrDirectory}
+			}
+			if err := putEntry(tx, name, m.MetaIndex); err != nil {
+				return err
+			} else if err := tx.Bucket(bucketMetaShards).Put([]byte(name), encoding.Marshal(m.Shards)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func mkdir(tx *bolt.Tx, name string, perm os.FileMode) error {
+	if err := checkParent(tx, "mkdir", name); err != nil {
+		return err
+	} else if _, ok, err := getEntry(tx, name); err != nil {
+		return err
+	} else if ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return putEntry(tx, name, renter.MetaIndex{
+		Mode:    os.ModeDir | perm.Perm(),
+		ModTime: time.Now(),
+	})
+}
+
+// Mkdir implements MetaStore.
+func (bs *BoltStore) Mkdir(name string, perm os.FileMode) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return mkdir(tx, name, perm)
+	})
+}
+
+// MkdirAll implements MetaStore.
+func (bs *BoltStore) MkdirAll(name string, perm os.FileMode) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		var dir string
+		for _, elem := range strings.Split(name, "/") {
+			dir = path.Join(dir, elem)
+			index, ok, err := getEntry(tx, dir)
+			if err != nil {
+				return err
+			} else if !ok {
+				if err := mkdir(tx, dir, perm); err != nil {
+					return err
+				}
+			} else if !index.Mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: ErrNotDirectory}
+			}
+		}
+		return nil
+	})
+}
+
+// updateDir applies fn to the MetaIndex of the named directory.
+func (bs *BoltStore) updateDir(op, name string, fn func(*renter.MetaIndex)) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		index, ok, err := getEntry(tx, name)
+		if err != nil {
+			return err
+		} else if !ok || name == "." {
+			return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		} else if !index.Mode.IsDir() {
+			return &os.PathError{Op: op, Path: name, Err: ErrNotDirectory}
+		}
+		fn(&index)
+		return putEntry(tx, name, index)
+	})
+}
+
+// Chmod implements MetaStore.
+func (bs *BoltStore) Chmod(name string, mode os.FileMode) error {
+	return bs.updateDir("chmod", name, func(index *renter.MetaIndex) {
+		index.Mode = os.ModeDir | mode.Perm()
+	})
+}
+
+// Chtimes implements MetaStore.
+func (bs *BoltStore) Chtimes(name string, atime, mtime time.Time) error {
+	return bs.updateDir("chtimes", name, func(index *renter.MetaIndex) {
+		index.ModTime = mtime
+	})
+}
+
+// Remove implements MetaStore.
+func (bs *BoltStore) Remove(name string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		index, ok, err := getEntry(tx, name)
+		if err != nil {
+			return err
+		} else if !ok || name == "." {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		} else if index.Mode.IsDir() {
+			prefix := []byte(name + "\x00")
+			if k, _ := tx.Bucket(bucketMetaEntries).Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+			}
+		}
+		if err := tx.Bucket(bucketMetaEntries).Delete(entryKey(name)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMetaShards).Delete([]byte(name))
+	})
+}
+
+// prefixKeys returns every key in b that begins with prefix.
+func prefixKeys(b *bolt.Bucket, prefix []byte) (keys [][]byte) {
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+// descendants returns the bucketMetaEntries and bucketMetaShards keys of every
+// entry within dir or one of its subdirectories.
+func descendants(tx *bolt.Tx, dir string) (entries, shards [][]byte) {
+	eb, sb := tx.Bucket(bucketMetaEntries), tx.Bucket(bucketMetaShards)
+	if dir == "." {
+		return prefixKeys(eb, nil), prefixKeys(sb, nil)
+	}
+	entries = append(prefixKeys(eb, []byte(dir+"\x00")), prefixKeys(eb, []byte(dir+"/"))...)
+	return entries, prefixKeys(sb, []byte(dir+"/"))
+}
+
+// RemoveAll implements MetaStore.
+func (bs *BoltStore) RemoveAll(name string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		index, ok, err := getEntry(tx, name)
+		if err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		entries, shards := [][]byte{entryKey(name)}, [][]byte{[]byte(name)}
+		if name == "." {
+			entries, shards = nil, nil
+		}
+		if index.Mode.IsDir() {
+			e, s := descendants(tx, name)
+			entries = append(entries, e...)
+			shards = append(shards, s...)
+		}
+		for _, k := range entries {
+			if err := tx.Bucket(bucketMetaEntries).Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range shards {
+			if err := tx.Bucket(bucketMetaShards).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rename implements MetaStore.
+func (bs *BoltStore) Rename(oldname, newname string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		linkErr := func(err error) error {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		if oldname == newname {
+			return nil
+		} else if oldname == "." || newname == "." || strings.HasPrefix(newname, oldname+"/") {
+			return linkErr(os.ErrInvalid)
+		}
+		oldIndex, ok, err := getEntry(tx, oldname)
+		if err != nil {
+			return err
+		} else if !ok {
+			return linkErr(os.ErrNotExist)
+		} else if err := checkParent(tx, "rename", newname); err != nil {
+			return err
+		}
+		if newIndex, ok, err := getEntry(tx, newname); err != nil {
+			return err
+		} else if ok && newIndex.Mode.IsDir() {
+			// as with rename(2), a directory may only replace an empty
+			// directory, and a file may not replace a directory
+			prefix := []byte(newname + "\x00")
+			if !oldIndex.Mode.IsDir() {
+				return linkErr(ErrDirectory)
+			} else if k, _ := tx.Bucket(bucketMetaEntries).Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+				return linkErr(errDirNotEmpty)
+			}
+		} else if ok && oldIndex.Mode.IsDir() {
+			return linkErr(ErrNotDirectory)
+		}
+
+		entries, shards := [][]byte{entryKey(oldname)}, [][]byte{[]byte(oldname)}
+		if oldIndex.Mode.IsDir() {
+			e, s := descendants(tx, oldname)
+			entries = append(entries, e...)
+			shards = append(shards, s...)
+		}
+		eb, sb := tx.Bucket(bucketMetaEntries), tx.Bucket(bucketMetaShards)
+		for _, k := range entries {
+			v := eb.Get(k)
+			newKey := entryKey(newname)
+			if !bytes.Equal(k, entryKey(oldname)) {
+				newKey = append([]byte(newname), k[len(oldname):]...)
+			}
+			if err := eb.Put(newKey, append([]byte(nil), v...)); err != nil {
+				return err
+			} else if err := eb.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range shards {
+			v := sb.Get(k)
+			if v == nil {
+				continue
+			}
+			newKey := append([]byte(newname), k[len(oldname):]...)
+			if err := sb.Put(newKey, append([]byte(nil), v...)); err != nil {
+				return err
+			} else if err := sb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the store's database.
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// NewBoltStore returns a BoltStore backed by the specified database file,
+// creating it if it does not exist.
+func NewBoltStore(filename string) (*BoltStore, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range metaStoreBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
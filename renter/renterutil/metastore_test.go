@@ -0,0 +1,242 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+func TestMetaStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBoltStore(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	for _, test := range []struct {
+		name  string
+		store MetaStore
+	}{
+		{"dir", NewDirStore(filepath.Join(dir, "dir"))},
+		{"bolt", bs},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testMetaStore(t, test.store)
+		})
+	}
+}
+
+func testMetaStore(t *testing.T, store MetaStore) {
+	hpk := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	newMetaFile := func() *renter.MetaFile {
+		m := renter.NewMetaFile(0640, 100, []hostdb.HostPublicKey{hpk}, 1)
+		m.Shards[0] = []renter.SectorSlice{{
+			MerkleRoot:  frand.Entropy256(),
+			NumSegments: 1,
+			Nonce:       frand.Entropy192(),
+		}}
+		return m
+	}
+	checkDir := func(dir string, exp ...string) {
+		t.Helper()
+		infos, err := store.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(infos))
+		for i := range infos {
+			names[i] = infos[i].Name()
+		}
+		if len(names) != len(exp) || (len(exp) > 0 && !reflect.DeepEqual(names, exp)) {
+			t.Fatalf("expected %v to contain %v, got %v", dir, exp, names)
+		}
+	}
+	checkFile := func(name string, m *renter.MetaFile) {
+		t.Helper()
+		m2, err := store.ReadMetaFile(name)
+		if err != nil {
+			t.Fatal(err)
+		} else if m2.Filesize != m.Filesize || m2.MasterKey != m.MasterKey || !reflect.DeepEqual(m2.Shards, m.Shards) {
+			t.Fatalf("metafile %v does not match", name)
+		}
+		info, err := store.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		} else if info.IsDir() || info.Size() != m.Filesize || info.Mode() != m.Mode {
+			t.Fatalf("metafile %v has wrong FileInfo", name)
+		} else if index, ok := info.Sys().(renter.MetaIndex); !ok || index.MasterKey != m.MasterKey {
+			t.Fatalf("metafile %v has wrong MetaIndex", name)
+		}
+	}
+
+	// create some directories and files
+	if err := store.MkdirAll("a/b", 0700); err != nil {
+		t.Fatal(err)
+	} else if err := store.Mkdir("c", 0700); err != nil {
+		t.Fatal(err)
+	} else if err := store.Mkdir("c", 0700); !os.IsExist(err) {
+		t.Fatal("expected IsExist error, got", err)
+	}
+	files := map[string]*renter.MetaFile{
+		"foo":     newMetaFile(),
+		"a/bar":   newMetaFile(),
+		"a/b/baz": newMetaFile(),
+	}
+	if err := store.WriteMetaFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range files {
+		checkFile(name, m)
+	}
+	if err := store.WriteMetaFiles(map[string]*renter.MetaFile{"nonexistent/foo": newMetaFile()}); !isNotExist(err) {
+		t.Fatal("expected IsNotExist error, got", err)
+	}
+	checkDir(".", "a", "c", "foo")
+	checkDir("a", "b", "bar")
+	if info, err := store.Stat("a"); err != nil {
+		t.Fatal(err)
+	} else if !info.IsDir() {
+		t.Fatal("expected a to be a directory")
+	}
+
+	// walk should visit every file
+	var walked []string
+	err := store.Walk(".", func(name string, info os.FileInfo) error {
+		walked = append(walked, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []string{"a/b/baz", "a/bar", "foo"}; !reflect.DeepEqual(walked, exp) {
+		t.Fatalf("expected to walk %v, got %v", exp, walked)
+	}
+
+	// renaming a directory should move its contents
+	if err := store.Rename("a", "c/d"); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(".", "c", "foo")
+	checkDir("c/d", "b", "bar")
+	checkFile("c/d/bar", files["a/bar"])
+	checkFile("c/d/b/baz", files["a/b/baz"])
+	if _, err := store.Stat("a/bar"); !isNotExist(err) {
+		t.Fatal("expected IsNotExist error, got", err)
+	}
+
+	// removing a non-empty directory should fail
+	if err := store.Remove("c/d"); err == nil {
+		t.Fatal("expected error when removing non-empty directory")
+	} else if err := store.Remove("foo"); err != nil {
+		t.Fatal(err)
+	} else if err := store.RemoveAll("c"); err != nil {
+		t.Fatal(err)
+	} else if err := store.RemoveAll("c"); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(".")
+	if _, err := store.ReadMetaFile("c/d/b/baz"); !isNotExist(err) {
+		t.Fatal("expected IsNotExist error, got", err)
+	}
+}
+
+func TestFileSystemBoltStore(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewBoltStore(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tfs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	fs := NewFileSystemWithStore(store, tfs.hosts)
+
+	// write some files, flushing them all at once
+	if err := fs.MkdirAll("dir/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{
+		"dir/foo":     frand.Bytes(100),
+		"dir/sub/bar": frand.Bytes(200),
+	}
+	for name, data := range contents {
+		pf, err := fs.Create(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.flushSectors(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rename the directory and read back the files
+	if err := fs.Rename("dir", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := fs.Open("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []string{"foo", "sub"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected %v, got %v", exp, names)
+	}
+	for name, data := range contents {
+		name = "renamed" + name[len("dir"):]
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadAll(pf)
+		pf.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatalf("contents of %v do not match", name)
+		}
+	}
+
+	// GC should not delete any sectors referenced by the store
+	if err := fs.GC(); err != nil {
+		t.Fatal(err)
+	}
+	pf, err := fs.Open("renamed/sub/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if p, err := ioutil.ReadAll(pf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, contents["dir/sub/bar"]) {
+		t.Fatal("contents do not match after GC")
+	}
+}
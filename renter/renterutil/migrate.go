@@ -1,7 +1,9 @@
 package renterutil
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -146,6 +148,121 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 	return nil
 }
 
+// RepairFile migrates f to the Migrator's new host set without access to the
+// original file data. For each chunk of f, RepairFile downloads f.MinShards
+// shards from the hosts of f that remain in the HostSet, and reconstructs the
+// shards of the hosts that do not. As with AddFile, the migration may not be
+// complete until the Flush method has been called, and onFinish is called on
+// the new metafile when the file has been fully migrated.
+func (m *Migrator) RepairFile(f *renter.MetaFile, onFinish func(*renter.MetaFile) error) error {
+	newHosts := replaceHosts(f.Hosts, m.hosts)
+	newShards := make([][]renter.SectorSlice, len(newHosts))
+	var available []int
+	for i := range newHosts {
+		if newHosts[i] == f.Hosts[i] {
+			available = append(available, i)
+		}
+	}
+	if len(available) < f.MinShards {
+		return fmt.Errorf("not enough hosts to repair file (needed %v, have %v)", f.MinShards, len(available))
+	}
+
+	shards := make([][]byte, len(f.Hosts))
+	for i := range shards {
+		shards[i] = make([]byte, 0, renterhost.SectorSize)
+	}
+	var offset int64
+	for _, ss := range f.Shards[0] {
+		// download shards from the remaining hosts until we have enough
+		length := int64(ss.NumSegments * merkle.SegmentSize)
+		for i := range shards {
+			shards[i] = shards[i][:0]
+		}
+		var goodShards int
+		var errs HostErrorSet
+		for _, i := range available {
+			if goodShards == f.MinShards {
+				break
+			}
+			shard, err := m.downloadShard(f, i, offset, length, shards[i])
+			if err != nil {
+				errs = append(errs, &HostError{f.Hosts[i], err})
+				continue
+			}
+			shards[i] = shard
+			goodShards++
+		}
+		if goodShards < f.MinShards {
+			return fmt.Errorf("too many hosts did not supply their shard (needed %v, got %v): %w", f.MinShards, goodShards, errs)
+		}
+		offset += length
+		// reconstruct the missing shards
+		if err := f.ErasureCode().Reconstruct(shards); err != nil {
+			return fmt.Errorf("could not reconstruct shards: %w", err)
+		}
+		// make room if necessary
+		if !m.canFit(int(length), f.Hosts, newHosts) {
+			if err := m.Flush(); err != nil {
+				return err
+			}
+		}
+		// append to sector builders
+		sliceIndices := make([]int, len(newHosts))
+		for i, hostKey := range newHosts {
+			if hostKey == f.Hosts[i] {
+				continue // no repair necessary
+			}
+			s := m.shards[hostKey]
+			s.Append(shards[i], f.MasterKey, renter.RandomNonce())
+			sliceIndices[i] = len(s.Slices()) - 1
+		}
+		m.onFlush = append(m.onFlush, func() error {
+			for i, hostKey := range newHosts {
+				if hostKey == f.Hosts[i] {
+					continue // no repair necessary
+				}
+				s := m.shards[hostKey]
+				newShards[i] = append(newShards[i], s.Slices()[sliceIndices[i]])
+			}
+			return nil
+		})
+	}
+
+	m.onFlush = append(m.onFlush, func() error {
+		for i, hostKey := range newHosts {
+			if hostKey == f.Hosts[i] {
+				continue // no repair necessary
+			}
+			f.Shards[i] = newShards[i]
+		}
+		f.Hosts = newHosts
+		f.ModTime = time.Now()
+		return onFinish(f)
+	})
+	return nil
+}
+
+// downloadShard downloads and decrypts the specified section of a shard of f,
+// appending it to buf[:0].
+func (m *Migrator) downloadShard(f *renter.MetaFile, shardIndex int, offset, length int64, buf []byte) ([]byte, error) {
+	hostKey := f.Hosts[shardIndex]
+	h, err := m.hosts.acquire(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	defer m.hosts.release(h)
+	b := bytes.NewBuffer(buf[:0])
+	err = (&renter.ShardDownloader{
+		Downloader: h,
+		Key:        f.MasterKey,
+		Slices:     f.Shards[shardIndex],
+	}).CopySection(b, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
 // Flush flushes any un-uploaded migration data to the new hosts. Flush must be
 // called to guarantee that migration is complete.
 func (m *Migrator) Flush() error {
@@ -168,7 +285,7 @@ func (m *Migrator) Flush() error {
 			}
 			sector := s.Finish()
 			root, err := h.Append(sector)
-			m.hosts.release(hostKey)
+			m.hosts.release(h)
 			if err != nil {
 				mu.Lock()
 				errs = append(errs, &HostError{hostKey, err})
@@ -5,11 +5,11 @@ import (
 	"encoding/hex"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"testing"
 
 	"lukechampine.com/frand"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
 )
 
 func TestMigrate(t *testing.T) {
@@ -69,7 +69,7 @@ func TestMigrate(t *testing.T) {
 	defer pf.Close()
 
 	// migrate file to hs2
-	metaPath := filepath.Join(fs1.root, metaName) + ".usa"
+	metaPath := fs1.store.(*DirStore).path(metaName) + ".usa"
 	m, err := renter.ReadMetaFile(metaPath)
 	if err != nil {
 		t.Fatal(err)
@@ -98,9 +98,11 @@ func TestMigrate(t *testing.T) {
 	defer fs2.Close()
 
 	// remove one of the non-hs2 hosts; this ensures that we'll download from the new host
-	for hostKey, lh := range fs1.hosts.sessions {
+	for hostKey, p := range fs1.hosts.sessions {
 		if fs2.hosts.HasHost(hostKey) {
-			lh.s.Close()
+			for _, lh := range p.conns {
+				lh.s.Close()
+			}
 			delete(fs2.hosts.sessions, hostKey)
 			break
 		}
@@ -126,9 +128,99 @@ func TestMigrate(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer hs2.release(hostKey)
+		defer hs2.release(h)
 		if h.Revision().NumSectors() != 1 {
 			t.Fatalf("expected %v stored sectors, got %v", 1, h.Revision().NumSectors())
 		}
 	}
 }
+
+func TestRepair(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// create two HostSets with three hosts, where two of those hosts are shared
+	hkr := make(testHKR)
+	hs1 := NewHostSet(hkr, 0)
+	hs2 := NewHostSet(hkr, 0)
+	for i := 0; i < 2; i++ {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hkr[h.PublicKey] = h.Settings.NetAddress
+		hs1.AddHost(c)
+		hs2.AddHost(c)
+	}
+	lost, c := createHostWithContract(t)
+	defer lost.Close()
+	hkr[lost.PublicKey] = lost.Settings.NetAddress
+	hs1.AddHost(c)
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hkr[h.PublicKey] = h.Settings.NetAddress
+	hs2.AddHost(c)
+
+	// upload a file spanning multiple chunks using hs1
+	fs1 := NewFileSystem(os.TempDir(), hs1)
+	defer fs1.Close()
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs1.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(renterhost.SectorSize*2 + 1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host exclusive to hs1 goes offline; repair the file using hs2
+	lost.Close()
+	metaPath := fs1.store.(*DirStore).path(metaName) + ".usa"
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator := NewMigrator(hs2)
+	if !migrator.NeedsMigrate(m) {
+		t.Error("migrator should recognize metafile as requiring migration")
+	}
+	err = migrator.RepairFile(m, func(newM *renter.MetaFile) error {
+		return renter.WriteMetaFile(metaPath, newM)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := migrator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := renter.ReadMetaFile(metaPath); err != nil {
+		t.Fatal(err)
+	} else if m.HostIndex(lost.PublicKey) != -1 || m.HostIndex(h.PublicKey) == -1 {
+		t.Fatal("metafile hosts were not updated")
+	}
+
+	// remove one of the shared hosts; this ensures that we'll download from
+	// the new host
+	for hostKey := range hs2.sessions {
+		if hostKey != h.PublicKey {
+			delete(hs2.sessions, hostKey)
+			break
+		}
+	}
+	fs2 := NewFileSystem(os.TempDir(), hs2)
+	defer fs2.Close()
+	pf, err = fs2.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	read, err := ioutil.ReadAll(pf)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(read, data) {
+		t.Fatal("contents do not match data")
+	}
+}
@@ -0,0 +1,277 @@
+package renterutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+// A ChainHeighter reports the current block height. SiadClient satisfies this
+// interface.
+type ChainHeighter interface {
+	ChainHeight() (types.BlockHeight, error)
+}
+
+// A ContractSaver persists contracts renewed by a ContractManager.
+type ContractSaver interface {
+	// SaveRenewedContract persists c, which was renewed from the contract
+	// with ID oldID. rev is the initial revision of c.
+	SaveRenewedContract(oldID types.FileContractID, c renter.Contract, rev proto.ContractRevision) error
+}
+
+// A RenewPolicy determines when, and for how long, a ContractManager renews
+// contracts. A zero value for RenewWindow or MinFunds disables the
+// corresponding trigger. A renewed contract must not immediately require
+// renewal again, so Duration must exceed RenewWindow, and Funds must exceed
+// MinFunds.
+type RenewPolicy struct {
+	// RenewWindow is the number of blocks before a contract's EndHeight at
+	// which the contract is renewed.
+	RenewWindow types.BlockHeight
+	// MinFunds triggers a renewal when a contract's remaining renter funds
+	// fall below the specified amount.
+	MinFunds types.Currency
+	// Duration is the number of blocks, counted from the current height, that
+	// a renewed contract remains valid for.
+	Duration types.BlockHeight
+	// Funds is the renter payout of a renewed contract.
+	Funds types.Currency
+}
+
+// A RenewalEvent records the outcome of an attempt to renew a contract.
+type RenewalEvent struct {
+	HostKey hostdb.HostPublicKey
+	OldID   types.FileContractID
+	// NewID and EndHeight describe the renewed contract. They are zero if the
+	// renewal failed.
+	NewID     types.FileContractID
+	EndHeight types.BlockHeight
+	Timestamp time.Time
+	// Err is non-nil if the renewal failed, or if the renewed contract could
+	// not be saved. In the latter case, NewID is set, but the renewed contract
+	// is not used by the HostSet until it has been saved; saving is retried
+	// at each subsequent Check.
+	Err error
+}
+
+// Succeeded returns true if the contract was renewed and saved.
+func (e RenewalEvent) Succeeded() bool { return e.Err == nil }
+
+// A ContractManager renews the contracts of a HostSet as they approach
+// expiration or run out of funds. Renewed contracts replace their predecessors
+// in the HostSet without interrupting other users of the set.
+type ContractManager struct {
+	hosts  *HostSet
+	chain  ChainHeighter
+	wallet proto.Wallet
+	tpool  proto.TransactionPool
+	saver  ContractSaver
+
+	mu      sync.Mutex
+	policy  RenewPolicy
+	onRenew func(RenewalEvent)
+	// renewed contracts that could not be saved, keyed by the ID of the
+	// contract they were renewed from
+	unsaved map[types.FileContractID]unsavedRenewal
+}
+
+type unsavedRenewal struct {
+	contract renter.Contract
+	rev      proto.ContractRevision
+}
+
+// SetPolicy sets the policy used for subsequent renewals.
+func (cm *ContractManager) SetPolicy(p RenewPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	cm.policy = p
+	cm.mu.Unlock()
+	return nil
+}
+
+// SetOnRenew sets the function called with the outcome of each attempted
+// renewal. The function must not block.
+func (cm *ContractManager) SetOnRenew(fn func(RenewalEvent)) {
+	cm.mu.Lock()
+	cm.onRenew = fn
+	cm.mu.Unlock()
+}
+
+// validate returns an error if contracts renewed under p would immediately
+// require renewal again.
+func (p RenewPolicy) validate() error {
+	switch {
+	case p.Duration <= p.RenewWindow:
+		return errors.New("renew policy Duration must exceed RenewWindow")
+	case !p.MinFunds.IsZero() && p.Funds.Cmp(p.MinFunds) <= 0:
+		return errors.New("renew policy Funds must exceed MinFunds")
+	}
+	return nil
+}
+
+// needsRenewal returns true if the contract should be renewed at the specified
+// height.
+func (p RenewPolicy) needsRenewal(rev proto.ContractRevision, height types.BlockHeight) bool {
+	return (p.RenewWindow != 0 && height+p.RenewWindow >= rev.EndHeight()) ||
+		(!p.MinFunds.IsZero() && rev.RenterFunds().Cmp(p.MinFunds) < 0)
+}
+
+// renew renews the specified contract if required by the policy. It returns
+// false if the contract did not need to be renewed, or if ctx was cancelled
+// before the renewal began.
+func (cm *ContractManager) renew(ctx context.Context, c renter.Contract, policy RenewPolicy, height types.BlockHeight) (RenewalEvent, bool) {
+	e := RenewalEvent{
+		HostKey: c.HostKey,
+		OldID:   c.ID,
+	}
+	s, err := cm.hosts.acquireContract(ctx, c.ID)
+	if err != nil && ctx.Err() != nil {
+		return RenewalEvent{}, false
+	} else if err != nil {
+		e.Timestamp, e.Err = time.Now(), errors.Wrap(err, "could not connect to host")
+		return e, true
+	}
+	if !policy.needsRenewal(s.Revision(), height) {
+		cm.hosts.release(s)
+		return RenewalEvent{}, false
+	}
+	rev, _, err := s.RenewContractContext(ctx, cm.wallet, cm.tpool, policy.Funds, height, height+policy.Duration)
+	if err != nil {
+		cm.hosts.release(s)
+		e.Timestamp, e.Err = time.Now(), errors.Wrap(err, "could not renew contract")
+		return e, true
+	}
+	// save the new contract before swapping it in, so that its revisions can
+	// be recorded as soon as it is used. If it cannot be saved, the old
+	// contract is cleared and cannot be used either, so it is taken out of
+	// service until a later Check manages to save the new one.
+	newContract := renter.Contract{
+		HostKey:   c.HostKey,
+		ID:        rev.ID(),
+		RenterKey: c.RenterKey,
+	}
+	e.NewID, e.EndHeight = rev.ID(), rev.EndHeight()
+	if err := cm.saver.SaveRenewedContract(c.ID, newContract, rev); err != nil {
+		err = errors.Wrap(err, "could not save renewed contract")
+		cm.mu.Lock()
+		cm.unsaved[c.ID] = unsavedRenewal{newContract, rev}
+		cm.mu.Unlock()
+		cm.hosts.suspendContract(s, errors.WithMessagef(err, "contract %v was renewed", c.ID))
+		e.Timestamp, e.Err = time.Now(), err
+		return e, true
+	}
+	cm.hosts.replaceContract(s, newContract, rev)
+	e.Timestamp = time.Now()
+	return e, true
+}
+
+// saveRenewed retries saving a renewed contract that previously could not be
+// saved, swapping it into the HostSet if successful.
+func (cm *ContractManager) saveRenewed(oldID types.FileContractID, r unsavedRenewal) RenewalEvent {
+	e := RenewalEvent{
+		HostKey:   r.contract.HostKey,
+		OldID:     oldID,
+		NewID:     r.contract.ID,
+		EndHeight: r.rev.EndHeight(),
+	}
+	if err := cm.saver.SaveRenewedContract(oldID, r.contract, r.rev); err != nil {
+		e.Timestamp, e.Err = time.Now(), errors.Wrap(err, "could not save renewed contract")
+		return e
+	}
+	cm.mu.Lock()
+	delete(cm.unsaved, oldID)
+	cm.mu.Unlock()
+	if err := cm.hosts.swapContract(oldID, r.contract, r.rev); err != nil {
+		e.Err = errors.Wrap(err, "could not use renewed contract")
+	}
+	e.Timestamp = time.Now()
+	return e
+}
+
+// Check renews each contract in the HostSet that requires renewal at the
+// current height, returning the outcome of each attempted renewal. Contracts
+// are renewed sequentially; if ctx is cancelled, Check returns the events
+// collected thus far, along with ctx.Err().
+func (cm *ContractManager) Check(ctx context.Context) ([]RenewalEvent, error) {
+	height, err := cm.chain.ChainHeight()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not determine current height")
+	}
+	cm.hosts.SetCurrentHeight(height)
+	cm.mu.Lock()
+	policy, onRenew := cm.policy, cm.onRenew
+	unsaved := make(map[types.FileContractID]unsavedRenewal, len(cm.unsaved))
+	for id, r := range cm.unsaved {
+		unsaved[id] = r
+	}
+	cm.mu.Unlock()
+
+	var events []RenewalEvent
+	for oldID, r := range unsaved {
+		if err := ctx.Err(); err != nil {
+			return events, err
+		}
+		e := cm.saveRenewed(oldID, r)
+		events = append(events, e)
+		if onRenew != nil {
+			onRenew(e)
+		}
+	}
+	for _, c := range cm.hosts.Contracts() {
+		if err := ctx.Err(); err != nil {
+			return events, err
+		} else if _, ok := unsaved[c.ID]; ok {
+			continue // already renewed
+		}
+		e, ok := cm.renew(ctx, c, policy, height)
+		if !ok {
+			continue
+		}
+		events = append(events, e)
+		if onRenew != nil {
+			onRenew(e)
+		}
+	}
+	return events, ctx.Err()
+}
+
+// Run calls Check every interval until ctx is cancelled. Errors from Check
+// are ignored; the contracts are checked again at the next interval.
+func (cm *ContractManager) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cm.Check(ctx) // on failure, retry at next tick
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewContractManager returns a ContractManager that renews the contracts in
+// hosts according to policy, using w and tpool to fund the renewal
+// transactions. Renewed contracts are persisted with saver.
+func NewContractManager(hosts *HostSet, chain ChainHeighter, w proto.Wallet, tpool proto.TransactionPool, saver ContractSaver, policy RenewPolicy) (*ContractManager, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &ContractManager{
+		hosts:   hosts,
+		chain:   chain,
+		wallet:  w,
+		tpool:   tpool,
+		saver:   saver,
+		policy:  policy,
+		unsaved: make(map[types.FileContractID]unsavedRenewal),
+	}, nil
+}
@@ -0,0 +1,220 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+type stubHeighter types.BlockHeight
+
+func (h stubHeighter) ChainHeight() (types.BlockHeight, error) { return types.BlockHeight(h), nil }
+
+type mapSaver map[types.FileContractID]renter.Contract
+
+func (ms mapSaver) SaveRenewedContract(oldID types.FileContractID, c renter.Contract, rev proto.ContractRevision) error {
+	if _, ok := ms[oldID]; !ok {
+		return errors.New("no record of old contract")
+	}
+	delete(ms, oldID)
+	ms[c.ID] = c
+	return nil
+}
+
+// flakySaver is a mapSaver that fails to save when fail is set.
+type flakySaver struct {
+	m    mapSaver
+	fail bool
+}
+
+func (fs *flakySaver) SaveRenewedContract(oldID types.FileContractID, c renter.Contract, rev proto.ContractRevision) error {
+	if fs.fail {
+		return errors.New("could not save")
+	}
+	return fs.m.SaveRenewedContract(oldID, c, rev)
+}
+
+func TestContractManager(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	host, c := createHostWithContract(t)
+	defer host.Close()
+	hkr := testHKR{host.PublicKey: host.Settings.NetAddress}
+	hs := NewHostSet(hkr, 0)
+	hs.AddHost(c)
+	fs := NewFileSystem(os.TempDir(), hs)
+	defer fs.Close()
+
+	// upload a file
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	data := frand.Bytes(100)
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	checkContents := func() {
+		t.Helper()
+		pf, err := fs.Open(metaName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		if p, err := ioutil.ReadAll(pf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match")
+		}
+	}
+
+	// the contract ends at height 10, so it should not be renewed at height
+	// 5 with a renew window of 2
+	saver := &flakySaver{m: mapSaver{c.ID: c}}
+	cm, err := NewContractManager(hs, stubHeighter(5), stubWallet{}, stubTpool{}, saver, RenewPolicy{
+		RenewWindow: 2,
+		Duration:    20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled []RenewalEvent
+	cm.SetOnRenew(func(e RenewalEvent) { handled = append(handled, e) })
+	if events, err := cm.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 0 {
+		t.Fatal("expected no renewals, got", events)
+	}
+
+	// with a larger renew window, the contract should be renewed and swapped
+	// into the HostSet
+	if err := cm.SetPolicy(RenewPolicy{
+		RenewWindow: 10,
+		Duration:    20,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events, err := cm.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 || !events[0].Succeeded() {
+		t.Fatal("expected one successful renewal, got", events)
+	} else if len(handled) != 1 || handled[0].NewID != events[0].NewID {
+		t.Fatal("event handler was not called")
+	}
+	e := events[0]
+	if e.OldID != c.ID || e.NewID == c.ID || e.EndHeight != 25 {
+		t.Fatal("renewal event is incorrect:", e)
+	} else if contracts := hs.Contracts(); len(contracts) != 1 || contracts[0].ID != e.NewID {
+		t.Fatal("renewed contract was not swapped into the HostSet")
+	} else if _, ok := saver.m[e.NewID]; !ok || len(saver.m) != 1 {
+		t.Fatal("renewed contract was not saved")
+	}
+
+	// the renewed contract should not be renewed again, and the file should
+	// still be accessible
+	if events, err := cm.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 0 {
+		t.Fatal("expected no renewals, got", events)
+	}
+	checkContents()
+
+	// the new contract should be usable for uploads
+	pf, err = fs.OpenFile(metaName, os.O_WRONLY|os.O_APPEND, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, data...)
+	checkContents()
+
+	// if the renewed contract cannot be saved, it should not be swapped in
+	// until a later Check saves it
+	saver.fail = true
+	if err := cm.SetPolicy(RenewPolicy{
+		RenewWindow: 25,
+		Duration:    30,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	oldID := e.NewID
+	events, err = cm.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 || events[0].Succeeded() || events[0].NewID == oldID {
+		t.Fatal("expected one unsaved renewal, got", events)
+	} else if contracts := hs.Contracts(); len(contracts) != 1 || contracts[0].ID != oldID {
+		t.Fatal("unsaved contract was swapped into the HostSet")
+	}
+	// the old contract can no longer be revised, so it should be out of
+	// service rather than failing at the host
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	if _, err := hs.acquireContext(ctx, c.HostKey); err == nil || ctx.Err() != nil {
+		t.Fatal("expected contract to be out of service, got", err)
+	} else if st := hs.Status(); st[0].State != CircuitClosed || st[0].ConsecutiveFailures != 0 {
+		t.Fatal("unavailable contract should not count against the host's health:", st[0])
+	}
+	cancel()
+	newID := events[0].NewID
+	saver.fail = false
+	events, err = cm.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 || !events[0].Succeeded() || events[0].NewID != newID {
+		t.Fatal("expected renewed contract to be saved, got", events)
+	} else if contracts := hs.Contracts(); len(contracts) != 1 || contracts[0].ID != newID {
+		t.Fatal("renewed contract was not swapped into the HostSet")
+	} else if _, ok := saver.m[newID]; !ok || len(saver.m) != 1 {
+		t.Fatal("renewed contract was not saved")
+	}
+	checkContents()
+
+	// a cancelled context should abort the check without renewing anything
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := cm.SetPolicy(RenewPolicy{
+		MinFunds: types.SiacoinPrecision,
+		Duration: 20,
+		Funds:    types.SiacoinPrecision.Mul64(2),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if events, err := cm.Check(ctx); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if len(events) != 0 {
+		t.Fatal("expected no renewals, got", events)
+	}
+
+	// policies under which renewed contracts would immediately require
+	// renewal again should be rejected
+	if err := cm.SetPolicy(RenewPolicy{RenewWindow: 20, Duration: 20}); err == nil {
+		t.Fatal("expected policy with Duration <= RenewWindow to be rejected")
+	} else if err := cm.SetPolicy(RenewPolicy{MinFunds: types.SiacoinPrecision, Duration: 20}); err == nil {
+		t.Fatal("expected policy with Funds <= MinFunds to be rejected")
+	} else if _, err := NewContractManager(hs, stubHeighter(5), stubWallet{}, stubTpool{}, saver, RenewPolicy{}); err == nil {
+		t.Fatal("expected zero policy to be rejected")
+	}
+}
@@ -0,0 +1,650 @@
+package renterutil
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// directory, relative to the PseudoFS root, where multipart uploads are
+// staged; since bucket names cannot begin with a dot, it cannot collide with a
+// bucket
+const s3UploadsDir = ".s3-uploads"
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+	status   int
+}
+
+var (
+	errS3NoSuchBucket   = s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist.", status: http.StatusNotFound}
+	errS3NoSuchKey      = s3Error{Code: "NoSuchKey", Message: "The specified key does not exist.", status: http.StatusNotFound}
+	errS3NoSuchUpload   = s3Error{Code: "NoSuchUpload", Message: "The specified multipart upload does not exist.", status: http.StatusNotFound}
+	errS3InvalidPart    = s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found.", status: http.StatusBadRequest}
+	errS3InvalidOrder   = s3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order.", status: http.StatusBadRequest}
+	errS3InvalidKey     = s3Error{Code: "InvalidArgument", Message: "The specified key is not supported.", status: http.StatusBadRequest}
+	errS3InvalidBucket  = s3Error{Code: "InvalidBucketName", Message: "The specified bucket is not valid.", status: http.StatusBadRequest}
+	errS3NotImplemented = s3Error{Code: "NotImplemented", Message: "The requested operation is not supported.", status: http.StatusNotImplemented}
+)
+
+type s3Bucket struct {
+	Name         string
+	CreationDate time.Time
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListObjectsV2Result struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+type s3Part struct {
+	etag string
+	size int64
+}
+
+type s3Upload struct {
+	bucket string
+	key    string
+	// every part is stored with the same hosts and key, so that the parts can
+	// be concatenated without re-uploading them
+	index renter.MetaIndex
+	parts map[int]s3Part
+}
+
+// An S3Gateway serves a subset of the Amazon S3 API, backed by a PseudoFS.
+// Each top-level directory of the PseudoFS is a bucket, and each file within
+// it is an object whose key is the file's path relative to the bucket.
+//
+// The supported operations are ListBuckets, CreateBucket, PutObject,
+// GetObject (including Range requests), HeadObject, ListObjectsV2,
+// DeleteObject, and the multipart upload operations CreateMultipartUpload,
+// UploadPart, CompleteMultipartUpload, and AbortMultipartUpload. Requests are
+// not authenticated, and in-progress multipart uploads do not persist across
+// restarts.
+type S3Gateway struct {
+	fs        *PseudoFS
+	minShards int
+
+	mu      sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+func writeS3Error(w http.ResponseWriter, err s3Error, resource string) {
+	err.Resource = resource
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(err.status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(err)
+}
+
+func writeS3Response(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3InternalError(w http.ResponseWriter, err error, resource string) {
+	writeS3Error(w, s3Error{
+		Code:    "InternalError",
+		Message: err.Error(),
+		status:  http.StatusInternalServerError,
+	}, resource)
+}
+
+// validS3Key reports whether key can be stored as a file. Keys must be clean,
+// relative, slash-separated paths.
+func validS3Key(key string) bool {
+	return key != "" && path.Clean(key) == key && !strings.HasPrefix(key, "/") &&
+		key != ".." && !strings.HasPrefix(key, "../")
+}
+
+func validS3Bucket(bucket string) bool {
+	return bucket != "" && !strings.HasPrefix(bucket, ".") && !strings.ContainsAny(bucket, `/\`)
+}
+
+// ServeHTTP implements http.Handler.
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/")
+	bucket, key := p, ""
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		bucket, key = p[:i], p[i+1:]
+	}
+	q := req.URL.Query()
+
+	if bucket == "" {
+		if req.Method == http.MethodGet {
+			g.listBuckets(w, req)
+		} else {
+			writeS3Error(w, errS3NotImplemented, req.URL.Path)
+		}
+		return
+	} else if !validS3Bucket(bucket) {
+		writeS3Error(w, errS3InvalidBucket, req.URL.Path)
+		return
+	}
+	if key == "" {
+		switch req.Method {
+		case http.MethodPut:
+			g.createBucket(w, req, bucket)
+		case http.MethodGet:
+			g.listObjectsV2(w, req, bucket)
+		default:
+			writeS3Error(w, errS3NotImplemented, req.URL.Path)
+		}
+		return
+	}
+
+	if !g.fs.isDir(bucket) {
+		writeS3Error(w, errS3NoSuchBucket, req.URL.Path)
+		return
+	} else if !validS3Key(key) {
+		writeS3Error(w, errS3InvalidKey, req.URL.Path)
+		return
+	}
+	_, isInitiate := q["uploads"]
+	uploadID := q.Get("uploadId")
+	switch {
+	case req.Method == http.MethodPost && isInitiate:
+		g.createMultipartUpload(w, req, bucket, key)
+	case req.Method == http.MethodPost && uploadID != "":
+		g.completeMultipartUpload(w, req, bucket, key, uploadID)
+	case req.Method == http.MethodPut && uploadID != "":
+		g.uploadPart(w, req, uploadID)
+	case req.Method == http.MethodDelete && uploadID != "":
+		g.abortMultipartUpload(w, req, uploadID)
+	case req.Method == http.MethodPut:
+		g.putObject(w, req, bucket, key)
+	case req.Method == http.MethodGet, req.Method == http.MethodHead:
+		g.getObject(w, req, bucket, key)
+	case req.Method == http.MethodDelete:
+		g.deleteObject(w, req, bucket, key)
+	default:
+		writeS3Error(w, errS3NotImplemented, req.URL.Path)
+	}
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, req *http.Request) {
+	infos, err := g.fs.store.ReadDir(".")
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	var resp s3ListBucketsResult
+	for _, info := range infos {
+		if info.IsDir() && validS3Bucket(info.Name()) {
+			resp.Buckets = append(resp.Buckets, s3Bucket{
+				Name:         info.Name(),
+				CreationDate: info.ModTime().UTC(),
+			})
+		}
+	}
+	sort.Slice(resp.Buckets, func(i, j int) bool {
+		return resp.Buckets[i].Name < resp.Buckets[j].Name
+	})
+	writeS3Response(w, resp)
+}
+
+func (g *S3Gateway) createBucket(w http.ResponseWriter, req *http.Request, bucket string) {
+	if err := g.fs.Mkdir(bucket, 0700); err != nil && !os.IsExist(err) {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+}
+
+// objectKeys returns the sorted keys of all objects in bucket.
+func (g *S3Gateway) objectKeys(bucket string) ([]s3Object, error) {
+	dir := storeName(bucket)
+	var objects []s3Object
+	err := g.fs.store.Walk(dir, func(name string, info os.FileInfo) error {
+		index := info.Sys().(renter.MetaIndex)
+		objects = append(objects, s3Object{
+			Key:          strings.TrimPrefix(name, dir+"/"),
+			LastModified: index.ModTime.UTC(),
+			Size:         index.Filesize,
+			StorageClass: "STANDARD",
+		})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, err
+}
+
+func (g *S3Gateway) listObjectsV2(w http.ResponseWriter, req *http.Request, bucket string) {
+	if !g.fs.isDir(bucket) {
+		writeS3Error(w, errS3NoSuchBucket, req.URL.Path)
+		return
+	}
+	q := req.URL.Query()
+	resp := s3ListObjectsV2Result{
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           1000,
+	}
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			writeS3Error(w, s3Error{Code: "InvalidArgument", Message: "Invalid max-keys.", status: http.StatusBadRequest}, req.URL.Path)
+			return
+		} else if n < resp.MaxKeys {
+			resp.MaxKeys = n
+		}
+	}
+	// the continuation token is simply the last key (or common prefix) returned
+	after := resp.StartAfter
+	if resp.ContinuationToken != "" {
+		after = resp.ContinuationToken
+	}
+
+	objects, err := g.objectKeys(bucket)
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	var last string
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, resp.Prefix) || obj.Key <= after {
+			continue
+		}
+		// group keys containing the delimiter into common prefixes
+		var commonPrefix string
+		if resp.Delimiter != "" {
+			if i := strings.Index(obj.Key[len(resp.Prefix):], resp.Delimiter); i >= 0 {
+				commonPrefix = obj.Key[:len(resp.Prefix)+i+len(resp.Delimiter)]
+			}
+		}
+		if commonPrefix != "" {
+			if commonPrefix <= after || (len(resp.CommonPrefixes) > 0 && resp.CommonPrefixes[len(resp.CommonPrefixes)-1].Prefix == commonPrefix) {
+				continue
+			}
+		}
+		if resp.KeyCount == resp.MaxKeys {
+			resp.IsTruncated = true
+			resp.NextContinuationToken = last
+			break
+		}
+		if commonPrefix != "" {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, s3CommonPrefix{commonPrefix})
+			last = commonPrefix
+		} else {
+			resp.Contents = append(resp.Contents, obj)
+			last = obj.Key
+		}
+		resp.KeyCount++
+	}
+	writeS3Response(w, resp)
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	name := path.Join(bucket, key)
+	if err := g.fs.MkdirAll(path.Dir(name), 0700); err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	pf, err := g.fs.Create(name, g.minShards)
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	etag, _, err := g.writeFile(req.Context(), pf, req.Body)
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	w.Header().Set("ETag", etag)
+}
+
+// contextFile binds a PseudoFile to a Context, so that it can be passed to
+// functions that expect an io.Reader, io.Writer, or io.Seeker. Any host I/O
+// performed by the file is aborted if the Context is cancelled.
+type contextFile struct {
+	ctx context.Context
+	pf  *PseudoFile
+}
+
+func (cf contextFile) Read(p []byte) (int, error)  { return cf.pf.ReadContext(cf.ctx, p) }
+func (cf contextFile) Write(p []byte) (int, error) { return cf.pf.WriteContext(cf.ctx, p) }
+func (cf contextFile) Seek(offset int64, whence int) (int64, error) {
+	return cf.pf.Seek(offset, whence)
+}
+
+// writeFile copies r into pf, flushes it to hosts, and closes it, returning
+// the ETag (MD5 hash) of the data and the number of bytes written. Uploads are
+// aborted if ctx is cancelled, e.g. because the client disconnected.
+func (g *S3Gateway) writeFile(ctx context.Context, pf *PseudoFile, r io.Reader) (string, int64, error) {
+	h := md5.New()
+	n, err := io.Copy(contextFile{ctx, pf}, io.TeeReader(r, h))
+	if err == nil {
+		err = pf.SyncContext(ctx)
+	}
+	if err != nil {
+		pf.Close()
+		return "", 0, err
+	} else if err := pf.Close(); err != nil {
+		return "", 0, err
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, n, nil
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	pf, err := g.fs.Open(path.Join(bucket, key))
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			writeS3Error(w, errS3NoSuchKey, req.URL.Path)
+		} else {
+			writeS3InternalError(w, err, req.URL.Path)
+		}
+		return
+	}
+	defer pf.Close()
+	info, err := pf.Stat()
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	} else if info.IsDir() {
+		writeS3Error(w, errS3NoSuchKey, req.URL.Path)
+		return
+	}
+	// ServeContent handles HEAD and Range requests; setting Content-Type
+	// prevents it from sniffing the content, which would require a download
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, key, info.ModTime(), contextFile{req.Context(), pf})
+}
+
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	name := path.Join(bucket, key)
+	// delete the object's data from hosts, if possible; any data that cannot
+	// be deleted now will be deleted by a later call to GC
+	if pf, err := g.fs.OpenFile(name, os.O_RDWR, 0, 0); err == nil {
+		pf.Free()
+		pf.Close()
+	}
+	if err := g.fs.Remove(name); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *S3Gateway) createMultipartUpload(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	g.fs.mu.RLock()
+	hosts := make([]hostdb.HostPublicKey, 0, len(g.fs.hosts.sessions))
+	for hostKey := range g.fs.hosts.sessions {
+		hosts = append(hosts, hostKey)
+	}
+	g.fs.mu.RUnlock()
+	if len(hosts) < g.minShards {
+		writeS3InternalError(w, errors.New("minShards cannot be greater than the number of hosts"), req.URL.Path)
+		return
+	}
+	uploadID := hex.EncodeToString(frand.Bytes(16))
+	if err := g.fs.MkdirAll(path.Join(s3UploadsDir, uploadID), 0700); err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	g.mu.Lock()
+	g.uploads[uploadID] = &s3Upload{
+		bucket: bucket,
+		key:    key,
+		index:  renter.NewMetaFile(0666, 0, hosts, g.minShards).MetaIndex,
+		parts:  make(map[int]s3Part),
+	}
+	g.mu.Unlock()
+	writeS3Response(w, s3InitiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+func (g *S3Gateway) lookupUpload(uploadID string) (*s3Upload, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	u, ok := g.uploads[uploadID]
+	return u, ok
+}
+
+func s3PartName(uploadID string, partNumber int) string {
+	return path.Join(s3UploadsDir, uploadID, strconv.Itoa(partNumber))
+}
+
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, req *http.Request, uploadID string) {
+	u, ok := g.lookupUpload(uploadID)
+	if !ok {
+		writeS3Error(w, errS3NoSuchUpload, req.URL.Path)
+		return
+	}
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		writeS3Error(w, s3Error{Code: "InvalidArgument", Message: "Invalid partNumber.", status: http.StatusBadRequest}, req.URL.Path)
+		return
+	}
+
+	// PseudoFS packs the part into shared sectors, so small parts do not
+	// consume a full sector on each host
+	pf, err := g.fs.createWithIndex(s3PartName(uploadID, partNumber), u.index)
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	etag, n, err := g.writeFile(req.Context(), pf, req.Body)
+	if err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	g.mu.Lock()
+	u.parts[partNumber] = s3Part{etag: etag, size: n}
+	g.mu.Unlock()
+	w.Header().Set("ETag", etag)
+}
+
+func (g *S3Gateway) completeMultipartUpload(w http.ResponseWriter, req *http.Request, bucket, key, uploadID string) {
+	u, ok := g.lookupUpload(uploadID)
+	if !ok || u.bucket != bucket || u.key != key {
+		writeS3Error(w, errS3NoSuchUpload, req.URL.Path)
+		return
+	}
+	var cmu s3CompleteMultipartUpload
+	if err := xml.NewDecoder(req.Body).Decode(&cmu); err != nil || len(cmu.Parts) == 0 {
+		writeS3Error(w, s3Error{Code: "MalformedXML", Message: "The XML provided was not well-formed.", status: http.StatusBadRequest}, req.URL.Path)
+		return
+	}
+	g.mu.Lock()
+	parts := make([]s3Part, len(cmu.Parts))
+	var s3err *s3Error
+	for i, p := range cmu.Parts {
+		part, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != strings.Trim(part.etag, `"`) {
+			s3err = &errS3InvalidPart
+			break
+		} else if i > 0 && p.PartNumber <= cmu.Parts[i-1].PartNumber {
+			s3err = &errS3InvalidOrder
+			break
+		}
+		parts[i] = part
+	}
+	g.mu.Unlock()
+	if s3err != nil {
+		writeS3Error(w, *s3err, req.URL.Path)
+		return
+	}
+
+	// the multipart ETag is the MD5 of the concatenated part MD5s
+	h := md5.New()
+	for _, part := range parts {
+		b, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		h.Write(b)
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(parts)) + `"`
+
+	name := path.Join(bucket, key)
+	if err := g.fs.MkdirAll(path.Dir(name), 0700); err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+	partNames := make([]string, len(cmu.Parts))
+	for i, p := range cmu.Parts {
+		partNames[i] = s3PartName(uploadID, p.PartNumber)
+	}
+	if err := g.concatenateParts(req.Context(), name, partNames, parts); err != nil {
+		writeS3InternalError(w, err, req.URL.Path)
+		return
+	}
+
+	g.mu.Lock()
+	delete(g.uploads, uploadID)
+	g.mu.Unlock()
+	g.fs.RemoveAll(path.Join(s3UploadsDir, uploadID))
+	writeS3Response(w, s3CompleteMultipartUploadResult{
+		Bucket: bucket,
+		Key:    key,
+		ETag:   etag,
+	})
+}
+
+// concatenateParts joins the named parts into a single file. If every part
+// except the last ends on a chunk boundary, the parts' metafiles are joined
+// directly, without transferring any data; otherwise, the parts are
+// downloaded and re-uploaded.
+func (g *S3Gateway) concatenateParts(ctx context.Context, name string, partNames []string, parts []s3Part) error {
+	ms := make([]*renter.MetaFile, len(partNames))
+	aligned := true
+	for i, partName := range partNames {
+		m, err := g.fs.store.ReadMetaFile(storeName(partName))
+		if err != nil {
+			return err
+		}
+		ms[i] = m
+		if i < len(parts)-1 && m.Filesize%m.MinChunkSize() != 0 {
+			aligned = false
+		}
+	}
+	if aligned {
+		m := &renter.MetaFile{
+			MetaIndex: ms[0].MetaIndex,
+			Shards:    make([][]renter.SectorSlice, len(ms[0].Hosts)),
+		}
+		m.Filesize = 0
+		m.ModTime = time.Now()
+		for _, pm := range ms {
+			for i := range m.Shards {
+				m.Shards[i] = append(m.Shards[i], pm.Shards[i]...)
+			}
+			m.Filesize += pm.Filesize
+		}
+		return g.fs.writeMetaFile(name, m)
+	}
+
+	pf, err := g.fs.Create(name, g.minShards)
+	if err != nil {
+		return err
+	}
+	readers := make([]io.Reader, 0, len(partNames))
+	for _, partName := range partNames {
+		part, err := g.fs.Open(partName)
+		if err != nil {
+			pf.Close()
+			return err
+		}
+		defer part.Close()
+		readers = append(readers, contextFile{ctx, part})
+	}
+	_, _, err = g.writeFile(ctx, pf, io.MultiReader(readers...))
+	return err
+}
+
+func (g *S3Gateway) abortMultipartUpload(w http.ResponseWriter, req *http.Request, uploadID string) {
+	g.mu.Lock()
+	_, ok := g.uploads[uploadID]
+	delete(g.uploads, uploadID)
+	g.mu.Unlock()
+	if !ok {
+		writeS3Error(w, errS3NoSuchUpload, req.URL.Path)
+		return
+	}
+	// the parts' data will be deleted by a later call to GC
+	g.fs.RemoveAll(path.Join(s3UploadsDir, uploadID))
+	io.Copy(ioutil.Discard, req.Body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NewS3Gateway returns an S3Gateway that stores objects in fs. New objects are
+// stored with the specified minShards.
+func NewS3Gateway(fs *PseudoFS, minShards int) *S3Gateway {
+	return &S3Gateway{
+		fs:        fs,
+		minShards: minShards,
+		uploads:   make(map[string]*s3Upload),
+	}
+}
@@ -0,0 +1,189 @@
+package renterutil
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestS3Gateway(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+
+	srv := httptest.NewServer(NewS3Gateway(fs, 2))
+	defer srv.Close()
+
+	do := func(method, path string, body io.Reader, hdr ...string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	// objects cannot be stored in a nonexistent bucket
+	if resp, _ := do("PUT", "/bucket/foo", strings.NewReader("foo")); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+	if resp, _ := do("PUT", "/bucket", nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected response:", resp.Status)
+	}
+
+	// put and get an object
+	data := frand.Bytes(5000)
+	resp, _ := do("PUT", "/bucket/dir/foo", bytes.NewReader(data))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == "" {
+		t.Fatal("unexpected response:", resp.Status)
+	}
+	if resp, body := do("GET", "/bucket/dir/foo", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("unexpected response: %v (%v bytes)", resp.Status, len(body))
+	}
+	if resp, body := do("GET", "/bucket/dir/foo", nil, "Range", "bytes=100-199"); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[100:200]) {
+		t.Fatalf("unexpected response: %v (%v bytes)", resp.Status, len(body))
+	}
+	if resp, _ := do("HEAD", "/bucket/dir/foo", nil); resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(data)) {
+		t.Fatal("unexpected response:", resp.Status, resp.ContentLength)
+	}
+	if resp, _ := do("GET", "/bucket/dir/bar", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+	if resp, _ := do("PUT", "/bucket/../foo", strings.NewReader("foo")); resp.StatusCode == http.StatusOK {
+		t.Fatal("expected invalid key to be rejected")
+	}
+
+	// empty objects should be stored too
+	do("PUT", "/bucket/empty", nil)
+	do("PUT", "/bucket/dir/sub/baz", strings.NewReader("baz"))
+
+	// list objects
+	list := func(query string) (res s3ListObjectsV2Result) {
+		t.Helper()
+		resp, body := do("GET", "/bucket?list-type=2&"+query, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected response:", resp.Status, string(body))
+		} else if err := xml.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	keys := func(res s3ListObjectsV2Result) string {
+		var s []string
+		for _, o := range res.Contents {
+			s = append(s, o.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			s = append(s, p.Prefix)
+		}
+		return strings.Join(s, ",")
+	}
+	if res := list(""); keys(res) != "dir/foo,dir/sub/baz,empty" {
+		t.Fatal("unexpected listing:", keys(res))
+	}
+	if res := list("delimiter=/"); keys(res) != "empty,dir/" {
+		t.Fatal("unexpected listing:", keys(res))
+	}
+	if res := list("prefix=dir/&delimiter=/"); keys(res) != "dir/foo,dir/sub/" {
+		t.Fatal("unexpected listing:", keys(res))
+	}
+	res := list("max-keys=2")
+	if keys(res) != "dir/foo,dir/sub/baz" || !res.IsTruncated {
+		t.Fatal("unexpected listing:", keys(res))
+	}
+	if res := list("max-keys=2&continuation-token=" + res.NextContinuationToken); keys(res) != "empty" || res.IsTruncated {
+		t.Fatal("unexpected listing:", keys(res))
+	}
+
+	// multipart upload; the first upload has unaligned parts, the second has
+	// aligned parts
+	for _, partSize := range []int{3000, 4096 * 2} {
+		resp, body := do("POST", "/bucket/multi?uploads", nil)
+		var init s3InitiateMultipartUploadResult
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected response:", resp.Status)
+		} else if err := xml.Unmarshal(body, &init); err != nil {
+			t.Fatal(err)
+		}
+		data := frand.Bytes(partSize*2 + 100)
+		parts := [][]byte{data[:partSize], data[partSize : partSize*2], data[partSize*2:]}
+		var complete bytes.Buffer
+		complete.WriteString("<CompleteMultipartUpload>")
+		for i, part := range parts {
+			resp, _ := do("PUT", fmt.Sprintf("/bucket/multi?partNumber=%v&uploadId=%v", i+1, init.UploadID), bytes.NewReader(part))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatal("unexpected response:", resp.Status)
+			}
+			fmt.Fprintf(&complete, "<Part><PartNumber>%v</PartNumber><ETag>%v</ETag></Part>", i+1, resp.Header.Get("ETag"))
+		}
+		complete.WriteString("</CompleteMultipartUpload>")
+		if resp, body := do("POST", "/bucket/multi?uploadId="+init.UploadID, &complete); resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected response:", resp.Status, string(body))
+		} else if !strings.Contains(string(body), `-3&#34;`) {
+			t.Fatal("unexpected ETag:", string(body))
+		}
+		if resp, body := do("GET", "/bucket/multi", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+			t.Fatalf("unexpected response: %v (%v bytes)", resp.Status, len(body))
+		}
+		if _, err := fs.store.Stat(s3UploadsDir + "/" + init.UploadID); !isNotExist(err) {
+			t.Fatal("staging directory was not removed")
+		}
+	}
+
+	// aborted uploads should no longer accept parts
+	_, body := do("POST", "/bucket/multi2?uploads", nil)
+	var init s3InitiateMultipartUploadResult
+	if err := xml.Unmarshal(body, &init); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := do("DELETE", "/bucket/multi2?uploadId="+init.UploadID, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal("unexpected response:", resp.Status)
+	}
+	if resp, _ := do("PUT", "/bucket/multi2?partNumber=1&uploadId="+init.UploadID, strings.NewReader("foo")); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+
+	// delete an object
+	if resp, _ := do("DELETE", "/bucket/dir/foo", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal("unexpected response:", resp.Status)
+	}
+	if resp, _ := do("GET", "/bucket/dir/foo", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+
+	// staging directories should not appear as buckets
+	resp, body = do("GET", "/", nil)
+	var buckets s3ListBucketsResult
+	if err := xml.Unmarshal(body, &buckets); err != nil {
+		t.Fatal(err)
+	} else if len(buckets.Buckets) != 1 || buckets.Buckets[0].Name != "bucket" {
+		t.Fatal("unexpected buckets:", buckets.Buckets)
+	}
+}
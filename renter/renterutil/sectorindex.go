@@ -0,0 +1,396 @@
+package renterutil
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/encoding"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+// sector index buckets/keys
+var (
+	// keyBuilt is set once the index has been populated from the metafiles
+	// on disk.
+	keyBuilt = []byte("keyBuilt")
+
+	// bucketIndexMeta contains global values for the index.
+	bucketIndexMeta = []byte("bucketIndexMeta")
+
+	// bucketSectors maps sector roots to a bucket containing the names of the
+	// files that reference them.
+	bucketSectors = []byte("bucketSectors")
+
+	// bucketFiles maps file names to the sectorRefs of the file.
+	bucketFiles = []byte("bucketFiles")
+
+	// bucketGarbage maps the roots of unreferenced sectors to the host
+	// storing them.
+	bucketGarbage = []byte("bucketGarbage")
+
+	sectorIndexBuckets = [][]byte{
+		bucketIndexMeta,
+		bucketSectors,
+		bucketFiles,
+		bucketGarbage,
+	}
+)
+
+// A sectorRef identifies a sector stored on a particular host.
+type sectorRef struct {
+	HostKey hostdb.HostPublicKey
+	Root    crypto.Hash
+}
+
+func metaFileRefs(m *renter.MetaFile) map[sectorRef]struct{} {
+	refs := make(map[sectorRef]struct{})
+	if m == nil {
+		return refs
+	}
+	for i, shard := range m.Shards {
+		for _, ss := range shard {
+			refs[sectorRef{m.Hosts[i], ss.MerkleRoot}] = struct{}{}
+		}
+	}
+	return refs
+}
+
+// A SectorIndex is a persistent index of the sectors referenced by each file
+// in a PseudoFS. It allows GC to delete unreferenced sectors without examining
+// every metafile and every host, and allows Free to delete sectors that were
+// shared with files that no longer exist.
+type SectorIndex struct {
+	db *bolt.DB
+}
+
+// References returns the names of the files that reference the sector with
+// the specified root.
+func (idx *SectorIndex) References(root crypto.Hash) ([]string, error) {
+	var names []string
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSectors).Bucket(root[:])
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Close closes the index database.
+func (idx *SectorIndex) Close() error {
+	return idx.db.Close()
+}
+
+func (idx *SectorIndex) built() (built bool, err error) {
+	err = idx.db.View(func(tx *bolt.Tx) error {
+		built = tx.Bucket(bucketIndexMeta).Get(keyBuilt) != nil
+		return nil
+	})
+	return
+}
+
+func (idx *SectorIndex) setBuilt() error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketIndexMeta).Put(keyBuilt, []byte{1})
+	})
+}
+
+// updateFile replaces the sectors referenced by the named file with those
+// referenced by m. A nil m removes the file from the index. Sectors that are
+// no longer referenced by any file are marked as garbage.
+func (idx *SectorIndex) updateFile(name string, m *renter.MetaFile) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return putFileRefs(tx, name, metaFileRefs(m))
+	})
+}
+
+func putFileRefs(tx *bolt.Tx, name string, refs map[sectorRef]struct{}) error {
+	files, sectors, garbage := tx.Bucket(bucketFiles), tx.Bucket(bucketSectors), tx.Bucket(bucketGarbage)
+	key := []byte(name)
+	var old []sectorRef
+	if v := files.Get(key); v != nil {
+		if err := encoding.Unmarshal(v, &old); err != nil {
+			return err
+		}
+	}
+	oldRefs := make(map[sectorRef]struct{}, len(old))
+	for _, ref := range old {
+		oldRefs[ref] = struct{}{}
+		if _, ok := refs[ref]; ok {
+			continue
+		}
+		b := sectors.Bucket(ref.Root[:])
+		if b == nil {
+			continue
+		} else if err := b.Delete(key); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			if err := sectors.DeleteBucket(ref.Root[:]); err != nil {
+				return err
+			} else if err := garbage.Put(ref.Root[:], []byte(ref.HostKey)); err != nil {
+				return err
+			}
+		}
+	}
+	cur := make([]sectorRef, 0, len(refs))
+	for ref := range refs {
+		cur = append(cur, ref)
+		if _, ok := oldRefs[ref]; ok {
+			continue
+		}
+		b, err := sectors.CreateBucketIfNotExists(ref.Root[:])
+		if err != nil {
+			return err
+		} else if err := b.Put(key, []byte{}); err != nil {
+			return err
+		} else if err := garbage.Delete(ref.Root[:]); err != nil {
+			return err
+		}
+	}
+	if len(cur) == 0 {
+		return files.Delete(key)
+	}
+	return files.Put(key, encoding.Marshal(cur))
+}
+
+// matchesPrefix reports whether name is prefix or is contained in the
+// directory prefix.
+func matchesPrefix(name, prefix string) bool {
+	return prefix == "." || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// removeFiles removes the named file, and any files within the named
+// directory, from the index.
+func (idx *SectorIndex) removeFiles(prefix string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		var names []string
+		c := tx.Bucket(bucketFiles).Cursor()
+		k, _ := c.Seek([]byte(prefix))
+		if prefix == "." {
+			k, _ = c.First()
+		}
+		for ; k != nil && (prefix == "." || strings.HasPrefix(string(k), prefix)); k, _ = c.Next() {
+			if matchesPrefix(string(k), prefix) {
+				names = append(names, string(k))
+			}
+		}
+		for _, name := range names {
+			if err := putFileRefs(tx, name, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// renameFiles moves the named file, and any files within the named directory,
+// to newPrefix. Any files previously indexed under newPrefix are removed.
+func (idx *SectorIndex) renameFiles(oldPrefix, newPrefix string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		moved := make(map[string][]sectorRef)
+		var replaced []string
+		c := tx.Bucket(bucketFiles).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			name := string(k)
+			if matchesPrefix(name, oldPrefix) {
+				var refs []sectorRef
+				if err := encoding.Unmarshal(v, &refs); err != nil {
+					return err
+				}
+				moved[newPrefix+strings.TrimPrefix(name, oldPrefix)] = refs
+				replaced = append(replaced, name)
+			} else if matchesPrefix(name, newPrefix) {
+				replaced = append(replaced, name)
+			}
+		}
+		// add the new references before removing the old ones, so that no
+		// sector is marked as garbage
+		for name, refs := range moved {
+			refSet := make(map[sectorRef]struct{}, len(refs))
+			for _, ref := range refs {
+				refSet[ref] = struct{}{}
+			}
+			if err := putFileRefs(tx, name, refSet); err != nil {
+				return err
+			}
+		}
+		for _, name := range replaced {
+			if _, ok := moved[name]; ok {
+				continue
+			} else if err := putFileRefs(tx, name, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unshare removes from roots any sector that is referenced by a file other
+// than name.
+func (idx *SectorIndex) unshare(name string, roots map[crypto.Hash]bool) error {
+	return idx.db.View(func(tx *bolt.Tx) error {
+		sectors := tx.Bucket(bucketSectors)
+		for root := range roots {
+			b := sectors.Bucket(root[:])
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if string(k) != name {
+					delete(roots, root)
+					break
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// garbage returns the unreferenced sectors stored on each host.
+func (idx *SectorIndex) garbage() (map[hostdb.HostPublicKey][]crypto.Hash, error) {
+	garbage := make(map[hostdb.HostPublicKey][]crypto.Hash)
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketGarbage).ForEach(func(k, v []byte) error {
+			var root crypto.Hash
+			copy(root[:], k)
+			hostKey := hostdb.HostPublicKey(v)
+			garbage[hostKey] = append(garbage[hostKey], root)
+			return nil
+		})
+	})
+	return garbage, err
+}
+
+// collected removes the specified roots from the set of garbage sectors.
+func (idx *SectorIndex) collected(roots []crypto.Hash) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		for _, root := range roots {
+			if err := tx.Bucket(bucketGarbage).Delete(root[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NewSectorIndex opens the sector index stored in filename, creating it if
+// necessary. The index must be attached to a PseudoFS with SetSectorIndex.
+func NewSectorIndex(filename string) (*SectorIndex, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range sectorIndexBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SectorIndex{db: db}, nil
+}
+
+func (fs *PseudoFS) sectorIndex() *SectorIndex {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.index
+}
+
+// SetSectorIndex configures the filesystem to record the sectors referenced by
+// each of its files in idx. If idx is empty, it is populated from the
+// filesystem's metafiles. Once an index is set, GC only deletes sectors that
+// the index has recorded as unreferenced, and Free deletes any sector that is
+// not referenced by another file.
+//
+// The index is only accurate if all changes to the filesystem are made through
+// the PseudoFS. The caller is responsible for closing idx after the filesystem
+// is closed.
+func (fs *PseudoFS) SetSectorIndex(idx *SectorIndex) error {
+	built, err := idx.built()
+	if err != nil {
+		return err
+	}
+	if !built {
+		err := fs.store.Walk(".", func(name string, _ os.FileInfo) error {
+			m, err := fs.store.ReadMetaFile(name)
+			if err != nil {
+				return err
+			}
+			return idx.updateFile(name, m)
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not build sector index")
+		} else if err := idx.setBuilt(); err != nil {
+			return err
+		}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.index = idx
+	return nil
+}
+
+// writeMetaFile writes m to the store as the named file, updating the sector
+// index if necessary.
+func (fs *PseudoFS) writeMetaFile(name string, m *renter.MetaFile) error {
+	return fs.writeMetaFiles(map[string]*renter.MetaFile{name: m})
+}
+
+// writeMetaFiles writes each of the specified metafiles to the store, updating
+// the sector index if necessary.
+func (fs *PseudoFS) writeMetaFiles(files map[string]*renter.MetaFile) error {
+	stored := make(map[string]*renter.MetaFile, len(files))
+	for name, m := range files {
+		stored[storeName(name)] = m
+	}
+	if err := fs.store.WriteMetaFiles(stored); err != nil {
+		return err
+	}
+	if idx := fs.sectorIndex(); idx != nil {
+		for name, m := range stored {
+			if err := idx.updateFile(name, m); err != nil {
+				return errors.Wrap(err, "could not update sector index")
+			}
+		}
+	}
+	return nil
+}
+
+// gcIndexed deletes the sectors that the index has recorded as unreferenced.
+func (fs *PseudoFS) gcIndexed(idx *SectorIndex) error {
+	garbage, err := idx.garbage()
+	if err != nil {
+		return err
+	}
+	for hostKey, roots := range garbage {
+		if _, ok := fs.hosts.sessions[hostKey]; !ok {
+			continue // retain until we have a contract with the host
+		}
+		err := fs.hosts.forEachContract(hostKey, func(h *proto.Session) error {
+			return h.DeleteSectors(roots)
+		})
+		if err != nil {
+			return err
+		} else if err := idx.collected(roots); err != nil {
+			return err
+		}
+	}
+	return nil
+}
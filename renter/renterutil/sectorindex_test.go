@@ -0,0 +1,136 @@
+package renterutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+)
+
+func TestSectorIndex(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 1)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+
+	storedSectors := func() int {
+		t.Helper()
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.hosts.release(h)
+			return h.Revision().NumSectors()
+		}
+		t.Fatal("couldn't connect to any hosts")
+		return 0
+	}
+	upload := func(name string) crypto.Hash {
+		t.Helper()
+		pf, err := fs.Create(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(frand.Bytes(100)); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		m, err := fs.store.ReadMetaFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Shards[0][0].MerkleRoot
+	}
+	free := func(name string) {
+		t.Helper()
+		pf, err := fs.OpenFile(name, os.O_RDWR, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := pf.Free(); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRefs := func(idx *SectorIndex, root crypto.Hash, exp ...string) {
+		t.Helper()
+		names, err := idx.References(root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(names, exp) {
+			t.Fatalf("expected references %v, got %v", exp, names)
+		}
+	}
+
+	// files that exist before the index is attached should be indexed
+	rootA := upload("a")
+	idx, err := NewSectorIndex(filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if err := fs.SetSectorIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(idx, rootA, "a")
+
+	// clones should be indexed
+	rootB := upload("b")
+	if err := fs.Clone("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(idx, rootA, "a", "c")
+	checkRefs(idx, rootB, "b")
+	if n := storedSectors(); n != 2 {
+		t.Fatalf("expected 2 stored sectors, got %v", n)
+	}
+
+	// Free should not delete a sector referenced by another file
+	free("a")
+	checkRefs(idx, rootA, "c")
+	if n := storedSectors(); n != 2 {
+		t.Fatalf("expected 2 stored sectors, got %v", n)
+	}
+
+	// renamed files should be tracked
+	if err := fs.Rename("c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(idx, rootA, "d")
+
+	// once the last reference is removed, GC should delete the sector
+	if err := fs.Remove("d"); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(idx, rootA)
+	if err := fs.GC(); err != nil {
+		t.Fatal(err)
+	} else if n := storedSectors(); n != 1 {
+		t.Fatalf("expected 1 stored sector, got %v", n)
+	}
+
+	// Free should delete a partially-filled sector if no other file
+	// references it
+	free("b")
+	if n := storedSectors(); n != 0 {
+		t.Fatalf("expected 0 stored sectors, got %v", n)
+	}
+	checkRefs(idx, rootB)
+}
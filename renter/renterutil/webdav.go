@@ -0,0 +1,135 @@
+package renterutil
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/webdav"
+)
+
+// davFileSystem implements webdav.FileSystem.
+type davFileSystem struct {
+	fs        *PseudoFS
+	minShards int
+}
+
+// davName converts a WebDAV path, which is always absolute, to a PseudoFS
+// name. PseudoFS identifies open files by name, so names must be normalized.
+func davName(name string) string {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+	return name
+}
+
+// davErr converts the wrapped errors returned by PseudoFS, so that the WebDAV
+// handler can recognize them.
+func davErr(op, name string, err error) error {
+	cause := errors.Cause(err)
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(cause):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case os.IsExist(cause):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	case os.IsPermission(cause):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return err
+}
+
+// Mkdir implements webdav.FileSystem.
+func (dfs davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return davErr("mkdir", name, dfs.fs.Mkdir(davName(name), perm))
+}
+
+// OpenFile implements webdav.FileSystem.
+func (dfs davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	// PseudoFS always creates a new, empty file when O_CREATE is specified,
+	// so handle the case where the file already exists here
+	if flag&os.O_CREATE != 0 {
+		if _, err := dfs.fs.Stat(name); err == nil {
+			if flag&os.O_EXCL != 0 {
+				return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+			} else if flag&os.O_TRUNC == 0 {
+				flag &^= os.O_CREATE
+			}
+		}
+	}
+	pf, err := dfs.fs.OpenFile(name, flag, perm, dfs.minShards)
+	if err != nil {
+		return nil, davErr("open", name, err)
+	}
+	return davFile{pf, ctx}, nil
+}
+
+// RemoveAll implements webdav.FileSystem. Like PseudoFS.RemoveAll, it does
+// not delete any data stored on hosts; use PseudoFS.GC for that.
+func (dfs davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return davErr("remove", name, dfs.fs.RemoveAll(davName(name)))
+}
+
+// Rename implements webdav.FileSystem.
+func (dfs davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return davErr("rename", oldName, dfs.fs.Rename(davName(oldName), davName(newName)))
+}
+
+// Stat implements webdav.FileSystem.
+func (dfs davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = davName(name)
+	info, err := dfs.fs.Stat(name)
+	if err != nil {
+		return nil, davErr("stat", name, err)
+	}
+	return namedFileInfo{info, path.Base(name)}, nil
+}
+
+// davFile implements webdav.File. Host I/O is aborted if the request that
+// opened the file is cancelled.
+type davFile struct {
+	*PseudoFile
+	ctx context.Context
+}
+
+// Read implements webdav.File.
+func (f davFile) Read(p []byte) (int, error) {
+	return f.PseudoFile.ReadContext(f.ctx, p)
+}
+
+// Write implements webdav.File.
+func (f davFile) Write(p []byte) (int, error) {
+	return f.PseudoFile.WriteContext(f.ctx, p)
+}
+
+// Close implements webdav.File. Unlike PseudoFile.Close, it flushes any
+// pending writes to hosts before returning, since WebDAV clients expect a
+// successful upload to be durable.
+func (f davFile) Close() error {
+	if f.writeable() {
+		if err := f.SyncContext(f.ctx); err != nil {
+			f.PseudoFile.Close()
+			return err
+		}
+	}
+	return f.PseudoFile.Close()
+}
+
+// Stat implements webdav.File.
+func (f davFile) Stat() (os.FileInfo, error) {
+	info, err := f.PseudoFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return namedFileInfo{info, path.Base(f.Name())}, nil
+}
+
+// NewWebDAVFileSystem returns a webdav.FileSystem backed by fs. Files created
+// via WebDAV are stored with the specified minShards.
+func NewWebDAVFileSystem(fs *PseudoFS, minShards int) webdav.FileSystem {
+	return davFileSystem{fs, minShards}
+}
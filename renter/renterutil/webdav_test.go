@@ -0,0 +1,94 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/webdav"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter"
+)
+
+func TestWebDAV(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tfs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	fs := NewFileSystem(dir, tfs.hosts)
+
+	srv := httptest.NewServer(&webdav.Handler{
+		FileSystem: NewWebDAVFileSystem(fs, 1),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer srv.Close()
+
+	do := func(method, path string, body []byte, header map[string]string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, b
+	}
+
+	if code, _ := do("MKCOL", "/sub", nil, nil); code != http.StatusCreated {
+		t.Fatal("MKCOL failed:", code)
+	}
+	data := frand.Bytes(4096)
+	if code, _ := do("PUT", "/sub/foo", data, nil); code != http.StatusCreated {
+		t.Fatal("PUT failed:", code)
+	}
+	// the upload should have been flushed to hosts
+	if m, err := renter.ReadMetaFile(filepath.Join(dir, "sub", "foo"+metafileExt)); err != nil {
+		t.Fatal(err)
+	} else if m.Filesize != int64(len(data)) {
+		t.Fatal("PUT did not flush pending writes")
+	}
+	if code, b := do("GET", "/sub/foo", nil, nil); code != http.StatusOK || !bytes.Equal(b, data) {
+		t.Fatal("GET failed:", code)
+	}
+	// overwrite the file
+	data = frand.Bytes(1000)
+	if code, _ := do("PUT", "/sub/foo", data, nil); code != http.StatusNoContent && code != http.StatusCreated {
+		t.Fatal("PUT failed:", code)
+	}
+	if code, b := do("GET", "/sub/foo", nil, nil); code != http.StatusOK || !bytes.Equal(b, data) {
+		t.Fatal("GET failed:", code)
+	}
+	if code, _ := do("MOVE", "/sub/foo", nil, map[string]string{"Destination": srv.URL + "/bar"}); code != http.StatusCreated {
+		t.Fatal("MOVE failed:", code)
+	}
+	if code, _ := do("GET", "/sub/foo", nil, nil); code != http.StatusNotFound {
+		t.Fatal("expected 404 after MOVE, got", code)
+	}
+	if code, b := do("GET", "/bar", nil, nil); code != http.StatusOK || !bytes.Equal(b, data) {
+		t.Fatal("GET failed:", code)
+	}
+	if code, _ := do("DELETE", "/bar", nil, nil); code != http.StatusNoContent {
+		t.Fatal("DELETE failed:", code)
+	}
+	if code, _ := do("PROPFIND", "/", nil, map[string]string{"Depth": "1"}); code != http.StatusMultiStatus {
+		t.Fatal("PROPFIND failed:", code)
+	}
+}
@@ -719,6 +719,299 @@ func (r *RPCWriteResponse) unmarshalBuffer(b *objBuffer) error {
 	return b.Err()
 }
 
+// Subscriber handshake
+
+func (r *subscriberRequest) marshalledSize() int {
+	return 8 + len(r.Subscriber)
+}
+
+func (r *subscriberRequest) marshalBuffer(b *objBuffer) {
+	b.writeString(r.Subscriber)
+}
+
+func (r *subscriberRequest) unmarshalBuffer(b *objBuffer) error {
+	r.Subscriber = string(b.readPrefixedBytes())
+	return b.Err()
+}
+
+func (r *subscriberResponse) marshalledSize() int {
+	return 8 + len(r.Err)
+}
+
+func (r *subscriberResponse) marshalBuffer(b *objBuffer) {
+	b.writeString(r.Err)
+}
+
+func (r *subscriberResponse) unmarshalBuffer(b *objBuffer) error {
+	r.Err = string(b.readPrefixedBytes())
+	return b.Err()
+}
+
+// RPCUpdatePriceTable
+
+func (r *RPCUpdatePriceTableResponse) marshalledSize() int {
+	return 8 + len(r.PriceTableJSON)
+}
+
+func (r *RPCUpdatePriceTableResponse) marshalBuffer(b *objBuffer) {
+	b.writePrefixedBytes(r.PriceTableJSON)
+}
+
+func (r *RPCUpdatePriceTableResponse) unmarshalBuffer(b *objBuffer) error {
+	r.PriceTableJSON = b.readPrefixedBytes()
+	return b.Err()
+}
+
+func (r *RPCPriceTableAccepted) marshalledSize() int {
+	return 0
+}
+
+func (r *RPCPriceTableAccepted) marshalBuffer(b *objBuffer) {}
+
+func (r *RPCPriceTableAccepted) unmarshalBuffer(b *objBuffer) error {
+	return b.Err()
+}
+
+// Payments
+
+func (r *RPCPaymentRequest) marshalledSize() int {
+	return len(r.Type)
+}
+
+func (r *RPCPaymentRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.Type[:])
+}
+
+func (r *RPCPaymentRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.Type[:])
+	return b.Err()
+}
+
+func (r *RPCPayByContractRequest) marshalledSize() int {
+	validSize := 8
+	for i := range r.NewValidProofValues {
+		validSize += (*objCurrency)(&r.NewValidProofValues[i]).marshalledSize()
+	}
+	missedSize := 8
+	for i := range r.NewMissedProofValues {
+		missedSize += (*objCurrency)(&r.NewMissedProofValues[i]).marshalledSize()
+	}
+	return len(r.ContractID) + 8 + validSize + missedSize + 8 + len(r.Signature)
+}
+
+func (r *RPCPayByContractRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.ContractID[:])
+	b.writeUint64(r.NewRevisionNumber)
+	b.writePrefix(len(r.NewValidProofValues))
+	for i := range r.NewValidProofValues {
+		(*objCurrency)(&r.NewValidProofValues[i]).marshalBuffer(b)
+	}
+	b.writePrefix(len(r.NewMissedProofValues))
+	for i := range r.NewMissedProofValues {
+		(*objCurrency)(&r.NewMissedProofValues[i]).marshalBuffer(b)
+	}
+	b.writePrefixedBytes(r.Signature)
+}
+
+func (r *RPCPayByContractRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.ContractID[:])
+	r.NewRevisionNumber = b.readUint64()
+	r.NewValidProofValues = make([]types.Currency, b.readPrefix(sizeofCurrency))
+	for i := range r.NewValidProofValues {
+		(*objCurrency)(&r.NewValidProofValues[i]).unmarshalBuffer(b)
+	}
+	r.NewMissedProofValues = make([]types.Currency, b.readPrefix(sizeofCurrency))
+	for i := range r.NewMissedProofValues {
+		(*objCurrency)(&r.NewMissedProofValues[i]).unmarshalBuffer(b)
+	}
+	r.Signature = b.readPrefixedBytes()
+	return b.Err()
+}
+
+func (r *RPCPayByContractResponse) marshalledSize() int {
+	return 8 + len(r.Signature)
+}
+
+func (r *RPCPayByContractResponse) marshalBuffer(b *objBuffer) {
+	b.writePrefixedBytes(r.Signature)
+}
+
+func (r *RPCPayByContractResponse) unmarshalBuffer(b *objBuffer) error {
+	r.Signature = b.readPrefixedBytes()
+	return b.Err()
+}
+
+func (wm *WithdrawalMessage) marshalledSize() int {
+	return len(wm.Account) + 8 + (*objCurrency)(&wm.Amount).marshalledSize() + len(wm.Nonce)
+}
+
+func (wm *WithdrawalMessage) marshalBuffer(b *objBuffer) {
+	b.write(wm.Account[:])
+	b.writeUint64(uint64(wm.Expiry))
+	(*objCurrency)(&wm.Amount).marshalBuffer(b)
+	b.write(wm.Nonce[:])
+}
+
+func (wm *WithdrawalMessage) unmarshalBuffer(b *objBuffer) error {
+	b.read(wm.Account[:])
+	wm.Expiry = types.BlockHeight(b.readUint64())
+	(*objCurrency)(&wm.Amount).unmarshalBuffer(b)
+	b.read(wm.Nonce[:])
+	return b.Err()
+}
+
+func (r *RPCPayByEphemeralAccountRequest) marshalledSize() int {
+	return r.Message.marshalledSize() + 8 + len(r.Signature)
+}
+
+func (r *RPCPayByEphemeralAccountRequest) marshalBuffer(b *objBuffer) {
+	r.Message.marshalBuffer(b)
+	b.writePrefixedBytes(r.Signature)
+}
+
+func (r *RPCPayByEphemeralAccountRequest) unmarshalBuffer(b *objBuffer) error {
+	r.Message.unmarshalBuffer(b)
+	r.Signature = b.readPrefixedBytes()
+	return b.Err()
+}
+
+// RPCFundAccount
+
+func (r *RPCFundAccountRequest) marshalledSize() int {
+	return len(r.Account)
+}
+
+func (r *RPCFundAccountRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.Account[:])
+}
+
+func (r *RPCFundAccountRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.Account[:])
+	return b.Err()
+}
+
+func (r *RPCFundAccountResponse) marshalledSize() int {
+	return (*objCurrency)(&r.Balance).marshalledSize()
+}
+
+func (r *RPCFundAccountResponse) marshalBuffer(b *objBuffer) {
+	(*objCurrency)(&r.Balance).marshalBuffer(b)
+}
+
+func (r *RPCFundAccountResponse) unmarshalBuffer(b *objBuffer) error {
+	return (*objCurrency)(&r.Balance).unmarshalBuffer(b)
+}
+
+// RPCAccountBalance
+
+func (r *RPCAccountBalanceRequest) marshalledSize() int {
+	return len(r.Account)
+}
+
+func (r *RPCAccountBalanceRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.Account[:])
+}
+
+func (r *RPCAccountBalanceRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.Account[:])
+	return b.Err()
+}
+
+func (r *RPCAccountBalanceResponse) marshalledSize() int {
+	return (*objCurrency)(&r.Balance).marshalledSize()
+}
+
+func (r *RPCAccountBalanceResponse) marshalBuffer(b *objBuffer) {
+	(*objCurrency)(&r.Balance).marshalBuffer(b)
+}
+
+func (r *RPCAccountBalanceResponse) unmarshalBuffer(b *objBuffer) error {
+	return (*objCurrency)(&r.Balance).unmarshalBuffer(b)
+}
+
+// RPCReadSector
+
+func (r *RPCReadSectorRequest) marshalledSize() int {
+	return len(r.MerkleRoot) + 8 + 8 + 1
+}
+
+func (r *RPCReadSectorRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.MerkleRoot[:])
+	b.writeUint64(r.Offset)
+	b.writeUint64(r.Length)
+	b.writeBool(r.MerkleProof)
+}
+
+func (r *RPCReadSectorRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.MerkleRoot[:])
+	r.Offset = b.readUint64()
+	r.Length = b.readUint64()
+	r.MerkleProof = b.readBool()
+	return b.Err()
+}
+
+func (r *RPCReadSectorResponse) marshalledSize() int {
+	return 8 + len(r.Data) + 8 + len(r.MerkleProof)*crypto.HashSize
+}
+
+func (r *RPCReadSectorResponse) marshalBuffer(b *objBuffer) {
+	b.writePrefixedBytes(r.Data)
+	b.writePrefix(len(r.MerkleProof))
+	for i := range r.MerkleProof {
+		b.write(r.MerkleProof[i][:])
+	}
+}
+
+func (r *RPCReadSectorResponse) unmarshalBuffer(b *objBuffer) error {
+	r.Data = b.readPrefixedBytes()
+	r.MerkleProof = make([]crypto.Hash, b.readPrefix(crypto.HashSize))
+	for i := range r.MerkleProof {
+		b.read(r.MerkleProof[i][:])
+	}
+	return b.Err()
+}
+
+func (r *RPCAppendSectorRequest) marshalledSize() int {
+	validSize := 8
+	for i := range r.NewValidProofValues {
+		validSize += (*objCurrency)(&r.NewValidProofValues[i]).marshalledSize()
+	}
+	missedSize := 8
+	for i := range r.NewMissedProofValues {
+		missedSize += (*objCurrency)(&r.NewMissedProofValues[i]).marshalledSize()
+	}
+	return len(r.ContractID) + 8 + len(r.Data) + 8 + validSize + missedSize
+}
+
+func (r *RPCAppendSectorRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.ContractID[:])
+	b.writePrefixedBytes(r.Data)
+	b.writeUint64(r.NewRevisionNumber)
+	b.writePrefix(len(r.NewValidProofValues))
+	for i := range r.NewValidProofValues {
+		(*objCurrency)(&r.NewValidProofValues[i]).marshalBuffer(b)
+	}
+	b.writePrefix(len(r.NewMissedProofValues))
+	for i := range r.NewMissedProofValues {
+		(*objCurrency)(&r.NewMissedProofValues[i]).marshalBuffer(b)
+	}
+}
+
+func (r *RPCAppendSectorRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.ContractID[:])
+	r.Data = b.readPrefixedBytes()
+	r.NewRevisionNumber = b.readUint64()
+	r.NewValidProofValues = make([]types.Currency, b.readPrefix(sizeofCurrency))
+	for i := range r.NewValidProofValues {
+		(*objCurrency)(&r.NewValidProofValues[i]).unmarshalBuffer(b)
+	}
+	r.NewMissedProofValues = make([]types.Currency, b.readPrefix(sizeofCurrency))
+	for i := range r.NewMissedProofValues {
+		(*objCurrency)(&r.NewMissedProofValues[i]).unmarshalBuffer(b)
+	}
+	return b.Err()
+}
+
 // generic objects
 
 type objSiaPublicKey types.SiaPublicKey
@@ -427,8 +427,10 @@ func (s *Stream) Write(p []byte) (int, error) {
 		if err != nil {
 			return len(p) - buf.Len(), err
 		}
-		// write next frame's worth of data
-		payload := buf.Next(s.m.settings.maxPayloadSize())
+		// write next frame's worth of data; bufferFrame returns before the
+		// frame is sent, so the payload must be copied, as io.Writer
+		// implementations may not retain p
+		payload := append([]byte(nil), buf.Next(s.m.settings.maxPayloadSize())...)
 		h := frameHeader{id: s.id, length: uint32(len(payload))}
 		if err := s.m.bufferFrame(h, payload, s.wd); err != nil {
 			return len(p) - buf.Len(), err
@@ -81,6 +81,70 @@ func TestMux(t *testing.T) {
 	}
 }
 
+func TestWriteReusedBuffer(t *testing.T) {
+	serverKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCh := make(chan error, 1)
+	go func() {
+		serverCh <- func() error {
+			conn, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			m, err := Accept(conn, serverKey)
+			if err != nil {
+				return err
+			}
+			defer m.Close()
+			s, err := m.AcceptStream()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			buf := make([]byte, 10)
+			if _, err := io.ReadFull(s, buf); err != nil {
+				return err
+			}
+			if string(buf) != "helloworld" {
+				return fmt.Errorf("expected %q, got %q", "helloworld", buf)
+			}
+			return s.Close()
+		}()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Dial(conn, serverKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	s, err := m.DialStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Write may return before its frame is sent, so it must not retain the
+	// caller's buffer
+	buf := []byte("hello")
+	if _, err := s.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, "world")
+	if _, err := s.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-serverCh; err != nil && err != ErrPeerClosedStream {
+		t.Fatal(err)
+	}
+}
+
 func TestManyStreams(t *testing.T) {
 	serverKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
 	l, err := net.Listen("tcp", ":0")
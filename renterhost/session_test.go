@@ -363,6 +363,68 @@ func TestRawMessage(t *testing.T) {
 	}
 }
 
+func TestStream(t *testing.T) {
+	renter, host := newFakeConns()
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- func() error {
+			hs, err := NewHostStream(host)
+			if err != nil {
+				return err
+			}
+			id, err := hs.ReadID()
+			if err != nil {
+				return err
+			} else if id != RPCAccountBalanceID {
+				return hs.WriteResponse(nil, ErrInvalidName)
+			}
+			var req RPCAccountBalanceRequest
+			if err := hs.ReadRequest(&req, MinMessageSize); err != nil {
+				return err
+			} else if req.Account != (AccountID{1}) {
+				return hs.WriteResponse(nil, ErrInvalidName)
+			}
+			return hs.WriteResponse(&RPCAccountBalanceResponse{
+				Balance: types.NewCurrency64(7),
+			}, nil)
+		}()
+	}()
+
+	rs, err := NewRenterStream(renter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp RPCAccountBalanceResponse
+	if err := rs.WriteRequest(RPCAccountBalanceID, &RPCAccountBalanceRequest{Account: AccountID{1}}); err != nil {
+		t.Fatal(err)
+	} else if err := rs.ReadResponse(&resp, MinMessageSize); err != nil {
+		t.Fatal(err)
+	} else if !resp.Balance.Equals64(7) {
+		t.Fatal("unexpected balance:", resp.Balance)
+	}
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// host should reject unknown subscribers
+	renter, host = newFakeConns()
+	go func() {
+		_, err := NewHostStream(host)
+		hostErr <- err
+	}()
+	s := &Stream{rw: renter}
+	var sresp subscriberResponse
+	if err := s.writeMessage(&subscriberRequest{Subscriber: "foo"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.readMessage(&sresp, MinMessageSize); err != nil {
+		t.Fatal(err)
+	} else if sresp.Err == "" {
+		t.Fatal("expected subscriber to be rejected")
+	} else if err := <-hostErr; err == nil {
+		t.Fatal("expected host to return error")
+	}
+}
+
 func TestChallenge(t *testing.T) {
 	s := Session{
 		challenge: frand.Entropy128(),
@@ -454,6 +516,60 @@ func TestEncoding(t *testing.T) {
 		&RPCWriteResponse{
 			Signature: frand.Bytes(64),
 		},
+		&RPCUpdatePriceTableResponse{
+			PriceTableJSON: frand.Bytes(100),
+		},
+		&RPCPaymentRequest{
+			Type: PaymentTypeEphemeralAccount,
+		},
+		&RPCPayByContractRequest{
+			ContractID:           randomTxn.FileContractRevisions[0].ParentID,
+			NewRevisionNumber:    frand.Uint64n(100),
+			NewValidProofValues:  randomTxn.MinerFees,
+			NewMissedProofValues: randomTxn.MinerFees,
+			Signature:            frand.Bytes(64),
+		},
+		&RPCPayByContractResponse{
+			Signature: frand.Bytes(64),
+		},
+		&RPCPayByEphemeralAccountRequest{
+			Message: WithdrawalMessage{
+				Account: AccountID(frand.Entropy256()),
+				Expiry:  types.BlockHeight(frand.Uint64n(100)),
+				Amount:  randomTxn.MinerFees[0],
+				Nonce:   [8]byte{1, 2, 3},
+			},
+			Signature: frand.Bytes(64),
+		},
+		&RPCFundAccountRequest{
+			Account: AccountID(frand.Entropy256()),
+		},
+		&RPCFundAccountResponse{
+			Balance: randomTxn.MinerFees[0],
+		},
+		&RPCAccountBalanceRequest{
+			Account: AccountID(frand.Entropy256()),
+		},
+		&RPCAccountBalanceResponse{
+			Balance: randomTxn.MinerFees[0],
+		},
+		&RPCReadSectorRequest{
+			MerkleRoot:  randomTxn.FileContractRevisions[0].NewFileMerkleRoot,
+			Offset:      frand.Uint64n(100),
+			Length:      frand.Uint64n(100),
+			MerkleProof: true,
+		},
+		&RPCReadSectorResponse{
+			Data:        frand.Bytes(1024),
+			MerkleProof: randomTxn.StorageProofs[0].HashSet,
+		},
+		&RPCAppendSectorRequest{
+			ContractID:           randomTxn.FileContractRevisions[0].ParentID,
+			Data:                 frand.Bytes(1024),
+			NewRevisionNumber:    frand.Uint64n(100),
+			NewValidProofValues:  randomTxn.MinerFees,
+			NewMissedProofValues: randomTxn.MinerFees,
+		},
 	}
 	for _, o := range objs {
 		siaenc := encoding.Marshal(reflect.ValueOf(o).Elem().Interface())
@@ -0,0 +1,286 @@
+package renterhost
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"golang.org/x/crypto/blake2b"
+)
+
+// HostSubscriber is the name of the subscriber that serves mux protocol RPCs on
+// a host's mux. It deliberately differs from the subscriber used by siad, so
+// that a renter cannot mistake a siad host for a us host.
+const HostSubscriber = "us-host"
+
+// A Stream is a single RPC exchange in the mux protocol. The mux protocol is
+// modeled on version 3 of the Sia renter-host protocol (RHP3), but it is NOT
+// wire-compatible with it: siad hosts implement RHP3 via ExecuteProgram, while
+// the mux protocol uses a small set of dedicated RPCs and a different price
+// table schema. It is only spoken by us hosts.
+//
+// Unlike a Session, a Stream does not encrypt its messages; it is intended to
+// be used on top of a renterhost/mux Stream, which handles encryption itself.
+//
+// Every message is length-prefixed, and may contain either an object or an
+// RPCError.
+type Stream struct {
+	rw     io.ReadWriter
+	inbuf  objBuffer
+	outbuf objBuffer
+}
+
+func (s *Stream) writeMessage(obj ProtocolObject) error {
+	s.outbuf.reset()
+	s.outbuf.grow(8 + obj.marshalledSize())
+	s.outbuf.writePrefix(obj.marshalledSize())
+	obj.marshalBuffer(&s.outbuf)
+	_, err := s.rw.Write(s.outbuf.bytes())
+	return err
+}
+
+func (s *Stream) readMessage(obj ProtocolObject, maxLen uint64) error {
+	s.inbuf.reset()
+	if err := s.inbuf.copyN(s.rw, 8); err != nil {
+		return err
+	}
+	msgSize := s.inbuf.readUint64()
+	if msgSize > maxLen {
+		return errors.Errorf("message size (%v bytes) exceeds maxLen of %v bytes", msgSize, maxLen)
+	}
+	s.inbuf.reset()
+	s.inbuf.grow(int(msgSize))
+	if err := s.inbuf.copyN(s.rw, msgSize); err != nil {
+		return err
+	}
+	return obj.unmarshalBuffer(&s.inbuf)
+}
+
+// WriteRequest sends an RPC request, comprising an RPC ID and an optional
+// request object.
+func (s *Stream) WriteRequest(rpcID Specifier, req ProtocolObject) (err error) {
+	err = errors.Wrap(s.writeMessage(&rpcResponse{nil, &rpcID}), "WriteRequestID")
+	if err == nil && req != nil {
+		err = errors.Wrap(s.writeMessage(&rpcResponse{nil, req}), "WriteRequest")
+	}
+	return
+}
+
+// ReadID reads an RPC request ID.
+func (s *Stream) ReadID() (rpcID Specifier, err error) {
+	defer wrapErr(&err, "ReadID")
+	err = s.ReadResponse(&rpcID, MinMessageSize)
+	return
+}
+
+// ReadRequest reads an RPC request object. If the peer sent an RPCError
+// instead, it is returned directly.
+func (s *Stream) ReadRequest(req ProtocolObject, maxLen uint64) (err error) {
+	defer wrapErr(&err, "ReadRequest")
+	return s.ReadResponse(req, maxLen)
+}
+
+// WriteResponse writes an RPC response object or error. Either resp or err must
+// be nil. If err is an *RPCError, it is sent directly; otherwise, a generic
+// RPCError is created from err's Error string.
+func (s *Stream) WriteResponse(resp ProtocolObject, err error) (e error) {
+	defer wrapErr(&e, "WriteResponse")
+	re, ok := err.(*RPCError)
+	if err != nil && !ok {
+		re = &RPCError{Description: err.Error()}
+	}
+	return s.writeMessage(&rpcResponse{re, resp})
+}
+
+// ReadResponse reads an RPC response. If the response is an error, it is
+// returned directly.
+func (s *Stream) ReadResponse(resp ProtocolObject, maxLen uint64) (err error) {
+	rr := rpcResponse{nil, resp}
+	if err := s.readMessage(&rr, maxLen); err != nil {
+		return err
+	} else if rr.err != nil {
+		return rr.err
+	}
+	return nil
+}
+
+// NewRenterStream conducts the renter's half of the subscriber handshake on rw,
+// requesting the host's mux protocol subscriber, and returns a Stream that can be used
+// to make a single RPC.
+func NewRenterStream(rw io.ReadWriter) (_ *Stream, err error) {
+	defer wrapErr(&err, "NewRenterStream")
+	s := &Stream{rw: rw}
+	if err := s.writeMessage(&subscriberRequest{Subscriber: HostSubscriber}); err != nil {
+		return nil, errors.Wrap(err, "couldn't write subscriber request")
+	}
+	var resp subscriberResponse
+	if err := s.readMessage(&resp, MinMessageSize); err != nil {
+		return nil, errors.Wrap(err, "couldn't read subscriber response")
+	} else if resp.Err != "" {
+		return nil, errors.New(resp.Err)
+	}
+	return s, nil
+}
+
+// NewHostStream conducts the host's half of the subscriber handshake on rw,
+// returning a Stream that can be used to handle a single RPC.
+func NewHostStream(rw io.ReadWriter) (_ *Stream, err error) {
+	defer wrapErr(&err, "NewHostStream")
+	s := &Stream{rw: rw}
+	var req subscriberRequest
+	if err := s.readMessage(&req, MinMessageSize); err != nil {
+		return nil, errors.Wrap(err, "couldn't read subscriber request")
+	}
+	var resp subscriberResponse
+	if req.Subscriber != HostSubscriber {
+		resp.Err = "unknown subscriber " + req.Subscriber
+	}
+	if err := s.writeMessage(&resp); err != nil {
+		return nil, errors.Wrap(err, "couldn't write subscriber response")
+	} else if resp.Err != "" {
+		return nil, errors.New(resp.Err)
+	}
+	return s, nil
+}
+
+// Subscriber handshake objects
+type (
+	subscriberRequest struct {
+		Subscriber string
+	}
+
+	subscriberResponse struct {
+		Err string
+	}
+)
+
+// mux protocol RPC IDs
+var (
+	RPCAccountBalanceID   = newSpecifier("AccountBalance")
+	RPCAppendSectorID     = newSpecifier("AppendSector")
+	RPCFundAccountID      = newSpecifier("FundEphAcc")
+	RPCReadSectorID       = newSpecifier("ReadSector")
+	RPCUpdatePriceTableID = newSpecifier("UpdatePriceTable")
+)
+
+// mux protocol payment types
+var (
+	PaymentTypeContract         = newSpecifier("PayByContract")
+	PaymentTypeEphemeralAccount = newSpecifier("PayByEphemAcc")
+)
+
+// An AccountID identifies an ephemeral account. It is the ed25519 public key
+// whose private key authorizes withdrawals from the account.
+type AccountID [32]byte
+
+// mux protocol request/response objects
+type (
+	// RPCUpdatePriceTableResponse contains the response data for the
+	// UpdatePriceTable RPC.
+	RPCUpdatePriceTableResponse struct {
+		PriceTableJSON []byte // JSON-encoded hostdb.HostPriceTable
+	}
+
+	// RPCPriceTableAccepted is sent by the host to confirm that payment for
+	// the UpdatePriceTable RPC was received and that the new price table may
+	// now be used.
+	RPCPriceTableAccepted struct{}
+
+	// RPCPaymentRequest is sent before a payment object to indicate its type.
+	RPCPaymentRequest struct {
+		Type Specifier
+	}
+
+	// RPCPayByContractRequest pays for an RPC by revising a file contract.
+	RPCPayByContractRequest struct {
+		ContractID           types.FileContractID
+		NewRevisionNumber    uint64
+		NewValidProofValues  []types.Currency
+		NewMissedProofValues []types.Currency
+		Signature            []byte
+	}
+
+	// RPCPayByContractResponse contains the host's signature for the revision
+	// in an RPCPayByContractRequest.
+	RPCPayByContractResponse struct {
+		Signature []byte
+	}
+
+	// WithdrawalMessage authorizes a withdrawal from an ephemeral account.
+	WithdrawalMessage struct {
+		Account AccountID
+		Expiry  types.BlockHeight
+		Amount  types.Currency
+		Nonce   [8]byte
+	}
+
+	// RPCPayByEphemeralAccountRequest pays for an RPC by withdrawing from an
+	// ephemeral account.
+	RPCPayByEphemeralAccountRequest struct {
+		Message   WithdrawalMessage
+		Signature []byte
+	}
+
+	// RPCFundAccountRequest contains the request parameters for the
+	// FundAccount RPC.
+	RPCFundAccountRequest struct {
+		Account AccountID
+	}
+
+	// RPCFundAccountResponse contains the response data for the FundAccount
+	// RPC.
+	RPCFundAccountResponse struct {
+		Balance types.Currency
+	}
+
+	// RPCAccountBalanceRequest contains the request parameters for the
+	// AccountBalance RPC.
+	RPCAccountBalanceRequest struct {
+		Account AccountID
+	}
+
+	// RPCAccountBalanceResponse contains the response data for the
+	// AccountBalance RPC.
+	RPCAccountBalanceResponse struct {
+		Balance types.Currency
+	}
+
+	// RPCReadSectorRequest contains the request parameters for the
+	// ReadSector RPC.
+	RPCReadSectorRequest struct {
+		MerkleRoot  crypto.Hash
+		Offset      uint64
+		Length      uint64
+		MerkleProof bool
+	}
+
+	// RPCReadSectorResponse contains the response data for the ReadSector
+	// RPC.
+	RPCReadSectorResponse struct {
+		Data        []byte
+		MerkleProof []crypto.Hash
+	}
+
+	// RPCAppendSectorRequest contains the request parameters for the
+	// AppendSector RPC. The host responds with an RPCWriteMerkleProof, and the
+	// renter then sends its signature for the revision in an
+	// RPCWriteResponse; the host replies with its own RPCWriteResponse.
+	RPCAppendSectorRequest struct {
+		ContractID           types.FileContractID
+		Data                 []byte
+		NewRevisionNumber    uint64
+		NewValidProofValues  []types.Currency
+		NewMissedProofValues []types.Currency
+	}
+)
+
+// HashWithdrawalMessage hashes a WithdrawalMessage. This is the hash signed by
+// the account owner when paying for an RPC.
+func HashWithdrawalMessage(wm WithdrawalMessage) crypto.Hash {
+	var b objBuffer
+	b.buf = *bytes.NewBuffer(make([]byte, 0, wm.marshalledSize()))
+	wm.marshalBuffer(&b)
+	return blake2b.Sum256(b.bytes())
+}